@@ -0,0 +1,291 @@
+package main
+
+import (
+        "archive/zip"
+        "encoding/json"
+        "fmt"
+        "net/http"
+        "time"
+)
+
+// exportSections lists the files of a data export, in order.
+var exportSections = []string{"profile", "addresses", "orders", "cart", "sessions", "api_tokens", "security_events"}
+
+// collectAccountData gathers everything stored about a user, keyed by
+// export section.
+func collectAccountData(user *User) (map[string]interface{}, error) {
+        data := map[string]interface{}{
+                "profile": map[string]interface{}{
+                        "id":           user.ID,
+                        "email":        user.Email,
+                        "full_name":    user.FullName,
+                        "created_at":   user.CreatedAt,
+                        "totp_enabled": user.TOTPEnabled,
+                        "roles":        user.Roles,
+                },
+        }
+
+        rows, err := db.Query("SELECT "+addressColumns+" FROM addresses WHERE user_id = $1 ORDER BY id", user.ID)
+        if err != nil {
+                return nil, err
+        }
+        var addresses []Address
+        for rows.Next() {
+                a, _ := scanAddress(rows)
+                addresses = append(addresses, a)
+        }
+        rows.Close()
+        data["addresses"] = addresses
+
+        rows, err = db.Query(`SELECT id, order_number, total_amount, COALESCE(shipping_method, ''), shipping_amount,
+                                     tax_amount, prices_include_tax, currency, exchange_rate, status, COALESCE(shipping_address_id, 0),
+                                     COALESCE(shipping_address, '{}'), COALESCE(payment_method, ''), created_at, updated_at
+                              FROM orders WHERE user_id = $1 ORDER BY created_at`, user.ID)
+        if err != nil {
+                return nil, err
+        }
+        var orders []Order
+        for rows.Next() {
+                var o Order
+                var shippingAddress []byte
+                rows.Scan(&o.ID, &o.OrderNumber, &o.TotalAmount, &o.ShippingMethod, &o.ShippingAmount,
+                        &o.TaxAmount, &o.PricesIncludeTax, &o.Currency, &o.ExchangeRate, &o.Status, &o.ShippingAddressID,
+                        &shippingAddress, &o.PaymentMethod, &o.CreatedAt, &o.UpdatedAt)
+                o.ShippingAddress = &Address{}
+                json.Unmarshal(shippingAddress, o.ShippingAddress)
+                o.UserID = user.ID
+                orders = append(orders, o)
+        }
+        rows.Close()
+
+        for i := range orders {
+                rows, err := db.Query(`SELECT oi.id, COALESCE(oi.book_id, 0), oi.quantity, oi.price_at_purchase, oi.subtotal,
+                                              oi.discount_amount, oi.tax_rate, oi.tax_amount,
+                                              COALESCE(oi.book_title, b.title, ''), COALESCE(oi.book_author, b.author, '')
+                                       FROM order_items oi
+                                       LEFT JOIN books b ON oi.book_id = b.id
+                                       WHERE oi.order_id = $1`, orders[i].ID)
+                if err != nil {
+                        return nil, err
+                }
+                for rows.Next() {
+                        var item OrderItem
+                        rows.Scan(&item.ID, &item.BookID, &item.Quantity, &item.PriceAtPurchase, &item.Subtotal,
+                                &item.DiscountAmount, &item.TaxRate, &item.TaxAmount, &item.BookTitle, &item.BookAuthor)
+                        item.OrderID = orders[i].ID
+                        orders[i].Items = append(orders[i].Items, item)
+                }
+                rows.Close()
+
+                orders[i].Discounts, err = loadOrderDiscounts(orders[i].ID)
+                if err != nil {
+                        return nil, err
+                }
+                orders[i].Payments, err = loadOrderPayments(orders[i].ID)
+                if err != nil {
+                        return nil, err
+                }
+        }
+        data["orders"] = orders
+
+        data["store_credit"], err = loadStoreCreditLedger(user.ID)
+        if err != nil {
+                return nil, err
+        }
+
+        data["notification_preferences"], err = loadNotificationPreferences(user.ID)
+        if err != nil {
+                return nil, err
+        }
+
+        rows, err = db.Query(`SELECT c.id, c.book_id, c.quantity, b.title
+                              FROM cart_items c JOIN books b ON c.book_id = b.id
+                              WHERE c.user_id = $1`, user.ID)
+        if err != nil {
+                return nil, err
+        }
+        var cart []CartItem
+        for rows.Next() {
+                var item CartItem
+                item.Book = &Book{}
+                rows.Scan(&item.ID, &item.BookID, &item.Quantity, &item.Book.Title)
+                item.UserID = user.ID
+                item.Book.ID = item.BookID
+                cart = append(cart, item)
+        }
+        rows.Close()
+        data["cart"] = cart
+
+        rows, err = db.Query(`SELECT id, user_agent, ip_address, created_at, last_seen_at, expires_at
+                              FROM user_sessions WHERE user_id = $1 ORDER BY created_at`, user.ID)
+        if err != nil {
+                return nil, err
+        }
+        var sessionList []UserSession
+        for rows.Next() {
+                var s UserSession
+                rows.Scan(&s.ID, &s.UserAgent, &s.IPAddress, &s.CreatedAt, &s.LastSeenAt, &s.ExpiresAt)
+                sessionList = append(sessionList, s)
+        }
+        rows.Close()
+        data["sessions"] = sessionList
+
+        rows, err = db.Query(`SELECT id, name, token_prefix, created_at, expires_at
+                              FROM api_tokens WHERE user_id = $1 ORDER BY created_at`, user.ID)
+        if err != nil {
+                return nil, err
+        }
+        var tokens []APIToken
+        for rows.Next() {
+                var t APIToken
+                rows.Scan(&t.ID, &t.Name, &t.Prefix, &t.CreatedAt, &t.ExpiresAt)
+                tokens = append(tokens, t)
+        }
+        rows.Close()
+        data["api_tokens"] = tokens
+
+        rows, err = db.Query(`SELECT id, event_type, ip_address, user_agent, details, created_at
+                              FROM security_events WHERE user_id = $1 ORDER BY created_at`, user.ID)
+        if err != nil {
+                return nil, err
+        }
+        var events []SecurityEvent
+        for rows.Next() {
+                var e SecurityEvent
+                var details []byte
+                rows.Scan(&e.ID, &e.EventType, &e.IPAddress, &e.UserAgent, &details, &e.CreatedAt)
+                json.Unmarshal(details, &e.Details)
+                events = append(events, e)
+        }
+        rows.Close()
+        data["security_events"] = events
+
+        return data, nil
+}
+
+// handleAccountExport serves GET /api/me/export as one JSON document, or as a
+// ZIP with one JSON file per section when ?format=zip.
+func handleAccountExport(w http.ResponseWriter, r *http.Request) {
+        user, err := getSessionUser(r)
+        if err != nil {
+                http.Error(w, "Unauthorized", http.StatusUnauthorized)
+                return
+        }
+
+        data, err := collectAccountData(user)
+        if err != nil {
+                http.Error(w, "Server error", http.StatusInternalServerError)
+                return
+        }
+        data["exported_at"] = time.Now()
+
+        recordSecurityEvent(r, user.ID, "account.exported", nil)
+
+        filename := fmt.Sprintf("bookstore-account-%d-%s", user.ID, time.Now().Format("20060102"))
+
+        if r.URL.Query().Get("format") != "zip" {
+                w.Header().Set("Content-Type", "application/json")
+                w.Header().Set("Content-Disposition", `attachment; filename="`+filename+`.json"`)
+                enc := json.NewEncoder(w)
+                enc.SetIndent("", "  ")
+                enc.Encode(data)
+                return
+        }
+
+        w.Header().Set("Content-Type", "application/zip")
+        w.Header().Set("Content-Disposition", `attachment; filename="`+filename+`.zip"`)
+
+        zw := zip.NewWriter(w)
+        for _, section := range exportSections {
+                f, err := zw.Create(section + ".json")
+                if err != nil {
+                        return
+                }
+                enc := json.NewEncoder(f)
+                enc.SetIndent("", "  ")
+                enc.Encode(data[section])
+        }
+        zw.Close()
+}
+
+// handleDeleteAccount serves DELETE /api/me. The users row is anonymized
+// rather than deleted so orders stay attached to it for accounting.
+func handleDeleteAccount(w http.ResponseWriter, r *http.Request) {
+        user, err := getSessionUser(r)
+        if err != nil {
+                http.Error(w, "Unauthorized", http.StatusUnauthorized)
+                return
+        }
+
+        var req struct {
+                Password string `json:"password"`
+                Confirm  string `json:"confirm"`
+        }
+
+        if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+                http.Error(w, "Invalid request", http.StatusBadRequest)
+                return
+        }
+
+        if req.Confirm != "DELETE" {
+                http.Error(w, `Set "confirm" to "DELETE" to delete your account`, http.StatusBadRequest)
+                return
+        }
+
+        var passwordHash string
+        db.QueryRow("SELECT password_hash FROM users WHERE id = $1", user.ID).Scan(&passwordHash)
+        // SSO-only accounts have no usable password to re-enter.
+        if passwordHash != "!" && !checkPassword(user.ID, req.Password) {
+                http.Error(w, "Invalid credentials", http.StatusUnauthorized)
+                return
+        }
+
+        if user.IsAdmin {
+                http.Error(w, "Staff accounts must have their roles removed before deletion", http.StatusForbidden)
+                return
+        }
+
+        tx, err := db.Begin()
+        if err != nil {
+                http.Error(w, "Server error", http.StatusInternalServerError)
+                return
+        }
+        defer tx.Rollback()
+
+        steps := []string{
+                // Orders keep their own copy of the shipping address.
+                `DELETE FROM addresses WHERE user_id = $1`,
+                `DELETE FROM cart_items WHERE user_id = $1`,
+                `DELETE FROM cart_coupons WHERE user_id = $1`,
+                `DELETE FROM user_sessions WHERE user_id = $1`,
+                `DELETE FROM api_tokens WHERE user_id = $1`,
+                `DELETE FROM user_identities WHERE user_id = $1`,
+                `DELETE FROM mfa_recovery_codes WHERE user_id = $1`,
+                `DELETE FROM email_change_requests WHERE user_id = $1`,
+                `DELETE FROM password_resets WHERE user_id = $1`,
+                `DELETE FROM security_events WHERE user_id = $1`,
+                `DELETE FROM notification_preferences WHERE user_id = $1`,
+                `DELETE FROM cart_reminders WHERE user_id = $1`,
+                `UPDATE users SET email = 'deleted-' || id || '@deleted.invalid', full_name = 'Deleted user',
+                        password_hash = '!', totp_secret = NULL, totp_enabled = FALSE, deleted_at = now()
+                 WHERE id = $1`,
+        }
+        for _, step := range steps {
+                if _, err := tx.Exec(step, user.ID); err != nil {
+                        http.Error(w, "Server error", http.StatusInternalServerError)
+                        return
+                }
+        }
+
+        if err = tx.Commit(); err != nil {
+                http.Error(w, "Server error", http.StatusInternalServerError)
+                return
+        }
+
+        session, _ := getSession(r)
+        session.Options.MaxAge = -1
+        session.Save(r, w)
+
+        w.Header().Set("Content-Type", "application/json")
+        json.NewEncoder(w).Encode(map[string]bool{"success": true})
+}
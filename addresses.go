@@ -0,0 +1,243 @@
+package main
+
+import (
+        "database/sql"
+        "encoding/json"
+        "fmt"
+        "net/http"
+        "strconv"
+        "strings"
+)
+
+const addressColumns = `id, COALESCE(user_id, 0), COALESCE(full_name, ''), COALESCE(phone, ''), COALESCE(address_line1, ''),
+                        COALESCE(address_line2, ''), COALESCE(city, ''), COALESCE(state, ''),
+                        COALESCE(postal_code, ''), COALESCE(country, ''), is_default`
+
+func scanAddress(row interface{ Scan(...interface{}) error }) (Address, error) {
+        var a Address
+        err := row.Scan(&a.ID, &a.UserID, &a.FullName, &a.Phone, &a.AddressLine1, &a.AddressLine2,
+                &a.City, &a.State, &a.PostalCode, &a.Country, &a.IsDefault)
+        return a, err
+}
+
+// validateAddress trims every field and checks the ones checkout requires.
+func validateAddress(a *Address) error {
+        for _, f := range []*string{&a.FullName, &a.Phone, &a.AddressLine1, &a.AddressLine2,
+                &a.City, &a.State, &a.PostalCode, &a.Country} {
+                *f = strings.TrimSpace(*f)
+        }
+        switch {
+        case a.FullName == "":
+                return fmt.Errorf("Full name is required")
+        case a.Phone == "":
+                return fmt.Errorf("Phone is required")
+        case a.AddressLine1 == "":
+                return fmt.Errorf("Address line 1 is required")
+        case a.City == "":
+                return fmt.Errorf("City is required")
+        case a.PostalCode == "":
+                return fmt.Errorf("Postal code is required")
+        case a.Country == "":
+                return fmt.Errorf("Country is required")
+        }
+        return nil
+}
+
+// insertAddress adds a to the user's address book. The first address a user
+// saves becomes their default.
+func insertAddress(tx *sql.Tx, userID int, a *Address) error {
+        var count int
+        if err := tx.QueryRow("SELECT COUNT(*) FROM addresses WHERE user_id = $1", userID).Scan(&count); err != nil {
+                return err
+        }
+        if count == 0 {
+                a.IsDefault = true
+        }
+        if a.IsDefault {
+                if _, err := tx.Exec("UPDATE addresses SET is_default = FALSE WHERE user_id = $1", userID); err != nil {
+                        return err
+                }
+        }
+        a.UserID = userID
+        return tx.QueryRow(`INSERT INTO addresses (user_id, full_name, phone, address_line1, address_line2, city, state, postal_code, country, is_default)
+                            VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10) RETURNING id`,
+                userID, a.FullName, a.Phone, a.AddressLine1, a.AddressLine2,
+                a.City, a.State, a.PostalCode, a.Country, a.IsDefault).Scan(&a.ID)
+}
+
+func handleAddresses(w http.ResponseWriter, r *http.Request) {
+        user, err := getAccountUser(r)
+        if err != nil {
+                http.Error(w, "Unauthorized", http.StatusUnauthorized)
+                return
+        }
+
+        switch r.Method {
+        case http.MethodGet:
+                rows, err := db.Query("SELECT "+addressColumns+" FROM addresses WHERE user_id = $1 ORDER BY is_default DESC, id", user.ID)
+                if err != nil {
+                        http.Error(w, "Server error", http.StatusInternalServerError)
+                        return
+                }
+                defer rows.Close()
+
+                addresses := []Address{}
+                for rows.Next() {
+                        a, err := scanAddress(rows)
+                        if err != nil {
+                                continue
+                        }
+                        addresses = append(addresses, a)
+                }
+
+                w.Header().Set("Content-Type", "application/json")
+                json.NewEncoder(w).Encode(addresses)
+
+        case http.MethodPost:
+                var a Address
+                if err := json.NewDecoder(r.Body).Decode(&a); err != nil {
+                        http.Error(w, "Invalid request", http.StatusBadRequest)
+                        return
+                }
+                if err := validateAddress(&a); err != nil {
+                        http.Error(w, err.Error(), http.StatusBadRequest)
+                        return
+                }
+
+                tx, err := db.Begin()
+                if err != nil {
+                        http.Error(w, "Server error", http.StatusInternalServerError)
+                        return
+                }
+                defer tx.Rollback()
+
+                if err := insertAddress(tx, user.ID, &a); err != nil {
+                        http.Error(w, "Server error", http.StatusInternalServerError)
+                        return
+                }
+                if err := tx.Commit(); err != nil {
+                        http.Error(w, "Server error", http.StatusInternalServerError)
+                        return
+                }
+
+                w.Header().Set("Content-Type", "application/json")
+                w.WriteHeader(http.StatusCreated)
+                json.NewEncoder(w).Encode(a)
+
+        default:
+                http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+        }
+}
+
+// handleAddressDetail serves GET/PUT/DELETE /api/addresses/{id}. Orders keep
+// their own copy of the address, so editing or deleting one never changes
+// order history.
+func handleAddressDetail(w http.ResponseWriter, r *http.Request) {
+        user, err := getAccountUser(r)
+        if err != nil {
+                http.Error(w, "Unauthorized", http.StatusUnauthorized)
+                return
+        }
+
+        idStr := strings.TrimPrefix(r.URL.Path, "/api/addresses/")
+        id, err := strconv.Atoi(idStr)
+        if err != nil {
+                http.Error(w, "Invalid address ID", http.StatusBadRequest)
+                return
+        }
+
+        existing, err := scanAddress(db.QueryRow("SELECT "+addressColumns+" FROM addresses WHERE id = $1 AND user_id = $2", id, user.ID))
+        if err == sql.ErrNoRows {
+                http.Error(w, "Address not found", http.StatusNotFound)
+                return
+        }
+        if err != nil {
+                http.Error(w, "Server error", http.StatusInternalServerError)
+                return
+        }
+
+        switch r.Method {
+        case http.MethodGet:
+                w.Header().Set("Content-Type", "application/json")
+                json.NewEncoder(w).Encode(existing)
+
+        case http.MethodPut:
+                var a Address
+                if err := json.NewDecoder(r.Body).Decode(&a); err != nil {
+                        http.Error(w, "Invalid request", http.StatusBadRequest)
+                        return
+                }
+                if err := validateAddress(&a); err != nil {
+                        http.Error(w, err.Error(), http.StatusBadRequest)
+                        return
+                }
+                // The default can be moved to another address but not cleared.
+                a.IsDefault = a.IsDefault || existing.IsDefault
+
+                tx, err := db.Begin()
+                if err != nil {
+                        http.Error(w, "Server error", http.StatusInternalServerError)
+                        return
+                }
+                defer tx.Rollback()
+
+                if a.IsDefault {
+                        if _, err := tx.Exec("UPDATE addresses SET is_default = FALSE WHERE user_id = $1", user.ID); err != nil {
+                                http.Error(w, "Server error", http.StatusInternalServerError)
+                                return
+                        }
+                }
+
+                _, err = tx.Exec(`UPDATE addresses SET full_name = $1, phone = $2, address_line1 = $3, address_line2 = $4,
+                                  city = $5, state = $6, postal_code = $7, country = $8, is_default = $9
+                                  WHERE id = $10`,
+                        a.FullName, a.Phone, a.AddressLine1, a.AddressLine2, a.City, a.State,
+                        a.PostalCode, a.Country, a.IsDefault, id)
+                if err != nil {
+                        http.Error(w, "Server error", http.StatusInternalServerError)
+                        return
+                }
+
+                if err := tx.Commit(); err != nil {
+                        http.Error(w, "Server error", http.StatusInternalServerError)
+                        return
+                }
+
+                a.ID = id
+                a.UserID = user.ID
+                w.Header().Set("Content-Type", "application/json")
+                json.NewEncoder(w).Encode(a)
+
+        case http.MethodDelete:
+                tx, err := db.Begin()
+                if err != nil {
+                        http.Error(w, "Server error", http.StatusInternalServerError)
+                        return
+                }
+                defer tx.Rollback()
+
+                if _, err := tx.Exec("DELETE FROM addresses WHERE id = $1", id); err != nil {
+                        http.Error(w, "Server error", http.StatusInternalServerError)
+                        return
+                }
+                if existing.IsDefault {
+                        _, err = tx.Exec(`UPDATE addresses SET is_default = TRUE
+                                          WHERE id = (SELECT MIN(id) FROM addresses WHERE user_id = $1)`, user.ID)
+                        if err != nil {
+                                http.Error(w, "Server error", http.StatusInternalServerError)
+                                return
+                        }
+                }
+
+                if err := tx.Commit(); err != nil {
+                        http.Error(w, "Server error", http.StatusInternalServerError)
+                        return
+                }
+
+                w.Header().Set("Content-Type", "application/json")
+                json.NewEncoder(w).Encode(map[string]bool{"success": true})
+
+        default:
+                http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+        }
+}
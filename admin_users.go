@@ -0,0 +1,471 @@
+package main
+
+import (
+        "database/sql"
+        "encoding/json"
+        "fmt"
+        "log"
+        "net/http"
+        "strconv"
+        "strings"
+        "time"
+
+        "github.com/lib/pq"
+        "golang.org/x/crypto/bcrypt"
+)
+
+const (
+        defaultUsersPerPage = 25
+        maxUsersPerPage     = 100
+        passwordResetExpiry = 24 * time.Hour
+)
+
+type AdminUser struct {
+        ID                    int        `json:"id"`
+        Email                 string     `json:"email"`
+        FullName              string     `json:"full_name"`
+        CreatedAt             time.Time  `json:"created_at"`
+        DisabledAt            *time.Time `json:"disabled_at"`
+        DeletedAt             *time.Time `json:"deleted_at"`
+        PasswordResetRequired bool       `json:"password_reset_required"`
+        TOTPEnabled           bool       `json:"totp_enabled"`
+        Roles                 []string   `json:"roles"`
+        OrderCount            int        `json:"order_count"`
+        LifetimeSpend         float64    `json:"lifetime_spend"`
+}
+
+type AuditEntry struct {
+        ID           int                    `json:"id"`
+        ActorID      int                    `json:"actor_id"`
+        ActorEmail   string                 `json:"actor_email"`
+        Action       string                 `json:"action"`
+        TargetUserID *int                   `json:"target_user_id"`
+        Details      map[string]interface{} `json:"details,omitempty"`
+        IPAddress    string                 `json:"ip_address"`
+        CreatedAt    time.Time              `json:"created_at"`
+}
+
+// recordAdminAudit appends to the staff audit log. targetUserID may be 0.
+func recordAdminAudit(r *http.Request, actorID int, action string, targetUserID int, details map[string]interface{}) {
+        var target interface{}
+        if targetUserID != 0 {
+                target = targetUserID
+        }
+        data, _ := json.Marshal(details)
+        _, err := db.Exec(`INSERT INTO admin_audit_log (actor_id, action, target_user_id, details, ip_address)
+                           VALUES ($1, $2, $3, $4, $5)`,
+                actorID, action, target, string(data), clientIP(r))
+        if err != nil {
+                log.Printf("Failed to record audit entry %s by user %d: %v", action, actorID, err)
+        }
+}
+
+const adminUserColumns = `u.id, u.email, COALESCE(u.full_name, ''), u.created_at, u.disabled_at, u.deleted_at,
+                          u.password_reset_required, u.totp_enabled,
+                          COALESCE((SELECT array_agg(r.name ORDER BY r.name) FROM user_roles ur
+                                    JOIN roles r ON r.id = ur.role_id WHERE ur.user_id = u.id), '{}'),
+                          (SELECT COUNT(*) FROM orders o WHERE o.user_id = u.id),
+                          (SELECT COALESCE(SUM(o.total_amount), 0) FROM orders o
+                           WHERE o.user_id = u.id AND o.status <> 'cancelled')`
+
+func scanAdminUser(row interface{ Scan(...interface{}) error }) (AdminUser, error) {
+        var u AdminUser
+        var disabledAt, deletedAt sql.NullTime
+        err := row.Scan(&u.ID, &u.Email, &u.FullName, &u.CreatedAt, &disabledAt, &deletedAt,
+                &u.PasswordResetRequired, &u.TOTPEnabled, pq.Array(&u.Roles), &u.OrderCount, &u.LifetimeSpend)
+        if disabledAt.Valid {
+                u.DisabledAt = &disabledAt.Time
+        }
+        if deletedAt.Valid {
+                u.DeletedAt = &deletedAt.Time
+        }
+        return u, err
+}
+
+func handleAdminUsers(w http.ResponseWriter, r *http.Request) {
+        query := r.URL.Query()
+        search := strings.ToLower(strings.TrimSpace(query.Get("search")))
+
+        page, _ := strconv.Atoi(query.Get("page"))
+        if page < 1 {
+                page = 1
+        }
+        perPage, _ := strconv.Atoi(query.Get("per_page"))
+        if perPage < 1 {
+                perPage = defaultUsersPerPage
+        }
+        if perPage > maxUsersPerPage {
+                perPage = maxUsersPerPage
+        }
+
+        where := "WHERE u.deleted_at IS NULL"
+        var args []interface{}
+        if search != "" {
+                where += " AND (LOWER(u.email) LIKE $1 OR LOWER(u.full_name) LIKE $1)"
+                args = append(args, "%"+search+"%")
+        }
+
+        var total int
+        if err := db.QueryRow("SELECT COUNT(*) FROM users u "+where, args...).Scan(&total); err != nil {
+                http.Error(w, "Server error", http.StatusInternalServerError)
+                return
+        }
+
+        stmt := fmt.Sprintf("SELECT %s FROM users u %s ORDER BY u.created_at DESC LIMIT $%d OFFSET $%d",
+                adminUserColumns, where, len(args)+1, len(args)+2)
+        args = append(args, perPage, (page-1)*perPage)
+
+        rows, err := db.Query(stmt, args...)
+        if err != nil {
+                http.Error(w, "Server error", http.StatusInternalServerError)
+                return
+        }
+        defer rows.Close()
+
+        users := []AdminUser{}
+        for rows.Next() {
+                u, err := scanAdminUser(rows)
+                if err != nil {
+                        continue
+                }
+                users = append(users, u)
+        }
+
+        w.Header().Set("Content-Type", "application/json")
+        json.NewEncoder(w).Encode(map[string]interface{}{
+                "users":    users,
+                "total":    total,
+                "page":     page,
+                "per_page": perPage,
+        })
+}
+
+// handleAdminUserDetail routes /api/admin/users/{id}[/action]. Each action
+// checks its own permission.
+func handleAdminUserDetail(w http.ResponseWriter, r *http.Request) {
+        rest := strings.TrimPrefix(r.URL.Path, "/api/admin/users/")
+        idStr, action, _ := strings.Cut(rest, "/")
+        id, err := strconv.Atoi(idStr)
+        if err != nil {
+                http.Error(w, "Invalid user ID", http.StatusBadRequest)
+                return
+        }
+
+        withID := func(h func(http.ResponseWriter, *http.Request, int)) http.HandlerFunc {
+                return func(w http.ResponseWriter, r *http.Request) { h(w, r, id) }
+        }
+
+        switch action {
+        case "":
+                requirePermission(map[string]string{http.MethodGet: permCustomersView}, withID(handleAdminUser))(w, r)
+        case "roles":
+                requirePermission(map[string]string{
+                        http.MethodGet: permRolesManage,
+                        http.MethodPut: permRolesManage,
+                }, withID(handleAdminUserRoles))(w, r)
+        case "promote", "demote":
+                requirePermission(map[string]string{http.MethodPost: permRolesManage}, withID(handleAdminUserPromote))(w, r)
+        case "disable", "enable":
+                requirePermission(map[string]string{http.MethodPost: permCustomersManage}, withID(handleAdminUserDisable))(w, r)
+        case "force-password-reset":
+                requirePermission(map[string]string{http.MethodPost: permCustomersManage}, withID(handleAdminForcePasswordReset))(w, r)
+        case "impersonate":
+                requirePermission(map[string]string{http.MethodPost: permCustomersImpersonate}, withID(handleAdminImpersonate))(w, r)
+        case "store-credit":
+                requirePermission(map[string]string{
+                        http.MethodGet:  permCreditManage,
+                        http.MethodPost: permCreditManage,
+                }, withID(handleAdminUserStoreCredit))(w, r)
+        default:
+                http.NotFound(w, r)
+        }
+}
+
+func handleAdminUser(w http.ResponseWriter, r *http.Request, id int) {
+        u, err := scanAdminUser(db.QueryRow("SELECT "+adminUserColumns+" FROM users u WHERE u.id = $1", id))
+        if err == sql.ErrNoRows {
+                http.Error(w, "User not found", http.StatusNotFound)
+                return
+        }
+        if err != nil {
+                http.Error(w, "Server error", http.StatusInternalServerError)
+                return
+        }
+
+        w.Header().Set("Content-Type", "application/json")
+        json.NewEncoder(w).Encode(u)
+}
+
+// handleAdminUserPromote adds a role (default superadmin) on /promote and
+// removes one, or all roles when none is given, on /demote.
+func handleAdminUserPromote(w http.ResponseWriter, r *http.Request, id int) {
+        actor, _ := getCurrentUser(r)
+
+        var req struct {
+                Role string `json:"role"`
+        }
+        json.NewDecoder(r.Body).Decode(&req)
+
+        target := User{ID: id}
+        if err := loadUserRoles(&target); err != nil {
+                http.Error(w, "Server error", http.StatusInternalServerError)
+                return
+        }
+
+        promote := strings.HasSuffix(r.URL.Path, "/promote")
+        var roles []string
+        if promote {
+                if req.Role == "" {
+                        req.Role = roleSuperadmin
+                }
+                roles = append(target.Roles, req.Role)
+        } else if req.Role != "" {
+                for _, role := range target.Roles {
+                        if role != req.Role {
+                                roles = append(roles, role)
+                        }
+                }
+        }
+
+        switch err := setUserRoles(id, roles); err {
+        case nil:
+        case errUserNotFound:
+                http.Error(w, "User not found", http.StatusNotFound)
+                return
+        case errUnknownRole:
+                http.Error(w, "Unknown role", http.StatusBadRequest)
+                return
+        case errLastSuperadmin:
+                http.Error(w, "At least one superadmin is required", http.StatusConflict)
+                return
+        default:
+                http.Error(w, "Server error", http.StatusInternalServerError)
+                return
+        }
+
+        action := "user.demoted"
+        if promote {
+                action = "user.promoted"
+        }
+        recordAdminAudit(r, actor.ID, action, id, map[string]interface{}{
+                "before": target.Roles,
+                "after":  uniqueStrings(roles),
+        })
+
+        w.Header().Set("Content-Type", "application/json")
+        json.NewEncoder(w).Encode(map[string]interface{}{
+                "success": true,
+                "roles":   uniqueStrings(roles),
+        })
+}
+
+// canManageAccount reports whether actor may disable, enable or force a
+// password reset on user id, answering the request when not. Staff
+// accounts need roles.manage, so customer support can't lock out the
+// people who assign roles.
+func canManageAccount(w http.ResponseWriter, actor *User, id int) bool {
+        target := User{ID: id}
+        if err := loadUserRoles(&target); err != nil {
+                http.Error(w, "Server error", http.StatusInternalServerError)
+                return false
+        }
+        if target.IsAdmin && !actor.Can(permRolesManage) {
+                http.Error(w, "Staff accounts can only be managed by staff who can manage roles", http.StatusForbidden)
+                return false
+        }
+        return true
+}
+
+func handleAdminUserDisable(w http.ResponseWriter, r *http.Request, id int) {
+        actor, _ := getCurrentUser(r)
+        disable := strings.HasSuffix(r.URL.Path, "/disable")
+
+        if disable && id == actor.ID {
+                http.Error(w, "You cannot disable your own account", http.StatusBadRequest)
+                return
+        }
+        if !canManageAccount(w, actor, id) {
+                return
+        }
+
+        var res sql.Result
+        var err error
+        if disable {
+                res, err = db.Exec("UPDATE users SET disabled_at = now() WHERE id = $1 AND deleted_at IS NULL", id)
+        } else {
+                res, err = db.Exec("UPDATE users SET disabled_at = NULL WHERE id = $1 AND deleted_at IS NULL", id)
+        }
+        if err != nil {
+                http.Error(w, "Server error", http.StatusInternalServerError)
+                return
+        }
+        if n, _ := res.RowsAffected(); n == 0 {
+                http.Error(w, "User not found", http.StatusNotFound)
+                return
+        }
+
+        action := "user.enabled"
+        if disable {
+                action = "user.disabled"
+                // Sign the account out everywhere and kill its API tokens.
+                revokeUserSessions(id, "")
+                db.Exec("DELETE FROM api_tokens WHERE user_id = $1", id)
+        }
+        recordAdminAudit(r, actor.ID, action, id, nil)
+
+        w.Header().Set("Content-Type", "application/json")
+        json.NewEncoder(w).Encode(map[string]bool{"success": true})
+}
+
+// handleAdminForcePasswordReset blocks password login for the user, signs
+// them out everywhere, revokes their API tokens and emails a link to choose
+// a new password.
+func handleAdminForcePasswordReset(w http.ResponseWriter, r *http.Request, id int) {
+        actor, _ := getCurrentUser(r)
+        if !canManageAccount(w, actor, id) {
+                return
+        }
+
+        var email, fullName string
+        err := db.QueryRow(`UPDATE users SET password_reset_required = TRUE
+                            WHERE id = $1 AND deleted_at IS NULL
+                            RETURNING email, COALESCE(full_name, '')`, id).Scan(&email, &fullName)
+        if err == sql.ErrNoRows {
+                http.Error(w, "User not found", http.StatusNotFound)
+                return
+        }
+        if err != nil {
+                http.Error(w, "Server error", http.StatusInternalServerError)
+                return
+        }
+
+        revokeUserSessions(id, "")
+        db.Exec("DELETE FROM api_tokens WHERE user_id = $1", id)
+
+        token := newSessionToken()
+        _, err = db.Exec("INSERT INTO password_resets (user_id, token_hash, expires_at) VALUES ($1, $2, $3)",
+                id, hashToken(token), time.Now().Add(passwordResetExpiry))
+        if err != nil {
+                http.Error(w, "Server error", http.StatusInternalServerError)
+                return
+        }
+
+        link := appBaseURL(r) + "/reset-password?token=" + token
+        sendMailAsync(email, "Please choose a new password",
+                "Hi "+fullName+",\n\nFor your security we've asked you to choose a new password for your Bookstore account.\n"+
+                        "Open this link within 24 hours to set it:\n\n"+link+"\n")
+
+        recordAdminAudit(r, actor.ID, "user.password_reset_forced", id, nil)
+
+        w.Header().Set("Content-Type", "application/json")
+        json.NewEncoder(w).Encode(map[string]bool{"success": true})
+}
+
+// handlePasswordReset serves POST /api/password-reset with a token from a
+// reset email.
+func handlePasswordReset(w http.ResponseWriter, r *http.Request) {
+        if r.Method != http.MethodPost {
+                http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+                return
+        }
+
+        var req struct {
+                Token       string `json:"token"`
+                NewPassword string `json:"new_password"`
+        }
+
+        if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+                http.Error(w, "Invalid request", http.StatusBadRequest)
+                return
+        }
+
+        if len(req.NewPassword) < minPasswordLength {
+                http.Error(w, "New password must be at least 8 characters", http.StatusBadRequest)
+                return
+        }
+
+        hashedPassword, err := bcrypt.GenerateFromPassword([]byte(req.NewPassword), bcrypt.DefaultCost)
+        if err != nil {
+                http.Error(w, "Server error", http.StatusInternalServerError)
+                return
+        }
+
+        tx, err := db.Begin()
+        if err != nil {
+                http.Error(w, "Server error", http.StatusInternalServerError)
+                return
+        }
+        defer tx.Rollback()
+
+        // Disabled and deleted accounts can't be brought back with a link
+        // mailed before they were.
+        var userID int
+        err = tx.QueryRow(`UPDATE password_resets p SET used_at = now()
+                           FROM users u
+                           WHERE p.token_hash = $1 AND p.used_at IS NULL AND p.expires_at > now()
+                             AND u.id = p.user_id AND u.disabled_at IS NULL AND u.deleted_at IS NULL
+                           RETURNING p.user_id`, hashToken(req.Token)).Scan(&userID)
+        if err == sql.ErrNoRows {
+                http.Error(w, "This link is invalid or has expired", http.StatusBadRequest)
+                return
+        }
+        if err != nil {
+                http.Error(w, "Server error", http.StatusInternalServerError)
+                return
+        }
+
+        _, err = tx.Exec("UPDATE users SET password_hash = $1, password_reset_required = FALSE WHERE id = $2",
+                string(hashedPassword), userID)
+        if err != nil {
+                http.Error(w, "Server error", http.StatusInternalServerError)
+                return
+        }
+
+        if err = tx.Commit(); err != nil {
+                http.Error(w, "Server error", http.StatusInternalServerError)
+                return
+        }
+
+        recordSecurityEvent(r, userID, "profile.password_reset", nil)
+
+        w.Header().Set("Content-Type", "application/json")
+        json.NewEncoder(w).Encode(map[string]bool{"success": true})
+}
+
+func handleAdminAuditLog(w http.ResponseWriter, r *http.Request) {
+        where := ""
+        var args []interface{}
+        if userID, err := strconv.Atoi(r.URL.Query().Get("user_id")); err == nil {
+                where = "WHERE a.target_user_id = $1 OR a.actor_id = $1"
+                args = append(args, userID)
+        }
+
+        rows, err := db.Query(`SELECT a.id, COALESCE(a.actor_id, 0), COALESCE(u.email, ''), a.action, a.target_user_id,
+                                      a.details, a.ip_address, a.created_at
+                               FROM admin_audit_log a
+                               LEFT JOIN users u ON u.id = a.actor_id
+                               `+where+`
+                               ORDER BY a.created_at DESC LIMIT 200`, args...)
+        if err != nil {
+                http.Error(w, "Server error", http.StatusInternalServerError)
+                return
+        }
+        defer rows.Close()
+
+        var entries []AuditEntry
+        for rows.Next() {
+                var e AuditEntry
+                var target sql.NullInt64
+                var details []byte
+                rows.Scan(&e.ID, &e.ActorID, &e.ActorEmail, &e.Action, &target, &details, &e.IPAddress, &e.CreatedAt)
+                if target.Valid {
+                        id := int(target.Int64)
+                        e.TargetUserID = &id
+                }
+                json.Unmarshal(details, &e.Details)
+                entries = append(entries, e)
+        }
+
+        w.Header().Set("Content-Type", "application/json")
+        json.NewEncoder(w).Encode(entries)
+}
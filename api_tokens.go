@@ -0,0 +1,214 @@
+package main
+
+import (
+        "crypto/sha256"
+        "database/sql"
+        "encoding/hex"
+        "encoding/json"
+        "fmt"
+        "net/http"
+        "strconv"
+        "strings"
+        "time"
+
+        "github.com/lib/pq"
+)
+
+const (
+        apiTokenPrefix      = "bks_"
+        defaultAPITokenDays = 90
+        maxAPITokenDays     = 365
+
+        // scopeAccount lets a token act as its owner the customer: cart,
+        // checkout, orders, addresses and settings. Other scopes are staff
+        // permissions.
+        scopeAccount = "account"
+)
+
+type APIToken struct {
+        ID         int        `json:"id"`
+        Name       string     `json:"name"`
+        Prefix     string     `json:"prefix"`
+        Scopes     []string   `json:"scopes"`
+        CreatedAt  time.Time  `json:"created_at"`
+        ExpiresAt  time.Time  `json:"expires_at"`
+        LastUsedAt *time.Time `json:"last_used_at"`
+}
+
+// hashToken is how random bearer secrets (API tokens, email links) are stored.
+func hashToken(token string) string {
+        sum := sha256.Sum256([]byte(token))
+        return hex.EncodeToString(sum[:])
+}
+
+// getTokenUser authenticates an "Authorization: Bearer" header. The user's
+// permissions are narrowed to the scopes the token was created with, and it
+// only reaches customer endpoints with the account scope.
+func getTokenUser(auth string) (*User, error) {
+        token, ok := strings.CutPrefix(auth, "Bearer ")
+        if !ok || !strings.HasPrefix(token, apiTokenPrefix) {
+                return nil, fmt.Errorf("invalid authorization header")
+        }
+
+        var tokenID, userID int
+        var scopes []string
+        err := db.QueryRow(`SELECT id, user_id, scopes FROM api_tokens
+                            WHERE token_hash = $1 AND expires_at > now()`, hashToken(token)).
+                Scan(&tokenID, &userID, pq.Array(&scopes))
+        if err != nil {
+                return nil, fmt.Errorf("invalid token")
+        }
+
+        user, err := loadUser(userID)
+        if err != nil {
+                return nil, err
+        }
+        user.APITokenID = tokenID
+
+        allowed := map[string]bool{}
+        for _, s := range scopes {
+                allowed[s] = true
+        }
+        var perms []string
+        for _, p := range user.Permissions {
+                if allowed[p] {
+                        perms = append(perms, p)
+                }
+        }
+        user.Permissions = perms
+        user.accountScope = allowed[scopeAccount]
+
+        db.Exec(`UPDATE api_tokens SET last_used_at = now()
+                 WHERE id = $1 AND (last_used_at IS NULL OR last_used_at < now() - INTERVAL '1 minute')`, tokenID)
+
+        return user, nil
+}
+
+func handleAPITokens(w http.ResponseWriter, r *http.Request) {
+        user, err := getSessionUser(r)
+        if err != nil {
+                http.Error(w, "Unauthorized", http.StatusUnauthorized)
+                return
+        }
+
+        switch r.Method {
+        case http.MethodGet:
+                rows, err := db.Query(`SELECT id, name, token_prefix, scopes, created_at, expires_at, last_used_at
+                                       FROM api_tokens WHERE user_id = $1 ORDER BY created_at DESC`, user.ID)
+                if err != nil {
+                        http.Error(w, "Server error", http.StatusInternalServerError)
+                        return
+                }
+                defer rows.Close()
+
+                var tokens []APIToken
+                for rows.Next() {
+                        var t APIToken
+                        var lastUsed sql.NullTime
+                        rows.Scan(&t.ID, &t.Name, &t.Prefix, pq.Array(&t.Scopes), &t.CreatedAt, &t.ExpiresAt, &lastUsed)
+                        if lastUsed.Valid {
+                                t.LastUsedAt = &lastUsed.Time
+                        }
+                        tokens = append(tokens, t)
+                }
+
+                w.Header().Set("Content-Type", "application/json")
+                json.NewEncoder(w).Encode(tokens)
+
+        case http.MethodPost:
+                var req struct {
+                        Name          string   `json:"name"`
+                        Scopes        []string `json:"scopes"`
+                        ExpiresInDays int      `json:"expires_in_days"`
+                }
+
+                if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+                        http.Error(w, "Invalid request", http.StatusBadRequest)
+                        return
+                }
+
+                if strings.TrimSpace(req.Name) == "" {
+                        http.Error(w, "Name is required", http.StatusBadRequest)
+                        return
+                }
+
+                if req.ExpiresInDays == 0 {
+                        req.ExpiresInDays = defaultAPITokenDays
+                }
+                if req.ExpiresInDays < 1 || req.ExpiresInDays > maxAPITokenDays {
+                        http.Error(w, fmt.Sprintf("expires_in_days must be between 1 and %d", maxAPITokenDays), http.StatusBadRequest)
+                        return
+                }
+
+                // A token can only carry permissions its owner holds right now.
+                req.Scopes = uniqueStrings(req.Scopes)
+                if len(req.Scopes) == 0 {
+                        http.Error(w, "At least one scope is required", http.StatusBadRequest)
+                        return
+                }
+                for _, scope := range req.Scopes {
+                        if scope != scopeAccount && !user.Can(scope) {
+                                http.Error(w, "Scope not permitted: "+scope, http.StatusForbidden)
+                                return
+                        }
+                }
+
+                token := apiTokenPrefix + newSessionToken()
+                expiresAt := time.Now().AddDate(0, 0, req.ExpiresInDays)
+
+                var id int
+                err = db.QueryRow(`INSERT INTO api_tokens (user_id, name, token_hash, token_prefix, scopes, expires_at)
+                                   VALUES ($1, $2, $3, $4, $5, $6) RETURNING id`,
+                        user.ID, req.Name, hashToken(token), token[:len(apiTokenPrefix)+6], pq.Array(req.Scopes), expiresAt).Scan(&id)
+                if err != nil {
+                        http.Error(w, "Server error", http.StatusInternalServerError)
+                        return
+                }
+
+                // The plain token is only ever returned here.
+                w.Header().Set("Content-Type", "application/json")
+                json.NewEncoder(w).Encode(map[string]interface{}{
+                        "success":    true,
+                        "id":         id,
+                        "token":      token,
+                        "scopes":     req.Scopes,
+                        "expires_at": expiresAt,
+                })
+
+        default:
+                http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+        }
+}
+
+func handleAPITokenDetail(w http.ResponseWriter, r *http.Request) {
+        if r.Method != http.MethodDelete {
+                http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+                return
+        }
+
+        user, err := getSessionUser(r)
+        if err != nil {
+                http.Error(w, "Unauthorized", http.StatusUnauthorized)
+                return
+        }
+
+        idStr := strings.TrimPrefix(r.URL.Path, "/api/tokens/")
+        id, err := strconv.Atoi(idStr)
+        if err != nil {
+                http.Error(w, "Invalid token ID", http.StatusBadRequest)
+                return
+        }
+
+        res, err := db.Exec("DELETE FROM api_tokens WHERE id = $1 AND user_id = $2", id, user.ID)
+        if err != nil {
+                http.Error(w, "Server error", http.StatusInternalServerError)
+                return
+        }
+        if n, _ := res.RowsAffected(); n == 0 {
+                http.Error(w, "Token not found", http.StatusNotFound)
+                return
+        }
+
+        w.Header().Set("Content-Type", "application/json")
+        json.NewEncoder(w).Encode(map[string]bool{"success": true})
+}
@@ -0,0 +1,105 @@
+package main
+
+import (
+        "database/sql"
+        "errors"
+        "fmt"
+)
+
+type CartWarning struct {
+        Code    string `json:"code"`
+        Message string `json:"message"`
+}
+
+// cartError is a reason a quantity can't go in the cart, or a code can't be
+// applied to it. Its text is shown to the customer.
+type cartError string
+
+func (e cartError) Error() string { return string(e) }
+
+var errBookNotFound = errors.New("book not found")
+
+// cartLimit is the most of one book a customer may have in their cart: the
+// stock, capped by what is left of the book's max_per_customer after the
+// copies they have already ordered.
+func cartLimit(stock int, maxPerCustomer sql.NullInt64, ordered int) int {
+        if maxPerCustomer.Valid {
+                left := int(maxPerCustomer.Int64) - ordered
+                if left < 0 {
+                        left = 0
+                }
+                if left < stock {
+                        return left
+                }
+        }
+        return stock
+}
+
+// orderedCopies counts the copies of bookID the customer has on orders that
+// weren't cancelled. Guests are only counted once checkout knows their email.
+func orderedCopies(q queryer, owner cartOwner, bookID int) (int, error) {
+        if owner.UserID == 0 && owner.Email == "" {
+                return 0, nil
+        }
+        var n int
+        err := q.QueryRow(`SELECT COALESCE(SUM(i.quantity), 0) FROM order_items i JOIN orders o ON i.order_id = o.id
+                           WHERE i.book_id = $1 AND o.status <> 'cancelled'
+                             AND (o.user_id = $2 OR LOWER(o.guest_email) = LOWER($3))`,
+                bookID, owner.UserID, owner.Email).Scan(&n)
+        return n, err
+}
+
+// checkCartQuantity checks that quantity copies of bookID can be in owner's
+// cart, counting what they have already ordered against max_per_customer.
+func checkCartQuantity(owner cartOwner, bookID, quantity int) error {
+        var stock int
+        var maxPerCustomer sql.NullInt64
+        err := db.QueryRow("SELECT stock_quantity, max_per_customer FROM books WHERE id = $1", bookID).
+                Scan(&stock, &maxPerCustomer)
+        if err == sql.ErrNoRows {
+                return errBookNotFound
+        }
+        if err != nil {
+                return err
+        }
+        var ordered int
+        if maxPerCustomer.Valid {
+                if ordered, err = orderedCopies(db, owner, bookID); err != nil {
+                        return err
+                }
+        }
+        return checkLimit(quantity, ordered, stock, maxPerCustomer)
+}
+
+func checkLimit(quantity, ordered, stock int, maxPerCustomer sql.NullInt64) error {
+        switch {
+        case stock <= 0:
+                return cartError("This book is out of stock")
+        case maxPerCustomer.Valid && ordered > 0 && ordered+quantity > int(maxPerCustomer.Int64):
+                return cartError(fmt.Sprintf("Limit of %d per customer, and you have already ordered %d",
+                        maxPerCustomer.Int64, ordered))
+        case maxPerCustomer.Valid && quantity > int(maxPerCustomer.Int64):
+                return cartError(fmt.Sprintf("Limit of %d per customer", maxPerCustomer.Int64))
+        case quantity > stock:
+                return cartError(fmt.Sprintf("Only %d left in stock", stock))
+        }
+        return nil
+}
+
+// cartWarnings explains what changed about a cart line since it was added.
+// Prices are compared in the base currency and shown in currency.
+func cartWarnings(item CartItem, maxPerCustomer sql.NullInt64, ordered int, priceAtAdd float64, currency Currency) []CartWarning {
+        var warnings []CartWarning
+        stock := item.Book.StockQuantity
+        if stock <= 0 {
+                warnings = append(warnings, CartWarning{"out_of_stock", "This book is out of stock"})
+        } else if err := checkLimit(item.Quantity, ordered, stock, maxPerCustomer); err != nil {
+                warnings = append(warnings, CartWarning{"reduced_availability", err.Error()})
+        }
+        if priceAtAdd != item.Book.Price {
+                warnings = append(warnings, CartWarning{"price_changed",
+                        fmt.Sprintf("Price changed from %s to %s since you added it",
+                                currency.format(priceAtAdd), currency.format(item.Book.Price))})
+        }
+        return warnings
+}
@@ -0,0 +1,341 @@
+package main
+
+import (
+        "crypto/rand"
+        "database/sql"
+        "encoding/hex"
+        "encoding/json"
+        "fmt"
+        "log"
+        "net/http"
+        "os"
+        "strconv"
+        "strings"
+        "time"
+)
+
+// Abandoned cart reminders are off when cartReminderAfter is zero. They are
+// configured by CART_REMINDER_HOURS (24 unless set) and
+// CART_REMINDER_COUPON_PERCENT (no coupon unless set), and need
+// APP_BASE_URL for their links.
+var (
+        cartReminderAfter         time.Duration
+        cartReminderCouponPercent float64
+)
+
+// Frequency caps: a customer gets at most one reminder per idle cart and one
+// per cartReminderInterval, and carts idle for longer than
+// cartReminderMaxIdle are left alone.
+const (
+        cartReminderInterval = 7 * 24 * time.Hour
+        cartReminderMaxIdle  = 14 * 24 * time.Hour
+        // cartReminderLinkTTL is how long a restore link works; the coupon in
+        // a reminder expires after cartReminderCouponTTL.
+        cartReminderLinkTTL   = 30 * 24 * time.Hour
+        cartReminderCouponTTL = 7 * 24 * time.Hour
+)
+
+func loadCartReminderSettings() error {
+        cartReminderAfter = 24 * time.Hour
+        if v := os.Getenv("CART_REMINDER_HOURS"); v != "" {
+                hours, err := strconv.Atoi(v)
+                if err != nil || hours < 0 {
+                        return fmt.Errorf("CART_REMINDER_HOURS must be a whole number of hours")
+                }
+                cartReminderAfter = time.Duration(hours) * time.Hour
+        }
+        if v := os.Getenv("CART_REMINDER_COUPON_PERCENT"); v != "" {
+                percent, err := strconv.ParseFloat(v, 64)
+                if err != nil || percent < 0 || percent > 100 {
+                        return fmt.Errorf("CART_REMINDER_COUPON_PERCENT must be between 0 and 100")
+                }
+                cartReminderCouponPercent = percent
+        }
+        if cartReminderAfter > 0 && os.Getenv("APP_BASE_URL") == "" {
+                log.Println("Cart reminders are off: they need APP_BASE_URL for their links")
+                cartReminderAfter = 0
+        }
+        return nil
+}
+
+// cartReminderItem is a line of the cart a reminder was sent for, which its
+// restore link puts back.
+type cartReminderItem struct {
+        BookID   int `json:"book_id"`
+        Quantity int `json:"quantity"`
+}
+
+// runCartRemindersJob reminds signed-in customers whose cart has been idle
+// for cartReminderAfter. Guest carts have no email address to write to.
+func runCartRemindersJob(json.RawMessage) error {
+        if cartReminderAfter == 0 {
+                return nil
+        }
+
+        now := time.Now()
+        rows, err := db.Query(`SELECT c.user_id, MAX(c.updated_at)
+                               FROM cart_items c JOIN users u ON u.id = c.user_id
+                               WHERE u.disabled_at IS NULL AND u.deleted_at IS NULL
+                               GROUP BY c.user_id
+                               HAVING MAX(c.updated_at) BETWEEN $1 AND $2`,
+                now.Add(-cartReminderMaxIdle), now.Add(-cartReminderAfter))
+        if err != nil {
+                return err
+        }
+        type idleCart struct {
+                userID     int
+                lastChange time.Time
+        }
+        var carts []idleCart
+        for rows.Next() {
+                var c idleCart
+                if err := rows.Scan(&c.userID, &c.lastChange); err != nil {
+                        rows.Close()
+                        return err
+                }
+                carts = append(carts, c)
+        }
+        rows.Close()
+        if err := rows.Err(); err != nil {
+                return err
+        }
+
+        // One customer's failure doesn't hold up the others; the job is
+        // retried, and customers already reminded are skipped.
+        var firstErr error
+        for _, c := range carts {
+                if err := sendCartReminder(c.userID, c.lastChange); err != nil {
+                        log.Printf("Failed to send cart reminder to user %d: %v", c.userID, err)
+                        if firstErr == nil {
+                                firstErr = err
+                        }
+                }
+        }
+        return firstErr
+}
+
+// sendCartReminder records a reminder for userID's cart, last changed at
+// lastChange, and queues its email, unless a frequency cap, an order placed
+// since or the customer's preferences say not to.
+func sendCartReminder(userID int, lastChange time.Time) error {
+        tx, err := db.Begin()
+        if err != nil {
+                return err
+        }
+        defer tx.Rollback()
+
+        // Locking the user keeps two runs from both reminding them.
+        var email, name string
+        err = tx.QueryRow("SELECT email, full_name FROM users WHERE id = $1 FOR UPDATE", userID).Scan(&email, &name)
+        if err != nil {
+                return err
+        }
+
+        enabled, err := notificationEnabled(tx, userID, notifyCartReminders)
+        if err != nil || !enabled {
+                return err
+        }
+        var skip bool
+        err = tx.QueryRow(`SELECT EXISTS (SELECT 1 FROM orders WHERE user_id = $1 AND created_at > $2)
+                               OR EXISTS (SELECT 1 FROM cart_reminders
+                                          WHERE user_id = $1 AND (cart_updated_at >= $2 OR sent_at > $3))`,
+                userID, lastChange, time.Now().Add(-cartReminderInterval)).Scan(&skip)
+        if err != nil || skip {
+                return err
+        }
+
+        quote, err := quoteCart(tx, cartOwner{UserID: userID}, Destination{}, "", false)
+        if err != nil || len(quote.Lines) == 0 {
+                return err
+        }
+
+        base := Currency{Code: baseCurrency, Rate: 1}
+        reminder := notice{Name: name, Total: base.format(quote.Subtotal)}
+        var items []cartReminderItem
+        for _, line := range quote.Lines {
+                items = append(items, cartReminderItem{line.BookID, line.Quantity})
+                reminder.Lines = append(reminder.Lines, noticeLine{line.Title, line.Quantity, base.format(line.Subtotal)})
+        }
+        snapshot, _ := json.Marshal(items)
+
+        var promotionID interface{}
+        if cartReminderCouponPercent > 0 {
+                buf := make([]byte, 4)
+                rand.Read(buf)
+                reminder.Coupon = "COMEBACK-" + strings.ToUpper(hex.EncodeToString(buf))
+                reminder.CouponDiscount = strconv.FormatFloat(cartReminderCouponPercent, 'f', -1, 64) + "%"
+                expires := time.Now().Add(cartReminderCouponTTL)
+                reminder.CouponExpires = expires.Format("January 2")
+                var id int
+                err = tx.QueryRow(`INSERT INTO promotions (code, description, kind, value, max_uses, max_uses_per_customer, ends_at, active)
+                                   VALUES ($1, $2, 'percent', $3, 1, 1, $4, TRUE) RETURNING id`,
+                        reminder.Coupon, reminder.CouponDiscount+" off for coming back to your cart",
+                        cartReminderCouponPercent, expires).Scan(&id)
+                if err != nil {
+                        return err
+                }
+                promotionID = id
+        }
+
+        // The restore link hands out the cart and coupon, so it gets its own
+        // token: an unsubscribe URL, which mail clients and forwarded
+        // messages pass around more freely, can't be used to restore.
+        token, unsubscribeToken := newSessionToken(), newSessionToken()
+        _, err = tx.Exec(`INSERT INTO cart_reminders (user_id, token_hash, unsubscribe_token_hash, items, cart_updated_at, promotion_id)
+                          VALUES ($1, $2, $3, $4, $5, $6)`,
+                userID, hashToken(token), hashToken(unsubscribeToken), snapshot, lastChange, promotionID)
+        if err != nil {
+                return err
+        }
+
+        baseURL := strings.TrimRight(os.Getenv("APP_BASE_URL"), "/")
+        reminder.Link = baseURL + "/cart/restore?token=" + token
+        reminder.UnsubscribeURL = baseURL + "/unsubscribe?token=" + unsubscribeToken
+        reminder.listUnsubscribe = baseURL + "/api/notifications/unsubscribe?token=" + unsubscribeToken
+        if err := notify(tx, "cart_reminder", userID, email, reminder); err != nil {
+                return err
+        }
+        return tx.Commit()
+}
+
+// serveCartRestore serves GET /cart/restore?token=, the link in a cart
+// reminder: a page that posts the token to /api/cart/restore, so link
+// scanners and prefetching don't restore the cart.
+func serveCartRestore(w http.ResponseWriter, r *http.Request) {
+        http.ServeFile(w, r, "static/cart-restore.html")
+}
+
+// handleCartRestore serves POST /api/cart/restore with a cart reminder's
+// {"token"}. It puts the reminded books, and the reminder's coupon, in the
+// visitor's cart. It never signs anyone in: a guest's restored cart joins
+// their account cart when they log in.
+func handleCartRestore(w http.ResponseWriter, r *http.Request) {
+        if r.Method != http.MethodPost {
+                http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+                return
+        }
+
+        var req struct {
+                Token string `json:"token"`
+        }
+        if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+                http.Error(w, "Invalid request", http.StatusBadRequest)
+                return
+        }
+
+        var reminderID int
+        var snapshot []byte
+        var promotionID sql.NullInt64
+        err := db.QueryRow("SELECT id, items, promotion_id FROM cart_reminders WHERE token_hash = $1 AND sent_at > $2",
+                hashToken(req.Token), time.Now().Add(-cartReminderLinkTTL)).
+                Scan(&reminderID, &snapshot, &promotionID)
+        if err == sql.ErrNoRows {
+                http.Error(w, "This cart link has expired", http.StatusNotFound)
+                return
+        }
+        if err != nil {
+                http.Error(w, "Server error", http.StatusInternalServerError)
+                return
+        }
+        var items []cartReminderItem
+        if err := json.Unmarshal(snapshot, &items); err != nil {
+                http.Error(w, "Server error", http.StatusInternalServerError)
+                return
+        }
+
+        owner, err := getCartOwner(w, r, true)
+        if err != nil {
+                http.Error(w, "Server error", http.StatusInternalServerError)
+                return
+        }
+
+        tx, err := db.Begin()
+        if err != nil {
+                http.Error(w, "Server error", http.StatusInternalServerError)
+                return
+        }
+        defer tx.Rollback()
+
+        // Quantities are clamped to what can be bought now, and never lower
+        // what is already in the cart.
+        for _, item := range items {
+                _, err = tx.Exec(`INSERT INTO cart_items (`+owner.column()+`, book_id, quantity, price_at_add)
+                                  SELECT $1, b.id, LEAST($3, b.stock_quantity, COALESCE(b.max_per_customer, $3)), b.price
+                                  FROM books b WHERE b.id = $2 AND b.stock_quantity > 0
+                                  ON CONFLICT `+owner.conflictTarget()+`
+                                  DO UPDATE SET quantity = GREATEST(cart_items.quantity, EXCLUDED.quantity), updated_at = now()`,
+                        owner.key(), item.BookID, item.Quantity)
+                if err != nil {
+                        http.Error(w, "Server error", http.StatusInternalServerError)
+                        return
+                }
+        }
+        if promotionID.Valid {
+                _, err = tx.Exec(`INSERT INTO cart_coupons (`+owner.column()+`, promotion_id) VALUES ($1, $2)
+                                  ON CONFLICT (`+owner.column()+`) DO UPDATE SET promotion_id = EXCLUDED.promotion_id, applied_at = now()`,
+                        owner.key(), promotionID.Int64)
+                if err != nil {
+                        http.Error(w, "Server error", http.StatusInternalServerError)
+                        return
+                }
+        }
+        if _, err := tx.Exec("UPDATE cart_reminders SET restored_at = COALESCE(restored_at, now()) WHERE id = $1", reminderID); err != nil {
+                http.Error(w, "Server error", http.StatusInternalServerError)
+                return
+        }
+        if err := tx.Commit(); err != nil {
+                http.Error(w, "Server error", http.StatusInternalServerError)
+                return
+        }
+
+        w.Header().Set("Content-Type", "application/json")
+        json.NewEncoder(w).Encode(map[string]bool{"success": true})
+}
+
+// handleUnsubscribe serves POST /api/notifications/unsubscribe with the
+// unsubscribe token of a cart reminder, in the query (the one-click
+// List-Unsubscribe request mail clients send) or as {"token"}. It turns cart
+// reminders off for the customer the reminder went to. Tokens never expire.
+// Reminders sent before they had an unsubscribe token used their restore
+// token for both.
+func handleUnsubscribe(w http.ResponseWriter, r *http.Request) {
+        if r.Method != http.MethodPost {
+                http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+                return
+        }
+
+        token := r.URL.Query().Get("token")
+        if token == "" {
+                var req struct {
+                        Token string `json:"token"`
+                }
+                if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+                        http.Error(w, "Invalid request", http.StatusBadRequest)
+                        return
+                }
+                token = req.Token
+        }
+
+        var userID int
+        err := db.QueryRow(`SELECT user_id FROM cart_reminders
+                            WHERE unsubscribe_token_hash = $1 OR (unsubscribe_token_hash IS NULL AND token_hash = $1)`,
+                hashToken(token)).Scan(&userID)
+        if err == sql.ErrNoRows {
+                http.Error(w, "This unsubscribe link is not valid", http.StatusNotFound)
+                return
+        }
+        if err != nil {
+                http.Error(w, "Server error", http.StatusInternalServerError)
+                return
+        }
+
+        _, err = db.Exec(`INSERT INTO notification_preferences (user_id, category, enabled) VALUES ($1, $2, FALSE)
+                          ON CONFLICT (user_id, category) DO UPDATE SET enabled = FALSE`, userID, notifyCartReminders)
+        if err != nil {
+                http.Error(w, "Server error", http.StatusInternalServerError)
+                return
+        }
+
+        w.Header().Set("Content-Type", "application/json")
+        json.NewEncoder(w).Encode(map[string]bool{"success": true})
+}
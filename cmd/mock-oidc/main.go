@@ -0,0 +1,186 @@
+// Command mock-oidc is a minimal OpenID Connect provider for trying the
+// bookstore's SSO login locally. It signs in every authorization request as
+// the user configured by flags, without asking for a password.
+//
+//      go run ./cmd/mock-oidc -email staff@example.com -groups bookstore-admins
+//
+// Then start the bookstore with
+//
+//      OIDC_ISSUER_URL=http://localhost:9400
+//      OIDC_CLIENT_ID=bookstore
+//      OIDC_REDIRECT_URL=http://localhost:5000/auth/oidc/callback
+package main
+
+import (
+        "crypto"
+        "crypto/rand"
+        "crypto/rsa"
+        "crypto/sha256"
+        "encoding/base64"
+        "encoding/json"
+        "flag"
+        "log"
+        "math/big"
+        "net/http"
+        "net/url"
+        "strings"
+        "sync"
+        "time"
+)
+
+type authRequest struct {
+        nonce     string
+        challenge string
+}
+
+var (
+        addr     = flag.String("addr", "localhost:9400", "listen address")
+        issuer   = flag.String("issuer", "http://localhost:9400", "issuer URL advertised in discovery")
+        clientID = flag.String("client-id", "bookstore", "accepted client ID")
+        subject  = flag.String("sub", "mock-user-1", "subject claim")
+        email    = flag.String("email", "staff@example.com", "email claim")
+        name     = flag.String("name", "Mock Staff", "name claim")
+        groups   = flag.String("groups", "", "comma-separated groups claim")
+        verified = flag.Bool("email-verified", true, "email_verified claim")
+
+        key   *rsa.PrivateKey
+        mu    sync.Mutex
+        codes = map[string]authRequest{}
+)
+
+func main() {
+        flag.Parse()
+
+        var err error
+        key, err = rsa.GenerateKey(rand.Reader, 2048)
+        if err != nil {
+                log.Fatal(err)
+        }
+
+        http.HandleFunc("/.well-known/openid-configuration", handleDiscovery)
+        http.HandleFunc("/jwks", handleJWKS)
+        http.HandleFunc("/authorize", handleAuthorize)
+        http.HandleFunc("/token", handleToken)
+
+        log.Printf("Mock OIDC provider on %s (issuer %s)", *addr, *issuer)
+        log.Fatal(http.ListenAndServe(*addr, nil))
+}
+
+func writeJSON(w http.ResponseWriter, v interface{}) {
+        w.Header().Set("Content-Type", "application/json")
+        json.NewEncoder(w).Encode(v)
+}
+
+func b64(data []byte) string {
+        return base64.RawURLEncoding.EncodeToString(data)
+}
+
+func handleDiscovery(w http.ResponseWriter, r *http.Request) {
+        writeJSON(w, map[string]interface{}{
+                "issuer":                                *issuer,
+                "authorization_endpoint":                *issuer + "/authorize",
+                "token_endpoint":                        *issuer + "/token",
+                "jwks_uri":                              *issuer + "/jwks",
+                "response_types_supported":              []string{"code"},
+                "subject_types_supported":               []string{"public"},
+                "id_token_signing_alg_values_supported": []string{"RS256"},
+                "code_challenge_methods_supported":      []string{"S256"},
+        })
+}
+
+func handleJWKS(w http.ResponseWriter, r *http.Request) {
+        writeJSON(w, map[string]interface{}{
+                "keys": []map[string]string{{
+                        "kty": "RSA",
+                        "alg": "RS256",
+                        "use": "sig",
+                        "kid": "mock",
+                        "n":   b64(key.N.Bytes()),
+                        "e":   b64(big.NewInt(int64(key.E)).Bytes()),
+                }},
+        })
+}
+
+func handleAuthorize(w http.ResponseWriter, r *http.Request) {
+        q := r.URL.Query()
+        if q.Get("client_id") != *clientID {
+                http.Error(w, "unknown client_id", http.StatusBadRequest)
+                return
+        }
+        redirect, err := url.Parse(q.Get("redirect_uri"))
+        if err != nil || redirect.Scheme == "" {
+                http.Error(w, "invalid redirect_uri", http.StatusBadRequest)
+                return
+        }
+
+        code := b64(randomBytes(16))
+        mu.Lock()
+        codes[code] = authRequest{nonce: q.Get("nonce"), challenge: q.Get("code_challenge")}
+        mu.Unlock()
+
+        v := redirect.Query()
+        v.Set("code", code)
+        v.Set("state", q.Get("state"))
+        redirect.RawQuery = v.Encode()
+        http.Redirect(w, r, redirect.String(), http.StatusFound)
+}
+
+func handleToken(w http.ResponseWriter, r *http.Request) {
+        r.ParseForm()
+
+        mu.Lock()
+        req, ok := codes[r.PostForm.Get("code")]
+        delete(codes, r.PostForm.Get("code"))
+        mu.Unlock()
+        if !ok {
+                http.Error(w, `{"error":"invalid_grant"}`, http.StatusBadRequest)
+                return
+        }
+
+        sum := sha256.Sum256([]byte(r.PostForm.Get("code_verifier")))
+        if req.challenge != "" && b64(sum[:]) != req.challenge {
+                http.Error(w, `{"error":"invalid_grant","error_description":"PKCE verification failed"}`, http.StatusBadRequest)
+                return
+        }
+
+        claims := map[string]interface{}{
+                "iss":            *issuer,
+                "sub":            *subject,
+                "aud":            *clientID,
+                "iat":            time.Now().Unix(),
+                "exp":            time.Now().Add(5 * time.Minute).Unix(),
+                "nonce":          req.nonce,
+                "email":          *email,
+                "email_verified": *verified,
+                "name":           *name,
+        }
+        if *groups != "" {
+                claims["groups"] = strings.Split(*groups, ",")
+        }
+
+        writeJSON(w, map[string]interface{}{
+                "access_token": b64(randomBytes(16)),
+                "token_type":   "Bearer",
+                "expires_in":   300,
+                "id_token":     signJWT(claims),
+        })
+}
+
+func signJWT(claims map[string]interface{}) string {
+        header, _ := json.Marshal(map[string]string{"alg": "RS256", "typ": "JWT", "kid": "mock"})
+        payload, _ := json.Marshal(claims)
+        signingInput := b64(header) + "." + b64(payload)
+
+        digest := sha256.Sum256([]byte(signingInput))
+        sig, err := rsa.SignPKCS1v15(rand.Reader, key, crypto.SHA256, digest[:])
+        if err != nil {
+                log.Fatal(err)
+        }
+        return signingInput + "." + b64(sig)
+}
+
+func randomBytes(n int) []byte {
+        buf := make([]byte, n)
+        rand.Read(buf)
+        return buf
+}
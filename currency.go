@@ -0,0 +1,274 @@
+package main
+
+import (
+        "database/sql"
+        "encoding/json"
+        "fmt"
+        "math"
+        "net/http"
+        "regexp"
+        "strings"
+        "time"
+
+        "github.com/gorilla/sessions"
+)
+
+// baseCurrency is the currency book prices, promotions, shipping rates, gift
+// cards and order amounts are kept in. STORE_CURRENCY, USD unless set.
+var baseCurrency = "USD"
+
+var currencyCodePattern = regexp.MustCompile(`^[A-Z]{3}$`)
+
+// Currency is a currency prices can be shown and charged in. Rate is how
+// many units of it one unit of the base currency buys.
+type Currency struct {
+        Code      string     `json:"code"`
+        Rate      float64    `json:"rate"`
+        UpdatedAt *time.Time `json:"updated_at,omitempty"`
+}
+
+// convert turns a base currency amount into c.
+func (c Currency) convert(amount float64) float64 {
+        return roundCents(amount * c.Rate)
+}
+
+// zeroDecimalCurrencies have no minor unit, so amounts in them are shown
+// without decimals.
+var zeroDecimalCurrencies = map[string]bool{
+        "BIF": true, "CLP": true, "DJF": true, "GNF": true, "ISK": true, "JPY": true, "KMF": true, "KRW": true,
+        "PYG": true, "RWF": true, "UGX": true, "VND": true, "VUV": true, "XAF": true, "XOF": true, "XPF": true,
+}
+
+// format converts a base currency amount into c for a message.
+func (c Currency) format(amount float64) string {
+        if c.Code == "USD" {
+                return fmt.Sprintf("$%.2f", c.convert(amount))
+        }
+        if zeroDecimalCurrencies[c.Code] {
+                return fmt.Sprintf("%.0f %s", math.Round(c.convert(amount)), c.Code)
+        }
+        return fmt.Sprintf("%.2f %s", c.convert(amount), c.Code)
+}
+
+// backfillOrderCurrency records the base currency on orders placed before
+// orders kept their currency, which schema.sql leaves NULL unless told the
+// base currency, and then makes the column NOT NULL.
+func backfillOrderCurrency() error {
+        tx, err := db.Begin()
+        if err != nil {
+                return err
+        }
+        defer tx.Rollback()
+        res, err := tx.Exec("UPDATE orders SET currency = $1 WHERE currency IS NULL", baseCurrency)
+        if err != nil {
+                return err
+        }
+        if n, _ := res.RowsAffected(); n == 0 {
+                return nil
+        }
+        if _, err := tx.Exec("ALTER TABLE orders ALTER COLUMN currency SET NOT NULL"); err != nil {
+                return err
+        }
+        return tx.Commit()
+}
+
+// lookupCurrency finds code among the currencies with an exchange rate. The
+// base currency is always there, at a rate of 1.
+func lookupCurrency(q queryer, code string) (Currency, error) {
+        code = strings.ToUpper(strings.TrimSpace(code))
+        if code == baseCurrency {
+                return Currency{Code: baseCurrency, Rate: 1}, nil
+        }
+        c := Currency{Code: code}
+        err := q.QueryRow("SELECT rate, updated_at FROM exchange_rates WHERE currency = $1", code).Scan(&c.Rate, &c.UpdatedAt)
+        return c, err
+}
+
+// requestCurrency is the currency to show r's prices in: the currency query
+// parameter, which a browser session then remembers, or the session's
+// earlier choice, or the base currency. An unknown currency parameter is a
+// cartError; a remembered currency that has since lost its rate falls back
+// to the base currency.
+func requestCurrency(w http.ResponseWriter, r *http.Request) (Currency, error) {
+        base := Currency{Code: baseCurrency, Rate: 1}
+
+        // API token requests have no session, so they pass currency each time.
+        var session *sessions.Session
+        var remembered string
+        if r.Header.Get("Authorization") == "" {
+                if s, err := getSession(r); err == nil {
+                        session = s
+                        remembered, _ = s.Values["currency"].(string)
+                }
+        }
+
+        if code := r.URL.Query().Get("currency"); code != "" {
+                c, err := lookupCurrency(db, code)
+                if err == sql.ErrNoRows {
+                        return base, cartError(fmt.Sprintf("Currency %s is not supported", strings.ToUpper(code)))
+                }
+                if err != nil {
+                        return base, err
+                }
+                if session != nil && remembered != c.Code {
+                        session.Values["currency"] = c.Code
+                        if err := session.Save(r, w); err != nil {
+                                return base, err
+                        }
+                }
+                return c, nil
+        }
+
+        if remembered == "" {
+                return base, nil
+        }
+        c, err := lookupCurrency(db, remembered)
+        if err == sql.ErrNoRows {
+                return base, nil
+        }
+        if err != nil {
+                return base, err
+        }
+        return c, nil
+}
+
+// currencyOrError writes the error response for requestCurrency and reports
+// whether the handler can go on.
+func currencyOrError(w http.ResponseWriter, r *http.Request) (Currency, bool) {
+        c, err := requestCurrency(w, r)
+        if err != nil {
+                if _, ok := err.(cartError); ok {
+                        http.Error(w, err.Error(), http.StatusBadRequest)
+                        return c, false
+                }
+                http.Error(w, "Server error", http.StatusInternalServerError)
+                return c, false
+        }
+        return c, true
+}
+
+func loadCurrencies() ([]Currency, error) {
+        rows, err := db.Query("SELECT currency, rate, updated_at FROM exchange_rates ORDER BY currency")
+        if err != nil {
+                return nil, err
+        }
+        defer rows.Close()
+
+        currencies := []Currency{}
+        for rows.Next() {
+                var c Currency
+                if err := rows.Scan(&c.Code, &c.Rate, &c.UpdatedAt); err != nil {
+                        return nil, err
+                }
+                currencies = append(currencies, c)
+        }
+        return currencies, rows.Err()
+}
+
+// handleCurrencies serves GET /api/currencies: the base currency, the ones
+// prices can be shown in and the one currently chosen (which ?currency=
+// changes, as on any priced endpoint).
+func handleCurrencies(w http.ResponseWriter, r *http.Request) {
+        if r.Method != http.MethodGet {
+                http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+                return
+        }
+
+        selected, ok := currencyOrError(w, r)
+        if !ok {
+                return
+        }
+        currencies, err := loadCurrencies()
+        if err != nil {
+                http.Error(w, "Server error", http.StatusInternalServerError)
+                return
+        }
+        codes := []string{baseCurrency}
+        for _, c := range currencies {
+                if c.Code != baseCurrency {
+                        codes = append(codes, c.Code)
+                }
+        }
+
+        w.Header().Set("Content-Type", "application/json")
+        json.NewEncoder(w).Encode(map[string]interface{}{
+                "base":       baseCurrency,
+                "selected":   selected.Code,
+                "currencies": codes,
+        })
+}
+
+// handleAdminExchangeRates serves GET (list) and PUT (set one currency's
+// rate) /api/admin/exchange-rates.
+func handleAdminExchangeRates(w http.ResponseWriter, r *http.Request) {
+        switch r.Method {
+        case http.MethodGet:
+                currencies, err := loadCurrencies()
+                if err != nil {
+                        http.Error(w, "Server error", http.StatusInternalServerError)
+                        return
+                }
+
+                w.Header().Set("Content-Type", "application/json")
+                json.NewEncoder(w).Encode(map[string]interface{}{
+                        "base":  baseCurrency,
+                        "rates": currencies,
+                })
+
+        case http.MethodPut:
+                var c Currency
+                if err := json.NewDecoder(r.Body).Decode(&c); err != nil {
+                        http.Error(w, "Invalid request", http.StatusBadRequest)
+                        return
+                }
+                c.Code = strings.ToUpper(strings.TrimSpace(c.Code))
+                switch {
+                case !currencyCodePattern.MatchString(c.Code):
+                        http.Error(w, "Currency must be a three-letter ISO 4217 code", http.StatusBadRequest)
+                        return
+                case c.Code == baseCurrency:
+                        http.Error(w, "The base currency has no exchange rate", http.StatusBadRequest)
+                        return
+                case c.Rate <= 0:
+                        http.Error(w, "Rate must be positive", http.StatusBadRequest)
+                        return
+                }
+
+                err := db.QueryRow(`INSERT INTO exchange_rates (currency, rate) VALUES ($1, $2)
+                                    ON CONFLICT (currency) DO UPDATE SET rate = EXCLUDED.rate, updated_at = now()
+                                    RETURNING updated_at`, c.Code, c.Rate).Scan(&c.UpdatedAt)
+                if err != nil {
+                        http.Error(w, "Server error", http.StatusInternalServerError)
+                        return
+                }
+
+                w.Header().Set("Content-Type", "application/json")
+                json.NewEncoder(w).Encode(c)
+
+        default:
+                http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+        }
+}
+
+// handleAdminExchangeRateDetail serves DELETE /api/admin/exchange-rates/{code}.
+// Orders keep the rate they were charged at.
+func handleAdminExchangeRateDetail(w http.ResponseWriter, r *http.Request) {
+        if r.Method != http.MethodDelete {
+                http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+                return
+        }
+
+        code := strings.ToUpper(strings.TrimPrefix(r.URL.Path, "/api/admin/exchange-rates/"))
+        res, err := db.Exec("DELETE FROM exchange_rates WHERE currency = $1", code)
+        if err != nil {
+                http.Error(w, "Server error", http.StatusInternalServerError)
+                return
+        }
+        if n, _ := res.RowsAffected(); n == 0 {
+                http.Error(w, "Exchange rate not found", http.StatusNotFound)
+                return
+        }
+
+        w.Header().Set("Content-Type", "application/json")
+        json.NewEncoder(w).Encode(map[string]bool{"success": true})
+}
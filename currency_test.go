@@ -0,0 +1,63 @@
+package main
+
+import "testing"
+
+func TestQuoteConvert(t *testing.T) {
+        quote := &CartQuote{Currency: baseCurrency, ExchangeRate: 1}
+        quote.addLine(QuoteLine{BookID: 1, UnitPrice: 19.99, Quantity: 3})
+        quote.addLine(QuoteLine{BookID: 2, UnitPrice: 7.25, Quantity: 1})
+        quote.addDiscount(Promotion{Kind: promoFixed, Value: 5, Code: "SAVE5"})
+        quote.Shipping, quote.Tax = 3.5, 5.14
+        quote.total()
+        quote.couponMinimum = 25
+
+        base := *quote
+        eur := Currency{Code: "EUR", Rate: 0.9137}
+        quote.convert(eur)
+
+        if quote.Currency != "EUR" || quote.ExchangeRate != 0.9137 {
+                t.Errorf("currency = %s at %v, want EUR at 0.9137", quote.Currency, quote.ExchangeRate)
+        }
+        checks := []struct {
+                name      string
+                got, base float64
+        }{
+                {"Subtotal", quote.Subtotal, base.Subtotal},
+                {"DiscountTotal", quote.DiscountTotal, base.DiscountTotal},
+                {"Shipping", quote.Shipping, base.Shipping},
+                {"Tax", quote.Tax, base.Tax},
+                {"Total", quote.Total, base.Total},
+        }
+        for _, c := range checks {
+                if want := eur.convert(c.base); c.got != want {
+                        t.Errorf("%s = %v, want %v converted to %v", c.name, c.got, c.base, want)
+                }
+        }
+        // Checkout charges total_amount * exchange_rate: that must be what
+        // the converted quote shows.
+        if charged := roundCents(base.Total * quote.ExchangeRate); quote.Total != charged {
+                t.Errorf("converted Total = %v, but checkout would charge %v", quote.Total, charged)
+        }
+        if want := "Spend at least 22.84 EUR to use this code"; quote.CouponError != want {
+                t.Errorf("CouponError = %q, want %q", quote.CouponError, want)
+        }
+}
+
+func TestCurrencyFormat(t *testing.T) {
+        tests := []struct {
+                currency Currency
+                amount   float64
+                want     string
+        }{
+                {Currency{Code: "USD", Rate: 1}, 12.5, "$12.50"},
+                {Currency{Code: "EUR", Rate: 0.92}, 10, "9.20 EUR"},
+                {Currency{Code: "JPY", Rate: 151.234}, 1, "151 JPY"},
+                {Currency{Code: "JPY", Rate: 151.5}, 1, "152 JPY"},
+                {Currency{Code: "KRW", Rate: 1350}, 8.99, "12137 KRW"},
+        }
+        for _, tt := range tests {
+                if got := tt.currency.format(tt.amount); got != tt.want {
+                        t.Errorf("%s.format(%v) = %q, want %q", tt.currency.Code, tt.amount, got, tt.want)
+                }
+        }
+}
@@ -0,0 +1,294 @@
+package main
+
+import (
+        "crypto/rand"
+        "database/sql"
+        "encoding/hex"
+        "encoding/json"
+        "fmt"
+        "net/http"
+        "strconv"
+        "strings"
+        "time"
+)
+
+// GiftCard is a card as staff see it. The code itself is only ever shown
+// once, when the card is issued; the database keeps its hash and last four
+// characters.
+type GiftCard struct {
+        ID             int        `json:"id"`
+        Last4          string     `json:"last4"`
+        InitialBalance float64    `json:"initial_balance"`
+        Balance        float64    `json:"balance"`
+        RecipientEmail string     `json:"recipient_email"`
+        OrderID        *int       `json:"order_id"`
+        IssuedBy       *int       `json:"issued_by"`
+        CreatedAt      time.Time  `json:"created_at"`
+        ExpiresAt      *time.Time `json:"expires_at"`
+        DisabledAt     *time.Time `json:"disabled_at"`
+}
+
+// LedgerEntry is one movement of a gift card or store credit balance:
+// positive when issued or granted, negative when spent.
+type LedgerEntry struct {
+        Amount    float64   `json:"amount"`
+        OrderID   *int      `json:"order_id"`
+        Note      string    `json:"note"`
+        CreatedAt time.Time `json:"created_at"`
+}
+
+const giftCardColumns = `id, code_last4, initial_balance, balance, COALESCE(recipient_email, ''), order_id, issued_by,
+                         created_at, expires_at, disabled_at`
+
+func scanGiftCard(row interface{ Scan(...interface{}) error }) (GiftCard, error) {
+        var g GiftCard
+        err := row.Scan(&g.ID, &g.Last4, &g.InitialBalance, &g.Balance, &g.RecipientEmail, &g.OrderID, &g.IssuedBy,
+                &g.CreatedAt, &g.ExpiresAt, &g.DisabledAt)
+        return g, err
+}
+
+// newGiftCardCode returns a code like 3F9A-07C2-B1D4-E865.
+func newGiftCardCode() string {
+        buf := make([]byte, 8)
+        rand.Read(buf)
+        code := strings.ToUpper(hex.EncodeToString(buf))
+        return code[0:4] + "-" + code[4:8] + "-" + code[8:12] + "-" + code[12:16]
+}
+
+// normalizeGiftCardCode lets customers type a code with or without dashes,
+// spaces or capitals.
+func normalizeGiftCardCode(code string) string {
+        return strings.ToUpper(strings.NewReplacer("-", "", " ", "").Replace(code))
+}
+
+// issueGiftCard creates a card worth amount and returns its code. orderID is
+// the order that bought it and issuedBy the staff user who issued it; either
+// may be 0.
+func issueGiftCard(tx *sql.Tx, amount float64, recipientEmail string, orderID, issuedBy int, expiresAt *time.Time, note string) (string, int, error) {
+        code := newGiftCardCode()
+        normalized := normalizeGiftCardCode(code)
+
+        var id int
+        err := tx.QueryRow(`INSERT INTO gift_cards (code_hash, code_last4, initial_balance, balance, recipient_email,
+                                                    order_id, issued_by, expires_at)
+                            VALUES ($1, $2, $3, $3, NULLIF($4, ''), NULLIF($5, 0), NULLIF($6, 0), $7) RETURNING id`,
+                hashToken(normalized), normalized[len(normalized)-4:], amount, recipientEmail,
+                orderID, issuedBy, expiresAt).Scan(&id)
+        if err != nil {
+                return "", 0, err
+        }
+        _, err = tx.Exec(`INSERT INTO gift_card_transactions (gift_card_id, amount, order_id, note)
+                          VALUES ($1, $2, NULLIF($3, 0), $4)`, id, amount, orderID, note)
+        return code, id, err
+}
+
+func sendGiftCardEmail(r *http.Request, to, code string, amount float64) {
+        sendMailAsync(to, "Your Bookstore gift card",
+                fmt.Sprintf("You have a Bookstore gift card worth %s.\n\nCode: %s\n\n"+
+                        "Enter the code at checkout on %s to spend it. Keep it safe: anyone with the code can use it.\n",
+                        Currency{Code: baseCurrency, Rate: 1}.format(amount), code, appBaseURL(r)))
+}
+
+// findGiftCard looks a card up by code, locking it with lock set. Disabled
+// and expired cards are not found.
+func findGiftCard(q queryer, code string, lock bool) (GiftCard, error) {
+        stmt := `SELECT ` + giftCardColumns + ` FROM gift_cards
+                 WHERE code_hash = $1 AND disabled_at IS NULL AND (expires_at IS NULL OR expires_at > now())`
+        if lock {
+                stmt += " FOR UPDATE"
+        }
+        return scanGiftCard(q.QueryRow(stmt, hashToken(normalizeGiftCardCode(code))))
+}
+
+func loadGiftCardLedger(giftCardID int) ([]LedgerEntry, error) {
+        rows, err := db.Query(`SELECT amount, order_id, note, created_at FROM gift_card_transactions
+                               WHERE gift_card_id = $1 ORDER BY created_at, id`, giftCardID)
+        if err != nil {
+                return nil, err
+        }
+        defer rows.Close()
+
+        entries := []LedgerEntry{}
+        for rows.Next() {
+                var e LedgerEntry
+                if err := rows.Scan(&e.Amount, &e.OrderID, &e.Note, &e.CreatedAt); err != nil {
+                        return nil, err
+                }
+                entries = append(entries, e)
+        }
+        return entries, rows.Err()
+}
+
+// handleGiftCardBalance serves GET /api/gift-cards/balance?code=.
+func handleGiftCardBalance(w http.ResponseWriter, r *http.Request) {
+        if r.Method != http.MethodGet {
+                http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+                return
+        }
+
+        card, err := findGiftCard(db, r.URL.Query().Get("code"), false)
+        if err == sql.ErrNoRows {
+                http.Error(w, "Gift card not found", http.StatusNotFound)
+                return
+        }
+        if err != nil {
+                http.Error(w, "Server error", http.StatusInternalServerError)
+                return
+        }
+
+        w.Header().Set("Content-Type", "application/json")
+        json.NewEncoder(w).Encode(map[string]interface{}{
+                "last4":      card.Last4,
+                "balance":    card.Balance,
+                "currency":   baseCurrency,
+                "expires_at": card.ExpiresAt,
+        })
+}
+
+// handleAdminGiftCards serves GET (list) and POST (issue)
+// /api/admin/gift-cards. The code is returned, and emailed to the recipient
+// when there is one, only on issue.
+func handleAdminGiftCards(w http.ResponseWriter, r *http.Request) {
+        switch r.Method {
+        case http.MethodGet:
+                rows, err := db.Query("SELECT " + giftCardColumns + " FROM gift_cards ORDER BY created_at DESC")
+                if err != nil {
+                        http.Error(w, "Server error", http.StatusInternalServerError)
+                        return
+                }
+                defer rows.Close()
+
+                cards := []GiftCard{}
+                for rows.Next() {
+                        card, err := scanGiftCard(rows)
+                        if err != nil {
+                                continue
+                        }
+                        cards = append(cards, card)
+                }
+
+                w.Header().Set("Content-Type", "application/json")
+                json.NewEncoder(w).Encode(cards)
+
+        case http.MethodPost:
+                actor, _ := getCurrentUser(r)
+
+                var req struct {
+                        Amount         float64    `json:"amount"`
+                        RecipientEmail string     `json:"recipient_email"`
+                        ExpiresAt      *time.Time `json:"expires_at"`
+                        Note           string     `json:"note"`
+                }
+                if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+                        http.Error(w, "Invalid request", http.StatusBadRequest)
+                        return
+                }
+                req.Amount = roundCents(req.Amount)
+                if req.Amount <= 0 {
+                        http.Error(w, "Amount must be positive", http.StatusBadRequest)
+                        return
+                }
+                if req.RecipientEmail != "" {
+                        email, err := parseGuestEmail(req.RecipientEmail)
+                        if err != nil {
+                                http.Error(w, err.Error(), http.StatusBadRequest)
+                                return
+                        }
+                        req.RecipientEmail = email
+                }
+                if req.Note == "" {
+                        req.Note = "Issued by staff"
+                }
+
+                tx, err := db.Begin()
+                if err != nil {
+                        http.Error(w, "Server error", http.StatusInternalServerError)
+                        return
+                }
+                defer tx.Rollback()
+
+                code, id, err := issueGiftCard(tx, req.Amount, req.RecipientEmail, 0, actor.ID, req.ExpiresAt, req.Note)
+                if err != nil {
+                        http.Error(w, "Server error", http.StatusInternalServerError)
+                        return
+                }
+                card, err := scanGiftCard(tx.QueryRow("SELECT "+giftCardColumns+" FROM gift_cards WHERE id = $1", id))
+                if err != nil {
+                        http.Error(w, "Server error", http.StatusInternalServerError)
+                        return
+                }
+                if err := tx.Commit(); err != nil {
+                        http.Error(w, "Server error", http.StatusInternalServerError)
+                        return
+                }
+
+                if req.RecipientEmail != "" {
+                        sendGiftCardEmail(r, req.RecipientEmail, code, req.Amount)
+                }
+                recordAdminAudit(r, actor.ID, "gift_card.issued", 0, map[string]interface{}{
+                        "gift_card_id": id,
+                        "amount":       req.Amount,
+                        "note":         req.Note,
+                })
+
+                w.Header().Set("Content-Type", "application/json")
+                w.WriteHeader(http.StatusCreated)
+                json.NewEncoder(w).Encode(map[string]interface{}{
+                        "gift_card": card,
+                        "code":      code,
+                })
+
+        default:
+                http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+        }
+}
+
+// handleAdminGiftCardDetail serves GET /api/admin/gift-cards/{id}, the card
+// and its ledger, and DELETE, which disables it.
+func handleAdminGiftCardDetail(w http.ResponseWriter, r *http.Request) {
+        idStr := strings.TrimPrefix(r.URL.Path, "/api/admin/gift-cards/")
+        id, err := strconv.Atoi(idStr)
+        if err != nil {
+                http.Error(w, "Invalid gift card ID", http.StatusBadRequest)
+                return
+        }
+
+        card, err := scanGiftCard(db.QueryRow("SELECT "+giftCardColumns+" FROM gift_cards WHERE id = $1", id))
+        if err == sql.ErrNoRows {
+                http.Error(w, "Gift card not found", http.StatusNotFound)
+                return
+        }
+        if err != nil {
+                http.Error(w, "Server error", http.StatusInternalServerError)
+                return
+        }
+
+        switch r.Method {
+        case http.MethodGet:
+                ledger, err := loadGiftCardLedger(id)
+                if err != nil {
+                        http.Error(w, "Server error", http.StatusInternalServerError)
+                        return
+                }
+
+                w.Header().Set("Content-Type", "application/json")
+                json.NewEncoder(w).Encode(map[string]interface{}{
+                        "gift_card": card,
+                        "ledger":    ledger,
+                })
+
+        case http.MethodDelete:
+                actor, _ := getCurrentUser(r)
+                if _, err := db.Exec("UPDATE gift_cards SET disabled_at = now() WHERE id = $1 AND disabled_at IS NULL", id); err != nil {
+                        http.Error(w, "Server error", http.StatusInternalServerError)
+                        return
+                }
+                recordAdminAudit(r, actor.ID, "gift_card.disabled", 0, map[string]interface{}{"gift_card_id": id})
+
+                w.Header().Set("Content-Type", "application/json")
+                json.NewEncoder(w).Encode(map[string]bool{"success": true})
+
+        default:
+                http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+        }
+}
@@ -3,9 +3,14 @@ module bookstore
 go 1.24
 
 require (
+	github.com/coreos/go-oidc/v3 v3.12.0
+	github.com/gorilla/securecookie v1.1.2
 	github.com/gorilla/sessions v1.2.2
+	github.com/jung-kurt/gofpdf v1.16.2
 	github.com/lib/pq v1.10.9
-	golang.org/x/crypto v0.18.0
+	github.com/skip2/go-qrcode v0.0.0-20200617195104-da1b6568686e
+	golang.org/x/crypto v0.25.0
+	golang.org/x/oauth2 v0.27.0
 )
 
-require github.com/gorilla/securecookie v1.1.2 // indirect
+require github.com/go-jose/go-jose/v4 v4.0.2 // indirect
@@ -0,0 +1,300 @@
+package main
+
+import (
+        "crypto/rand"
+        "database/sql"
+        "encoding/hex"
+        "encoding/json"
+        "fmt"
+        "log"
+        "net/http"
+        "net/mail"
+        "net/url"
+        "strings"
+        "time"
+
+        "github.com/gorilla/sessions"
+        "golang.org/x/crypto/bcrypt"
+)
+
+// cartOwner identifies a cart: a signed-in user's, or a guest's through the
+// cart token kept in their session.
+type cartOwner struct {
+        UserID int
+        Token  string
+
+        // Email is a guest's email once checkout knows it. Promotion limits
+        // per customer count a guest's earlier orders by it.
+        Email string
+}
+
+func (o cartOwner) column() string {
+        if o.UserID != 0 {
+                return "user_id"
+        }
+        return "cart_token"
+}
+
+func (o cartOwner) key() interface{} {
+        if o.UserID != 0 {
+                return o.UserID
+        }
+        return o.Token
+}
+
+// conflictTarget matches the unique index that an upsert into cart_items
+// must use for this owner.
+func (o cartOwner) conflictTarget() string {
+        if o.UserID != 0 {
+                return "(user_id, book_id)"
+        }
+        return "(cart_token, book_id) WHERE cart_token IS NOT NULL"
+}
+
+// getCartOwner returns the cart for the request. Guests get a cart token in
+// their session; with create false a guest without one has an empty cart
+// (Token == ""). API tokens never get a guest cart.
+func getCartOwner(w http.ResponseWriter, r *http.Request, create bool) (cartOwner, error) {
+        if user, err := getAccountUser(r); err == nil {
+                return cartOwner{UserID: user.ID}, nil
+        }
+        if r.Header.Get("Authorization") != "" {
+                return cartOwner{}, fmt.Errorf("not authenticated")
+        }
+
+        session, err := getSession(r)
+        if err != nil {
+                return cartOwner{}, err
+        }
+        token, _ := session.Values["cart_token"].(string)
+        if token == "" && create {
+                token = newSessionToken()
+                session.Values["cart_token"] = token
+                if err := session.Save(r, w); err != nil {
+                        return cartOwner{}, err
+                }
+        }
+        return cartOwner{Token: token}, nil
+}
+
+// guestOrderNumber is used instead of the ORD-<user>-<time> scheme, which
+// would collide for guests checking out in the same second.
+func guestOrderNumber() string {
+        buf := make([]byte, 3)
+        rand.Read(buf)
+        return fmt.Sprintf("ORD-G-%d-%s", time.Now().Unix(), strings.ToUpper(hex.EncodeToString(buf)))
+}
+
+// parseGuestEmail validates the email a guest checks out with.
+func parseGuestEmail(email string) (string, error) {
+        addr, err := mail.ParseAddress(email)
+        if err != nil || addr.Address != strings.TrimSpace(email) {
+                return "", fmt.Errorf("A valid email address is required")
+        }
+        return addr.Address, nil
+}
+
+// guestOrderLink is the only way back to a guest order, and is only ever
+// mailed. The lookup token is never shown in the browser, so holding it
+// proves access to the mailbox.
+func guestOrderLink(r *http.Request, email, orderNumber, token string) string {
+        return appBaseURL(r) + "/order-lookup?" + url.Values{
+                "order_number": {orderNumber},
+                "email":        {email},
+                "token":        {token},
+        }.Encode()
+}
+
+// findGuestOrder returns the ID of the guest order matching all three lookup
+// values, or sql.ErrNoRows.
+func findGuestOrder(orderNumber, email, token string) (int, error) {
+        var orderID int
+        err := db.QueryRow(`SELECT id FROM orders
+                            WHERE order_number = $1 AND LOWER(guest_email) = LOWER($2) AND guest_token_hash = $3`,
+                orderNumber, email, hashToken(token)).Scan(&orderID)
+        return orderID, err
+}
+
+// handleGuestOrder serves GET /api/guest-orders?order_number=&email=&token=.
+func handleGuestOrder(w http.ResponseWriter, r *http.Request) {
+        if r.Method != http.MethodGet {
+                http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+                return
+        }
+
+        query := r.URL.Query()
+        orderID, err := findGuestOrder(query.Get("order_number"), query.Get("email"), query.Get("token"))
+        if err == sql.ErrNoRows {
+                http.Error(w, "Order not found", http.StatusNotFound)
+                return
+        }
+        if err != nil {
+                http.Error(w, "Server error", http.StatusInternalServerError)
+                return
+        }
+
+        order, err := loadOrder("id = $1", orderID)
+        if err != nil {
+                http.Error(w, "Server error", http.StatusInternalServerError)
+                return
+        }
+
+        var hasAccount bool
+        db.QueryRow("SELECT user_id IS NOT NULL FROM orders WHERE id = $1", orderID).Scan(&hasAccount)
+
+        w.Header().Set("Content-Type", "application/json")
+        json.NewEncoder(w).Encode(map[string]interface{}{
+                "order":       order,
+                "has_account": hasAccount,
+        })
+}
+
+// handleGuestConvert serves POST /api/guest-orders/convert. It creates an
+// account for the email of a guest order and attaches every guest order
+// placed with that email to it.
+func handleGuestConvert(w http.ResponseWriter, r *http.Request) {
+        if r.Method != http.MethodPost {
+                http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+                return
+        }
+
+        var req struct {
+                OrderNumber string `json:"order_number"`
+                Email       string `json:"email"`
+                Token       string `json:"token"`
+                FullName    string `json:"full_name"`
+                Password    string `json:"password"`
+        }
+
+        if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+                http.Error(w, "Invalid request", http.StatusBadRequest)
+                return
+        }
+
+        if len(req.Password) < minPasswordLength {
+                http.Error(w, "Password must be at least 8 characters", http.StatusBadRequest)
+                return
+        }
+
+        if _, err := findGuestOrder(req.OrderNumber, req.Email, req.Token); err != nil {
+                http.Error(w, "Order not found", http.StatusNotFound)
+                return
+        }
+
+        hashedPassword, err := bcrypt.GenerateFromPassword([]byte(req.Password), bcrypt.DefaultCost)
+        if err != nil {
+                http.Error(w, "Server error", http.StatusInternalServerError)
+                return
+        }
+
+        tx, err := db.Begin()
+        if err != nil {
+                http.Error(w, "Server error", http.StatusInternalServerError)
+                return
+        }
+        defer tx.Rollback()
+
+        var email string
+        tx.QueryRow("SELECT guest_email FROM orders WHERE order_number = $1", req.OrderNumber).Scan(&email)
+
+        var userID int
+        err = tx.QueryRow("INSERT INTO users (email, password_hash, full_name) VALUES ($1, $2, $3) RETURNING id",
+                email, string(hashedPassword), strings.TrimSpace(req.FullName)).Scan(&userID)
+        if err != nil {
+                if strings.Contains(err.Error(), "duplicate") {
+                        http.Error(w, "An account with this email already exists. Log in instead.", http.StatusConflict)
+                        return
+                }
+                http.Error(w, "Server error", http.StatusInternalServerError)
+                return
+        }
+
+        res, err := tx.Exec("UPDATE orders SET user_id = $1 WHERE user_id IS NULL AND LOWER(guest_email) = LOWER($2)", userID, email)
+        if err != nil {
+                http.Error(w, "Server error", http.StatusInternalServerError)
+                return
+        }
+        attached, _ := res.RowsAffected()
+
+        welcome := notice{Name: strings.TrimSpace(req.FullName), Link: appBaseURL(r) + "/books"}
+        if err := notify(tx, "welcome", userID, email, welcome); err != nil {
+                http.Error(w, "Server error", http.StatusInternalServerError)
+                return
+        }
+
+        if err = tx.Commit(); err != nil {
+                http.Error(w, "Server error", http.StatusInternalServerError)
+                return
+        }
+
+        session, _ := getSession(r)
+        store.Renew(session)
+        session.Values["user_id"] = userID
+        mergeGuestCart(session, userID)
+        session.Save(r, w)
+
+        w.Header().Set("Content-Type", "application/json")
+        json.NewEncoder(w).Encode(map[string]interface{}{
+                "success":         true,
+                "user_id":         userID,
+                "orders_attached": attached,
+        })
+}
+
+// mergeGuestCart moves the guest cart of session into the user's cart when
+// they log in or register. Quantities are summed and clamped to stock and
+// the per-customer limit; a failure only loses the guest cart, never the
+// login.
+func mergeGuestCart(session *sessions.Session, userID int) {
+        token, _ := session.Values["cart_token"].(string)
+        if token == "" {
+                return
+        }
+        delete(session.Values, "cart_token")
+
+        tx, err := db.Begin()
+        if err != nil {
+                log.Printf("Failed to merge guest cart into user %d: %v", userID, err)
+                return
+        }
+        defer tx.Rollback()
+
+        _, err = tx.Exec(`INSERT INTO cart_items (user_id, book_id, quantity, price_at_add)
+                          SELECT $1, g.book_id, LEAST(g.quantity, b.stock_quantity, COALESCE(b.max_per_customer, g.quantity)), g.price_at_add
+                          FROM cart_items g JOIN books b ON b.id = g.book_id
+                          WHERE g.cart_token = $2 AND b.stock_quantity > 0
+                          ON CONFLICT (user_id, book_id) DO UPDATE
+                          SET quantity = GREATEST(cart_items.quantity, LEAST(cart_items.quantity + EXCLUDED.quantity,
+                                  (SELECT LEAST(stock_quantity, COALESCE(max_per_customer, stock_quantity))
+                                   FROM books WHERE id = EXCLUDED.book_id))),
+                              updated_at = now()`,
+                userID, token)
+        if err == nil {
+                _, err = tx.Exec("DELETE FROM cart_items WHERE cart_token = $1", token)
+        }
+        // A code entered as a guest replaces the one on the account cart.
+        if err == nil {
+                _, err = tx.Exec(`DELETE FROM cart_coupons
+                                  WHERE user_id = $1 AND EXISTS (SELECT 1 FROM cart_coupons WHERE cart_token = $2)`, userID, token)
+        }
+        if err == nil {
+                _, err = tx.Exec("UPDATE cart_coupons SET user_id = $1, cart_token = NULL WHERE cart_token = $2", userID, token)
+        }
+        if err == nil {
+                err = tx.Commit()
+        }
+        if err != nil {
+                log.Printf("Failed to merge guest cart into user %d: %v", userID, err)
+        }
+}
+
+// purgeGuestCarts drops guest carts that outlived any session that could
+// still reach them. It runs as the purge_guest_carts job.
+func purgeGuestCarts(maxAge time.Duration) error {
+        cutoff := time.Now().Add(-maxAge)
+        if _, err := db.Exec("DELETE FROM cart_items WHERE cart_token IS NOT NULL AND updated_at < $1", cutoff); err != nil {
+                return err
+        }
+        _, err := db.Exec("DELETE FROM cart_coupons WHERE cart_token IS NOT NULL AND applied_at < $1", cutoff)
+        return err
+}
@@ -0,0 +1,146 @@
+package main
+
+import (
+        "encoding/json"
+        "net/http"
+        "strings"
+        "time"
+
+        "github.com/gorilla/sessions"
+)
+
+// impersonationTimeout ends an impersonation that was left running.
+const impersonationTimeout = time.Hour
+
+// allowImpersonatedCheckout lets staff place orders on a customer's behalf.
+// Off unless IMPERSONATION_ALLOW_CHECKOUT=true.
+var allowImpersonatedCheckout bool
+
+// impersonatorID returns the staff user behind an impersonated session, or 0.
+// Bearer tokens never impersonate.
+func impersonatorID(r *http.Request) int {
+        if r.Header.Get("Authorization") != "" {
+                return 0
+        }
+        session, err := getSession(r)
+        if err != nil {
+                return 0
+        }
+        actorID, _ := session.Values["impersonator_id"].(int)
+        return actorID
+}
+
+func clearImpersonation(session *sessions.Session) {
+        delete(session.Values, "impersonator_id")
+        delete(session.Values, "impersonation_started")
+}
+
+// auditImpersonation records every request made while impersonating, and
+// hands the session back to the staff user once impersonationTimeout passes.
+func auditImpersonation(next http.Handler) http.Handler {
+        return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+                actorID := impersonatorID(r)
+                if actorID == 0 || strings.HasPrefix(r.URL.Path, "/static/") {
+                        next.ServeHTTP(w, r)
+                        return
+                }
+
+                session, _ := getSession(r)
+                targetID, _ := session.Values["user_id"].(int)
+                started, _ := session.Values["impersonation_started"].(int64)
+
+                if time.Since(time.Unix(started, 0)) > impersonationTimeout {
+                        clearImpersonation(session)
+                        session.Values["user_id"] = actorID
+                        session.Save(r, w)
+                        recordAdminAudit(r, actorID, "user.impersonation_expired", targetID, nil)
+                } else {
+                        recordAdminAudit(r, actorID, "user.impersonated_request", targetID, map[string]interface{}{
+                                "method": r.Method,
+                                "path":   r.URL.Path,
+                        })
+                }
+
+                next.ServeHTTP(w, r)
+        })
+}
+
+// notWhileImpersonating guards account-security and payment endpoints, which
+// staff must not use on a customer's behalf.
+func notWhileImpersonating(next http.HandlerFunc) http.HandlerFunc {
+        return func(w http.ResponseWriter, r *http.Request) {
+                if impersonatorID(r) != 0 {
+                        http.Error(w, "Not allowed while impersonating a customer", http.StatusForbidden)
+                        return
+                }
+                next(w, r)
+        }
+}
+
+// handleAdminImpersonate switches the admin's session to a customer account.
+// The admin's own ID is kept so /api/admin/impersonation/stop can switch back.
+func handleAdminImpersonate(w http.ResponseWriter, r *http.Request, id int) {
+        actor, err := getSessionUser(r)
+        if err != nil {
+                http.Error(w, "Impersonation needs a browser session", http.StatusBadRequest)
+                return
+        }
+
+        target, err := loadUser(id)
+        if err != nil {
+                http.Error(w, "User not found", http.StatusNotFound)
+                return
+        }
+        if target.IsAdmin {
+                http.Error(w, "Staff accounts cannot be impersonated", http.StatusForbidden)
+                return
+        }
+
+        session, _ := getSession(r)
+        session.Values["impersonator_id"] = actor.ID
+        session.Values["impersonation_started"] = time.Now().Unix()
+        session.Values["user_id"] = target.ID
+        if err := session.Save(r, w); err != nil {
+                http.Error(w, "Server error", http.StatusInternalServerError)
+                return
+        }
+
+        recordAdminAudit(r, actor.ID, "user.impersonation_started", target.ID, nil)
+
+        w.Header().Set("Content-Type", "application/json")
+        json.NewEncoder(w).Encode(map[string]interface{}{
+                "success": true,
+                "user":    target,
+        })
+}
+
+func handleStopImpersonation(w http.ResponseWriter, r *http.Request) {
+        if r.Method != http.MethodPost {
+                http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+                return
+        }
+
+        actorID := impersonatorID(r)
+        if actorID == 0 {
+                http.Error(w, "Not impersonating", http.StatusBadRequest)
+                return
+        }
+
+        session, _ := getSession(r)
+        targetID, _ := session.Values["user_id"].(int)
+
+        clearImpersonation(session)
+        session.Values["user_id"] = actorID
+        if err := session.Save(r, w); err != nil {
+                http.Error(w, "Server error", http.StatusInternalServerError)
+                return
+        }
+
+        recordAdminAudit(r, actorID, "user.impersonation_stopped", targetID, nil)
+
+        w.Header().Set("Content-Type", "application/json")
+        json.NewEncoder(w).Encode(map[string]interface{}{
+                "success":  true,
+                "redirect": "/admin",
+        })
+}
@@ -0,0 +1,334 @@
+package main
+
+import (
+        "bytes"
+        "database/sql"
+        "fmt"
+        "net/http"
+        "os"
+        "sort"
+        "strconv"
+        "strings"
+        "time"
+
+        "github.com/jung-kurt/gofpdf"
+)
+
+// seller is who invoices are issued by, from SELLER_NAME, SELLER_ADDRESS
+// (lines separated by semicolons), SELLER_TAX_ID and SELLER_EMAIL.
+var seller struct {
+        Name    string
+        Address []string
+        TaxID   string
+        Email   string
+}
+
+func loadSellerDetails() {
+        seller.Name = os.Getenv("SELLER_NAME")
+        if seller.Name == "" {
+                seller.Name = "Bookstore"
+        }
+        seller.Address = nil
+        for _, line := range strings.Split(os.Getenv("SELLER_ADDRESS"), ";") {
+                if line = strings.TrimSpace(line); line != "" {
+                        seller.Address = append(seller.Address, line)
+                }
+        }
+        seller.TaxID = os.Getenv("SELLER_TAX_ID")
+        seller.Email = os.Getenv("SELLER_EMAIL")
+}
+
+// Invoice is the invoice issued for an order. Numbers come from a single
+// counter row updated in the checkout transaction, so they have no gaps (a
+// failed checkout rolls the counter back with it) and follow the order in
+// which orders were placed.
+type Invoice struct {
+        Number   int
+        IssuedAt time.Time
+}
+
+func (inv Invoice) label() string {
+        return fmt.Sprintf("INV-%06d", inv.Number)
+}
+
+// issueInvoice gives orderID the next invoice number. Pass the checkout
+// transaction: the counter row stays locked until it commits, so
+// concurrent checkouts take numbers one after another.
+func issueInvoice(q queryer, orderID int) (Invoice, error) {
+        var inv Invoice
+        if err := q.QueryRow("UPDATE invoice_counter SET last_number = last_number + 1 RETURNING last_number").
+                Scan(&inv.Number); err != nil {
+                return inv, err
+        }
+        err := q.QueryRow("INSERT INTO invoices (order_id, invoice_number) VALUES ($1, $2) RETURNING issued_at",
+                orderID, inv.Number).Scan(&inv.IssuedAt)
+        return inv, err
+}
+
+// loadInvoice returns the invoice issued for orderID, or sql.ErrNoRows.
+func loadInvoice(orderID int) (Invoice, error) {
+        var inv Invoice
+        err := db.QueryRow("SELECT invoice_number, issued_at FROM invoices WHERE order_id = $1", orderID).
+                Scan(&inv.Number, &inv.IssuedAt)
+        return inv, err
+}
+
+// taxBand is the tax on every line charged at one rate.
+type taxBand struct {
+        Rate    float64
+        Taxable float64
+        Tax     float64
+}
+
+func taxBands(items []OrderItem) []taxBand {
+        byRate := map[float64]*taxBand{}
+        for _, item := range items {
+                band, ok := byRate[item.TaxRate]
+                if !ok {
+                        band = &taxBand{Rate: item.TaxRate}
+                        byRate[item.TaxRate] = band
+                }
+                band.Taxable += item.Subtotal - item.DiscountAmount
+                band.Tax += item.TaxAmount
+        }
+        bands := make([]taxBand, 0, len(byRate))
+        for _, band := range byRate {
+                band.Taxable, band.Tax = roundCents(band.Taxable), roundCents(band.Tax)
+                bands = append(bands, *band)
+        }
+        sort.Slice(bands, func(i, j int) bool { return bands[i].Rate > bands[j].Rate })
+        return bands
+}
+
+// renderInvoice lays out the invoice for order as a PDF. Amounts are in the
+// base currency, like the order's; an order charged in another currency
+// also shows what was charged.
+func renderInvoice(order *Order, inv Invoice) ([]byte, error) {
+        pdf := gofpdf.New("P", "mm", "A4", "")
+        pdf.SetTitle(inv.label(), true)
+        pdf.SetAuthor(seller.Name, true)
+        pdf.SetMargins(15, 15, 15)
+        pdf.AddPage()
+        // The core fonts are cp1252; this maps titles and names onto it.
+        tr := pdf.UnicodeTranslatorFromDescriptor("")
+        money := func(amount float64) string {
+                return fmt.Sprintf("%.2f %s", amount, baseCurrency)
+        }
+
+        pdf.SetFont("Helvetica", "B", 18)
+        pdf.CellFormat(100, 9, tr(seller.Name), "", 0, "L", false, 0, "")
+        pdf.CellFormat(80, 9, "INVOICE", "", 1, "R", false, 0, "")
+
+        pdf.SetFont("Helvetica", "", 9)
+        top := pdf.GetY()
+        for _, line := range seller.Address {
+                pdf.CellFormat(100, 4.5, tr(line), "", 2, "L", false, 0, "")
+        }
+        if seller.TaxID != "" {
+                pdf.CellFormat(100, 4.5, tr("Tax ID: "+seller.TaxID), "", 2, "L", false, 0, "")
+        }
+        if seller.Email != "" {
+                pdf.CellFormat(100, 4.5, tr(seller.Email), "", 2, "L", false, 0, "")
+        }
+        bottom := pdf.GetY()
+
+        pdf.SetXY(115, top)
+        for _, row := range [][2]string{
+                {"Invoice number", inv.label()},
+                {"Invoice date", inv.IssuedAt.Format("2 January 2006")},
+                {"Order number", order.OrderNumber},
+                {"Order date", order.CreatedAt.Format("2 January 2006")},
+        } {
+                pdf.SetX(115)
+                pdf.CellFormat(30, 4.5, row[0], "", 0, "L", false, 0, "")
+                pdf.CellFormat(50, 4.5, row[1], "", 1, "R", false, 0, "")
+        }
+        if pdf.GetY() > bottom {
+                bottom = pdf.GetY()
+        }
+
+        pdf.SetXY(15, bottom+8)
+        pdf.SetFont("Helvetica", "B", 10)
+        pdf.CellFormat(100, 5, "Ship to", "", 2, "L", false, 0, "")
+        pdf.SetFont("Helvetica", "", 9)
+        a := order.ShippingAddress
+        for _, line := range []string{a.FullName, a.AddressLine1, a.AddressLine2,
+                strings.TrimSpace(strings.Join([]string{a.City, a.State, a.PostalCode}, " ")), a.Country} {
+                if line != "" {
+                        pdf.CellFormat(100, 4.5, tr(line), "", 2, "L", false, 0, "")
+                }
+        }
+
+        pdf.Ln(8)
+        widths := []float64{72, 12, 22, 20, 14, 20, 20}
+        pdf.SetFont("Helvetica", "B", 8.5)
+        pdf.SetFillColor(235, 235, 235)
+        for i, heading := range []string{"Item", "Qty", "Unit price", "Discount", "Tax %", "Tax", "Amount"} {
+                align := "R"
+                if i == 0 {
+                        align = "L"
+                }
+                pdf.CellFormat(widths[i], 6, heading, "B", 0, align, true, 0, "")
+        }
+        pdf.Ln(-1)
+
+        pdf.SetFont("Helvetica", "", 8.5)
+        for _, item := range order.Items {
+                title := item.BookTitle
+                if title == "" {
+                        title = "Book no longer in the catalogue"
+                }
+                if pdf.GetStringWidth(tr(title)) > widths[0]-2 {
+                        runes := []rune(title)
+                        for len(runes) > 0 && pdf.GetStringWidth(tr(string(runes)+"...")) > widths[0]-2 {
+                                runes = runes[:len(runes)-1]
+                        }
+                        title = string(runes) + "..."
+                }
+                cells := []string{tr(title), strconv.Itoa(item.Quantity), fmt.Sprintf("%.2f", item.PriceAtPurchase),
+                        fmt.Sprintf("%.2f", item.DiscountAmount), fmt.Sprintf("%g", item.TaxRate),
+                        fmt.Sprintf("%.2f", item.TaxAmount), fmt.Sprintf("%.2f", item.Subtotal-item.DiscountAmount)}
+                for i, cell := range cells {
+                        align := "R"
+                        if i == 0 {
+                                align = "L"
+                        }
+                        pdf.CellFormat(widths[i], 5.5, cell, "B", 0, align, false, 0, "")
+                }
+                pdf.Ln(-1)
+        }
+
+        totalRow := func(label, value string, bold bool) {
+                style := ""
+                if bold {
+                        style = "B"
+                }
+                pdf.SetFont("Helvetica", style, 9)
+                pdf.SetX(105)
+                pdf.CellFormat(45, 5.5, tr(label), "", 0, "L", false, 0, "")
+                pdf.CellFormat(30, 5.5, value, "", 1, "R", false, 0, "")
+        }
+
+        pdf.Ln(4)
+        var subtotal float64
+        for _, item := range order.Items {
+                subtotal += item.Subtotal
+        }
+        totalRow("Subtotal", money(roundCents(subtotal)), false)
+        for _, discount := range order.Discounts {
+                label := discount.Description
+                if discount.Code != "" {
+                        label += " (" + discount.Code + ")"
+                }
+                totalRow(label, money(-discount.Amount), false)
+        }
+        if order.ShippingMethod != "" {
+                totalRow("Shipping ("+shippingMethodName(order.ShippingMethod)+")", money(order.ShippingAmount), false)
+        }
+        if !order.PricesIncludeTax {
+                totalRow("Tax", money(order.TaxAmount), false)
+        }
+        totalRow("Total", money(order.TotalAmount), true)
+        if order.ExchangeRate != 0 && order.Currency != baseCurrency {
+                totalRow(fmt.Sprintf("Charged in %s at %g", order.Currency, order.ExchangeRate),
+                        fmt.Sprintf("%.2f %s", roundCents(order.TotalAmount*order.ExchangeRate), order.Currency), false)
+        }
+
+        pdf.Ln(6)
+        pdf.SetFont("Helvetica", "B", 10)
+        pdf.CellFormat(100, 5, "Tax breakdown", "", 1, "L", false, 0, "")
+        pdf.SetFont("Helvetica", "", 9)
+        if order.PricesIncludeTax {
+                pdf.CellFormat(180, 4.5, "Prices include tax.", "", 1, "L", false, 0, "")
+        }
+        for _, band := range taxBands(order.Items) {
+                pdf.CellFormat(30, 5, fmt.Sprintf("%g%%", band.Rate), "", 0, "L", false, 0, "")
+                pdf.CellFormat(50, 5, "on "+money(band.Taxable), "", 0, "L", false, 0, "")
+                pdf.CellFormat(40, 5, money(band.Tax), "", 1, "R", false, 0, "")
+        }
+
+        if len(order.Payments) > 0 {
+                pdf.Ln(6)
+                pdf.SetFont("Helvetica", "B", 10)
+                pdf.CellFormat(100, 5, "Payments", "", 1, "L", false, 0, "")
+                pdf.SetFont("Helvetica", "", 9)
+                for _, p := range order.Payments {
+                        label := map[string]string{
+                                tenderGiftCard:    "Gift card ending " + p.GiftCardLast4,
+                                tenderStoreCredit: "Store credit",
+                                tenderGateway:     "Card",
+                        }[p.Tender]
+                        pdf.CellFormat(80, 5, label, "", 0, "L", false, 0, "")
+                        pdf.CellFormat(40, 5, money(p.Amount), "", 1, "R", false, 0, "")
+                }
+        }
+
+        var buf bytes.Buffer
+        if err := pdf.Output(&buf); err != nil {
+                return nil, err
+        }
+        return buf.Bytes(), nil
+}
+
+// writeInvoice sends the invoice for order.
+func writeInvoice(w http.ResponseWriter, order *Order) {
+        inv, err := loadInvoice(order.ID)
+        if err == sql.ErrNoRows {
+                http.Error(w, "This order has no invoice", http.StatusNotFound)
+                return
+        }
+        if err != nil {
+                http.Error(w, "Server error", http.StatusInternalServerError)
+                return
+        }
+        body, err := renderInvoice(order, inv)
+        if err != nil {
+                http.Error(w, "Server error", http.StatusInternalServerError)
+                return
+        }
+
+        w.Header().Set("Content-Type", "application/pdf")
+        w.Header().Set("Content-Disposition", fmt.Sprintf(`inline; filename="%s.pdf"`, inv.label()))
+        w.Write(body)
+}
+
+// handleAdminOrderInvoice serves GET /api/admin/orders/{id}/invoice.pdf.
+func handleAdminOrderInvoice(w http.ResponseWriter, r *http.Request, id int) {
+        order, err := loadOrder("id = $1", id)
+        if err == sql.ErrNoRows {
+                http.Error(w, "Order not found", http.StatusNotFound)
+                return
+        }
+        if err != nil {
+                http.Error(w, "Server error", http.StatusInternalServerError)
+                return
+        }
+        writeInvoice(w, order)
+}
+
+// handleGuestOrderInvoice serves GET /api/guest-orders/invoice.pdf, with the
+// same order_number, email and token as the guest order lookup.
+func handleGuestOrderInvoice(w http.ResponseWriter, r *http.Request) {
+        if r.Method != http.MethodGet {
+                http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+                return
+        }
+
+        query := r.URL.Query()
+        orderID, err := findGuestOrder(query.Get("order_number"), query.Get("email"), query.Get("token"))
+        if err == sql.ErrNoRows {
+                http.Error(w, "Order not found", http.StatusNotFound)
+                return
+        }
+        if err != nil {
+                http.Error(w, "Server error", http.StatusInternalServerError)
+                return
+        }
+
+        order, err := loadOrder("id = $1", orderID)
+        if err != nil {
+                http.Error(w, "Server error", http.StatusInternalServerError)
+                return
+        }
+        writeInvoice(w, order)
+}
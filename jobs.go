@@ -0,0 +1,367 @@
+package main
+
+import (
+        "database/sql"
+        "encoding/json"
+        "fmt"
+        "log"
+        "net/http"
+        "os"
+        "strconv"
+        "strings"
+        "time"
+)
+
+// jobKind is a kind of background job and how it is run.
+type jobKind struct {
+        run func(payload json.RawMessage) error
+        // maxAttempts is how often a failing job is tried before it is
+        // dead-lettered; defaultJobAttempts when zero.
+        maxAttempts int
+        // every makes the job recurring: the next run is scheduled that long
+        // after each one finishes, whether or not it succeeded.
+        every time.Duration
+        // private payloads are never shown to staff and are cleared once the
+        // job succeeds, for jobs that carry tokens or gift card codes.
+        private bool
+}
+
+var jobKinds = map[string]jobKind{
+        "send_mail":         {run: runSendMailJob, maxAttempts: 8, private: true},
+        "purge_sessions":    {run: runPurgeSessionsJob, every: time.Hour},
+        "purge_guest_carts": {run: runPurgeGuestCartsJob, every: time.Hour},
+        "dispatch_event":    {run: runDispatchEventJob},
+        "deliver_webhook":   {run: runDeliverWebhookJob, maxAttempts: webhookMaxAttempts},
+        "purge_outbox":      {run: runPurgeOutboxJob, every: 24 * time.Hour},
+        "cart_reminders":    {run: runCartRemindersJob, every: 15 * time.Minute},
+}
+
+const defaultJobAttempts = 5
+
+// jobLockTimeout is how long a job may stay running before it is assumed
+// its worker died and it is handed to another one.
+const jobLockTimeout = 15 * time.Minute
+
+// Job is a row of the jobs table, as staff see it.
+type Job struct {
+        ID         int              `json:"id"`
+        Kind       string           `json:"kind"`
+        Payload    *json.RawMessage `json:"payload"`
+        Status     string           `json:"status"`
+        Attempts   int              `json:"attempts"`
+        LastError  *string          `json:"last_error"`
+        RunAt      time.Time        `json:"run_at"`
+        LockedAt   *time.Time       `json:"locked_at"`
+        FinishedAt *time.Time       `json:"finished_at"`
+        CreatedAt  time.Time        `json:"created_at"`
+}
+
+const jobColumns = `id, kind, payload, status, attempts, last_error, run_at, locked_at, finished_at, created_at`
+
+func scanJob(row interface{ Scan(...interface{}) error }) (Job, error) {
+        var j Job
+        var payload []byte
+        err := row.Scan(&j.ID, &j.Kind, &payload, &j.Status, &j.Attempts, &j.LastError,
+                &j.RunAt, &j.LockedAt, &j.FinishedAt, &j.CreatedAt)
+        if payload != nil && !jobKinds[j.Kind].private {
+                raw := json.RawMessage(payload)
+                j.Payload = &raw
+        }
+        return j, err
+}
+
+// enqueueJob queues a job to run as soon as a worker is free. Pass the
+// transaction the triggering change is made in, so the job only exists if
+// that change commits.
+func enqueueJob(q queryer, kind string, payload interface{}) error {
+        return scheduleJob(q, kind, payload, time.Now(), "")
+}
+
+// scheduleJob queues a job to run at runAt. A non-empty dedupeKey makes it
+// a no-op while another pending or running job has the same key.
+func scheduleJob(q queryer, kind string, payload interface{}, runAt time.Time, dedupeKey string) error {
+        body, err := json.Marshal(payload)
+        if err != nil {
+                return err
+        }
+        var id int
+        err = q.QueryRow(`INSERT INTO jobs (kind, payload, run_at, dedupe_key) VALUES ($1, $2, $3, NULLIF($4, ''))
+                          ON CONFLICT (dedupe_key) WHERE status IN ('pending', 'running') DO NOTHING
+                          RETURNING id`, kind, body, runAt, dedupeKey).Scan(&id)
+        if err == sql.ErrNoRows {
+                return nil
+        }
+        return err
+}
+
+// jobWorkerCount is JOB_WORKERS, 4 unless set. 0 runs no workers, for
+// processes that should only serve requests.
+func jobWorkerCount() (int, error) {
+        v := os.Getenv("JOB_WORKERS")
+        if v == "" {
+                return 4, nil
+        }
+        n, err := strconv.Atoi(v)
+        if err != nil || n < 0 {
+                return 0, fmt.Errorf("JOB_WORKERS must be a non-negative number")
+        }
+        return n, nil
+}
+
+// startJobWorkers runs n workers polling the jobs table every poll, and
+// makes sure every recurring job is scheduled. Jobs are claimed with SKIP
+// LOCKED, so any number of server processes can share the queue.
+func startJobWorkers(n int, poll time.Duration) {
+        if n == 0 {
+                return
+        }
+        for kind, k := range jobKinds {
+                if k.every == 0 {
+                        continue
+                }
+                if err := scheduleJob(db, kind, nil, time.Now(), kind); err != nil {
+                        log.Printf("Failed to schedule %s job: %v", kind, err)
+                }
+        }
+        go reclaimStaleJobs(time.Minute)
+        for i := 0; i < n; i++ {
+                go runJobWorker(poll)
+        }
+}
+
+func runJobWorker(poll time.Duration) {
+        for {
+                ran, err := runNextJob()
+                if err != nil {
+                        log.Println("Job queue error:", err)
+                }
+                if !ran || err != nil {
+                        time.Sleep(poll)
+                }
+        }
+}
+
+// runNextJob claims the next due job, runs it and records the outcome. The
+// claim is committed before the job runs, so a slow job holds no lock.
+func runNextJob() (bool, error) {
+        var id, attempts int
+        var kind string
+        var payload []byte
+        err := db.QueryRow(`UPDATE jobs SET status = 'running', locked_at = now(), attempts = attempts + 1
+                            WHERE id = (SELECT id FROM jobs
+                                        WHERE status = 'pending' AND run_at <= now()
+                                        ORDER BY run_at, id LIMIT 1
+                                        FOR UPDATE SKIP LOCKED)
+                            RETURNING id, kind, payload, attempts`).Scan(&id, &kind, &payload, &attempts)
+        if err == sql.ErrNoRows {
+                return false, nil
+        }
+        if err != nil {
+                return false, err
+        }
+
+        k, known := jobKinds[kind]
+        maxAttempts := k.maxAttempts
+        if maxAttempts == 0 {
+                maxAttempts = defaultJobAttempts
+        }
+
+        var jobErr error
+        switch {
+        case !known:
+                jobErr, attempts = fmt.Errorf("unknown job kind %q", kind), maxAttempts
+        case attempts > maxAttempts:
+                // Only a job reclaimed from a dead worker gets here.
+                jobErr = fmt.Errorf("gave up after %d attempts", maxAttempts)
+        default:
+                jobErr = runJob(k, payload)
+        }
+
+        if jobErr == nil {
+                _, err = db.Exec(`UPDATE jobs SET status = 'succeeded', finished_at = now(), locked_at = NULL, last_error = NULL,
+                                         payload = CASE WHEN $2 THEN NULL ELSE payload END
+                                  WHERE id = $1`, id, k.private)
+        } else if attempts >= maxAttempts {
+                log.Printf("Job %d (%s) failed for good: %v", id, kind, jobErr)
+                _, err = db.Exec(`UPDATE jobs SET status = 'dead', finished_at = now(), locked_at = NULL, last_error = $2
+                                  WHERE id = $1`, id, jobErr.Error())
+        } else {
+                log.Printf("Job %d (%s) failed, will retry: %v", id, kind, jobErr)
+                _, err = db.Exec(`UPDATE jobs SET status = 'pending', locked_at = NULL, last_error = $2, run_at = now() + make_interval(secs => $3)
+                                  WHERE id = $1`, id, jobErr.Error(), jobBackoff(attempts).Seconds())
+        }
+        if err != nil {
+                return true, err
+        }
+
+        if known && k.every > 0 {
+                if err := scheduleJob(db, kind, nil, time.Now().Add(k.every), kind); err != nil {
+                        return true, err
+                }
+        }
+        return true, nil
+}
+
+// runJob runs one attempt of a job, turning a panic into a failure.
+func runJob(k jobKind, payload []byte) (err error) {
+        defer func() {
+                if p := recover(); p != nil {
+                        err = fmt.Errorf("panic: %v", p)
+                }
+        }()
+        return k.run(payload)
+}
+
+// jobBackoff is the wait before retrying after the given number of attempts:
+// 30 seconds, doubling each time, capped at six hours.
+func jobBackoff(attempts int) time.Duration {
+        wait := 30 * time.Second
+        for i := 1; i < attempts && wait < 6*time.Hour; i++ {
+                wait *= 2
+        }
+        if wait > 6*time.Hour {
+                wait = 6 * time.Hour
+        }
+        return wait
+}
+
+// reclaimStaleJobs hands jobs whose worker died mid-run back to the queue.
+// The lost run counts as an attempt.
+func reclaimStaleJobs(interval time.Duration) {
+        for range time.Tick(interval) {
+                _, err := db.Exec(`UPDATE jobs SET status = 'pending', locked_at = NULL, run_at = now(),
+                                          last_error = 'worker stopped before the job finished'
+                                   WHERE status = 'running' AND locked_at < now() - make_interval(secs => $1)`,
+                        jobLockTimeout.Seconds())
+                if err != nil {
+                        log.Println("Failed to reclaim stale jobs:", err)
+                }
+        }
+}
+
+func runSendMailJob(payload json.RawMessage) error {
+        var msg Message
+        if err := json.Unmarshal(payload, &msg); err != nil {
+                return err
+        }
+        return mailer.Send(msg)
+}
+
+func runPurgeSessionsJob(json.RawMessage) error {
+        return store.purgeExpired()
+}
+
+func runPurgeGuestCartsJob(json.RawMessage) error {
+        return purgeGuestCarts(time.Duration(store.Options.MaxAge) * time.Second)
+}
+
+// handleAdminJobs serves GET /api/admin/jobs: the newest jobs, optionally
+// filtered by status and kind, and a count of jobs by kind and status.
+func handleAdminJobs(w http.ResponseWriter, r *http.Request) {
+        if r.Method != http.MethodGet {
+                http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+                return
+        }
+
+        query := r.URL.Query()
+        limit, err := strconv.Atoi(query.Get("limit"))
+        if err != nil || limit <= 0 || limit > 500 {
+                limit = 100
+        }
+
+        rows, err := db.Query(`SELECT `+jobColumns+` FROM jobs
+                               WHERE ($1 = '' OR status = $1) AND ($2 = '' OR kind = $2)
+                               ORDER BY id DESC LIMIT $3`, query.Get("status"), query.Get("kind"), limit)
+        if err != nil {
+                http.Error(w, "Server error", http.StatusInternalServerError)
+                return
+        }
+        defer rows.Close()
+
+        jobs := []Job{}
+        for rows.Next() {
+                job, err := scanJob(rows)
+                if err != nil {
+                        http.Error(w, "Server error", http.StatusInternalServerError)
+                        return
+                }
+                jobs = append(jobs, job)
+        }
+
+        counts := map[string]map[string]int{}
+        countRows, err := db.Query("SELECT kind, status, COUNT(*) FROM jobs GROUP BY kind, status")
+        if err != nil {
+                http.Error(w, "Server error", http.StatusInternalServerError)
+                return
+        }
+        defer countRows.Close()
+        for countRows.Next() {
+                var kind, status string
+                var n int
+                if err := countRows.Scan(&kind, &status, &n); err != nil {
+                        http.Error(w, "Server error", http.StatusInternalServerError)
+                        return
+                }
+                if counts[kind] == nil {
+                        counts[kind] = map[string]int{}
+                }
+                counts[kind][status] = n
+        }
+
+        w.Header().Set("Content-Type", "application/json")
+        json.NewEncoder(w).Encode(map[string]interface{}{
+                "jobs":   jobs,
+                "counts": counts,
+        })
+}
+
+// handleAdminJobDetail serves GET /api/admin/jobs/{id} and
+// POST /api/admin/jobs/{id}/retry, which runs a dead or waiting job again
+// now with a fresh set of attempts.
+func handleAdminJobDetail(w http.ResponseWriter, r *http.Request) {
+        idStr, retry := strings.CutSuffix(strings.TrimPrefix(r.URL.Path, "/api/admin/jobs/"), "/retry")
+        id, err := strconv.Atoi(idStr)
+        if err != nil {
+                http.Error(w, "Invalid job ID", http.StatusBadRequest)
+                return
+        }
+        if retry != (r.Method == http.MethodPost) {
+                http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+                return
+        }
+
+        job, err := scanJob(db.QueryRow("SELECT "+jobColumns+" FROM jobs WHERE id = $1", id))
+        if err == sql.ErrNoRows {
+                http.Error(w, "Job not found", http.StatusNotFound)
+                return
+        }
+        if err != nil {
+                http.Error(w, "Server error", http.StatusInternalServerError)
+                return
+        }
+
+        if retry {
+                job, err = scanJob(db.QueryRow(`UPDATE jobs SET status = 'pending', attempts = 0, run_at = now(), finished_at = NULL
+                                                WHERE id = $1 AND status IN ('pending', 'dead')
+                                                RETURNING `+jobColumns, id))
+                if err == sql.ErrNoRows {
+                        http.Error(w, "Only dead or waiting jobs can be retried", http.StatusConflict)
+                        return
+                }
+                // A dead recurring job can't come back while its next run is
+                // already queued under the same dedupe key.
+                if err != nil && strings.Contains(err.Error(), "duplicate") {
+                        http.Error(w, "Another run of this job is already queued", http.StatusConflict)
+                        return
+                }
+                if err != nil {
+                        http.Error(w, "Server error", http.StatusInternalServerError)
+                        return
+                }
+                actor, _ := getCurrentUser(r)
+                recordAdminAudit(r, actor.ID, "job.retried", 0, map[string]interface{}{"job_id": id, "kind": job.Kind})
+        }
+
+        w.Header().Set("Content-Type", "application/json")
+        json.NewEncoder(w).Encode(job)
+}
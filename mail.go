@@ -0,0 +1,190 @@
+package main
+
+import (
+        "crypto/rand"
+        "encoding/hex"
+        "fmt"
+        "log"
+        "mime"
+        "net"
+        "net/http"
+        "net/smtp"
+        "os"
+        "path/filepath"
+        "strings"
+        "time"
+)
+
+// Message is an email. HTML is optional; when set, Text is sent alongside it
+// as the plain-text alternative.
+type Message struct {
+        To      string `json:"to"`
+        Subject string `json:"subject"`
+        Text    string `json:"text"`
+        HTML    string `json:"html,omitempty"`
+        // ListUnsubscribe, when set, is a URL that unsubscribes the recipient
+        // with a single POST (RFC 8058).
+        ListUnsubscribe string `json:"list_unsubscribe,omitempty"`
+}
+
+// Mailer delivers messages. Handlers don't use one directly: they queue mail
+// (see queueMail), and a send_mail job hands it to the configured Mailer.
+type Mailer interface {
+        Send(msg Message) error
+}
+
+// mailer is chosen by MAIL_TRANSPORT: smtp (the default when SMTP_HOST is
+// set), maildir (files under MAILDIR) or log.
+var mailer Mailer = logMailer{}
+
+func mailerFromEnv() (Mailer, error) {
+        // Links in mail must not depend on the Host header of whoever
+        // triggered it.
+        if isProduction() && os.Getenv("APP_BASE_URL") == "" {
+                return nil, fmt.Errorf("APP_BASE_URL must be set in production")
+        }
+
+        transport := os.Getenv("MAIL_TRANSPORT")
+        if transport == "" && os.Getenv("SMTP_HOST") != "" {
+                transport = "smtp"
+        }
+
+        switch transport {
+        case "smtp":
+                m := smtpMailer{
+                        host: os.Getenv("SMTP_HOST"),
+                        port: os.Getenv("SMTP_PORT"),
+                        from: mailFrom(),
+                }
+                if m.host == "" {
+                        return nil, fmt.Errorf("MAIL_TRANSPORT=smtp needs SMTP_HOST")
+                }
+                if m.port == "" {
+                        m.port = "587"
+                }
+                if user := os.Getenv("SMTP_USERNAME"); user != "" {
+                        m.auth = smtp.PlainAuth("", user, os.Getenv("SMTP_PASSWORD"), m.host)
+                }
+                return m, nil
+        case "maildir":
+                dir := os.Getenv("MAILDIR")
+                if dir == "" {
+                        dir = "maildir"
+                }
+                for _, sub := range []string{"tmp", "new", "cur"} {
+                        if err := os.MkdirAll(filepath.Join(dir, sub), 0o700); err != nil {
+                                return nil, err
+                        }
+                }
+                return maildirMailer{dir: dir, from: mailFrom()}, nil
+        case "", "log":
+                return logMailer{}, nil
+        }
+        return nil, fmt.Errorf("unknown MAIL_TRANSPORT %q", transport)
+}
+
+func mailFrom() string {
+        if from := os.Getenv("MAIL_FROM"); from != "" {
+                return from
+        }
+        return "no-reply@bookstore.local"
+}
+
+// formatMessage renders msg as an RFC 5322 message: plain text, or
+// multipart/alternative with the text part first when there is HTML.
+func formatMessage(from string, msg Message) []byte {
+        headers := []string{
+                "From: " + from,
+                "To: " + msg.To,
+                "Subject: " + mime.QEncoding.Encode("utf-8", msg.Subject),
+                "Date: " + time.Now().Format(time.RFC1123Z),
+                "MIME-Version: 1.0",
+        }
+        if msg.ListUnsubscribe != "" {
+                headers = append(headers, "List-Unsubscribe: <"+msg.ListUnsubscribe+">", "List-Unsubscribe-Post: List-Unsubscribe=One-Click")
+        }
+        if msg.HTML == "" {
+                headers = append(headers, "Content-Type: text/plain; charset=UTF-8", "", msg.Text)
+                return []byte(strings.Join(headers, "\r\n"))
+        }
+
+        buf := make([]byte, 12)
+        rand.Read(buf)
+        boundary := "bookstore-" + hex.EncodeToString(buf)
+        headers = append(headers,
+                `Content-Type: multipart/alternative; boundary="`+boundary+`"`,
+                "",
+                "--"+boundary,
+                "Content-Type: text/plain; charset=UTF-8",
+                "",
+                msg.Text,
+                "--"+boundary,
+                "Content-Type: text/html; charset=UTF-8",
+                "",
+                msg.HTML,
+                "--"+boundary+"--",
+                "")
+        return []byte(strings.Join(headers, "\r\n"))
+}
+
+type smtpMailer struct {
+        host, port, from string
+        auth             smtp.Auth
+}
+
+func (m smtpMailer) Send(msg Message) error {
+        return smtp.SendMail(m.host+":"+m.port, m.auth, m.from, []string{msg.To}, formatMessage(m.from, msg))
+}
+
+// maildirMailer delivers into a local Maildir, for development and for
+// inspecting exactly what would have been sent.
+type maildirMailer struct {
+        dir, from string
+}
+
+func (m maildirMailer) Send(msg Message) error {
+        buf := make([]byte, 6)
+        rand.Read(buf)
+        name := fmt.Sprintf("%d.%s.bookstore", time.Now().UnixNano(), hex.EncodeToString(buf))
+        tmp := filepath.Join(m.dir, "tmp", name)
+        if err := os.WriteFile(tmp, formatMessage(m.from, msg), 0o600); err != nil {
+                return err
+        }
+        return os.Rename(tmp, filepath.Join(m.dir, "new", name))
+}
+
+// logMailer only logs the plain-text part, which is enough for local
+// development.
+type logMailer struct{}
+
+func (logMailer) Send(msg Message) error {
+        log.Printf("mail to %s: %s\n%s", msg.To, msg.Subject, msg.Text)
+        return nil
+}
+
+// sendMailAsync queues a plain-text message. It is for mail that must not
+// hold up or fail the request that triggered it; a failure to queue is only
+// logged.
+func sendMailAsync(to, subject, body string) {
+        if err := queueMail(db, Message{To: to, Subject: subject, Text: body}); err != nil {
+                log.Printf("Failed to queue %q to %s: %v", subject, to, err)
+        }
+}
+
+// appBaseURL is used to build links in emails. APP_BASE_URL wins, and is
+// required in production; otherwise it is derived from the request, trusting
+// X-Forwarded-Proto only from a trusted proxy.
+func appBaseURL(r *http.Request) string {
+        if base := os.Getenv("APP_BASE_URL"); base != "" {
+                return strings.TrimRight(base, "/")
+        }
+        host, _, err := net.SplitHostPort(r.RemoteAddr)
+        if err != nil {
+                host = r.RemoteAddr
+        }
+        scheme := "http"
+        if r.TLS != nil || (isTrustedProxy(host) && r.Header.Get("X-Forwarded-Proto") == "https") {
+                scheme = "https"
+        }
+        return fmt.Sprintf("%s://%s", scheme, r.Host)
+}
@@ -18,7 +18,7 @@ import (
 
 var (
         db    *sql.DB
-        store *sessions.CookieStore
+        store *PGStore
 )
 
 type User struct {
@@ -26,8 +26,27 @@ type User struct {
         Email        string    `json:"email"`
         PasswordHash string    `json:"-"`
         FullName     string    `json:"full_name"`
+        // IsAdmin is true for staff, i.e. any user holding at least one role.
         IsAdmin      bool      `json:"is_admin"`
         CreatedAt    time.Time `json:"created_at"`
+        TOTPEnabled  bool      `json:"totp_enabled"`
+        Roles        []string  `json:"roles,omitempty"`
+        Permissions  []string  `json:"permissions,omitempty"`
+        // MFASetupRequired is set for admins who must enrol in 2FA before
+        // they get admin access.
+        MFASetupRequired bool `json:"mfa_setup_required,omitempty"`
+        // APITokenID is set when the request authenticated with a bearer token,
+        // and accountScope when that token may act as the customer.
+        APITokenID   int  `json:"-"`
+        accountScope bool
+        // ImpersonatorID and ImpersonatorEmail identify the staff user when
+        // the session is impersonating this user.
+        ImpersonatorID    int    `json:"impersonator_id,omitempty"`
+        ImpersonatorEmail string `json:"impersonator_email,omitempty"`
+}
+
+func (u *User) HasAdminAccess() bool {
+        return u.IsAdmin && !u.MFASetupRequired
 }
 
 type Book struct {
@@ -42,6 +61,19 @@ type Book struct {
         CoverImageURL   string  `json:"cover_image_url"`
         ISBN            string  `json:"isbn"`
         PublicationYear int     `json:"publication_year"`
+        // MaxPerCustomer caps how many copies one cart may hold; nil means
+        // no limit beyond stock.
+        MaxPerCustomer *int `json:"max_per_customer"`
+        // TaxClass picks the tax rates that apply: standard, books or ebooks.
+        TaxClass string `json:"tax_class"`
+        // WeightGrams is the shipping weight of one copy.
+        WeightGrams int `json:"weight_grams"`
+        // GiftCard makes the product a gift card: buying one issues a card
+        // worth its price.
+        GiftCard bool `json:"gift_card"`
+        // Currency is the currency Price is in on the storefront, where
+        // prices are converted to the customer's chosen currency.
+        Currency string `json:"currency,omitempty"`
 }
 
 type Category struct {
@@ -56,6 +88,9 @@ type CartItem struct {
         BookID   int     `json:"book_id"`
         Quantity int     `json:"quantity"`
         Book     *Book   `json:"book,omitempty"`
+        // MaxQuantity is the most that can be ordered right now.
+        MaxQuantity int           `json:"max_quantity"`
+        Warnings    []CartWarning `json:"warnings,omitempty"`
 }
 
 type Order struct {
@@ -68,7 +103,17 @@ type Order struct {
         PaymentMethod     string    `json:"payment_method"`
         CreatedAt         time.Time `json:"created_at"`
         UpdatedAt         time.Time `json:"updated_at"`
+        ShippingMethod    string      `json:"shipping_method"`
+        ShippingAmount    float64     `json:"shipping_amount"`
+        TaxAmount         float64     `json:"tax_amount"`
+        PricesIncludeTax  bool        `json:"prices_include_tax"`
+        // Amounts are in the base currency; the customer was charged in
+        // Currency at ExchangeRate units per base unit.
+        Currency          string      `json:"currency"`
+        ExchangeRate      float64     `json:"exchange_rate"`
         Items             []OrderItem `json:"items,omitempty"`
+        Discounts         []Discount  `json:"discounts,omitempty"`
+        Payments          []Payment   `json:"payments,omitempty"`
         ShippingAddress   *Address    `json:"shipping_address,omitempty"`
 }
 
@@ -79,6 +124,9 @@ type OrderItem struct {
         Quantity        int     `json:"quantity"`
         PriceAtPurchase float64 `json:"price_at_purchase"`
         Subtotal        float64 `json:"subtotal"`
+        DiscountAmount  float64 `json:"discount_amount"`
+        TaxRate         float64 `json:"tax_rate"`
+        TaxAmount       float64 `json:"tax_amount"`
         BookTitle       string  `json:"book_title,omitempty"`
         BookAuthor      string  `json:"book_author,omitempty"`
 }
@@ -118,11 +166,42 @@ func main() {
         }
         defer db.Close()
 
-        sessionSecret := os.Getenv("SESSION_SECRET")
-        if sessionSecret == "" {
-                sessionSecret = "your-secret-key-change-in-production"
+        keyPairs, err := sessionKeyPairs()
+        if err != nil {
+                log.Fatal("Invalid session configuration: ", err)
+        }
+        store = NewPGStore(db, keyPairs...)
+        if err := loadTrustedProxies(); err != nil {
+                log.Fatal("Invalid proxy configuration: ", err)
+        }
+        requireAdminMFA = os.Getenv("REQUIRE_ADMIN_2FA") == "true"
+        allowImpersonatedCheckout = os.Getenv("IMPERSONATION_ALLOW_CHECKOUT") == "true"
+        pricesIncludeTax = os.Getenv("PRICES_INCLUDE_TAX") == "true"
+        loadSellerDetails()
+        if err := loadCartReminderSettings(); err != nil {
+                log.Fatal("Invalid cart reminder configuration: ", err)
+        }
+        if c := strings.ToUpper(os.Getenv("STORE_CURRENCY")); c != "" {
+                baseCurrency = c
+        }
+        if err := backfillOrderCurrency(); err != nil {
+                log.Fatal("Failed to backfill order currencies: ", err)
         }
-        store = sessions.NewCookieStore([]byte(sessionSecret))
+
+        mailer, err = mailerFromEnv()
+        if err != nil {
+                log.Fatal("Invalid mail configuration: ", err)
+        }
+
+        oidcConfig, err = loadOIDCConfig()
+        if err != nil {
+                log.Fatal("Invalid OIDC configuration: ", err)
+        }
+        workers, err := jobWorkerCount()
+        if err != nil {
+                log.Fatal("Invalid job configuration: ", err)
+        }
+        startJobWorkers(workers, 2*time.Second)
 
         mux := http.NewServeMux()
 
@@ -131,34 +210,153 @@ func main() {
         mux.HandleFunc("/", serveHome)
         mux.HandleFunc("/login", serveLogin)
         mux.HandleFunc("/register", serveRegister)
+        mux.HandleFunc("/reset-password", serveResetPassword)
         mux.HandleFunc("/books", serveBooks)
         mux.HandleFunc("/book/", serveBookDetail)
         mux.HandleFunc("/cart", serveCart)
+        mux.HandleFunc("/cart/restore", serveCartRestore)
+        mux.HandleFunc("/unsubscribe", serveUnsubscribe)
         mux.HandleFunc("/checkout", serveCheckout)
         mux.HandleFunc("/customer/dashboard", serveCustomerDashboard)
         mux.HandleFunc("/customer/orders", serveCustomerOrders)
+        mux.HandleFunc("/order-lookup", serveOrderLookup)
         mux.HandleFunc("/admin", serveAdminDashboard)
         mux.HandleFunc("/admin/books", serveAdminBooks)
         mux.HandleFunc("/admin/orders", serveAdminOrders)
 
+        mux.HandleFunc("/auth/oidc/start", handleOIDCStart)
+        mux.HandleFunc("/auth/oidc/callback", handleOIDCCallback)
+
         mux.HandleFunc("/api/register", handleRegister)
         mux.HandleFunc("/api/login", handleLogin)
+        mux.HandleFunc("/api/login/mfa", handleLoginMFA)
+        mux.HandleFunc("/api/auth/config", handleAuthConfig)
         mux.HandleFunc("/api/logout", handleLogout)
-        mux.HandleFunc("/api/me", handleGetCurrentUser)
+        mux.HandleFunc("/api/password-reset", handlePasswordReset)
+        mux.HandleFunc("/api/me", handleMe)
+        mux.HandleFunc("/api/me/email", notWhileImpersonating(handleChangeEmail))
+        mux.HandleFunc("/api/me/email/confirm", handleConfirmEmail)
+        mux.HandleFunc("/api/me/password", notWhileImpersonating(handleChangePassword))
+        mux.HandleFunc("/api/me/security-events", handleSecurityEvents)
+        mux.HandleFunc("/api/me/store-credit", handleStoreCredit)
+        mux.HandleFunc("/api/me/notifications", handleNotificationPreferences)
+        mux.HandleFunc("/api/notifications/unsubscribe", handleUnsubscribe)
+        mux.HandleFunc("/api/cart/restore", handleCartRestore)
+        mux.HandleFunc("/api/me/export", notWhileImpersonating(handleAccountExport))
+        mux.HandleFunc("/api/sessions", notWhileImpersonating(handleSessions))
+        mux.HandleFunc("/api/sessions/", notWhileImpersonating(handleSessionDetail))
+        mux.HandleFunc("/api/me/2fa/setup", notWhileImpersonating(handleMFASetup))
+        mux.HandleFunc("/api/me/2fa/enable", notWhileImpersonating(handleMFAEnable))
+        mux.HandleFunc("/api/me/2fa/disable", notWhileImpersonating(handleMFADisable))
+        mux.HandleFunc("/api/me/2fa/recovery-codes", notWhileImpersonating(handleMFARecoveryCodes))
+        mux.HandleFunc("/api/tokens", notWhileImpersonating(handleAPITokens))
+        mux.HandleFunc("/api/tokens/", notWhileImpersonating(handleAPITokenDetail))
         mux.HandleFunc("/api/books", handleBooks)
         mux.HandleFunc("/api/books/", handleBookDetail)
         mux.HandleFunc("/api/categories", handleCategories)
+        mux.HandleFunc("/api/addresses", handleAddresses)
+        mux.HandleFunc("/api/addresses/", handleAddressDetail)
         mux.HandleFunc("/api/cart", handleCart)
         mux.HandleFunc("/api/cart/add", handleAddToCart)
+        mux.HandleFunc("/api/cart/summary", handleCartSummary)
+        mux.HandleFunc("/api/cart/coupon", handleCartCoupon)
+        mux.HandleFunc("/api/shipping/quote", handleShippingQuote)
+        mux.HandleFunc("/api/currencies", handleCurrencies)
+        mux.HandleFunc("/api/gift-cards/balance", handleGiftCardBalance)
         mux.HandleFunc("/api/cart/update", handleUpdateCartItem)
         mux.HandleFunc("/api/cart/remove", handleRemoveFromCart)
-        mux.HandleFunc("/api/checkout", handleCheckout)
+        if allowImpersonatedCheckout {
+                mux.HandleFunc("/api/checkout", handleCheckout)
+        } else {
+                mux.HandleFunc("/api/checkout", notWhileImpersonating(handleCheckout))
+        }
         mux.HandleFunc("/api/orders", handleOrders)
         mux.HandleFunc("/api/orders/", handleOrderDetail)
-        mux.HandleFunc("/api/admin/books", handleAdminBooks)
-        mux.HandleFunc("/api/admin/books/", handleAdminBookDetail)
-        mux.HandleFunc("/api/admin/orders", handleAdminOrders)
-        mux.HandleFunc("/api/admin/orders/", handleAdminOrderUpdate)
+        mux.HandleFunc("/api/guest-orders", handleGuestOrder)
+        mux.HandleFunc("/api/guest-orders/convert", handleGuestConvert)
+        mux.HandleFunc("/api/guest-orders/invoice.pdf", handleGuestOrderInvoice)
+        mux.HandleFunc("/api/admin/books", requirePermission(map[string]string{
+                http.MethodGet:  permCatalogView,
+                http.MethodPost: permCatalogEdit,
+        }, handleAdminBooks))
+        mux.HandleFunc("/api/admin/books/", requirePermission(map[string]string{
+                http.MethodPut:    permCatalogEdit,
+                http.MethodDelete: permCatalogDelete,
+        }, handleAdminBookDetail))
+        mux.HandleFunc("/api/admin/orders", requirePermission(map[string]string{
+                http.MethodGet: permOrdersView,
+        }, handleAdminOrders))
+        mux.HandleFunc("/api/admin/orders/", requirePermission(map[string]string{
+                http.MethodGet: permOrdersView,
+                http.MethodPut: permOrdersUpdate,
+        }, handleAdminOrderUpdate))
+        mux.HandleFunc("/api/admin/exchange-rates", requirePermission(map[string]string{
+                http.MethodGet: permCurrencyManage,
+                http.MethodPut: permCurrencyManage,
+        }, handleAdminExchangeRates))
+        mux.HandleFunc("/api/admin/exchange-rates/", requirePermission(map[string]string{
+                http.MethodDelete: permCurrencyManage,
+        }, handleAdminExchangeRateDetail))
+        mux.HandleFunc("/api/admin/gift-cards", requirePermission(map[string]string{
+                http.MethodGet:  permCreditManage,
+                http.MethodPost: permCreditManage,
+        }, handleAdminGiftCards))
+        mux.HandleFunc("/api/admin/gift-cards/", requirePermission(map[string]string{
+                http.MethodGet:    permCreditManage,
+                http.MethodDelete: permCreditManage,
+        }, handleAdminGiftCardDetail))
+        mux.HandleFunc("/api/admin/promotions", requirePermission(map[string]string{
+                http.MethodGet:  permPromotionsManage,
+                http.MethodPost: permPromotionsManage,
+        }, handleAdminPromotions))
+        mux.HandleFunc("/api/admin/promotions/", requirePermission(map[string]string{
+                http.MethodPut:    permPromotionsManage,
+                http.MethodDelete: permPromotionsManage,
+        }, handleAdminPromotionDetail))
+        mux.HandleFunc("/api/admin/shipping/zones", requirePermission(map[string]string{
+                http.MethodGet:  permShippingManage,
+                http.MethodPost: permShippingManage,
+        }, handleAdminShippingZones))
+        mux.HandleFunc("/api/admin/shipping/zones/", requirePermission(map[string]string{
+                http.MethodPut:    permShippingManage,
+                http.MethodDelete: permShippingManage,
+        }, handleAdminShippingZoneDetail))
+        mux.HandleFunc("/api/admin/tax-rates", requirePermission(map[string]string{
+                http.MethodGet:  permTaxManage,
+                http.MethodPost: permTaxManage,
+        }, handleAdminTaxRates))
+        mux.HandleFunc("/api/admin/tax-rates/", requirePermission(map[string]string{
+                http.MethodPut:    permTaxManage,
+                http.MethodDelete: permTaxManage,
+        }, handleAdminTaxRateDetail))
+        mux.HandleFunc("/api/admin/roles", requirePermission(map[string]string{
+                http.MethodGet: permRolesManage,
+        }, handleAdminRoles))
+        mux.HandleFunc("/api/admin/users", requirePermission(map[string]string{
+                http.MethodGet: permCustomersView,
+        }, handleAdminUsers))
+        mux.HandleFunc("/api/admin/users/", handleAdminUserDetail)
+        mux.HandleFunc("/api/admin/impersonation/stop", handleStopImpersonation)
+        mux.HandleFunc("/api/admin/audit-log", requirePermission(map[string]string{
+                http.MethodGet: permAuditView,
+        }, handleAdminAuditLog))
+        mux.HandleFunc("/api/admin/webhooks", requirePermission(map[string]string{
+                http.MethodGet:  permWebhooksManage,
+                http.MethodPost: permWebhooksManage,
+        }, handleAdminWebhooks))
+        mux.HandleFunc("/api/admin/webhooks/", requirePermission(map[string]string{
+                http.MethodGet:    permWebhooksManage,
+                http.MethodPost:   permWebhooksManage,
+                http.MethodPut:    permWebhooksManage,
+                http.MethodDelete: permWebhooksManage,
+        }, handleAdminWebhookDetail))
+        mux.HandleFunc("/api/admin/jobs", requirePermission(map[string]string{
+                http.MethodGet: permJobsManage,
+        }, handleAdminJobs))
+        mux.HandleFunc("/api/admin/jobs/", requirePermission(map[string]string{
+                http.MethodGet:  permJobsManage,
+                http.MethodPost: permJobsManage,
+        }, handleAdminJobDetail))
 
         // port := "5000"
         port := os.Getenv("PORT")
@@ -167,7 +365,7 @@ func main() {
         }
         //
         log.Printf("Server starting on port %s...", port)
-        if err := http.ListenAndServe("0.0.0.0:"+port, mux); err != nil {
+        if err := http.ListenAndServe("0.0.0.0:"+port, auditImpersonation(mux)); err != nil {
                 log.Fatal(err)
         }
 }
@@ -177,6 +375,10 @@ func getSession(r *http.Request) (*sessions.Session, error) {
 }
 
 func getCurrentUser(r *http.Request) (*User, error) {
+        if auth := r.Header.Get("Authorization"); auth != "" {
+                return getTokenUser(auth)
+        }
+
         session, err := getSession(r)
         if err != nil {
                 return nil, err
@@ -187,16 +389,70 @@ func getCurrentUser(r *http.Request) (*User, error) {
                 return nil, fmt.Errorf("not authenticated")
         }
 
+        user, err := loadUser(userID)
+        if err != nil {
+                return nil, err
+        }
+
+        // While impersonating, the session acts as the customer but only for
+        // as long as the staff user keeps the permission to do so.
+        if actorID, ok := session.Values["impersonator_id"].(int); ok {
+                actor, err := loadUser(actorID)
+                if err != nil || !actor.Can(permCustomersImpersonate) {
+                        return nil, fmt.Errorf("impersonation no longer allowed")
+                }
+                user.ImpersonatorID = actor.ID
+                user.ImpersonatorEmail = actor.Email
+        }
+
+        return user, nil
+}
+
+var errAccountDisabled = fmt.Errorf("account disabled")
+
+// loadUser returns errAccountDisabled for disabled accounts, so their
+// sessions and tokens stop working at once.
+func loadUser(userID int) (*User, error) {
         var user User
-        err = db.QueryRow("SELECT id, email, full_name, is_admin, created_at FROM users WHERE id = $1", userID).
-                Scan(&user.ID, &user.Email, &user.FullName, &user.IsAdmin, &user.CreatedAt)
+        var disabled bool
+        err := db.QueryRow("SELECT id, email, full_name, created_at, totp_enabled, disabled_at IS NOT NULL FROM users WHERE id = $1", userID).
+                Scan(&user.ID, &user.Email, &user.FullName, &user.CreatedAt, &user.TOTPEnabled, &disabled)
         if err != nil {
                 return nil, err
         }
+        if disabled {
+                return nil, errAccountDisabled
+        }
+        if err := loadUserRoles(&user); err != nil {
+                return nil, err
+        }
+        user.MFASetupRequired = requireAdminMFA && user.IsAdmin && !user.TOTPEnabled
 
         return &user, nil
 }
 
+// getSessionUser is getCurrentUser for account-security endpoints that an
+// API token must not be able to reach (tokens, sessions, 2FA).
+func getSessionUser(r *http.Request) (*User, error) {
+        if r.Header.Get("Authorization") != "" {
+                return nil, fmt.Errorf("API tokens cannot be used here")
+        }
+        return getCurrentUser(r)
+}
+
+// getAccountUser is getCurrentUser for a customer's own cart, orders,
+// addresses and settings. API tokens only reach these with the account scope.
+func getAccountUser(r *http.Request) (*User, error) {
+        user, err := getCurrentUser(r)
+        if err != nil {
+                return nil, err
+        }
+        if user.APITokenID != 0 && !user.accountScope {
+                return nil, fmt.Errorf("API token lacks the %s scope", scopeAccount)
+        }
+        return user, nil
+}
+
 func requireAuth(next http.HandlerFunc) http.HandlerFunc {
         return func(w http.ResponseWriter, r *http.Request) {
                 _, err := getCurrentUser(r)
@@ -211,7 +467,7 @@ func requireAuth(next http.HandlerFunc) http.HandlerFunc {
 func requireAdmin(next http.HandlerFunc) http.HandlerFunc {
         return func(w http.ResponseWriter, r *http.Request) {
                 user, err := getCurrentUser(r)
-                if err != nil || !user.IsAdmin {
+                if err != nil || !user.HasAdminAccess() {
                         http.Error(w, "Forbidden", http.StatusForbidden)
                         return
                 }
@@ -257,8 +513,15 @@ func handleRegister(w http.ResponseWriter, r *http.Request) {
                 return
         }
 
+        welcome := notice{Name: req.FullName, Link: appBaseURL(r) + "/books"}
+        if err := notify(db, "welcome", userID, req.Email, welcome); err != nil {
+                log.Println("Failed to queue welcome email:", err)
+        }
+
         session, _ := getSession(r)
+        store.Renew(session)
         session.Values["user_id"] = userID
+        mergeGuestCart(session, userID)
         session.Save(r, w)
 
         w.Header().Set("Content-Type", "application/json")
@@ -285,8 +548,10 @@ func handleLogin(w http.ResponseWriter, r *http.Request) {
         }
 
         var user User
-        err := db.QueryRow("SELECT id, email, password_hash, full_name, is_admin FROM users WHERE email = $1", req.Email).
-                Scan(&user.ID, &user.Email, &user.PasswordHash, &user.FullName, &user.IsAdmin)
+        var disabled, resetRequired bool
+        err := db.QueryRow(`SELECT id, email, password_hash, full_name, totp_enabled, disabled_at IS NOT NULL, password_reset_required
+                            FROM users WHERE email = $1`, req.Email).
+                Scan(&user.ID, &user.Email, &user.PasswordHash, &user.FullName, &user.TOTPEnabled, &disabled, &resetRequired)
 
         if err != nil {
                 http.Error(w, "Invalid credentials", http.StatusUnauthorized)
@@ -298,15 +563,49 @@ func handleLogin(w http.ResponseWriter, r *http.Request) {
                 return
         }
 
+        if disabled {
+                http.Error(w, "This account has been disabled", http.StatusForbidden)
+                return
+        }
+
+        if resetRequired {
+                http.Error(w, "You must choose a new password. Check your email for a reset link.", http.StatusForbidden)
+                return
+        }
+
+        if err := loadUserRoles(&user); err != nil {
+                http.Error(w, "Server error", http.StatusInternalServerError)
+                return
+        }
+
         session, _ := getSession(r)
+        store.Renew(session)
+
+        if user.TOTPEnabled {
+                // Password is correct but the session stays unauthenticated
+                // until /api/login/mfa accepts a code.
+                session.Values["mfa_user_id"] = user.ID
+                session.Values["mfa_started"] = time.Now().Unix()
+                session.Save(r, w)
+
+                w.Header().Set("Content-Type", "application/json")
+                json.NewEncoder(w).Encode(map[string]interface{}{
+                        "success":      false,
+                        "mfa_required": true,
+                })
+                return
+        }
+
         session.Values["user_id"] = user.ID
+        mergeGuestCart(session, user.ID)
         session.Save(r, w)
 
         w.Header().Set("Content-Type", "application/json")
         json.NewEncoder(w).Encode(map[string]interface{}{
-                "success":  true,
-                "user_id":  user.ID,
-                "is_admin": user.IsAdmin,
+                "success":            true,
+                "user_id":            user.ID,
+                "is_admin":           user.IsAdmin,
+                "mfa_setup_required": requireAdminMFA && user.IsAdmin,
         })
 }
 
@@ -342,6 +641,11 @@ func handleBooks(w http.ResponseWriter, r *http.Request) {
         categoryID := query.Get("category")
         sortBy := query.Get("sort")
 
+        currency, ok := currencyOrError(w, r)
+        if !ok {
+                return
+        }
+
         sql := `SELECT b.id, b.title, b.author, b.description, b.price, b.stock_quantity, 
                        b.category_id, c.name as category_name, b.cover_image_url, b.isbn, b.publication_year
                 FROM books b
@@ -395,6 +699,7 @@ func handleBooks(w http.ResponseWriter, r *http.Request) {
                 if categoryName != nil {
                         book.CategoryName = *categoryName
                 }
+                book.Price, book.Currency = currency.convert(book.Price), currency.Code
                 books = append(books, book)
         }
 
@@ -418,13 +723,14 @@ func handleBookDetail(w http.ResponseWriter, r *http.Request) {
         var book Book
         var categoryName *string
         err = db.QueryRow(`SELECT b.id, b.title, b.author, b.description, b.price, b.stock_quantity, 
-                                  b.category_id, c.name as category_name, b.cover_image_url, b.isbn, b.publication_year
+                                  b.category_id, c.name as category_name, b.cover_image_url, b.isbn, b.publication_year,
+                                  b.max_per_customer, b.tax_class, b.weight_grams, b.gift_card
                            FROM books b
                            LEFT JOIN categories c ON b.category_id = c.id
                            WHERE b.id = $1`, id).
                 Scan(&book.ID, &book.Title, &book.Author, &book.Description, &book.Price,
                         &book.StockQuantity, &book.CategoryID, &categoryName, &book.CoverImageURL,
-                        &book.ISBN, &book.PublicationYear)
+                        &book.ISBN, &book.PublicationYear, &book.MaxPerCustomer, &book.TaxClass, &book.WeightGrams, &book.GiftCard)
 
         if err != nil {
                 http.Error(w, "Book not found", http.StatusNotFound)
@@ -435,6 +741,12 @@ func handleBookDetail(w http.ResponseWriter, r *http.Request) {
                 book.CategoryName = *categoryName
         }
 
+        currency, ok := currencyOrError(w, r)
+        if !ok {
+                return
+        }
+        book.Price, book.Currency = currency.convert(book.Price), currency.Code
+
         w.Header().Set("Content-Type", "application/json")
         json.NewEncoder(w).Encode(book)
 }
@@ -459,17 +771,24 @@ func handleCategories(w http.ResponseWriter, r *http.Request) {
 }
 
 func handleCart(w http.ResponseWriter, r *http.Request) {
-        user, err := getCurrentUser(r)
+        owner, err := getCartOwner(w, r, false)
         if err != nil {
                 http.Error(w, "Unauthorized", http.StatusUnauthorized)
                 return
         }
 
-        rows, err := db.Query(`SELECT c.id, c.user_id, c.book_id, c.quantity,
-                                      b.title, b.author, b.price, b.cover_image_url, b.stock_quantity
+        currency, ok := currencyOrError(w, r)
+        if !ok {
+                return
+        }
+
+        rows, err := db.Query(`SELECT c.id, COALESCE(c.user_id, 0), c.book_id, c.quantity,
+                                      b.title, b.author, b.price, b.cover_image_url, b.stock_quantity,
+                                      b.max_per_customer, COALESCE(c.price_at_add, b.price)
                                FROM cart_items c
                                JOIN books b ON c.book_id = b.id
-                               WHERE c.user_id = $1`, user.ID)
+                               WHERE c.`+owner.column()+` = $1
+                               ORDER BY c.id`, owner.key())
         if err != nil {
                 http.Error(w, "Server error", http.StatusInternalServerError)
                 return
@@ -479,11 +798,28 @@ func handleCart(w http.ResponseWriter, r *http.Request) {
         var items []CartItem
         for rows.Next() {
                 var item CartItem
+                var maxPerCustomer sql.NullInt64
+                var priceAtAdd float64
                 item.Book = &Book{}
                 rows.Scan(&item.ID, &item.UserID, &item.BookID, &item.Quantity,
                         &item.Book.Title, &item.Book.Author, &item.Book.Price,
-                        &item.Book.CoverImageURL, &item.Book.StockQuantity)
+                        &item.Book.CoverImageURL, &item.Book.StockQuantity,
+                        &maxPerCustomer, &priceAtAdd)
                 item.Book.ID = item.BookID
+                if maxPerCustomer.Valid {
+                        limit := int(maxPerCustomer.Int64)
+                        item.Book.MaxPerCustomer = &limit
+                }
+                var ordered int
+                if maxPerCustomer.Valid {
+                        if ordered, err = orderedCopies(db, owner, item.BookID); err != nil {
+                                http.Error(w, "Server error", http.StatusInternalServerError)
+                                return
+                        }
+                }
+                item.MaxQuantity = cartLimit(item.Book.StockQuantity, maxPerCustomer, ordered)
+                item.Warnings = cartWarnings(item, maxPerCustomer, ordered, priceAtAdd, currency)
+                item.Book.Price, item.Book.Currency = currency.convert(item.Book.Price), currency.Code
                 items = append(items, item)
         }
 
@@ -497,7 +833,7 @@ func handleAddToCart(w http.ResponseWriter, r *http.Request) {
                 return
         }
 
-        user, err := getCurrentUser(r)
+        owner, err := getCartOwner(w, r, true)
         if err != nil {
                 http.Error(w, "Unauthorized", http.StatusUnauthorized)
                 return
@@ -517,11 +853,31 @@ func handleAddToCart(w http.ResponseWriter, r *http.Request) {
                 req.Quantity = 1
         }
 
-        _, err = db.Exec(`INSERT INTO cart_items (user_id, book_id, quantity) 
-                          VALUES ($1, $2, $3)
-                          ON CONFLICT (user_id, book_id) 
-                          DO UPDATE SET quantity = cart_items.quantity + $3`,
-                user.ID, req.BookID, req.Quantity)
+        var inCart int
+        db.QueryRow("SELECT quantity FROM cart_items WHERE "+owner.column()+" = $1 AND book_id = $2",
+                owner.key(), req.BookID).Scan(&inCart)
+
+        switch err := checkCartQuantity(owner, req.BookID, inCart+req.Quantity); err.(type) {
+        case nil:
+        case cartError:
+                http.Error(w, err.Error(), http.StatusBadRequest)
+                return
+        default:
+                if err == errBookNotFound {
+                        http.Error(w, "Book not found", http.StatusNotFound)
+                        return
+                }
+                http.Error(w, "Server error", http.StatusInternalServerError)
+                return
+        }
+
+        // price_at_add is what the customer saw when adding, so handleCart
+        // can warn when it changes.
+        _, err = db.Exec(`INSERT INTO cart_items (`+owner.column()+`, book_id, quantity, price_at_add) 
+                          VALUES ($1, $2, $3, (SELECT price FROM books WHERE id = $2))
+                          ON CONFLICT `+owner.conflictTarget()+` 
+                          DO UPDATE SET quantity = cart_items.quantity + $3, updated_at = now(), price_at_add = EXCLUDED.price_at_add`,
+                owner.key(), req.BookID, req.Quantity)
 
         if err != nil {
                 http.Error(w, "Server error", http.StatusInternalServerError)
@@ -538,7 +894,7 @@ func handleUpdateCartItem(w http.ResponseWriter, r *http.Request) {
                 return
         }
 
-        user, err := getCurrentUser(r)
+        owner, err := getCartOwner(w, r, false)
         if err != nil {
                 http.Error(w, "Unauthorized", http.StatusUnauthorized)
                 return
@@ -559,8 +915,22 @@ func handleUpdateCartItem(w http.ResponseWriter, r *http.Request) {
                 return
         }
 
-        _, err = db.Exec("UPDATE cart_items SET quantity = $1 WHERE user_id = $2 AND book_id = $3",
-                req.Quantity, user.ID, req.BookID)
+        switch err := checkCartQuantity(owner, req.BookID, req.Quantity); err.(type) {
+        case nil:
+        case cartError:
+                http.Error(w, err.Error(), http.StatusBadRequest)
+                return
+        default:
+                if err == errBookNotFound {
+                        http.Error(w, "Book not found", http.StatusNotFound)
+                        return
+                }
+                http.Error(w, "Server error", http.StatusInternalServerError)
+                return
+        }
+
+        _, err = db.Exec("UPDATE cart_items SET quantity = $1, updated_at = now() WHERE "+owner.column()+" = $2 AND book_id = $3",
+                req.Quantity, owner.key(), req.BookID)
 
         if err != nil {
                 http.Error(w, "Server error", http.StatusInternalServerError)
@@ -577,7 +947,7 @@ func handleRemoveFromCart(w http.ResponseWriter, r *http.Request) {
                 return
         }
 
-        user, err := getCurrentUser(r)
+        owner, err := getCartOwner(w, r, false)
         if err != nil {
                 http.Error(w, "Unauthorized", http.StatusUnauthorized)
                 return
@@ -592,8 +962,8 @@ func handleRemoveFromCart(w http.ResponseWriter, r *http.Request) {
                 return
         }
 
-        _, err = db.Exec("DELETE FROM cart_items WHERE user_id = $1 AND book_id = $2",
-                user.ID, req.BookID)
+        _, err = db.Exec("DELETE FROM cart_items WHERE "+owner.column()+" = $1 AND book_id = $2",
+                owner.key(), req.BookID)
 
         if err != nil {
                 http.Error(w, "Server error", http.StatusInternalServerError)
@@ -610,21 +980,25 @@ func handleCheckout(w http.ResponseWriter, r *http.Request) {
                 return
         }
 
-        user, err := getCurrentUser(r)
+        owner, err := getCartOwner(w, r, false)
         if err != nil {
                 http.Error(w, "Unauthorized", http.StatusUnauthorized)
                 return
         }
 
+        // Ship to a saved address by address_id, or to the address fields
+        // given inline, which are saved to the address book on save_address.
+        // Guests must give an inline address and an email.
         var req struct {
-                FullName     string `json:"full_name"`
-                Phone        string `json:"phone"`
-                AddressLine1 string `json:"address_line1"`
-                AddressLine2 string `json:"address_line2"`
-                City         string `json:"city"`
-                State        string `json:"state"`
-                PostalCode   string `json:"postal_code"`
-                Country      string `json:"country"`
+                Address
+                AddressID      int    `json:"address_id"`
+                SaveAddress    bool   `json:"save_address"`
+                Email          string `json:"email"`
+                ShippingMethod string `json:"shipping_method"`
+                // GiftCards and UseStoreCredit pay for the order before the
+                // gateway, which takes whatever is left.
+                GiftCards      []string `json:"gift_cards"`
+                UseStoreCredit bool     `json:"use_store_credit"`
         }
 
         if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
@@ -632,6 +1006,35 @@ func handleCheckout(w http.ResponseWriter, r *http.Request) {
                 return
         }
 
+        if req.ShippingMethod == "" {
+                http.Error(w, "Choose a shipping method", http.StatusBadRequest)
+                return
+        }
+
+        // The order is charged in the customer's chosen currency at today's
+        // rate, which the order keeps.
+        currency, ok := currencyOrError(w, r)
+        if !ok {
+                return
+        }
+
+        guest := owner.UserID == 0
+        var guestEmail, guestToken string
+        if guest {
+                guestEmail, err = parseGuestEmail(req.Email)
+                if err != nil {
+                        http.Error(w, err.Error(), http.StatusBadRequest)
+                        return
+                }
+                if req.AddressID != 0 {
+                        http.Error(w, "Log in to use a saved address", http.StatusBadRequest)
+                        return
+                }
+                req.SaveAddress = false
+                guestToken = newSessionToken()
+                owner.Email = guestEmail
+        }
+
         tx, err := db.Begin()
         if err != nil {
                 http.Error(w, "Server error", http.StatusInternalServerError)
@@ -639,89 +1042,233 @@ func handleCheckout(w http.ResponseWriter, r *http.Request) {
         }
         defer tx.Rollback()
 
-        var addressID int
-        err = tx.QueryRow(`INSERT INTO addresses (user_id, full_name, phone, address_line1, address_line2, city, state, postal_code, country)
-                           VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9) RETURNING id`,
-                user.ID, req.FullName, req.Phone, req.AddressLine1, req.AddressLine2,
-                req.City, req.State, req.PostalCode, req.Country).Scan(&addressID)
+        shipping := req.Address
+        shipping.ID, shipping.UserID = 0, owner.UserID
+        if req.AddressID != 0 {
+                shipping, err = scanAddress(tx.QueryRow("SELECT "+addressColumns+" FROM addresses WHERE id = $1 AND user_id = $2",
+                        req.AddressID, owner.UserID))
+                if err == sql.ErrNoRows {
+                        http.Error(w, "Address not found", http.StatusBadRequest)
+                        return
+                }
+                if err != nil {
+                        http.Error(w, "Server error", http.StatusInternalServerError)
+                        return
+                }
+        } else {
+                if err := validateAddress(&shipping); err != nil {
+                        http.Error(w, err.Error(), http.StatusBadRequest)
+                        return
+                }
+                shipping.IsDefault = false
+                if req.SaveAddress {
+                        if err := insertAddress(tx, owner.UserID, &shipping); err != nil {
+                                http.Error(w, "Server error", http.StatusInternalServerError)
+                                return
+                        }
+                }
+        }
 
-        if err != nil {
-                http.Error(w, "Server error", http.StatusInternalServerError)
-                return
+        // The order keeps a snapshot so later address edits don't rewrite it.
+        var addressID interface{}
+        if shipping.ID != 0 {
+                addressID = shipping.ID
         }
+        addressSnapshot, _ := json.Marshal(shipping)
 
-        rows, err := tx.Query(`SELECT book_id, quantity FROM cart_items WHERE user_id = $1`, user.ID)
+        // Price the cart with the code behind /api/cart/summary, so the total
+        // recorded here is the one the customer was shown.
+        quote, err := quoteCart(tx, owner, destinationOf(shipping), req.ShippingMethod, true)
         if err != nil {
                 http.Error(w, "Server error", http.StatusInternalServerError)
                 return
         }
-        defer rows.Close()
 
-        type CartData struct {
-                BookID   int
-                Quantity int
-        }
-        var cartItems []CartData
-        for rows.Next() {
-                var item CartData
-                rows.Scan(&item.BookID, &item.Quantity)
-                cartItems = append(cartItems, item)
-        }
-        rows.Close()
-
-        if len(cartItems) == 0 {
+        if len(quote.Lines) == 0 {
                 http.Error(w, "Cart is empty", http.StatusBadRequest)
                 return
         }
 
-        var totalAmount float64
-        for _, item := range cartItems {
-                var price float64
-                var stock int
-                err = tx.QueryRow("SELECT price, stock_quantity FROM books WHERE id = $1", item.BookID).
-                        Scan(&price, &stock)
-                if err != nil || stock < item.Quantity {
-                        http.Error(w, "Insufficient stock", http.StatusBadRequest)
+        // The books are locked, so copies ordered by a concurrent checkout
+        // of the same customer are counted here.
+        for _, line := range quote.Lines {
+                var ordered int
+                if line.maxPerCustomer.Valid {
+                        if ordered, err = orderedCopies(tx, owner, line.BookID); err != nil {
+                                http.Error(w, "Server error", http.StatusInternalServerError)
+                                return
+                        }
+                }
+                if err := checkLimit(line.Quantity, ordered, line.stock, line.maxPerCustomer); err != nil {
+                        http.Error(w, line.Title+": "+err.Error(), http.StatusBadRequest)
                         return
                 }
-                totalAmount += price * float64(item.Quantity)
+        }
+        if quote.CouponError != "" {
+                // Restates a missed minimum spend in the checkout currency.
+                quote.convert(currency)
+                http.Error(w, quote.Coupon+": "+quote.CouponError, http.StatusBadRequest)
+                return
+        }
+        if quote.ShippingError != "" {
+                http.Error(w, quote.ShippingError, http.StatusBadRequest)
+                return
         }
 
-        orderNumber := fmt.Sprintf("ORD-%d-%d", user.ID, time.Now().Unix())
+        orderNumber := fmt.Sprintf("ORD-%d-%d", owner.UserID, time.Now().Unix())
+        var userID interface{} = owner.UserID
+        if guest {
+                orderNumber = guestOrderNumber()
+                userID = nil
+        }
 
         var orderID int
-        err = tx.QueryRow(`INSERT INTO orders (user_id, order_number, total_amount, status, shipping_address_id, payment_method)
-                           VALUES ($1, $2, $3, 'pending', $4, 'mock') RETURNING id`,
-                user.ID, orderNumber, totalAmount, addressID).Scan(&orderID)
+        err = tx.QueryRow(`INSERT INTO orders (user_id, order_number, total_amount, tax_amount, prices_include_tax,
+                                              shipping_method, shipping_amount, currency, exchange_rate, status,
+                                              shipping_address_id, shipping_address, payment_method, guest_email, guest_token_hash)
+                           VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, 'pending', $10, $11, 'mock', $12, $13) RETURNING id`,
+                userID, orderNumber, quote.Total, quote.Tax, quote.PricesIncludeTax, quote.ShippingMethod, quote.Shipping,
+                currency.Code, currency.Rate, addressID, string(addressSnapshot),
+                sql.NullString{String: guestEmail, Valid: guest}, sql.NullString{String: hashToken(guestToken), Valid: guest}).Scan(&orderID)
 
         if err != nil {
                 http.Error(w, "Server error", http.StatusInternalServerError)
                 return
         }
 
-        for _, item := range cartItems {
-                var price float64
-                tx.QueryRow("SELECT price FROM books WHERE id = $1", item.BookID).Scan(&price)
+        for _, line := range quote.Lines {
+                _, err = tx.Exec(`INSERT INTO order_items (order_id, book_id, book_title, book_author, quantity,
+                                                           price_at_purchase, subtotal, discount_amount, tax_rate, tax_amount)
+                                  VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10)`,
+                        orderID, line.BookID, line.Title, line.author, line.Quantity, line.UnitPrice, line.Subtotal,
+                        line.Discount, line.TaxRate, line.Tax)
 
-                subtotal := price * float64(item.Quantity)
-                _, err = tx.Exec(`INSERT INTO order_items (order_id, book_id, quantity, price_at_purchase, subtotal)
-                                  VALUES ($1, $2, $3, $4, $5)`,
-                        orderID, item.BookID, item.Quantity, price, subtotal)
+                if err != nil {
+                        http.Error(w, "Server error", http.StatusInternalServerError)
+                        return
+                }
 
+                var stock int
+                err = tx.QueryRow("UPDATE books SET stock_quantity = stock_quantity - $1 WHERE id = $2 RETURNING stock_quantity",
+                        line.Quantity, line.BookID).Scan(&stock)
+                if err == nil {
+                        err = recordStockChange(tx, line.BookID, stock, -line.Quantity)
+                }
+                if err != nil {
+                        http.Error(w, "Server error", http.StatusInternalServerError)
+                        return
+                }
+        }
+
+        for _, discount := range quote.Discounts {
+                _, err = tx.Exec(`INSERT INTO order_discounts (order_id, promotion_id, code, description, amount)
+                                  VALUES ($1, $2, $3, $4, $5)`,
+                        orderID, discount.promotionID, discount.Code, discount.Description, discount.Amount)
                 if err != nil {
                         http.Error(w, "Server error", http.StatusInternalServerError)
                         return
                 }
+        }
+
+        payments, err := payOrder(tx, orderID, quote.Total, req.GiftCards, owner.UserID, req.UseStoreCredit)
+        if msg, ok := err.(cartError); ok {
+                http.Error(w, string(msg), http.StatusBadRequest)
+                return
+        }
+        if err != nil {
+                http.Error(w, "Server error", http.StatusInternalServerError)
+                return
+        }
+
+        // The order is paid here, so it is invoiced here too.
+        if _, err := issueInvoice(tx, orderID); err != nil {
+                http.Error(w, "Server error", http.StatusInternalServerError)
+                return
+        }
 
-                _, err = tx.Exec("UPDATE books SET stock_quantity = stock_quantity - $1 WHERE id = $2",
-                        item.Quantity, item.BookID)
+        // Payment is taken with the order, so it is created and paid at once.
+        err = recordEvent(tx, eventOrderCreated, map[string]interface{}{
+                "order_id":         orderID,
+                "order_number":     orderNumber,
+                "user_id":          userID,
+                "guest_email":      guestEmail,
+                "status":           "pending",
+                "items":            quote.Lines,
+                "discounts":        quote.Discounts,
+                "shipping_method":  quote.ShippingMethod,
+                "shipping":         quote.Shipping,
+                "tax":              quote.Tax,
+                "total":            quote.Total,
+                "currency":         currency.Code,
+                "exchange_rate":    currency.Rate,
+                "shipping_address": shipping,
+        })
+        if err == nil {
+                err = recordEvent(tx, eventOrderPaid, map[string]interface{}{
+                        "order_id":     orderID,
+                        "order_number": orderNumber,
+                        "total":        quote.Total,
+                        "payments":     payments,
+                })
+        }
+        if err != nil {
+                http.Error(w, "Server error", http.StatusInternalServerError)
+                return
+        }
+
+        // Gift cards bought on this order are issued to the buyer, one per
+        // card, and emailed once the order is committed.
+        type issuedCard struct {
+                code   string
+                amount float64
+        }
+        var issued []issuedCard
+        buyerEmail, buyerName := guestEmail, shipping.FullName
+        if !guest {
+                err := tx.QueryRow("SELECT email, full_name FROM users WHERE id = $1", owner.UserID).Scan(&buyerEmail, &buyerName)
                 if err != nil {
                         http.Error(w, "Server error", http.StatusInternalServerError)
                         return
                 }
         }
+        for _, line := range quote.Lines {
+                if !line.giftCard {
+                        continue
+                }
+                for n := 0; n < line.Quantity; n++ {
+                        code, _, err := issueGiftCard(tx, line.UnitPrice, buyerEmail, orderID, 0, nil, "Purchased")
+                        if err != nil {
+                                http.Error(w, "Server error", http.StatusInternalServerError)
+                                return
+                        }
+                        issued = append(issued, issuedCard{code, line.UnitPrice})
+                }
+        }
+
+        // The confirmation is queued in the order's transaction, so it goes
+        // out once the order exists, however long mail is down.
+        confirmation := notice{
+                Name:        buyerName,
+                OrderNumber: orderNumber,
+                Total:       currency.format(quote.Total),
+                Guest:       guest,
+                Link:        appBaseURL(r) + "/customer/orders",
+        }
+        if guest {
+                confirmation.Link = guestOrderLink(r, guestEmail, orderNumber, guestToken)
+        }
+        for _, line := range quote.Lines {
+                confirmation.Lines = append(confirmation.Lines, noticeLine{line.Title, line.Quantity, currency.format(line.Subtotal)})
+        }
+        if err := notify(tx, "order_placed", owner.UserID, buyerEmail, confirmation); err != nil {
+                http.Error(w, "Server error", http.StatusInternalServerError)
+                return
+        }
 
-        _, err = tx.Exec("DELETE FROM cart_items WHERE user_id = $1", user.ID)
+        _, err = tx.Exec("DELETE FROM cart_items WHERE "+owner.column()+" = $1", owner.key())
+        if err == nil {
+                _, err = tx.Exec("DELETE FROM cart_coupons WHERE "+owner.column()+" = $1", owner.key())
+        }
         if err != nil {
                 http.Error(w, "Server error", http.StatusInternalServerError)
                 return
@@ -732,16 +1279,24 @@ func handleCheckout(w http.ResponseWriter, r *http.Request) {
                 return
         }
 
+        for _, card := range issued {
+                sendGiftCardEmail(r, buyerEmail, card.code, card.amount)
+        }
+
         w.Header().Set("Content-Type", "application/json")
         json.NewEncoder(w).Encode(map[string]interface{}{
-                "success":      true,
-                "order_id":     orderID,
-                "order_number": orderNumber,
+                "success":       true,
+                "order_id":      orderID,
+                "order_number":  orderNumber,
+                "guest":         guest,
+                "payments":      payments,
+                "currency":      currency.Code,
+                "charged_total": currency.convert(quote.Total),
         })
 }
 
 func handleOrders(w http.ResponseWriter, r *http.Request) {
-        user, err := getCurrentUser(r)
+        user, err := getAccountUser(r)
         if err != nil {
                 http.Error(w, "Unauthorized", http.StatusUnauthorized)
                 return
@@ -767,66 +1322,95 @@ func handleOrders(w http.ResponseWriter, r *http.Request) {
 }
 
 func handleOrderDetail(w http.ResponseWriter, r *http.Request) {
-        user, err := getCurrentUser(r)
+        user, err := getAccountUser(r)
         if err != nil {
                 http.Error(w, "Unauthorized", http.StatusUnauthorized)
                 return
         }
 
-        idStr := strings.TrimPrefix(r.URL.Path, "/api/orders/")
+        idStr, invoice := strings.CutSuffix(strings.TrimPrefix(r.URL.Path, "/api/orders/"), "/invoice.pdf")
         id, err := strconv.Atoi(idStr)
         if err != nil {
                 http.Error(w, "Invalid order ID", http.StatusBadRequest)
                 return
         }
 
-        var order Order
-        order.ShippingAddress = &Address{}
-        err = db.QueryRow(`SELECT o.id, o.order_number, o.total_amount, o.status, o.created_at, o.shipping_address_id,
-                                  a.full_name, a.phone, a.address_line1, a.address_line2, a.city, a.state, a.postal_code, a.country
-                           FROM orders o
-                           LEFT JOIN addresses a ON o.shipping_address_id = a.id
-                           WHERE o.id = $1 AND o.user_id = $2`, id, user.ID).
-                Scan(&order.ID, &order.OrderNumber, &order.TotalAmount, &order.Status, &order.CreatedAt, &order.ShippingAddressID,
-                        &order.ShippingAddress.FullName, &order.ShippingAddress.Phone, &order.ShippingAddress.AddressLine1,
-                        &order.ShippingAddress.AddressLine2, &order.ShippingAddress.City, &order.ShippingAddress.State,
-                        &order.ShippingAddress.PostalCode, &order.ShippingAddress.Country)
-
-        if err != nil {
+        order, err := loadOrder("id = $1 AND user_id = $2", id, user.ID)
+        if err == sql.ErrNoRows {
                 http.Error(w, "Order not found", http.StatusNotFound)
                 return
         }
+        if err != nil {
+                http.Error(w, "Server error", http.StatusInternalServerError)
+                return
+        }
 
-        rows, err := db.Query(`SELECT oi.id, oi.book_id, oi.quantity, oi.price_at_purchase, oi.subtotal,
-                                      b.title, b.author
-                               FROM order_items oi
-                               JOIN books b ON oi.book_id = b.id
-                               WHERE oi.order_id = $1`, order.ID)
-        if err == nil {
-                defer rows.Close()
-                for rows.Next() {
-                        var item OrderItem
-                        rows.Scan(&item.ID, &item.BookID, &item.Quantity, &item.PriceAtPurchase, &item.Subtotal,
-                                &item.BookTitle, &item.BookAuthor)
-                        order.Items = append(order.Items, item)
-                }
+        if invoice {
+                writeInvoice(w, order)
+                return
         }
 
         w.Header().Set("Content-Type", "application/json")
         json.NewEncoder(w).Encode(order)
 }
 
-func handleAdminBooks(w http.ResponseWriter, r *http.Request) {
-        user, err := getCurrentUser(r)
-        if err != nil || !user.IsAdmin {
-                http.Error(w, "Forbidden", http.StatusForbidden)
-                return
+// loadOrder returns the single order matching where, with its items and
+// shipping address.
+func loadOrder(where string, args ...interface{}) (*Order, error) {
+        var order Order
+        var shippingAddress []byte
+        err := db.QueryRow(`SELECT id, order_number, total_amount, COALESCE(shipping_method, ''), shipping_amount,
+                                   tax_amount, prices_include_tax, currency, exchange_rate, status, created_at,
+                                   COALESCE(shipping_address_id, 0), COALESCE(shipping_address, '{}')
+                            FROM orders
+                            WHERE `+where, args...).
+                Scan(&order.ID, &order.OrderNumber, &order.TotalAmount, &order.ShippingMethod, &order.ShippingAmount,
+                        &order.TaxAmount, &order.PricesIncludeTax, &order.Currency, &order.ExchangeRate, &order.Status,
+                        &order.CreatedAt, &order.ShippingAddressID, &shippingAddress)
+        if err != nil {
+                return nil, err
+        }
+
+        order.ShippingAddress = &Address{}
+        json.Unmarshal(shippingAddress, order.ShippingAddress)
+
+        rows, err := db.Query(`SELECT oi.id, COALESCE(oi.book_id, 0), oi.quantity, oi.price_at_purchase, oi.subtotal,
+                                      oi.discount_amount, oi.tax_rate, oi.tax_amount,
+                                      COALESCE(oi.book_title, b.title, ''), COALESCE(oi.book_author, b.author, '')
+                               FROM order_items oi
+                               LEFT JOIN books b ON oi.book_id = b.id
+                               WHERE oi.order_id = $1
+                               ORDER BY oi.id`, order.ID)
+        if err != nil {
+                return nil, err
+        }
+        defer rows.Close()
+        for rows.Next() {
+                var item OrderItem
+                rows.Scan(&item.ID, &item.BookID, &item.Quantity, &item.PriceAtPurchase, &item.Subtotal,
+                        &item.DiscountAmount, &item.TaxRate, &item.TaxAmount, &item.BookTitle, &item.BookAuthor)
+                item.OrderID = order.ID
+                order.Items = append(order.Items, item)
+        }
+
+        order.Discounts, err = loadOrderDiscounts(order.ID)
+        if err != nil {
+                return nil, err
+        }
+        order.Payments, err = loadOrderPayments(order.ID)
+        if err != nil {
+                return nil, err
         }
 
+        return &order, nil
+}
+
+func handleAdminBooks(w http.ResponseWriter, r *http.Request) {
         switch r.Method {
         case http.MethodGet:
                 rows, err := db.Query(`SELECT b.id, b.title, b.author, b.description, b.price, b.stock_quantity, 
-                                              b.category_id, c.name as category_name, b.cover_image_url, b.isbn, b.publication_year
+                                              b.category_id, c.name as category_name, b.cover_image_url, b.isbn, b.publication_year,
+                                              b.max_per_customer, b.tax_class, b.weight_grams, b.gift_card
                                        FROM books b
                                        LEFT JOIN categories c ON b.category_id = c.id
                                        ORDER BY b.created_at DESC`)
@@ -842,7 +1426,7 @@ func handleAdminBooks(w http.ResponseWriter, r *http.Request) {
                         var categoryName *string
                         rows.Scan(&book.ID, &book.Title, &book.Author, &book.Description, &book.Price,
                                 &book.StockQuantity, &book.CategoryID, &categoryName, &book.CoverImageURL,
-                                &book.ISBN, &book.PublicationYear)
+                                &book.ISBN, &book.PublicationYear, &book.MaxPerCustomer, &book.TaxClass, &book.WeightGrams, &book.GiftCard)
                         if categoryName != nil {
                                 book.CategoryName = *categoryName
                         }
@@ -859,12 +1443,35 @@ func handleAdminBooks(w http.ResponseWriter, r *http.Request) {
                         return
                 }
 
+                if book.TaxClass == "" {
+                        book.TaxClass = taxClassBooks
+                }
+                if !validTaxClass(book.TaxClass) {
+                        http.Error(w, "Tax class must be standard, books or ebooks", http.StatusBadRequest)
+                        return
+                }
+
+                tx, err := db.Begin()
+                if err != nil {
+                        http.Error(w, "Server error", http.StatusInternalServerError)
+                        return
+                }
+                defer tx.Rollback()
+
                 var bookID int
-                err = db.QueryRow(`INSERT INTO books (title, author, description, price, stock_quantity, category_id, cover_image_url, isbn, publication_year)
-                                   VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9) RETURNING id`,
+                err = tx.QueryRow(`INSERT INTO books (title, author, description, price, stock_quantity, category_id, cover_image_url, isbn, publication_year, max_per_customer, tax_class, weight_grams, gift_card)
+                                   VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13) RETURNING id`,
                         book.Title, book.Author, book.Description, book.Price, book.StockQuantity,
-                        book.CategoryID, book.CoverImageURL, book.ISBN, book.PublicationYear).Scan(&bookID)
+                        book.CategoryID, book.CoverImageURL, book.ISBN, book.PublicationYear, book.MaxPerCustomer, book.TaxClass,
+                        book.WeightGrams, book.GiftCard).Scan(&bookID)
 
+                if err == nil {
+                        book.ID = bookID
+                        err = recordEvent(tx, eventBookCreated, book)
+                }
+                if err == nil {
+                        err = tx.Commit()
+                }
                 if err != nil {
                         http.Error(w, "Server error", http.StatusInternalServerError)
                         return
@@ -879,12 +1486,6 @@ func handleAdminBooks(w http.ResponseWriter, r *http.Request) {
 }
 
 func handleAdminBookDetail(w http.ResponseWriter, r *http.Request) {
-        user, err := getCurrentUser(r)
-        if err != nil || !user.IsAdmin {
-                http.Error(w, "Forbidden", http.StatusForbidden)
-                return
-        }
-
         idStr := strings.TrimPrefix(r.URL.Path, "/api/admin/books/")
         id, err := strconv.Atoi(idStr)
         if err != nil {
@@ -900,11 +1501,48 @@ func handleAdminBookDetail(w http.ResponseWriter, r *http.Request) {
                         return
                 }
 
-                _, err = db.Exec(`UPDATE books SET title=$1, author=$2, description=$3, price=$4, stock_quantity=$5, 
-                                  category_id=$6, cover_image_url=$7, isbn=$8, publication_year=$9 WHERE id=$10`,
+                if book.TaxClass == "" {
+                        book.TaxClass = taxClassBooks
+                }
+                if !validTaxClass(book.TaxClass) {
+                        http.Error(w, "Tax class must be standard, books or ebooks", http.StatusBadRequest)
+                        return
+                }
+
+                tx, err := db.Begin()
+                if err != nil {
+                        http.Error(w, "Server error", http.StatusInternalServerError)
+                        return
+                }
+                defer tx.Rollback()
+
+                var oldStock int
+                err = tx.QueryRow("SELECT stock_quantity FROM books WHERE id = $1 FOR UPDATE", id).Scan(&oldStock)
+                if err == sql.ErrNoRows {
+                        http.Error(w, "Book not found", http.StatusNotFound)
+                        return
+                }
+                if err != nil {
+                        http.Error(w, "Server error", http.StatusInternalServerError)
+                        return
+                }
+
+                _, err = tx.Exec(`UPDATE books SET title=$1, author=$2, description=$3, price=$4, stock_quantity=$5, 
+                                  category_id=$6, cover_image_url=$7, isbn=$8, publication_year=$9, max_per_customer=$10, tax_class=$11, weight_grams=$12, gift_card=$13 WHERE id=$14`,
                         book.Title, book.Author, book.Description, book.Price, book.StockQuantity,
-                        book.CategoryID, book.CoverImageURL, book.ISBN, book.PublicationYear, id)
+                        book.CategoryID, book.CoverImageURL, book.ISBN, book.PublicationYear, book.MaxPerCustomer, book.TaxClass,
+                        book.WeightGrams, book.GiftCard, id)
 
+                if err == nil {
+                        book.ID = id
+                        err = recordEvent(tx, eventBookUpdated, book)
+                }
+                if err == nil && book.StockQuantity != oldStock {
+                        err = recordStockChange(tx, id, book.StockQuantity, book.StockQuantity-oldStock)
+                }
+                if err == nil {
+                        err = tx.Commit()
+                }
                 if err != nil {
                         http.Error(w, "Server error", http.StatusInternalServerError)
                         return
@@ -914,7 +1552,24 @@ func handleAdminBookDetail(w http.ResponseWriter, r *http.Request) {
                 json.NewEncoder(w).Encode(map[string]bool{"success": true})
 
         case http.MethodDelete:
-                _, err = db.Exec("DELETE FROM books WHERE id = $1", id)
+                tx, err := db.Begin()
+                if err != nil {
+                        http.Error(w, "Server error", http.StatusInternalServerError)
+                        return
+                }
+                defer tx.Rollback()
+
+                res, err := tx.Exec("DELETE FROM books WHERE id = $1", id)
+                if err != nil {
+                        http.Error(w, "Server error", http.StatusInternalServerError)
+                        return
+                }
+                if n, _ := res.RowsAffected(); n > 0 {
+                        err = recordEvent(tx, eventBookDeleted, map[string]int{"book_id": id})
+                }
+                if err == nil {
+                        err = tx.Commit()
+                }
                 if err != nil {
                         http.Error(w, "Server error", http.StatusInternalServerError)
                         return
@@ -926,16 +1581,10 @@ func handleAdminBookDetail(w http.ResponseWriter, r *http.Request) {
 }
 
 func handleAdminOrders(w http.ResponseWriter, r *http.Request) {
-        user, err := getCurrentUser(r)
-        if err != nil || !user.IsAdmin {
-                http.Error(w, "Forbidden", http.StatusForbidden)
-                return
-        }
-
-        rows, err := db.Query(`SELECT o.id, o.user_id, o.order_number, o.total_amount, o.status, o.created_at,
-                                      u.full_name, u.email
+        rows, err := db.Query(`SELECT o.id, COALESCE(o.user_id, 0), o.order_number, o.total_amount, o.status, o.created_at,
+                                      COALESCE(u.full_name, 'Guest'), COALESCE(u.email, o.guest_email, '')
                                FROM orders o
-                               JOIN users u ON o.user_id = u.id
+                               LEFT JOIN users u ON o.user_id = u.id
                                ORDER BY o.created_at DESC`)
         if err != nil {
                 http.Error(w, "Server error", http.StatusInternalServerError)
@@ -961,22 +1610,21 @@ func handleAdminOrders(w http.ResponseWriter, r *http.Request) {
         json.NewEncoder(w).Encode(orders)
 }
 
+// handleAdminOrderUpdate serves PUT /api/admin/orders/{id} and
+// GET /api/admin/orders/{id}/invoice.pdf.
 func handleAdminOrderUpdate(w http.ResponseWriter, r *http.Request) {
-        if r.Method != http.MethodPut {
-                http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+        idStr, invoice := strings.CutSuffix(strings.TrimPrefix(r.URL.Path, "/api/admin/orders/"), "/invoice.pdf")
+        id, err := strconv.Atoi(idStr)
+        if err != nil {
+                http.Error(w, "Invalid order ID", http.StatusBadRequest)
                 return
         }
-
-        user, err := getCurrentUser(r)
-        if err != nil || !user.IsAdmin {
-                http.Error(w, "Forbidden", http.StatusForbidden)
+        if invoice != (r.Method == http.MethodGet) {
+                http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
                 return
         }
-
-        idStr := strings.TrimPrefix(r.URL.Path, "/api/admin/orders/")
-        id, err := strconv.Atoi(idStr)
-        if err != nil {
-                http.Error(w, "Invalid order ID", http.StatusBadRequest)
+        if invoice {
+                handleAdminOrderInvoice(w, r, id)
                 return
         }
 
@@ -989,7 +1637,29 @@ func handleAdminOrderUpdate(w http.ResponseWriter, r *http.Request) {
                 return
         }
 
-        _, err = db.Exec("UPDATE orders SET status = $1, updated_at = CURRENT_TIMESTAMP WHERE id = $2",
+        tx, err := db.Begin()
+        if err != nil {
+                http.Error(w, "Server error", http.StatusInternalServerError)
+                return
+        }
+        defer tx.Rollback()
+
+        var oldStatus, orderNumber, name, email string
+        var userID sql.NullInt64
+        err = tx.QueryRow(`SELECT o.status, o.order_number, o.user_id, COALESCE(u.full_name, o.shipping_address->>'full_name', ''),
+                                  COALESCE(u.email, o.guest_email, '')
+                           FROM orders o LEFT JOIN users u ON u.id = o.user_id
+                           WHERE o.id = $1 FOR UPDATE OF o`, id).Scan(&oldStatus, &orderNumber, &userID, &name, &email)
+        if err == sql.ErrNoRows {
+                http.Error(w, "Order not found", http.StatusNotFound)
+                return
+        }
+        if err != nil {
+                http.Error(w, "Server error", http.StatusInternalServerError)
+                return
+        }
+
+        _, err = tx.Exec("UPDATE orders SET status = $1, updated_at = CURRENT_TIMESTAMP WHERE id = $2",
                 req.Status, id)
 
         if err != nil {
@@ -997,6 +1667,37 @@ func handleAdminOrderUpdate(w http.ResponseWriter, r *http.Request) {
                 return
         }
 
+        if req.Status != oldStatus {
+                change := map[string]interface{}{"order_id": id, "order_number": orderNumber, "from": oldStatus, "to": req.Status}
+                err := recordEvent(tx, eventOrderStatusChanged, change)
+                if err == nil && req.Status == "shipped" {
+                        err = recordEvent(tx, eventOrderShipped, map[string]interface{}{"order_id": id, "order_number": orderNumber})
+                }
+                if err != nil {
+                        http.Error(w, "Server error", http.StatusInternalServerError)
+                        return
+                }
+        }
+
+        // Guests have no account to link to; their confirmation email has
+        // the lookup link.
+        if req.Status != oldStatus && email != "" {
+                update := notice{Name: name, OrderNumber: orderNumber, Status: req.Status}
+                if userID.Valid {
+                        update.Link = appBaseURL(r) + "/customer/orders"
+                        update.PreferencesURL = appBaseURL(r) + "/customer/dashboard"
+                }
+                if err := notify(tx, "order_status", int(userID.Int64), email, update); err != nil {
+                        http.Error(w, "Server error", http.StatusInternalServerError)
+                        return
+                }
+        }
+
+        if err = tx.Commit(); err != nil {
+                http.Error(w, "Server error", http.StatusInternalServerError)
+                return
+        }
+
         w.Header().Set("Content-Type", "application/json")
         json.NewEncoder(w).Encode(map[string]bool{"success": true})
 }
@@ -1017,6 +1718,10 @@ func serveRegister(w http.ResponseWriter, r *http.Request) {
         http.ServeFile(w, r, "static/register.html")
 }
 
+func serveResetPassword(w http.ResponseWriter, r *http.Request) {
+        http.ServeFile(w, r, "static/reset-password.html")
+}
+
 func serveBooks(w http.ResponseWriter, r *http.Request) {
         http.ServeFile(w, r, "static/books.html")
 }
@@ -1041,6 +1746,14 @@ func serveCustomerOrders(w http.ResponseWriter, r *http.Request) {
         http.ServeFile(w, r, "static/customer-orders.html")
 }
 
+func serveUnsubscribe(w http.ResponseWriter, r *http.Request) {
+        http.ServeFile(w, r, "static/unsubscribe.html")
+}
+
+func serveOrderLookup(w http.ResponseWriter, r *http.Request) {
+        http.ServeFile(w, r, "static/order-lookup.html")
+}
+
 func serveAdminDashboard(w http.ResponseWriter, r *http.Request) {
         http.ServeFile(w, r, "static/admin-dashboard.html")
 }
@@ -0,0 +1,211 @@
+package main
+
+import (
+        "bytes"
+        "database/sql"
+        "embed"
+        "encoding/json"
+        htmltemplate "html/template"
+        "net/http"
+        "strings"
+        texttemplate "text/template"
+)
+
+// Notification preference categories. Mail a customer can't do without
+// (order confirmations, security notices) has no category and is always
+// sent.
+const (
+        notifyOrderUpdates  = "order_updates"
+        notifyCartReminders = "cart_reminders"
+)
+
+var notificationCategories = []string{notifyOrderUpdates, notifyCartReminders}
+
+// notificationKinds lists every templated email and the preference that
+// governs it, if any. Each has templates/email/<kind>.txt, defining
+// "subject" and "body", and <kind>.html, defining "content" for the layout.
+var notificationKinds = map[string]string{
+        "welcome":       "",
+        "order_placed":  "",
+        "order_status":  notifyOrderUpdates,
+        "cart_reminder": notifyCartReminders,
+}
+
+//go:embed templates/email
+var emailTemplateFS embed.FS
+
+type emailTemplate struct {
+        text *texttemplate.Template
+        html *htmltemplate.Template
+}
+
+var emailTemplates = parseEmailTemplates()
+
+func parseEmailTemplates() map[string]emailTemplate {
+        templates := map[string]emailTemplate{}
+        for kind := range notificationKinds {
+                templates[kind] = emailTemplate{
+                        text: texttemplate.Must(texttemplate.ParseFS(emailTemplateFS, "templates/email/"+kind+".txt")),
+                        html: htmltemplate.Must(htmltemplate.ParseFS(emailTemplateFS,
+                                "templates/email/layout.html", "templates/email/"+kind+".html")),
+                }
+        }
+        return templates
+}
+
+// notice is what notification templates are rendered with. Not every
+// template uses every field.
+type notice struct {
+        Name           string
+        Link           string
+        PreferencesURL string
+        OrderNumber    string
+        Status         string
+        Total          string
+        Guest          bool
+        Lines          []noticeLine
+        Coupon         string
+        CouponDiscount string
+        CouponExpires  string
+        UnsubscribeURL string
+
+        // listUnsubscribe is the one-click unsubscribe URL for the
+        // List-Unsubscribe header.
+        listUnsubscribe string
+}
+
+type noticeLine struct {
+        Title    string
+        Quantity int
+        Amount   string
+}
+
+// notificationEnabled reports whether userID wants mail of category. Every
+// category is on until the customer turns it off.
+func notificationEnabled(q queryer, userID int, category string) (bool, error) {
+        if category == "" || userID == 0 {
+                return true, nil
+        }
+        enabled := true
+        err := q.QueryRow("SELECT enabled FROM notification_preferences WHERE user_id = $1 AND category = $2",
+                userID, category).Scan(&enabled)
+        if err != nil && err != sql.ErrNoRows {
+                return false, err
+        }
+        return enabled, nil
+}
+
+// notify renders the kind of email for data and queues it to to, unless
+// userID (0 for guests) has turned off its category. Pass the transaction
+// the triggering change is made in, so the mail is queued only if that
+// change commits.
+func notify(q queryer, kind string, userID int, to string, data notice) error {
+        enabled, err := notificationEnabled(q, userID, notificationKinds[kind])
+        if err != nil || !enabled {
+                return err
+        }
+
+        t := emailTemplates[kind]
+        var subject, text, html bytes.Buffer
+        if err := t.text.ExecuteTemplate(&subject, "subject", data); err != nil {
+                return err
+        }
+        if err := t.text.ExecuteTemplate(&text, "body", data); err != nil {
+                return err
+        }
+        if err := t.html.ExecuteTemplate(&html, "layout", data); err != nil {
+                return err
+        }
+        return queueMail(q, Message{
+                To:      to,
+                Subject: strings.TrimSpace(subject.String()),
+                Text:    strings.TrimLeft(text.String(), "\n"),
+                HTML:    html.String(),
+
+                ListUnsubscribe: data.listUnsubscribe,
+        })
+}
+
+// queueMail queues msg as a send_mail job, so a mail outage only delays
+// mail instead of failing the request that sent it.
+func queueMail(q queryer, msg Message) error {
+        return enqueueJob(q, "send_mail", msg)
+}
+
+// handleNotificationPreferences serves GET and PUT /api/me/notifications, a
+// map of category to whether the customer gets that mail.
+func handleNotificationPreferences(w http.ResponseWriter, r *http.Request) {
+        user, err := getAccountUser(r)
+        if err != nil {
+                http.Error(w, "Unauthorized", http.StatusUnauthorized)
+                return
+        }
+
+        switch r.Method {
+        case http.MethodGet:
+        case http.MethodPut:
+                var req map[string]bool
+                if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+                        http.Error(w, "Invalid request", http.StatusBadRequest)
+                        return
+                }
+                for category := range req {
+                        if !validNotificationCategory(category) {
+                                http.Error(w, "Unknown notification category "+category, http.StatusBadRequest)
+                                return
+                        }
+                }
+                for category, enabled := range req {
+                        _, err := db.Exec(`INSERT INTO notification_preferences (user_id, category, enabled) VALUES ($1, $2, $3)
+                                           ON CONFLICT (user_id, category) DO UPDATE SET enabled = EXCLUDED.enabled`,
+                                user.ID, category, enabled)
+                        if err != nil {
+                                http.Error(w, "Server error", http.StatusInternalServerError)
+                                return
+                        }
+                }
+        default:
+                http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+                return
+        }
+
+        prefs, err := loadNotificationPreferences(user.ID)
+        if err != nil {
+                http.Error(w, "Server error", http.StatusInternalServerError)
+                return
+        }
+        w.Header().Set("Content-Type", "application/json")
+        json.NewEncoder(w).Encode(prefs)
+}
+
+func validNotificationCategory(category string) bool {
+        for _, c := range notificationCategories {
+                if c == category {
+                        return true
+                }
+        }
+        return false
+}
+
+func loadNotificationPreferences(userID int) (map[string]bool, error) {
+        prefs := map[string]bool{}
+        for _, category := range notificationCategories {
+                prefs[category] = true
+        }
+        rows, err := db.Query("SELECT category, enabled FROM notification_preferences WHERE user_id = $1", userID)
+        if err != nil {
+                return nil, err
+        }
+        defer rows.Close()
+        for rows.Next() {
+                var category string
+                var enabled bool
+                if err := rows.Scan(&category, &enabled); err != nil {
+                        return nil, err
+                }
+                if validNotificationCategory(category) {
+                        prefs[category] = enabled
+                }
+        }
+        return prefs, rows.Err()
+}
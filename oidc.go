@@ -0,0 +1,365 @@
+package main
+
+import (
+        "context"
+        "database/sql"
+        "encoding/json"
+        "errors"
+        "fmt"
+        "log"
+        "net/http"
+        "os"
+        "strings"
+        "sync"
+        "time"
+
+        "github.com/coreos/go-oidc/v3/oidc"
+        "golang.org/x/oauth2"
+)
+
+// OIDCConfig is read from the environment. SSO is disabled unless
+// OIDC_ISSUER_URL is set. The issuer may be a plain http://localhost URL, so
+// the flow can be exercised against a local mock provider.
+type OIDCConfig struct {
+        IssuerURL    string
+        ClientID     string
+        ClientSecret string
+        RedirectURL  string
+        Scopes       []string
+        GroupsClaim  string
+        // RoleMap maps an IdP group to a role name. Roles that appear here are
+        // managed by the IdP and are synced on every SSO login.
+        RoleMap     map[string]string
+        AllowSignup bool
+}
+
+type oidcClient struct {
+        config   OIDCConfig
+        provider *oidc.Provider
+        oauth    oauth2.Config
+        verifier *oidc.IDTokenVerifier
+}
+
+var (
+        oidcConfig *OIDCConfig
+        oidcMu     sync.Mutex
+        oidcCached *oidcClient
+
+        errSignupDisabled = errors.New("signup disabled")
+)
+
+func loadOIDCConfig() (*OIDCConfig, error) {
+        issuer := os.Getenv("OIDC_ISSUER_URL")
+        if issuer == "" {
+                return nil, nil
+        }
+
+        cfg := &OIDCConfig{
+                IssuerURL:    issuer,
+                ClientID:     os.Getenv("OIDC_CLIENT_ID"),
+                ClientSecret: os.Getenv("OIDC_CLIENT_SECRET"),
+                RedirectURL:  os.Getenv("OIDC_REDIRECT_URL"),
+                Scopes:       []string{oidc.ScopeOpenID, "email", "profile"},
+                GroupsClaim:  "groups",
+                RoleMap:      map[string]string{},
+                AllowSignup:  os.Getenv("OIDC_ALLOW_SIGNUP") != "false",
+        }
+        if cfg.ClientID == "" || cfg.RedirectURL == "" {
+                return nil, fmt.Errorf("OIDC_CLIENT_ID and OIDC_REDIRECT_URL are required when OIDC_ISSUER_URL is set")
+        }
+        if scopes := os.Getenv("OIDC_SCOPES"); scopes != "" {
+                cfg.Scopes = strings.Fields(scopes)
+        }
+        if claim := os.Getenv("OIDC_GROUPS_CLAIM"); claim != "" {
+                cfg.GroupsClaim = claim
+        }
+
+        // OIDC_ROLE_MAP="bookstore-admins=superadmin,warehouse=order_fulfilment"
+        if roleMap := os.Getenv("OIDC_ROLE_MAP"); roleMap != "" {
+                for _, entry := range strings.Split(roleMap, ",") {
+                        group, role, ok := strings.Cut(strings.TrimSpace(entry), "=")
+                        if !ok || group == "" || role == "" {
+                                return nil, fmt.Errorf("invalid OIDC_ROLE_MAP entry %q", entry)
+                        }
+                        cfg.RoleMap[group] = role
+                }
+        }
+
+        return cfg, nil
+}
+
+// getOIDCClient discovers the provider on first use rather than at startup,
+// so an unreachable IdP doesn't stop the shop from booting.
+func getOIDCClient(ctx context.Context) (*oidcClient, error) {
+        oidcMu.Lock()
+        defer oidcMu.Unlock()
+
+        if oidcCached != nil {
+                return oidcCached, nil
+        }
+
+        provider, err := oidc.NewProvider(ctx, oidcConfig.IssuerURL)
+        if err != nil {
+                return nil, err
+        }
+
+        oidcCached = &oidcClient{
+                config:   *oidcConfig,
+                provider: provider,
+                oauth: oauth2.Config{
+                        ClientID:     oidcConfig.ClientID,
+                        ClientSecret: oidcConfig.ClientSecret,
+                        RedirectURL:  oidcConfig.RedirectURL,
+                        Endpoint:     provider.Endpoint(),
+                        Scopes:       oidcConfig.Scopes,
+                },
+                verifier: provider.Verifier(&oidc.Config{ClientID: oidcConfig.ClientID}),
+        }
+        return oidcCached, nil
+}
+
+func handleAuthConfig(w http.ResponseWriter, r *http.Request) {
+        w.Header().Set("Content-Type", "application/json")
+        json.NewEncoder(w).Encode(map[string]bool{
+                "oidc_enabled": oidcConfig != nil,
+        })
+}
+
+func handleOIDCStart(w http.ResponseWriter, r *http.Request) {
+        if oidcConfig == nil {
+                http.NotFound(w, r)
+                return
+        }
+
+        client, err := getOIDCClient(r.Context())
+        if err != nil {
+                log.Println("OIDC discovery failed:", err)
+                http.Error(w, "Single sign-on is unavailable", http.StatusBadGateway)
+                return
+        }
+
+        state := newSessionToken()
+        nonce := newSessionToken()
+        verifier := oauth2.GenerateVerifier()
+
+        session, _ := getSession(r)
+        session.Values["oidc_state"] = state
+        session.Values["oidc_nonce"] = nonce
+        session.Values["oidc_verifier"] = verifier
+        session.Values["oidc_started"] = time.Now().Unix()
+        if err := session.Save(r, w); err != nil {
+                http.Error(w, "Server error", http.StatusInternalServerError)
+                return
+        }
+
+        http.Redirect(w, r, client.oauth.AuthCodeURL(state, oidc.Nonce(nonce), oauth2.S256ChallengeOption(verifier)), http.StatusFound)
+}
+
+func handleOIDCCallback(w http.ResponseWriter, r *http.Request) {
+        if oidcConfig == nil {
+                http.NotFound(w, r)
+                return
+        }
+
+        client, err := getOIDCClient(r.Context())
+        if err != nil {
+                log.Println("OIDC discovery failed:", err)
+                http.Error(w, "Single sign-on is unavailable", http.StatusBadGateway)
+                return
+        }
+
+        session, _ := getSession(r)
+        state, _ := session.Values["oidc_state"].(string)
+        nonce, _ := session.Values["oidc_nonce"].(string)
+        verifier, _ := session.Values["oidc_verifier"].(string)
+        started, _ := session.Values["oidc_started"].(int64)
+        delete(session.Values, "oidc_state")
+        delete(session.Values, "oidc_nonce")
+        delete(session.Values, "oidc_verifier")
+        delete(session.Values, "oidc_started")
+
+        if state == "" || r.URL.Query().Get("state") != state || time.Since(time.Unix(started, 0)) > 10*time.Minute {
+                http.Error(w, "Invalid or expired login attempt", http.StatusBadRequest)
+                return
+        }
+        if errCode := r.URL.Query().Get("error"); errCode != "" {
+                http.Error(w, "Sign-in was rejected by the identity provider: "+errCode, http.StatusUnauthorized)
+                return
+        }
+
+        token, err := client.oauth.Exchange(r.Context(), r.URL.Query().Get("code"), oauth2.VerifierOption(verifier))
+        if err != nil {
+                log.Println("OIDC code exchange failed:", err)
+                http.Error(w, "Sign-in failed", http.StatusUnauthorized)
+                return
+        }
+
+        rawIDToken, ok := token.Extra("id_token").(string)
+        if !ok {
+                http.Error(w, "Sign-in failed", http.StatusUnauthorized)
+                return
+        }
+
+        idToken, err := client.verifier.Verify(r.Context(), rawIDToken)
+        if err != nil || idToken.Nonce != nonce {
+                log.Println("OIDC ID token rejected:", err)
+                http.Error(w, "Sign-in failed", http.StatusUnauthorized)
+                return
+        }
+
+        var claims map[string]interface{}
+        if err := idToken.Claims(&claims); err != nil {
+                http.Error(w, "Sign-in failed", http.StatusUnauthorized)
+                return
+        }
+
+        email, _ := claims["email"].(string)
+        // Some providers send email_verified as the string "true".
+        verified := claims["email_verified"] == true || claims["email_verified"] == "true"
+        if email == "" || !verified {
+                http.Error(w, "Your identity provider did not supply a verified email address", http.StatusForbidden)
+                return
+        }
+        name, _ := claims["name"].(string)
+
+        userID, err := linkOIDCUser(client.config, idToken.Issuer, idToken.Subject, email, name, appBaseURL(r))
+        if err == errSignupDisabled {
+                http.Error(w, "No account exists for "+email, http.StatusForbidden)
+                return
+        }
+        if err != nil {
+                log.Println("OIDC account linking failed:", err)
+                http.Error(w, "Server error", http.StatusInternalServerError)
+                return
+        }
+
+        if len(client.config.RoleMap) > 0 {
+                if err := syncOIDCRoles(client.config, userID, claimStrings(claims[client.config.GroupsClaim])); err != nil {
+                        log.Println("OIDC role sync failed:", err)
+                }
+        }
+
+        user, err := loadUser(userID)
+        if err == errAccountDisabled {
+                http.Error(w, "This account has been disabled", http.StatusForbidden)
+                return
+        }
+        if err != nil {
+                http.Error(w, "Server error", http.StatusInternalServerError)
+                return
+        }
+
+        store.Renew(session)
+
+        if user.TOTPEnabled {
+                session.Values["mfa_user_id"] = user.ID
+                session.Values["mfa_started"] = time.Now().Unix()
+                session.Save(r, w)
+                http.Redirect(w, r, "/login?mfa=required", http.StatusFound)
+                return
+        }
+
+        session.Values["user_id"] = user.ID
+        mergeGuestCart(session, user.ID)
+        session.Save(r, w)
+
+        if user.IsAdmin {
+                http.Redirect(w, r, "/admin", http.StatusFound)
+                return
+        }
+        http.Redirect(w, r, "/", http.StatusFound)
+}
+
+// linkOIDCUser finds the user for an IdP identity: first by (issuer, subject),
+// then by verified email, creating the account if signup is allowed. baseURL
+// is for the links in a new account's welcome email.
+func linkOIDCUser(cfg OIDCConfig, issuer, subject, email, name, baseURL string) (int, error) {
+        tx, err := db.Begin()
+        if err != nil {
+                return 0, err
+        }
+        defer tx.Rollback()
+
+        var userID int
+        err = tx.QueryRow("SELECT user_id FROM user_identities WHERE issuer = $1 AND subject = $2", issuer, subject).Scan(&userID)
+        if err == nil {
+                tx.Exec("UPDATE user_identities SET last_login_at = now() WHERE issuer = $1 AND subject = $2", issuer, subject)
+                return userID, tx.Commit()
+        }
+        if err != sql.ErrNoRows {
+                return 0, err
+        }
+
+        err = tx.QueryRow("SELECT id FROM users WHERE LOWER(email) = LOWER($1)", email).Scan(&userID)
+        if err == sql.ErrNoRows {
+                if !cfg.AllowSignup {
+                        return 0, errSignupDisabled
+                }
+                // SSO-only accounts get a password hash that can never match.
+                err = tx.QueryRow("INSERT INTO users (email, password_hash, full_name) VALUES ($1, '!', $2) RETURNING id",
+                        email, name).Scan(&userID)
+                if err == nil {
+                        err = notify(tx, "welcome", userID, email, notice{Name: name, Link: baseURL + "/books"})
+                }
+        }
+        if err != nil {
+                return 0, err
+        }
+
+        _, err = tx.Exec(`INSERT INTO user_identities (user_id, issuer, subject, email, last_login_at)
+                          VALUES ($1, $2, $3, $4, now())`, userID, issuer, subject, email)
+        if err != nil {
+                return 0, err
+        }
+
+        return userID, tx.Commit()
+}
+
+// syncOIDCRoles grants the roles mapped from the user's groups and removes
+// other IdP-managed roles. Roles outside the map are left alone.
+func syncOIDCRoles(cfg OIDCConfig, userID int, groups []string) error {
+        managed := map[string]bool{}
+        for _, role := range cfg.RoleMap {
+                managed[role] = true
+        }
+
+        granted := map[string]bool{}
+        for _, group := range groups {
+                if role, ok := cfg.RoleMap[group]; ok {
+                        granted[role] = true
+                }
+        }
+
+        current := User{ID: userID}
+        if err := loadUserRoles(&current); err != nil {
+                return err
+        }
+
+        var roles []string
+        for _, role := range current.Roles {
+                if !managed[role] {
+                        roles = append(roles, role)
+                }
+        }
+        for role := range granted {
+                roles = append(roles, role)
+        }
+
+        return setUserRoles(userID, roles)
+}
+
+func claimStrings(v interface{}) []string {
+        switch v := v.(type) {
+        case string:
+                return []string{v}
+        case []interface{}:
+                var out []string
+                for _, item := range v {
+                        if s, ok := item.(string); ok {
+                                out = append(out, s)
+                        }
+                }
+                return out
+        }
+        return nil
+}
@@ -0,0 +1,145 @@
+package main
+
+import (
+        "database/sql"
+        "fmt"
+        "math"
+)
+
+// Tenders an order can be paid with. The gateway pays whatever gift cards
+// and store credit don't cover.
+const (
+        tenderGiftCard    = "gift_card"
+        tenderStoreCredit = "store_credit"
+        tenderGateway     = "gateway"
+)
+
+type Payment struct {
+        Tender        string  `json:"tender"`
+        Amount        float64 `json:"amount"`
+        GiftCardLast4 string  `json:"gift_card_last4,omitempty"`
+}
+
+// payOrder splits total over the given gift cards in turn, then the user's
+// store credit when useStoreCredit is set, then the gateway, and records each
+// tender on the order. Gift card balances and store credit are debited in tx.
+// Problems with a card are returned as a cartError.
+func payOrder(tx *sql.Tx, orderID int, total float64, giftCardCodes []string, userID int, useStoreCredit bool) ([]Payment, error) {
+        var cards []GiftCard
+        var balances []float64
+        seen := map[string]bool{}
+        for _, code := range giftCardCodes {
+                key := normalizeGiftCardCode(code)
+                if key == "" || seen[key] {
+                        continue
+                }
+                seen[key] = true
+
+                card, err := findGiftCard(tx, code, true)
+                if err == sql.ErrNoRows {
+                        return nil, cartError(fmt.Sprintf("Gift card %s is not valid", code))
+                }
+                if err != nil {
+                        return nil, err
+                }
+                if card.Balance <= 0 {
+                        return nil, cartError(fmt.Sprintf("Gift card ending %s has no balance left", card.Last4))
+                }
+                cards = append(cards, card)
+                balances = append(balances, card.Balance)
+        }
+
+        useStoreCredit = useStoreCredit && userID != 0
+        if useStoreCredit {
+                balance, err := storeCreditBalance(tx, userID, true)
+                if err != nil {
+                        return nil, err
+                }
+                balances = append(balances, balance)
+        }
+
+        amounts, remaining := splitTender(total, balances)
+        var payments []Payment
+        for i, card := range cards {
+                amount := amounts[i]
+                if amount <= 0 {
+                        continue
+                }
+                if _, err := tx.Exec("UPDATE gift_cards SET balance = balance - $1 WHERE id = $2", amount, card.ID); err != nil {
+                        return nil, err
+                }
+                _, err := tx.Exec(`INSERT INTO gift_card_transactions (gift_card_id, amount, order_id, note)
+                                   VALUES ($1, $2, $3, 'Spent on order')`, card.ID, -amount, orderID)
+                if err != nil {
+                        return nil, err
+                }
+                _, err = tx.Exec(`INSERT INTO order_payments (order_id, tender, amount, gift_card_id) VALUES ($1, $2, $3, $4)`,
+                        orderID, tenderGiftCard, amount, card.ID)
+                if err != nil {
+                        return nil, err
+                }
+                payments = append(payments, Payment{Tender: tenderGiftCard, Amount: amount, GiftCardLast4: card.Last4})
+        }
+
+        // Store credit, when used, is the last of the balances.
+        if useStoreCredit && amounts[len(cards)] > 0 {
+                amount := amounts[len(cards)]
+                _, err := tx.Exec(`INSERT INTO store_credit_transactions (user_id, amount, order_id, note)
+                                   VALUES ($1, $2, $3, 'Spent on order')`, userID, -amount, orderID)
+                if err != nil {
+                        return nil, err
+                }
+                _, err = tx.Exec(`INSERT INTO order_payments (order_id, tender, amount) VALUES ($1, $2, $3)`,
+                        orderID, tenderStoreCredit, amount)
+                if err != nil {
+                        return nil, err
+                }
+                payments = append(payments, Payment{Tender: tenderStoreCredit, Amount: amount})
+        }
+
+        if remaining > 0 {
+                _, err := tx.Exec(`INSERT INTO order_payments (order_id, tender, amount) VALUES ($1, $2, $3)`,
+                        orderID, tenderGateway, remaining)
+                if err != nil {
+                        return nil, err
+                }
+                payments = append(payments, Payment{Tender: tenderGateway, Amount: remaining})
+        }
+        return payments, nil
+}
+
+// splitTender pays total from balances in turn, each as far as it goes, and
+// returns what each pays and what is left for the gateway.
+func splitTender(total float64, balances []float64) ([]float64, float64) {
+        amounts := make([]float64, len(balances))
+        remaining := total
+        for i, balance := range balances {
+                if remaining <= 0 || balance <= 0 {
+                        continue
+                }
+                amounts[i] = roundCents(math.Min(balance, remaining))
+                remaining = roundCents(remaining - amounts[i])
+        }
+        return amounts, remaining
+}
+
+// loadOrderPayments returns the tenders an order was paid with.
+func loadOrderPayments(orderID int) ([]Payment, error) {
+        rows, err := db.Query(`SELECT p.tender, p.amount, COALESCE(g.code_last4, '')
+                               FROM order_payments p LEFT JOIN gift_cards g ON p.gift_card_id = g.id
+                               WHERE p.order_id = $1 ORDER BY p.id`, orderID)
+        if err != nil {
+                return nil, err
+        }
+        defer rows.Close()
+
+        var payments []Payment
+        for rows.Next() {
+                var p Payment
+                if err := rows.Scan(&p.Tender, &p.Amount, &p.GiftCardLast4); err != nil {
+                        return nil, err
+                }
+                payments = append(payments, p)
+        }
+        return payments, rows.Err()
+}
@@ -0,0 +1,32 @@
+package main
+
+import "testing"
+
+func TestSplitTender(t *testing.T) {
+        tests := []struct {
+                name        string
+                total       float64
+                balances    []float64
+                wantAmounts []float64
+                wantGateway float64
+        }{
+                {"gateway pays it all", 42.5, nil, []float64{}, 42.5},
+                {"one card covers part", 42.5, []float64{25}, []float64{25}, 17.5},
+                {"cards in turn, then credit", 42.5, []float64{20, 15, 30}, []float64{20, 15, 7.5}, 0},
+                {"later balances untouched once paid", 10, []float64{12.34, 5}, []float64{10, 0}, 0},
+                {"empty credit is skipped", 10, []float64{4.99, 0}, []float64{4.99, 0}, 5.01},
+                {"negative credit is skipped", 10, []float64{-3}, []float64{0}, 10},
+                {"cents stay exact", 0.3, []float64{0.1, 0.1}, []float64{0.1, 0.1}, 0.1},
+        }
+        for _, tt := range tests {
+                t.Run(tt.name, func(t *testing.T) {
+                        amounts, gateway := splitTender(tt.total, tt.balances)
+                        if !sameAmounts(amounts, tt.wantAmounts) {
+                                t.Errorf("amounts = %v, want %v", amounts, tt.wantAmounts)
+                        }
+                        if gateway != tt.wantGateway {
+                                t.Errorf("gateway = %v, want %v", gateway, tt.wantGateway)
+                        }
+                })
+        }
+}
@@ -0,0 +1,248 @@
+package main
+
+import (
+        "database/sql"
+        "encoding/json"
+        "math"
+        "net/http"
+        "strconv"
+        "strings"
+)
+
+// queryer is satisfied by both *sql.DB and *sql.Tx, so the cart summary and
+// checkout can price a cart with the same code.
+type queryer interface {
+        Query(query string, args ...interface{}) (*sql.Rows, error)
+        QueryRow(query string, args ...interface{}) *sql.Row
+}
+
+// Destination is where a cart would be shipped, as far as pricing cares.
+type Destination struct {
+        Country    string `json:"country"`
+        State      string `json:"state"`
+        PostalCode string `json:"postal_code"`
+}
+
+func destinationOf(a Address) Destination {
+        return Destination{Country: a.Country, State: a.State, PostalCode: a.PostalCode}
+}
+
+// destinationFromRequest reads the destination of a cart quote from the
+// country, state and postal_code parameters, or address_id. Without either a
+// signed-in customer's default address is used.
+func destinationFromRequest(r *http.Request, owner cartOwner) (Destination, error) {
+        query := r.URL.Query()
+        dest := Destination{
+                Country:    strings.TrimSpace(query.Get("country")),
+                State:      strings.TrimSpace(query.Get("state")),
+                PostalCode: strings.TrimSpace(query.Get("postal_code")),
+        }
+        if owner.UserID == 0 || dest != (Destination{}) {
+                return dest, nil
+        }
+
+        stmt := "SELECT " + addressColumns + " FROM addresses WHERE user_id = $1 AND is_default"
+        args := []interface{}{owner.UserID}
+        if idStr := query.Get("address_id"); idStr != "" {
+                id, err := strconv.Atoi(idStr)
+                if err != nil {
+                        return dest, cartError("Invalid address ID")
+                }
+                stmt = "SELECT " + addressColumns + " FROM addresses WHERE user_id = $1 AND id = $2"
+                args = append(args, id)
+        }
+        a, err := scanAddress(db.QueryRow(stmt, args...))
+        if err == sql.ErrNoRows && len(args) > 1 {
+                return dest, cartError("Address not found")
+        }
+        if err == sql.ErrNoRows {
+                return dest, nil
+        }
+        if err != nil {
+                return dest, err
+        }
+        return destinationOf(a), nil
+}
+
+type QuoteLine struct {
+        BookID    int     `json:"book_id"`
+        Title     string  `json:"title"`
+        Quantity  int     `json:"quantity"`
+        UnitPrice float64 `json:"unit_price"`
+        Subtotal  float64 `json:"subtotal"`
+        Discount  float64 `json:"discount"`
+        TaxRate   float64 `json:"tax_rate"`
+        Tax       float64 `json:"tax"`
+
+        author         string
+        categoryID     int
+        taxClass       string
+        weight         int
+        giftCard       bool
+        stock          int
+        maxPerCustomer sql.NullInt64
+}
+
+type Discount struct {
+        Code        string  `json:"code"`
+        Description string  `json:"description"`
+        Amount      float64 `json:"amount"`
+
+        promotionID int
+}
+
+// CartQuote is the price of a cart, in the base currency until converted.
+// Total is what checkout records as the order's total_amount. When
+// PricesIncludeTax is set, Tax is the part of the prices that is tax and is
+// not added to Total.
+type CartQuote struct {
+        Destination      Destination `json:"destination"`
+        Lines            []QuoteLine `json:"lines"`
+        Subtotal         float64     `json:"subtotal"`
+        Coupon           string      `json:"coupon,omitempty"`
+        CouponError      string      `json:"coupon_error,omitempty"`
+        Discounts        []Discount  `json:"discounts"`
+        DiscountTotal    float64     `json:"discount_total"`
+        ShippingMethod   string      `json:"shipping_method,omitempty"`
+        ShippingError    string      `json:"shipping_error,omitempty"`
+        Shipping         float64     `json:"shipping"`
+        Tax              float64     `json:"tax"`
+        PricesIncludeTax bool        `json:"prices_include_tax"`
+        Total            float64     `json:"total"`
+        Currency         string      `json:"currency"`
+        ExchangeRate     float64     `json:"exchange_rate"`
+
+        // couponMinimum is the minimum spend the coupon missed, if that is
+        // why CouponError is set.
+        couponMinimum float64
+}
+
+func roundCents(amount float64) float64 {
+        return math.Round(amount*100) / 100
+}
+
+// quoteCart prices owner's cart at current book prices, shipped to dest by
+// shippingMethod (the cheapest method when empty). Checkout passes its
+// transaction with lock set, so the books stay as priced until the order is
+// written.
+func quoteCart(q queryer, owner cartOwner, dest Destination, shippingMethod string, lock bool) (*CartQuote, error) {
+        quote := &CartQuote{Destination: dest, Lines: []QuoteLine{}, Discounts: []Discount{}, PricesIncludeTax: pricesIncludeTax,
+                Currency: baseCurrency, ExchangeRate: 1}
+        if owner.UserID == 0 && owner.Token == "" {
+                return quote, nil
+        }
+
+        stmt := `SELECT c.book_id, c.quantity, b.title, b.author, b.price, COALESCE(b.category_id, 0), b.tax_class, b.weight_grams, b.gift_card, b.stock_quantity, b.max_per_customer
+                 FROM cart_items c JOIN books b ON c.book_id = b.id
+                 WHERE c.` + owner.column() + ` = $1 ORDER BY c.id`
+        if lock {
+                stmt += " FOR UPDATE OF b"
+        }
+        rows, err := q.Query(stmt, owner.key())
+        if err != nil {
+                return nil, err
+        }
+        defer rows.Close()
+
+        for rows.Next() {
+                var line QuoteLine
+                if err := rows.Scan(&line.BookID, &line.Quantity, &line.Title, &line.author, &line.UnitPrice,
+                        &line.categoryID, &line.taxClass, &line.weight, &line.giftCard, &line.stock, &line.maxPerCustomer); err != nil {
+                        return nil, err
+                }
+                quote.addLine(line)
+        }
+        if err := rows.Err(); err != nil {
+                return nil, err
+        }
+        rows.Close()
+
+        if err := applyPromotions(q, owner, quote, lock); err != nil {
+                return nil, err
+        }
+
+        if err := applyShipping(q, quote, shippingMethod); err != nil {
+                return nil, err
+        }
+        if err := applyTax(q, quote); err != nil {
+                return nil, err
+        }
+
+        quote.total()
+        return quote, nil
+}
+
+// addLine prices line at its unit price and adds it to q.
+func (q *CartQuote) addLine(line QuoteLine) {
+        line.Subtotal = roundCents(line.UnitPrice * float64(line.Quantity))
+        q.Lines = append(q.Lines, line)
+        q.Subtotal = roundCents(q.Subtotal + line.Subtotal)
+}
+
+// total works out Total once discounts, shipping and tax are in.
+func (q *CartQuote) total() {
+        q.Total = roundCents(q.Subtotal - q.DiscountTotal + q.Shipping)
+        if !q.PricesIncludeTax {
+                q.Total = roundCents(q.Total + q.Tax)
+        }
+}
+
+// convert restates a base currency quote in c for display. Each amount is
+// converted on its own, so Total is exactly what checkout charges in c.
+func (q *CartQuote) convert(c Currency) {
+        for i := range q.Lines {
+                line := &q.Lines[i]
+                line.UnitPrice, line.Subtotal = c.convert(line.UnitPrice), c.convert(line.Subtotal)
+                line.Discount, line.Tax = c.convert(line.Discount), c.convert(line.Tax)
+        }
+        for i := range q.Discounts {
+                q.Discounts[i].Amount = c.convert(q.Discounts[i].Amount)
+        }
+        q.Subtotal, q.DiscountTotal = c.convert(q.Subtotal), c.convert(q.DiscountTotal)
+        q.Shipping, q.Tax, q.Total = c.convert(q.Shipping), c.convert(q.Tax), c.convert(q.Total)
+        q.Currency, q.ExchangeRate = c.Code, c.Rate
+        if q.couponMinimum > 0 {
+                q.CouponError = minimumSpendError(q.couponMinimum).in(c)
+        }
+}
+
+// handleCartSummary serves GET /api/cart/summary. The destination is read
+// as for /api/shipping/quote; shipping_method picks the method, otherwise
+// the cheapest is used as an estimate.
+func handleCartSummary(w http.ResponseWriter, r *http.Request) {
+        if r.Method != http.MethodGet {
+                http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+                return
+        }
+
+        owner, err := getCartOwner(w, r, false)
+        if err != nil {
+                http.Error(w, "Unauthorized", http.StatusUnauthorized)
+                return
+        }
+
+        dest, err := destinationFromRequest(r, owner)
+        if err != nil {
+                if _, ok := err.(cartError); ok {
+                        http.Error(w, err.Error(), http.StatusBadRequest)
+                        return
+                }
+                http.Error(w, "Server error", http.StatusInternalServerError)
+                return
+        }
+
+        currency, ok := currencyOrError(w, r)
+        if !ok {
+                return
+        }
+
+        quote, err := quoteCart(db, owner, dest, r.URL.Query().Get("shipping_method"), false)
+        if err != nil {
+                http.Error(w, "Server error", http.StatusInternalServerError)
+                return
+        }
+        quote.convert(currency)
+
+        w.Header().Set("Content-Type", "application/json")
+        json.NewEncoder(w).Encode(quote)
+}
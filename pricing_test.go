@@ -0,0 +1,65 @@
+package main
+
+import "testing"
+
+func TestQuoteSubtotal(t *testing.T) {
+        tests := []struct {
+                name      string
+                lines     []QuoteLine
+                wantLines []float64
+                want      float64
+        }{
+                {"empty cart", nil, nil, 0},
+                {"unit price times quantity", []QuoteLine{{UnitPrice: 12.99, Quantity: 2}, {UnitPrice: 5, Quantity: 1}},
+                        []float64{25.98, 5}, 30.98},
+                {"lines are rounded to cents", []QuoteLine{{UnitPrice: 0.335, Quantity: 3}}, []float64{1.01}, 1.01},
+                {"no float drift over many lines", []QuoteLine{{UnitPrice: 0.1, Quantity: 1}, {UnitPrice: 0.1, Quantity: 1},
+                        {UnitPrice: 0.1, Quantity: 1}}, []float64{0.1, 0.1, 0.1}, 0.3},
+        }
+        for _, tt := range tests {
+                t.Run(tt.name, func(t *testing.T) {
+                        quote := &CartQuote{}
+                        for _, line := range tt.lines {
+                                quote.addLine(line)
+                        }
+                        for i, line := range quote.Lines {
+                                if line.Subtotal != tt.wantLines[i] {
+                                        t.Errorf("line %d Subtotal = %v, want %v", i, line.Subtotal, tt.wantLines[i])
+                                }
+                        }
+                        if quote.Subtotal != tt.want {
+                                t.Errorf("Subtotal = %v, want %v", quote.Subtotal, tt.want)
+                        }
+                })
+        }
+}
+
+func TestQuoteTotal(t *testing.T) {
+        tests := []struct {
+                name             string
+                subtotal         float64
+                discount         float64
+                shipping         float64
+                tax              float64
+                pricesIncludeTax bool
+                want             float64
+        }{
+                {"subtotal only", 30.98, 0, 0, 0, false, 30.98},
+                {"discount comes off", 40, 10, 0, 0, false, 30},
+                {"shipping is added", 45, 0, 4.99, 0, false, 49.99},
+                {"tax is added on top", 35.55, 3.56, 4.99, 3.2, false, 40.18},
+                {"tax included in prices is not added again", 12, 0, 0, 2, true, 12},
+                {"included tax with discount and shipping", 59.5, 9.5, 3.5, 7.98, true, 53.5},
+                {"fully discounted cart pays shipping", 10, 10, 2.5, 0, false, 2.5},
+        }
+        for _, tt := range tests {
+                t.Run(tt.name, func(t *testing.T) {
+                        quote := &CartQuote{Subtotal: tt.subtotal, DiscountTotal: tt.discount, Shipping: tt.shipping,
+                                Tax: tt.tax, PricesIncludeTax: tt.pricesIncludeTax}
+                        quote.total()
+                        if quote.Total != tt.want {
+                                t.Errorf("Total = %v, want %v", quote.Total, tt.want)
+                        }
+                })
+        }
+}
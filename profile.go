@@ -0,0 +1,322 @@
+package main
+
+import (
+        "database/sql"
+        "encoding/json"
+        "log"
+        "net/http"
+        "net/mail"
+        "strings"
+        "time"
+
+        "golang.org/x/crypto/bcrypt"
+)
+
+const (
+        minPasswordLength = 8
+        emailChangeExpiry = 24 * time.Hour
+)
+
+type SecurityEvent struct {
+        ID        int                    `json:"id"`
+        EventType string                 `json:"event_type"`
+        IPAddress string                 `json:"ip_address"`
+        UserAgent string                 `json:"user_agent"`
+        Details   map[string]interface{} `json:"details,omitempty"`
+        CreatedAt time.Time              `json:"created_at"`
+}
+
+// recordSecurityEvent appends to the user's security log. Failures are only
+// logged: the change itself has already happened.
+func recordSecurityEvent(r *http.Request, userID int, eventType string, details map[string]interface{}) {
+        data, _ := json.Marshal(details)
+        _, err := db.Exec(`INSERT INTO security_events (user_id, event_type, ip_address, user_agent, details)
+                           VALUES ($1, $2, $3, $4, $5)`,
+                userID, eventType, clientIP(r), r.UserAgent(), string(data))
+        if err != nil {
+                log.Printf("Failed to record security event %s for user %d: %v", eventType, userID, err)
+        }
+}
+
+func handleMe(w http.ResponseWriter, r *http.Request) {
+        switch r.Method {
+        case http.MethodGet:
+                handleGetCurrentUser(w, r)
+        case http.MethodPut:
+                handleUpdateProfile(w, r)
+        case http.MethodDelete:
+                notWhileImpersonating(handleDeleteAccount)(w, r)
+        default:
+                http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+        }
+}
+
+func handleUpdateProfile(w http.ResponseWriter, r *http.Request) {
+        user, err := getSessionUser(r)
+        if err != nil {
+                http.Error(w, "Unauthorized", http.StatusUnauthorized)
+                return
+        }
+
+        var req struct {
+                FullName string `json:"full_name"`
+        }
+
+        if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+                http.Error(w, "Invalid request", http.StatusBadRequest)
+                return
+        }
+
+        req.FullName = strings.TrimSpace(req.FullName)
+        if req.FullName == "" {
+                http.Error(w, "Full name is required", http.StatusBadRequest)
+                return
+        }
+
+        _, err = db.Exec("UPDATE users SET full_name = $1 WHERE id = $2", req.FullName, user.ID)
+        if err != nil {
+                http.Error(w, "Server error", http.StatusInternalServerError)
+                return
+        }
+
+        recordSecurityEvent(r, user.ID, "profile.name_changed", map[string]interface{}{
+                "old": user.FullName,
+                "new": req.FullName,
+        })
+
+        w.Header().Set("Content-Type", "application/json")
+        json.NewEncoder(w).Encode(map[string]bool{"success": true})
+}
+
+// handleChangeEmail starts an email change. Nothing changes until the link
+// sent to the new address is opened.
+func handleChangeEmail(w http.ResponseWriter, r *http.Request) {
+        if r.Method != http.MethodPost {
+                http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+                return
+        }
+
+        user, err := getSessionUser(r)
+        if err != nil {
+                http.Error(w, "Unauthorized", http.StatusUnauthorized)
+                return
+        }
+
+        var req struct {
+                NewEmail string `json:"new_email"`
+                Password string `json:"password"`
+        }
+
+        if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+                http.Error(w, "Invalid request", http.StatusBadRequest)
+                return
+        }
+
+        addr, err := mail.ParseAddress(req.NewEmail)
+        if err != nil || addr.Address != strings.TrimSpace(req.NewEmail) {
+                http.Error(w, "Invalid email address", http.StatusBadRequest)
+                return
+        }
+        newEmail := addr.Address
+
+        if !checkPassword(user.ID, req.Password) {
+                http.Error(w, "Invalid credentials", http.StatusUnauthorized)
+                return
+        }
+
+        var taken bool
+        db.QueryRow("SELECT EXISTS(SELECT 1 FROM users WHERE LOWER(email) = LOWER($1))", newEmail).Scan(&taken)
+        if taken {
+                http.Error(w, "Email already exists", http.StatusConflict)
+                return
+        }
+
+        token := newSessionToken()
+        _, err = db.Exec(`INSERT INTO email_change_requests (user_id, new_email, token_hash, expires_at)
+                          VALUES ($1, $2, $3, $4)`,
+                user.ID, newEmail, hashToken(token), time.Now().Add(emailChangeExpiry))
+        if err != nil {
+                http.Error(w, "Server error", http.StatusInternalServerError)
+                return
+        }
+
+        recordSecurityEvent(r, user.ID, "profile.email_change_requested", map[string]interface{}{
+                "new_email": newEmail,
+        })
+
+        link := appBaseURL(r) + "/api/me/email/confirm?token=" + token
+        sendMailAsync(newEmail, "Confirm your new email address",
+                "Hi "+user.FullName+",\n\nOpen this link within 24 hours to use this address for your Bookstore account:\n\n"+link+
+                        "\n\nIf you didn't ask for this, ignore this email.\n")
+        sendMailAsync(user.Email, "Email change requested",
+                "Hi "+user.FullName+",\n\nSomeone asked to change the email on your Bookstore account to "+newEmail+
+                        ". It will only change once the new address is confirmed.\n\nIf this wasn't you, change your password now.\n")
+
+        w.Header().Set("Content-Type", "application/json")
+        json.NewEncoder(w).Encode(map[string]interface{}{
+                "success":              true,
+                "confirmation_pending": true,
+        })
+}
+
+func handleConfirmEmail(w http.ResponseWriter, r *http.Request) {
+        if r.Method != http.MethodGet {
+                http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+                return
+        }
+
+        token := r.URL.Query().Get("token")
+        if token == "" {
+                http.Error(w, "Invalid link", http.StatusBadRequest)
+                return
+        }
+
+        tx, err := db.Begin()
+        if err != nil {
+                http.Error(w, "Server error", http.StatusInternalServerError)
+                return
+        }
+        defer tx.Rollback()
+
+        var requestID, userID int
+        var newEmail, oldEmail, fullName string
+        err = tx.QueryRow(`UPDATE email_change_requests ecr SET confirmed_at = now()
+                           FROM users u
+                           WHERE ecr.user_id = u.id AND ecr.token_hash = $1
+                             AND ecr.confirmed_at IS NULL AND ecr.expires_at > now()
+                           RETURNING ecr.id, ecr.user_id, ecr.new_email, u.email, COALESCE(u.full_name, '')`, hashToken(token)).
+                Scan(&requestID, &userID, &newEmail, &oldEmail, &fullName)
+        if err == sql.ErrNoRows {
+                http.Error(w, "This link is invalid or has expired", http.StatusBadRequest)
+                return
+        }
+        if err != nil {
+                http.Error(w, "Server error", http.StatusInternalServerError)
+                return
+        }
+
+        _, err = tx.Exec("UPDATE users SET email = $1 WHERE id = $2", newEmail, userID)
+        if err != nil {
+                if strings.Contains(err.Error(), "duplicate") {
+                        http.Error(w, "Email already exists", http.StatusConflict)
+                        return
+                }
+                http.Error(w, "Server error", http.StatusInternalServerError)
+                return
+        }
+
+        // Any other pending change for this user is void now.
+        tx.Exec("DELETE FROM email_change_requests WHERE user_id = $1 AND id <> $2 AND confirmed_at IS NULL", userID, requestID)
+
+        if err = tx.Commit(); err != nil {
+                http.Error(w, "Server error", http.StatusInternalServerError)
+                return
+        }
+
+        recordSecurityEvent(r, userID, "profile.email_changed", map[string]interface{}{
+                "old": oldEmail,
+                "new": newEmail,
+        })
+        sendMailAsync(oldEmail, "Your email address was changed",
+                "Hi "+fullName+",\n\nThe email on your Bookstore account was changed to "+newEmail+
+                        ". If this wasn't you, contact support immediately.\n")
+
+        http.Redirect(w, r, "/customer/dashboard?email_changed=1", http.StatusFound)
+}
+
+func handleChangePassword(w http.ResponseWriter, r *http.Request) {
+        if r.Method != http.MethodPost {
+                http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+                return
+        }
+
+        user, err := getSessionUser(r)
+        if err != nil {
+                http.Error(w, "Unauthorized", http.StatusUnauthorized)
+                return
+        }
+
+        var req struct {
+                CurrentPassword string `json:"current_password"`
+                NewPassword     string `json:"new_password"`
+        }
+
+        if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+                http.Error(w, "Invalid request", http.StatusBadRequest)
+                return
+        }
+
+        if len(req.NewPassword) < minPasswordLength {
+                http.Error(w, "New password must be at least 8 characters", http.StatusBadRequest)
+                return
+        }
+
+        if !checkPassword(user.ID, req.CurrentPassword) {
+                http.Error(w, "Invalid credentials", http.StatusUnauthorized)
+                return
+        }
+
+        hashedPassword, err := bcrypt.GenerateFromPassword([]byte(req.NewPassword), bcrypt.DefaultCost)
+        if err != nil {
+                http.Error(w, "Server error", http.StatusInternalServerError)
+                return
+        }
+
+        // The revoke_sessions_on_password_change trigger signs out every
+        // session, this one included, so issue a fresh one for this device.
+        _, err = db.Exec("UPDATE users SET password_hash = $1 WHERE id = $2", string(hashedPassword), user.ID)
+        if err != nil {
+                http.Error(w, "Server error", http.StatusInternalServerError)
+                return
+        }
+
+        session, _ := getSession(r)
+        store.Renew(session)
+        session.Values["user_id"] = user.ID
+        session.Save(r, w)
+
+        recordSecurityEvent(r, user.ID, "profile.password_changed", nil)
+        sendMailAsync(user.Email, "Your password was changed",
+                "Hi "+user.FullName+",\n\nThe password for your Bookstore account was just changed and all other devices were signed out.\n"+
+                        "If this wasn't you, reset your password and contact support immediately.\n")
+
+        w.Header().Set("Content-Type", "application/json")
+        json.NewEncoder(w).Encode(map[string]bool{"success": true})
+}
+
+func handleSecurityEvents(w http.ResponseWriter, r *http.Request) {
+        user, err := getSessionUser(r)
+        if err != nil {
+                http.Error(w, "Unauthorized", http.StatusUnauthorized)
+                return
+        }
+
+        rows, err := db.Query(`SELECT id, event_type, ip_address, user_agent, details, created_at
+                               FROM security_events WHERE user_id = $1
+                               ORDER BY created_at DESC LIMIT 100`, user.ID)
+        if err != nil {
+                http.Error(w, "Server error", http.StatusInternalServerError)
+                return
+        }
+        defer rows.Close()
+
+        var events []SecurityEvent
+        for rows.Next() {
+                var e SecurityEvent
+                var details []byte
+                rows.Scan(&e.ID, &e.EventType, &e.IPAddress, &e.UserAgent, &details, &e.CreatedAt)
+                json.Unmarshal(details, &e.Details)
+                events = append(events, e)
+        }
+
+        w.Header().Set("Content-Type", "application/json")
+        json.NewEncoder(w).Encode(events)
+}
+
+func checkPassword(userID int, password string) bool {
+        var passwordHash string
+        if err := db.QueryRow("SELECT password_hash FROM users WHERE id = $1", userID).Scan(&passwordHash); err != nil {
+                return false
+        }
+        return bcrypt.CompareHashAndPassword([]byte(passwordHash), []byte(password)) == nil
+}
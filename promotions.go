@@ -0,0 +1,523 @@
+package main
+
+import (
+        "database/sql"
+        "encoding/json"
+        "fmt"
+        "math"
+        "net/http"
+        "strconv"
+        "strings"
+        "time"
+)
+
+// Promotion kinds. Value is a percentage for promoPercent and an amount for
+// promoFixed; promoBuyGet makes GetQuantity of every BuyQuantity+GetQuantity
+// copies of a book free.
+const (
+        promoPercent = "percent"
+        promoFixed   = "fixed"
+        promoBuyGet  = "buy_x_get_y"
+)
+
+// Promotion is a discount rule. A promotion without a code applies to every
+// cart it qualifies for; one with a code only once the customer enters it.
+// CategoryID and BookID narrow it to those books.
+type Promotion struct {
+        ID                 int        `json:"id"`
+        Code               string     `json:"code"`
+        Description        string     `json:"description"`
+        Kind               string     `json:"kind"`
+        Value              float64    `json:"value"`
+        BuyQuantity        int        `json:"buy_quantity"`
+        GetQuantity        int        `json:"get_quantity"`
+        MinOrderAmount     float64    `json:"min_order_amount"`
+        CategoryID         *int       `json:"category_id"`
+        BookID             *int       `json:"book_id"`
+        MaxUses            *int       `json:"max_uses"`
+        MaxUsesPerCustomer *int       `json:"max_uses_per_customer"`
+        StartsAt           *time.Time `json:"starts_at"`
+        EndsAt             *time.Time `json:"ends_at"`
+        Active             bool       `json:"active"`
+        Uses               int        `json:"uses"`
+}
+
+// promotionColumns selects a promotion as p. Uses counts the orders that got
+// it, not counting cancelled ones.
+const promotionColumns = `p.id, COALESCE(p.code, ''), p.description, p.kind, p.value, p.buy_quantity, p.get_quantity,
+                          p.min_order_amount, p.category_id, p.book_id, p.max_uses, p.max_uses_per_customer,
+                          p.starts_at, p.ends_at, p.active,
+                          (SELECT COUNT(*) FROM order_discounts d JOIN orders o ON d.order_id = o.id
+                           WHERE d.promotion_id = p.id AND o.status <> 'cancelled')`
+
+func scanPromotion(row interface{ Scan(...interface{}) error }) (Promotion, error) {
+        var p Promotion
+        err := row.Scan(&p.ID, &p.Code, &p.Description, &p.Kind, &p.Value, &p.BuyQuantity, &p.GetQuantity,
+                &p.MinOrderAmount, &p.CategoryID, &p.BookID, &p.MaxUses, &p.MaxUsesPerCustomer,
+                &p.StartsAt, &p.EndsAt, &p.Active, &p.Uses)
+        return p, err
+}
+
+// covers reports whether p discounts line. Gift cards are never discounted.
+func (p Promotion) covers(line QuoteLine) bool {
+        return !line.giftCard && (p.BookID == nil || *p.BookID == line.BookID) &&
+                (p.CategoryID == nil || *p.CategoryID == line.categoryID)
+}
+
+// discount is what p takes off each of lines, before any cap.
+func (p Promotion) discount(lines []QuoteLine) []float64 {
+        amounts := make([]float64, len(lines))
+        weights := make([]float64, len(lines))
+        var eligible float64
+        for i, line := range lines {
+                if !p.covers(line) {
+                        continue
+                }
+                weights[i] = line.Subtotal
+                eligible += line.Subtotal
+                switch p.Kind {
+                case promoPercent:
+                        amounts[i] = roundCents(line.Subtotal * p.Value / 100)
+                case promoBuyGet:
+                        free := line.Quantity / (p.BuyQuantity + p.GetQuantity) * p.GetQuantity
+                        amounts[i] = roundCents(float64(free) * line.UnitPrice)
+                }
+        }
+        if p.Kind == promoFixed {
+                amounts = allocate(math.Min(p.Value, eligible), weights)
+        }
+        return amounts
+}
+
+// allocate splits amount over weights proportionally, in cents, so the parts
+// add up to amount exactly.
+func allocate(amount float64, weights []float64) []float64 {
+        parts := make([]float64, len(weights))
+        var total float64
+        last := -1
+        for i, weight := range weights {
+                total += weight
+                if weight > 0 {
+                        last = i
+                }
+        }
+        if last < 0 {
+                return parts
+        }
+        remaining := amount
+        for i, weight := range weights {
+                if i == last {
+                        parts[i] = roundCents(remaining)
+                        break
+                }
+                parts[i] = roundCents(amount * weight / total)
+                remaining -= parts[i]
+        }
+        return parts
+}
+
+// minimumSpendError is the cartError for a cart below a promotion's
+// minimum order amount, in the base currency. The amount is kept so the
+// message can be restated in the currency the cart is shown in.
+type minimumSpendError float64
+
+func (e minimumSpendError) Error() string {
+        return e.in(Currency{Code: baseCurrency, Rate: 1})
+}
+
+func (e minimumSpendError) in(c Currency) string {
+        return "Spend at least " + c.format(float64(e)) + " to use this code"
+}
+
+func sumAmounts(amounts []float64) float64 {
+        var sum float64
+        for _, amount := range amounts {
+                sum += amount
+        }
+        return roundCents(sum)
+}
+
+// check returns why p can't be used on quote, as a cartError.
+func (p Promotion) check(q queryer, owner cartOwner, quote *CartQuote) error {
+        now := time.Now()
+        switch {
+        case !p.Active:
+                return cartError("This code is no longer valid")
+        case p.StartsAt != nil && now.Before(*p.StartsAt):
+                return cartError("This code is not valid yet")
+        case p.EndsAt != nil && now.After(*p.EndsAt):
+                return cartError("This code has expired")
+        case p.MaxUses != nil && p.Uses >= *p.MaxUses:
+                return cartError("This code has been fully redeemed")
+        case quote.Subtotal < p.MinOrderAmount:
+                return minimumSpendError(p.MinOrderAmount)
+        }
+
+        // Guests are only counted once checkout knows their email.
+        if p.MaxUsesPerCustomer != nil && (owner.UserID != 0 || owner.Email != "") {
+                var uses int
+                err := q.QueryRow(`SELECT COUNT(*) FROM order_discounts d JOIN orders o ON d.order_id = o.id
+                                   WHERE d.promotion_id = $1 AND o.status <> 'cancelled'
+                                     AND (o.user_id = $2 OR LOWER(o.guest_email) = LOWER($3))`,
+                        p.ID, owner.UserID, owner.Email).Scan(&uses)
+                if err != nil {
+                        return err
+                }
+                if uses >= *p.MaxUsesPerCustomer {
+                        return cartError("You have already used this code")
+                }
+        }
+
+        if sumAmounts(p.discount(quote.Lines)) == 0 {
+                return cartError("This code doesn't apply to anything in your cart")
+        }
+        return nil
+}
+
+// applyPromotions adds the automatic promotions the cart qualifies for and
+// then its coupon to quote. A coupon that doesn't apply is reported in
+// quote.CouponError rather than failing the quote. With lock set the
+// promotions that carry a usage limit are locked and their uses counted
+// again, so the limits hold under concurrent checkouts.
+func applyPromotions(q queryer, owner cartOwner, quote *CartQuote, lock bool) error {
+        rows, err := q.Query(`SELECT `+promotionColumns+` FROM promotions p
+                              WHERE (p.code IS NULL AND p.active)
+                                 OR p.id = (SELECT promotion_id FROM cart_coupons WHERE `+owner.column()+` = $1)
+                              ORDER BY p.code NULLS FIRST, p.id`, owner.key())
+        if err != nil {
+                return err
+        }
+        var promotions []Promotion
+        for rows.Next() {
+                p, err := scanPromotion(rows)
+                if err != nil {
+                        rows.Close()
+                        return err
+                }
+                promotions = append(promotions, p)
+        }
+        rows.Close()
+        if err := rows.Err(); err != nil {
+                return err
+        }
+
+        for _, p := range promotions {
+                if lock && (p.MaxUses != nil || p.MaxUsesPerCustomer != nil) {
+                        if err := p.lock(q); err != nil {
+                                return err
+                        }
+                }
+                if p.Code != "" {
+                        quote.Coupon = p.Code
+                }
+                if err := p.check(q, owner, quote); err != nil {
+                        switch err := err.(type) {
+                        case cartError:
+                        case minimumSpendError:
+                                if p.Code != "" {
+                                        quote.couponMinimum = float64(err)
+                                }
+                        default:
+                                return err
+                        }
+                        if p.Code != "" {
+                                quote.CouponError = err.Error()
+                        }
+                        continue
+                }
+
+                quote.addDiscount(p)
+        }
+        return nil
+}
+
+// lock locks p's row until the transaction ends and recounts p.Uses. The
+// count is its own statement so it sees orders committed while we waited.
+func (p *Promotion) lock(q queryer) error {
+        var id int
+        if err := q.QueryRow("SELECT id FROM promotions WHERE id = $1 FOR UPDATE", p.ID).Scan(&id); err != nil {
+                return err
+        }
+        return q.QueryRow(`SELECT COUNT(*) FROM order_discounts d JOIN orders o ON d.order_id = o.id
+                           WHERE d.promotion_id = $1 AND o.status <> 'cancelled'`, p.ID).Scan(&p.Uses)
+}
+
+// addDiscount takes p off quote's lines and records it, unless it comes to
+// nothing. Discounts never take a line below zero.
+func (q *CartQuote) addDiscount(p Promotion) {
+        amounts := p.discount(q.Lines)
+        for i := range amounts {
+                line := &q.Lines[i]
+                amounts[i] = math.Min(amounts[i], roundCents(line.Subtotal-line.Discount))
+                line.Discount = roundCents(line.Discount + amounts[i])
+        }
+        amount := sumAmounts(amounts)
+        if amount <= 0 {
+                return
+        }
+        q.Discounts = append(q.Discounts, Discount{
+                Code:        p.Code,
+                Description: p.Description,
+                Amount:      amount,
+                promotionID: p.ID,
+        })
+        q.DiscountTotal = roundCents(q.DiscountTotal + amount)
+}
+
+// handleCartCoupon serves POST /api/cart/coupon {"code"}, which applies a
+// code to the cart and returns the new summary, and DELETE, which removes it.
+// A cart has at most one code.
+func handleCartCoupon(w http.ResponseWriter, r *http.Request) {
+        switch r.Method {
+        case http.MethodPost:
+                owner, err := getCartOwner(w, r, true)
+                if err != nil {
+                        http.Error(w, "Unauthorized", http.StatusUnauthorized)
+                        return
+                }
+
+                var req struct {
+                        Code string `json:"code"`
+                }
+                if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+                        http.Error(w, "Invalid request", http.StatusBadRequest)
+                        return
+                }
+
+                var promotionID int
+                err = db.QueryRow("SELECT id FROM promotions WHERE code = $1",
+                        strings.ToUpper(strings.TrimSpace(req.Code))).Scan(&promotionID)
+                if err == sql.ErrNoRows {
+                        http.Error(w, "This code is not valid", http.StatusBadRequest)
+                        return
+                }
+                if err != nil {
+                        http.Error(w, "Server error", http.StatusInternalServerError)
+                        return
+                }
+
+                tx, err := db.Begin()
+                if err != nil {
+                        http.Error(w, "Server error", http.StatusInternalServerError)
+                        return
+                }
+                defer tx.Rollback()
+
+                _, err = tx.Exec(`INSERT INTO cart_coupons (`+owner.column()+`, promotion_id) VALUES ($1, $2)
+                                  ON CONFLICT (`+owner.column()+`) DO UPDATE SET promotion_id = EXCLUDED.promotion_id, applied_at = now()`,
+                        owner.key(), promotionID)
+                if err != nil {
+                        http.Error(w, "Server error", http.StatusInternalServerError)
+                        return
+                }
+
+                quote, err := quoteCart(tx, owner, Destination{}, "", false)
+                if err != nil {
+                        http.Error(w, "Server error", http.StatusInternalServerError)
+                        return
+                }
+                if quote.CouponError != "" {
+                        if currency, err := requestCurrency(w, r); err == nil {
+                                quote.convert(currency)
+                        }
+                        http.Error(w, quote.CouponError, http.StatusBadRequest)
+                        return
+                }
+
+                if err := tx.Commit(); err != nil {
+                        http.Error(w, "Server error", http.StatusInternalServerError)
+                        return
+                }
+                if currency, err := requestCurrency(w, r); err == nil {
+                        quote.convert(currency)
+                }
+
+                w.Header().Set("Content-Type", "application/json")
+                json.NewEncoder(w).Encode(quote)
+
+        case http.MethodDelete:
+                owner, err := getCartOwner(w, r, false)
+                if err != nil {
+                        http.Error(w, "Unauthorized", http.StatusUnauthorized)
+                        return
+                }
+
+                _, err = db.Exec("DELETE FROM cart_coupons WHERE "+owner.column()+" = $1", owner.key())
+                if err != nil {
+                        http.Error(w, "Server error", http.StatusInternalServerError)
+                        return
+                }
+
+                w.Header().Set("Content-Type", "application/json")
+                json.NewEncoder(w).Encode(map[string]bool{"success": true})
+
+        default:
+                http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+        }
+}
+
+// loadOrderDiscounts returns the discount lines recorded on an order.
+func loadOrderDiscounts(orderID int) ([]Discount, error) {
+        rows, err := db.Query("SELECT code, description, amount FROM order_discounts WHERE order_id = $1 ORDER BY id", orderID)
+        if err != nil {
+                return nil, err
+        }
+        defer rows.Close()
+
+        var discounts []Discount
+        for rows.Next() {
+                var d Discount
+                if err := rows.Scan(&d.Code, &d.Description, &d.Amount); err != nil {
+                        return nil, err
+                }
+                discounts = append(discounts, d)
+        }
+        return discounts, rows.Err()
+}
+
+// validatePromotion normalises p and checks that its rule makes sense.
+func validatePromotion(p *Promotion) error {
+        p.Code = strings.ToUpper(strings.TrimSpace(p.Code))
+        p.Description = strings.TrimSpace(p.Description)
+        switch p.Kind {
+        case promoPercent:
+                if p.Value <= 0 || p.Value > 100 {
+                        return fmt.Errorf("Percentage must be between 0 and 100")
+                }
+        case promoFixed:
+                if p.Value <= 0 {
+                        return fmt.Errorf("Amount must be positive")
+                }
+        case promoBuyGet:
+                if p.BuyQuantity < 1 || p.GetQuantity < 1 {
+                        return fmt.Errorf("Buy and get quantities must be at least 1")
+                }
+        default:
+                return fmt.Errorf("Kind must be percent, fixed or buy_x_get_y")
+        }
+        switch {
+        case p.Description == "":
+                return fmt.Errorf("Description is required")
+        case p.MinOrderAmount < 0:
+                return fmt.Errorf("Minimum order amount can't be negative")
+        case p.MaxUses != nil && *p.MaxUses < 1, p.MaxUsesPerCustomer != nil && *p.MaxUsesPerCustomer < 1:
+                return fmt.Errorf("Usage limits must be at least 1")
+        case p.StartsAt != nil && p.EndsAt != nil && !p.EndsAt.After(*p.StartsAt):
+                return fmt.Errorf("End date must be after the start date")
+        }
+        return nil
+}
+
+// handleAdminPromotions serves GET (list) and POST (create) /api/admin/promotions.
+func handleAdminPromotions(w http.ResponseWriter, r *http.Request) {
+        switch r.Method {
+        case http.MethodGet:
+                rows, err := db.Query("SELECT " + promotionColumns + " FROM promotions p ORDER BY p.created_at DESC")
+                if err != nil {
+                        http.Error(w, "Server error", http.StatusInternalServerError)
+                        return
+                }
+                defer rows.Close()
+
+                promotions := []Promotion{}
+                for rows.Next() {
+                        p, err := scanPromotion(rows)
+                        if err != nil {
+                                continue
+                        }
+                        promotions = append(promotions, p)
+                }
+
+                w.Header().Set("Content-Type", "application/json")
+                json.NewEncoder(w).Encode(promotions)
+
+        case http.MethodPost:
+                p := Promotion{Active: true}
+                if err := json.NewDecoder(r.Body).Decode(&p); err != nil {
+                        http.Error(w, "Invalid request", http.StatusBadRequest)
+                        return
+                }
+                if err := validatePromotion(&p); err != nil {
+                        http.Error(w, err.Error(), http.StatusBadRequest)
+                        return
+                }
+
+                err := db.QueryRow(`INSERT INTO promotions (code, description, kind, value, buy_quantity, get_quantity,
+                                                            min_order_amount, category_id, book_id, max_uses, max_uses_per_customer,
+                                                            starts_at, ends_at, active)
+                                    VALUES (NULLIF($1, ''), $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13, $14) RETURNING id`,
+                        p.Code, p.Description, p.Kind, p.Value, p.BuyQuantity, p.GetQuantity, p.MinOrderAmount,
+                        p.CategoryID, p.BookID, p.MaxUses, p.MaxUsesPerCustomer, p.StartsAt, p.EndsAt, p.Active).Scan(&p.ID)
+                if err != nil {
+                        if strings.Contains(err.Error(), "duplicate") {
+                                http.Error(w, "A promotion with this code already exists", http.StatusConflict)
+                                return
+                        }
+                        http.Error(w, "Server error", http.StatusInternalServerError)
+                        return
+                }
+
+                w.Header().Set("Content-Type", "application/json")
+                w.WriteHeader(http.StatusCreated)
+                json.NewEncoder(w).Encode(p)
+
+        default:
+                http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+        }
+}
+
+// handleAdminPromotionDetail serves PUT and DELETE /api/admin/promotions/{id}.
+// Deleting deactivates the promotion, so orders that used it keep pointing at
+// it and its usage still counts.
+func handleAdminPromotionDetail(w http.ResponseWriter, r *http.Request) {
+        idStr := strings.TrimPrefix(r.URL.Path, "/api/admin/promotions/")
+        id, err := strconv.Atoi(idStr)
+        if err != nil {
+                http.Error(w, "Invalid promotion ID", http.StatusBadRequest)
+                return
+        }
+
+        var res sql.Result
+        switch r.Method {
+        case http.MethodPut:
+                var p Promotion
+                if err := json.NewDecoder(r.Body).Decode(&p); err != nil {
+                        http.Error(w, "Invalid request", http.StatusBadRequest)
+                        return
+                }
+                if err := validatePromotion(&p); err != nil {
+                        http.Error(w, err.Error(), http.StatusBadRequest)
+                        return
+                }
+
+                res, err = db.Exec(`UPDATE promotions SET code = NULLIF($1, ''), description = $2, kind = $3, value = $4,
+                                    buy_quantity = $5, get_quantity = $6, min_order_amount = $7, category_id = $8, book_id = $9,
+                                    max_uses = $10, max_uses_per_customer = $11, starts_at = $12, ends_at = $13, active = $14
+                                    WHERE id = $15`,
+                        p.Code, p.Description, p.Kind, p.Value, p.BuyQuantity, p.GetQuantity, p.MinOrderAmount,
+                        p.CategoryID, p.BookID, p.MaxUses, p.MaxUsesPerCustomer, p.StartsAt, p.EndsAt, p.Active, id)
+                if err != nil && strings.Contains(err.Error(), "duplicate") {
+                        http.Error(w, "A promotion with this code already exists", http.StatusConflict)
+                        return
+                }
+
+        case http.MethodDelete:
+                res, err = db.Exec("UPDATE promotions SET active = FALSE WHERE id = $1", id)
+
+        default:
+                http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+                return
+        }
+
+        if err != nil {
+                http.Error(w, "Server error", http.StatusInternalServerError)
+                return
+        }
+        if n, _ := res.RowsAffected(); n == 0 {
+                http.Error(w, "Promotion not found", http.StatusNotFound)
+                return
+        }
+
+        w.Header().Set("Content-Type", "application/json")
+        json.NewEncoder(w).Encode(map[string]bool{"success": true})
+}
@@ -0,0 +1,138 @@
+package main
+
+import (
+        "math"
+        "testing"
+)
+
+func intPtr(n int) *int { return &n }
+
+func sameAmounts(a, b []float64) bool {
+        if len(a) != len(b) {
+                return false
+        }
+        for i := range a {
+                if math.Abs(a[i]-b[i]) > 0.001 {
+                        return false
+                }
+        }
+        return true
+}
+
+func TestAllocate(t *testing.T) {
+        tests := []struct {
+                name    string
+                amount  float64
+                weights []float64
+                want    []float64
+        }{
+                {"proportional", 10, []float64{30, 10}, []float64{7.5, 2.5}},
+                {"remainder on the last weighted part", 1, []float64{1, 1, 1}, []float64{0.33, 0.33, 0.34}},
+                {"zero weights get nothing", 6, []float64{0, 2, 1, 0}, []float64{0, 4, 2, 0}},
+                {"no weights", 5, []float64{0, 0}, []float64{0, 0}},
+        }
+        for _, tt := range tests {
+                t.Run(tt.name, func(t *testing.T) {
+                        got := allocate(tt.amount, tt.weights)
+                        if !sameAmounts(got, tt.want) {
+                                t.Errorf("allocate(%v, %v) = %v, want %v", tt.amount, tt.weights, got, tt.want)
+                        }
+                })
+        }
+}
+
+func TestAddDiscount(t *testing.T) {
+        tests := []struct {
+                name          string
+                lines         []QuoteLine
+                promotions    []Promotion
+                wantDiscounts []float64 // per line
+                wantRecorded  int
+        }{
+                {
+                        name:          "fixed discount split by line value",
+                        lines:         []QuoteLine{{BookID: 1, UnitPrice: 30, Quantity: 1}, {BookID: 2, UnitPrice: 10, Quantity: 1}},
+                        promotions:    []Promotion{{Kind: promoFixed, Value: 10}},
+                        wantDiscounts: []float64{7.5, 2.5},
+                        wantRecorded:  1,
+                },
+                {
+                        name: "fixed discount rounding lands on the last line",
+                        lines: []QuoteLine{{BookID: 1, UnitPrice: 10, Quantity: 1}, {BookID: 2, UnitPrice: 10, Quantity: 1},
+                                {BookID: 3, UnitPrice: 10, Quantity: 1}},
+                        promotions:    []Promotion{{Kind: promoFixed, Value: 10}},
+                        wantDiscounts: []float64{3.33, 3.33, 3.34},
+                        wantRecorded:  1,
+                },
+                {
+                        name:          "fixed discount capped at what it covers",
+                        lines:         []QuoteLine{{BookID: 1, UnitPrice: 8, Quantity: 1}, {BookID: 2, UnitPrice: 20, Quantity: 1}},
+                        promotions:    []Promotion{{Kind: promoFixed, Value: 15, BookID: intPtr(1)}},
+                        wantDiscounts: []float64{8, 0},
+                        wantRecorded:  1,
+                },
+                {
+                        name: "percent discount on one category",
+                        lines: []QuoteLine{{BookID: 1, UnitPrice: 19.99, Quantity: 1, categoryID: 3},
+                                {BookID: 2, UnitPrice: 10, Quantity: 2, categoryID: 4}},
+                        promotions:    []Promotion{{Kind: promoPercent, Value: 15, CategoryID: intPtr(3)}},
+                        wantDiscounts: []float64{3, 0},
+                        wantRecorded:  1,
+                },
+                {
+                        name:          "buy two get one free",
+                        lines:         []QuoteLine{{BookID: 1, UnitPrice: 9.5, Quantity: 7}},
+                        promotions:    []Promotion{{Kind: promoBuyGet, BuyQuantity: 2, GetQuantity: 1}},
+                        wantDiscounts: []float64{19},
+                        wantRecorded:  1,
+                },
+                {
+                        name:          "stacked discounts never take a line below zero",
+                        lines:         []QuoteLine{{BookID: 1, UnitPrice: 10, Quantity: 1}},
+                        promotions:    []Promotion{{Kind: promoPercent, Value: 80}, {Kind: promoFixed, Value: 5}},
+                        wantDiscounts: []float64{10},
+                        wantRecorded:  2,
+                },
+                {
+                        name:          "a discount that comes to nothing is not recorded",
+                        lines:         []QuoteLine{{BookID: 1, UnitPrice: 10, Quantity: 1}},
+                        promotions:    []Promotion{{Kind: promoPercent, Value: 100}, {Kind: promoFixed, Value: 5}},
+                        wantDiscounts: []float64{10},
+                        wantRecorded:  1,
+                },
+                {
+                        name:          "gift cards are not discounted",
+                        lines:         []QuoteLine{{BookID: 1, UnitPrice: 25, Quantity: 1, giftCard: true}, {BookID: 2, UnitPrice: 25, Quantity: 1}},
+                        promotions:    []Promotion{{Kind: promoPercent, Value: 20}},
+                        wantDiscounts: []float64{0, 5},
+                        wantRecorded:  1,
+                },
+        }
+        for _, tt := range tests {
+                t.Run(tt.name, func(t *testing.T) {
+                        quote := &CartQuote{}
+                        for _, line := range tt.lines {
+                                quote.addLine(line)
+                        }
+                        for _, p := range tt.promotions {
+                                quote.addDiscount(p)
+                        }
+
+                        var discounts []float64
+                        var lineTotal float64
+                        for _, line := range quote.Lines {
+                                discounts = append(discounts, line.Discount)
+                                lineTotal += line.Discount
+                        }
+                        if !sameAmounts(discounts, tt.wantDiscounts) {
+                                t.Errorf("line discounts = %v, want %v", discounts, tt.wantDiscounts)
+                        }
+                        if roundCents(lineTotal) != quote.DiscountTotal {
+                                t.Errorf("line discounts add up to %v, DiscountTotal is %v", roundCents(lineTotal), quote.DiscountTotal)
+                        }
+                        if len(quote.Discounts) != tt.wantRecorded {
+                                t.Errorf("recorded %d discounts, want %d", len(quote.Discounts), tt.wantRecorded)
+                        }
+                })
+        }
+}
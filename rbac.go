@@ -0,0 +1,255 @@
+package main
+
+import (
+        "database/sql"
+        "encoding/json"
+        "errors"
+        "net/http"
+
+        "github.com/lib/pq"
+)
+
+// Permissions checked by admin routes. Roles and the permissions they grant
+// live in the roles and role_permissions tables (see schema.sql).
+const (
+        permCatalogView   = "catalog.view"
+        permCatalogEdit   = "catalog.edit"
+        permCatalogDelete = "catalog.delete"
+        permOrdersView    = "orders.view"
+        permOrdersUpdate  = "orders.update"
+        permCustomersView = "customers.view"
+        permReportsView   = "reports.view"
+        permRolesManage   = "roles.manage"
+
+        permCustomersManage      = "customers.manage"
+        permCustomersImpersonate = "customers.impersonate"
+        permAuditView            = "audit.view"
+        permPromotionsManage     = "promotions.manage"
+        permTaxManage            = "tax.manage"
+        permShippingManage       = "shipping.manage"
+        permCreditManage         = "credit.manage"
+        permCurrencyManage       = "currency.manage"
+        permJobsManage           = "jobs.manage"
+        permWebhooksManage       = "webhooks.manage"
+)
+
+const roleSuperadmin = "superadmin"
+
+type Role struct {
+        ID          int      `json:"id"`
+        Name        string   `json:"name"`
+        Description string   `json:"description"`
+        Permissions []string `json:"permissions"`
+}
+
+// loadUserRoles fills in the user's roles and the union of their
+// permissions. Any role at all makes the user staff (IsAdmin).
+func loadUserRoles(user *User) error {
+        rows, err := db.Query(`SELECT r.name, rp.permission
+                               FROM user_roles ur
+                               JOIN roles r ON ur.role_id = r.id
+                               LEFT JOIN role_permissions rp ON rp.role_id = r.id
+                               WHERE ur.user_id = $1
+                               ORDER BY r.name, rp.permission`, user.ID)
+        if err != nil {
+                return err
+        }
+        defer rows.Close()
+
+        user.Roles = nil
+        user.Permissions = nil
+        seenRole := map[string]bool{}
+        seenPerm := map[string]bool{}
+        for rows.Next() {
+                var role string
+                var perm sql.NullString
+                if err := rows.Scan(&role, &perm); err != nil {
+                        return err
+                }
+                if !seenRole[role] {
+                        seenRole[role] = true
+                        user.Roles = append(user.Roles, role)
+                }
+                if perm.Valid && !seenPerm[perm.String] {
+                        seenPerm[perm.String] = true
+                        user.Permissions = append(user.Permissions, perm.String)
+                }
+        }
+
+        user.IsAdmin = len(user.Roles) > 0
+        return rows.Err()
+}
+
+func (u *User) Can(permission string) bool {
+        if !u.HasAdminAccess() {
+                return false
+        }
+        for _, p := range u.Permissions {
+                if p == permission {
+                        return true
+                }
+        }
+        return false
+}
+
+// requirePermission guards a route with the permission named for each
+// allowed method, e.g. {http.MethodGet: permOrdersView}. Methods that are not
+// listed get 405.
+func requirePermission(perms map[string]string, next http.HandlerFunc) http.HandlerFunc {
+        return func(w http.ResponseWriter, r *http.Request) {
+                perm, ok := perms[r.Method]
+                if !ok {
+                        http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+                        return
+                }
+
+                user, err := getCurrentUser(r)
+                if err != nil || !user.Can(perm) {
+                        http.Error(w, "Forbidden", http.StatusForbidden)
+                        return
+                }
+                next(w, r)
+        }
+}
+
+func handleAdminRoles(w http.ResponseWriter, r *http.Request) {
+        rows, err := db.Query(`SELECT r.id, r.name, r.description, COALESCE(array_agg(rp.permission ORDER BY rp.permission)
+                                      FILTER (WHERE rp.permission IS NOT NULL), '{}')
+                               FROM roles r
+                               LEFT JOIN role_permissions rp ON rp.role_id = r.id
+                               GROUP BY r.id
+                               ORDER BY r.name`)
+        if err != nil {
+                http.Error(w, "Server error", http.StatusInternalServerError)
+                return
+        }
+        defer rows.Close()
+
+        var roles []Role
+        for rows.Next() {
+                var role Role
+                rows.Scan(&role.ID, &role.Name, &role.Description, pq.Array(&role.Permissions))
+                roles = append(roles, role)
+        }
+
+        w.Header().Set("Content-Type", "application/json")
+        json.NewEncoder(w).Encode(roles)
+}
+
+// handleAdminUserRoles serves GET/PUT /api/admin/users/{id}/roles.
+func handleAdminUserRoles(w http.ResponseWriter, r *http.Request, id int) {
+        target := User{ID: id}
+
+        switch r.Method {
+        case http.MethodGet:
+                var exists bool
+                db.QueryRow("SELECT EXISTS(SELECT 1 FROM users WHERE id = $1)", id).Scan(&exists)
+                if !exists {
+                        http.Error(w, "User not found", http.StatusNotFound)
+                        return
+                }
+
+                if err := loadUserRoles(&target); err != nil {
+                        http.Error(w, "Server error", http.StatusInternalServerError)
+                        return
+                }
+
+                w.Header().Set("Content-Type", "application/json")
+                json.NewEncoder(w).Encode(map[string]interface{}{
+                        "user_id":     id,
+                        "roles":       target.Roles,
+                        "permissions": target.Permissions,
+                })
+
+        case http.MethodPut:
+                var req struct {
+                        Roles []string `json:"roles"`
+                }
+
+                if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+                        http.Error(w, "Invalid request", http.StatusBadRequest)
+                        return
+                }
+
+                switch err := setUserRoles(id, req.Roles); err {
+                case nil:
+                case errUserNotFound:
+                        http.Error(w, "User not found", http.StatusNotFound)
+                        return
+                case errUnknownRole:
+                        http.Error(w, "Unknown role", http.StatusBadRequest)
+                        return
+                case errLastSuperadmin:
+                        http.Error(w, "At least one superadmin is required", http.StatusConflict)
+                        return
+                default:
+                        http.Error(w, "Server error", http.StatusInternalServerError)
+                        return
+                }
+
+                w.Header().Set("Content-Type", "application/json")
+                json.NewEncoder(w).Encode(map[string]bool{"success": true})
+        }
+}
+
+var (
+        errUserNotFound   = errors.New("user not found")
+        errUnknownRole    = errors.New("unknown role")
+        errLastSuperadmin = errors.New("at least one superadmin is required")
+)
+
+// setUserRoles replaces the user's roles. It refuses to leave the store
+// without a superadmin.
+func setUserRoles(userID int, roles []string) error {
+        tx, err := db.Begin()
+        if err != nil {
+                return err
+        }
+        defer tx.Rollback()
+
+        var exists bool
+        tx.QueryRow("SELECT EXISTS(SELECT 1 FROM users WHERE id = $1)", userID).Scan(&exists)
+        if !exists {
+                return errUserNotFound
+        }
+
+        var known int
+        err = tx.QueryRow("SELECT COUNT(*) FROM roles WHERE name = ANY($1)", pq.Array(roles)).Scan(&known)
+        if err != nil {
+                return err
+        }
+        if known != len(uniqueStrings(roles)) {
+                return errUnknownRole
+        }
+
+        if _, err := tx.Exec("DELETE FROM user_roles WHERE user_id = $1", userID); err != nil {
+                return err
+        }
+
+        _, err = tx.Exec(`INSERT INTO user_roles (user_id, role_id)
+                          SELECT $1, id FROM roles WHERE name = ANY($2)`, userID, pq.Array(roles))
+        if err != nil {
+                return err
+        }
+
+        var superadmins int
+        tx.QueryRow(`SELECT COUNT(*) FROM user_roles ur JOIN roles r ON ur.role_id = r.id
+                     WHERE r.name = $1`, roleSuperadmin).Scan(&superadmins)
+        if superadmins == 0 {
+                return errLastSuperadmin
+        }
+
+        return tx.Commit()
+}
+
+func uniqueStrings(values []string) []string {
+        seen := map[string]bool{}
+        var out []string
+        for _, v := range values {
+                if !seen[v] {
+                        seen[v] = true
+                        out = append(out, v)
+                }
+        }
+        return out
+}
@@ -10,7 +10,6 @@ CREATE TABLE IF NOT EXISTS users (
     email TEXT NOT NULL UNIQUE,
     password_hash TEXT NOT NULL,
     full_name TEXT,
-    is_admin BOOLEAN NOT NULL DEFAULT FALSE,
     created_at TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT now()
 );
 
@@ -83,10 +82,527 @@ CREATE TABLE IF NOT EXISTS order_items (
     subtotal NUMERIC(12,2) NOT NULL DEFAULT 0.00
 );
 
+-- Server-side sessions (the cookie only carries a signed token)
+CREATE TABLE IF NOT EXISTS user_sessions (
+    id SERIAL PRIMARY KEY,
+    token TEXT NOT NULL UNIQUE,
+    user_id INTEGER REFERENCES users(id) ON DELETE CASCADE,
+    data TEXT NOT NULL,
+    user_agent TEXT NOT NULL DEFAULT '',
+    ip_address TEXT NOT NULL DEFAULT '',
+    created_at TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT now(),
+    last_seen_at TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT now(),
+    expires_at TIMESTAMP WITH TIME ZONE NOT NULL
+);
+
+-- Two-factor authentication (TOTP)
+ALTER TABLE users ADD COLUMN IF NOT EXISTS totp_secret TEXT;
+ALTER TABLE users ADD COLUMN IF NOT EXISTS totp_enabled BOOLEAN NOT NULL DEFAULT FALSE;
+ALTER TABLE users ADD COLUMN IF NOT EXISTS totp_last_step BIGINT NOT NULL DEFAULT 0;
+
+CREATE TABLE IF NOT EXISTS mfa_recovery_codes (
+    id SERIAL PRIMARY KEY,
+    user_id INTEGER NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    code_hash TEXT NOT NULL,
+    used_at TIMESTAMP WITH TIME ZONE,
+    UNIQUE (user_id, code_hash)
+);
+
+-- Roles and permissions (staff access control)
+CREATE TABLE IF NOT EXISTS roles (
+    id SERIAL PRIMARY KEY,
+    name TEXT NOT NULL UNIQUE,
+    description TEXT NOT NULL DEFAULT ''
+);
+
+CREATE TABLE IF NOT EXISTS role_permissions (
+    role_id INTEGER NOT NULL REFERENCES roles(id) ON DELETE CASCADE,
+    permission TEXT NOT NULL,
+    PRIMARY KEY (role_id, permission)
+);
+
+CREATE TABLE IF NOT EXISTS user_roles (
+    user_id INTEGER NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    role_id INTEGER NOT NULL REFERENCES roles(id) ON DELETE CASCADE,
+    PRIMARY KEY (user_id, role_id)
+);
+
+INSERT INTO roles (name, description) VALUES
+('superadmin', 'Full access, including role assignment'),
+('catalog_editor', 'Create, edit and delete books'),
+('order_fulfilment', 'View and update orders'),
+('support', 'View orders and customers'),
+('finance', 'View orders and reports')
+ON CONFLICT (name) DO NOTHING;
+
+INSERT INTO role_permissions (role_id, permission)
+SELECT r.id, p.permission
+FROM roles r
+JOIN (VALUES
+    ('superadmin', 'catalog.view'),
+    ('superadmin', 'catalog.edit'),
+    ('superadmin', 'catalog.delete'),
+    ('superadmin', 'orders.view'),
+    ('superadmin', 'orders.update'),
+    ('superadmin', 'customers.view'),
+    ('superadmin', 'reports.view'),
+    ('superadmin', 'roles.manage'),
+    ('superadmin', 'customers.manage'),
+    ('superadmin', 'customers.impersonate'),
+    ('superadmin', 'audit.view'),
+    ('superadmin', 'promotions.manage'),
+    ('superadmin', 'tax.manage'),
+    ('superadmin', 'shipping.manage'),
+    ('superadmin', 'credit.manage'),
+    ('superadmin', 'currency.manage'),
+    ('superadmin', 'jobs.manage'),
+    ('superadmin', 'webhooks.manage'),
+    ('catalog_editor', 'catalog.view'),
+    ('catalog_editor', 'catalog.edit'),
+    ('catalog_editor', 'catalog.delete'),
+    ('order_fulfilment', 'catalog.view'),
+    ('order_fulfilment', 'orders.view'),
+    ('order_fulfilment', 'orders.update'),
+    ('support', 'catalog.view'),
+    ('support', 'orders.view'),
+    ('support', 'customers.view'),
+    ('support', 'customers.impersonate'),
+    ('finance', 'orders.view'),
+    ('finance', 'reports.view')
+) AS p(role, permission) ON p.role = r.name
+ON CONFLICT DO NOTHING;
+
+-- Migrate the old users.is_admin flag to the superadmin role
+DO $$
+BEGIN
+    IF EXISTS (SELECT 1 FROM information_schema.columns
+               WHERE table_name = 'users' AND column_name = 'is_admin') THEN
+        INSERT INTO user_roles (user_id, role_id)
+        SELECT u.id, r.id FROM users u, roles r
+        WHERE u.is_admin AND r.name = 'superadmin'
+        ON CONFLICT DO NOTHING;
+        ALTER TABLE users DROP COLUMN is_admin;
+    END IF;
+END $$;
+
+-- Personal API tokens (only the SHA-256 hash of the token is stored)
+CREATE TABLE IF NOT EXISTS api_tokens (
+    id SERIAL PRIMARY KEY,
+    user_id INTEGER NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    name TEXT NOT NULL,
+    token_hash TEXT NOT NULL UNIQUE,
+    token_prefix TEXT NOT NULL,
+    scopes TEXT[] NOT NULL DEFAULT '{}',
+    created_at TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT now(),
+    expires_at TIMESTAMP WITH TIME ZONE NOT NULL,
+    last_used_at TIMESTAMP WITH TIME ZONE
+);
+-- Customer access became the account scope; tokens made without scopes
+-- before then only ever had customer access
+UPDATE api_tokens SET scopes = '{account}' WHERE scopes = '{}';
+
+-- Single sign-on identities linked to local users
+CREATE TABLE IF NOT EXISTS user_identities (
+    id SERIAL PRIMARY KEY,
+    user_id INTEGER NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    issuer TEXT NOT NULL,
+    subject TEXT NOT NULL,
+    email TEXT NOT NULL,
+    created_at TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT now(),
+    last_login_at TIMESTAMP WITH TIME ZONE,
+    UNIQUE (issuer, subject)
+);
+
+-- Deleted accounts are anonymized in place so their orders are kept
+ALTER TABLE users ADD COLUMN IF NOT EXISTS deleted_at TIMESTAMP WITH TIME ZONE;
+
+-- Security-relevant account changes
+CREATE TABLE IF NOT EXISTS security_events (
+    id SERIAL PRIMARY KEY,
+    user_id INTEGER NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    event_type TEXT NOT NULL,
+    ip_address TEXT NOT NULL DEFAULT '',
+    user_agent TEXT NOT NULL DEFAULT '',
+    details JSONB NOT NULL DEFAULT '{}',
+    created_at TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT now()
+);
+
+-- Pending email changes, confirmed through a link sent to the new address
+CREATE TABLE IF NOT EXISTS email_change_requests (
+    id SERIAL PRIMARY KEY,
+    user_id INTEGER NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    new_email TEXT NOT NULL,
+    token_hash TEXT NOT NULL UNIQUE,
+    created_at TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT now(),
+    expires_at TIMESTAMP WITH TIME ZONE NOT NULL,
+    confirmed_at TIMESTAMP WITH TIME ZONE
+);
+
+-- Account state managed from the admin users API
+ALTER TABLE users ADD COLUMN IF NOT EXISTS disabled_at TIMESTAMP WITH TIME ZONE;
+ALTER TABLE users ADD COLUMN IF NOT EXISTS password_reset_required BOOLEAN NOT NULL DEFAULT FALSE;
+
+-- Password reset links (only the SHA-256 hash of the token is stored)
+CREATE TABLE IF NOT EXISTS password_resets (
+    id SERIAL PRIMARY KEY,
+    user_id INTEGER NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    token_hash TEXT NOT NULL UNIQUE,
+    created_at TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT now(),
+    expires_at TIMESTAMP WITH TIME ZONE NOT NULL,
+    used_at TIMESTAMP WITH TIME ZONE
+);
+
+-- Actions staff take on user accounts
+CREATE TABLE IF NOT EXISTS admin_audit_log (
+    id SERIAL PRIMARY KEY,
+    actor_id INTEGER REFERENCES users(id) ON DELETE SET NULL,
+    action TEXT NOT NULL,
+    target_user_id INTEGER REFERENCES users(id) ON DELETE SET NULL,
+    details JSONB NOT NULL DEFAULT '{}',
+    ip_address TEXT NOT NULL DEFAULT '',
+    created_at TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT now()
+);
+
+-- Orders keep a copy of the shipping address as it was at checkout
+ALTER TABLE orders ADD COLUMN IF NOT EXISTS shipping_address JSONB;
+UPDATE orders o SET shipping_address = to_jsonb(a)
+FROM addresses a
+WHERE o.shipping_address_id = a.id AND o.shipping_address IS NULL;
+
+-- Guest carts belong to a cart token kept in the visitor's session
+ALTER TABLE cart_items ALTER COLUMN user_id DROP NOT NULL;
+ALTER TABLE cart_items ADD COLUMN IF NOT EXISTS cart_token TEXT;
+ALTER TABLE cart_items DROP CONSTRAINT IF EXISTS cart_items_owner;
+ALTER TABLE cart_items ADD CONSTRAINT cart_items_owner CHECK (user_id IS NOT NULL OR cart_token IS NOT NULL);
+CREATE UNIQUE INDEX IF NOT EXISTS idx_cart_items_token ON cart_items(cart_token, book_id) WHERE cart_token IS NOT NULL;
+
+-- Guest orders: user_id is NULL until the guest creates an account. The
+-- lookup token (hashed) is emailed to the guest.
+ALTER TABLE orders ADD COLUMN IF NOT EXISTS guest_email TEXT;
+ALTER TABLE orders ADD COLUMN IF NOT EXISTS guest_token_hash TEXT;
+
+-- Cart limits: at most max_per_customer copies of a book per customer,
+-- counting their orders that weren't cancelled, and the price the customer
+-- saw when adding it
+ALTER TABLE books ADD COLUMN IF NOT EXISTS max_per_customer INTEGER CHECK (max_per_customer > 0);
+ALTER TABLE cart_items ADD COLUMN IF NOT EXISTS price_at_add NUMERIC(10,2);
+
+-- Promotions: a code the customer enters, or applied automatically when code
+-- is NULL. category_id and book_id narrow a promotion to those books.
+CREATE TABLE IF NOT EXISTS promotions (
+    id SERIAL PRIMARY KEY,
+    code TEXT UNIQUE,
+    description TEXT NOT NULL DEFAULT '',
+    kind TEXT NOT NULL CHECK (kind IN ('percent', 'fixed', 'buy_x_get_y')),
+    value NUMERIC(10,2) NOT NULL DEFAULT 0,
+    buy_quantity INTEGER NOT NULL DEFAULT 0,
+    get_quantity INTEGER NOT NULL DEFAULT 0,
+    min_order_amount NUMERIC(10,2) NOT NULL DEFAULT 0,
+    category_id INTEGER REFERENCES categories(id) ON DELETE CASCADE,
+    book_id INTEGER REFERENCES books(id) ON DELETE CASCADE,
+    max_uses INTEGER,
+    max_uses_per_customer INTEGER,
+    starts_at TIMESTAMP WITH TIME ZONE,
+    ends_at TIMESTAMP WITH TIME ZONE,
+    active BOOLEAN NOT NULL DEFAULT TRUE,
+    created_at TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT now()
+);
+
+-- The code applied to a cart, owned like cart_items
+CREATE TABLE IF NOT EXISTS cart_coupons (
+    user_id INTEGER UNIQUE REFERENCES users(id) ON DELETE CASCADE,
+    cart_token TEXT UNIQUE,
+    promotion_id INTEGER NOT NULL REFERENCES promotions(id) ON DELETE CASCADE,
+    applied_at TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT now(),
+    CONSTRAINT cart_coupons_owner CHECK (user_id IS NOT NULL OR cart_token IS NOT NULL)
+);
+
+-- Discounts given on an order: total_amount is the item subtotals less these
+CREATE TABLE IF NOT EXISTS order_discounts (
+    id SERIAL PRIMARY KEY,
+    order_id INTEGER NOT NULL REFERENCES orders(id) ON DELETE CASCADE,
+    promotion_id INTEGER REFERENCES promotions(id) ON DELETE SET NULL,
+    code TEXT NOT NULL DEFAULT '',
+    description TEXT NOT NULL DEFAULT '',
+    amount NUMERIC(10,2) NOT NULL
+);
+
+-- Tax: rates in percent per jurisdiction and tax class. An empty state,
+-- postal_code_prefix or tax_class matches anything; the most specific
+-- matching rate applies.
+ALTER TABLE books ADD COLUMN IF NOT EXISTS tax_class TEXT NOT NULL DEFAULT 'books'
+    CHECK (tax_class IN ('standard', 'books', 'ebooks'));
+CREATE TABLE IF NOT EXISTS tax_rates (
+    id SERIAL PRIMARY KEY,
+    country TEXT NOT NULL,
+    state TEXT NOT NULL DEFAULT '',
+    postal_code_prefix TEXT NOT NULL DEFAULT '',
+    tax_class TEXT NOT NULL DEFAULT '' CHECK (tax_class IN ('', 'standard', 'books', 'ebooks')),
+    rate NUMERIC(6,3) NOT NULL CHECK (rate >= 0 AND rate <= 100),
+    name TEXT NOT NULL DEFAULT '',
+    UNIQUE (country, state, postal_code_prefix, tax_class)
+);
+
+-- Orders keep the tax of every line, worked out after discounts
+ALTER TABLE order_items ADD COLUMN IF NOT EXISTS discount_amount NUMERIC(10,2) NOT NULL DEFAULT 0;
+ALTER TABLE order_items ADD COLUMN IF NOT EXISTS tax_rate NUMERIC(6,3) NOT NULL DEFAULT 0;
+ALTER TABLE order_items ADD COLUMN IF NOT EXISTS tax_amount NUMERIC(10,2) NOT NULL DEFAULT 0;
+ALTER TABLE orders ADD COLUMN IF NOT EXISTS tax_amount NUMERIC(10,2) NOT NULL DEFAULT 0;
+ALTER TABLE orders ADD COLUMN IF NOT EXISTS prices_include_tax BOOLEAN NOT NULL DEFAULT FALSE;
+
+-- Shipping: a zone covers regions (an empty state means the whole country,
+-- an empty country everywhere else) and prices each method by weight in
+-- grams, item count or value, within [min_value, max_value)
+ALTER TABLE books ADD COLUMN IF NOT EXISTS weight_grams INTEGER NOT NULL DEFAULT 0 CHECK (weight_grams >= 0);
+CREATE TABLE IF NOT EXISTS shipping_zones (
+    id SERIAL PRIMARY KEY,
+    name TEXT NOT NULL
+);
+CREATE TABLE IF NOT EXISTS shipping_zone_regions (
+    zone_id INTEGER NOT NULL REFERENCES shipping_zones(id) ON DELETE CASCADE,
+    country TEXT NOT NULL DEFAULT '',
+    state TEXT NOT NULL DEFAULT '',
+    PRIMARY KEY (zone_id, country, state)
+);
+CREATE TABLE IF NOT EXISTS shipping_rates (
+    id SERIAL PRIMARY KEY,
+    zone_id INTEGER NOT NULL REFERENCES shipping_zones(id) ON DELETE CASCADE,
+    method TEXT NOT NULL CHECK (method IN ('standard', 'express', 'pickup')),
+    basis TEXT NOT NULL CHECK (basis IN ('weight', 'count', 'value')),
+    min_value NUMERIC(10,2) NOT NULL DEFAULT 0,
+    max_value NUMERIC(10,2),
+    price NUMERIC(10,2) NOT NULL,
+    free_over NUMERIC(10,2)
+);
+ALTER TABLE orders ADD COLUMN IF NOT EXISTS shipping_method TEXT;
+ALTER TABLE orders ADD COLUMN IF NOT EXISTS shipping_amount NUMERIC(10,2) NOT NULL DEFAULT 0;
+
+-- Gift cards and store credit. Codes are stored hashed; each balance change
+-- is a ledger row (positive when issued or granted, negative when spent),
+-- and order_payments records the tenders an order was paid with
+ALTER TABLE books ADD COLUMN IF NOT EXISTS gift_card BOOLEAN NOT NULL DEFAULT FALSE;
+CREATE TABLE IF NOT EXISTS gift_cards (
+    id SERIAL PRIMARY KEY,
+    code_hash TEXT UNIQUE NOT NULL,
+    code_last4 TEXT NOT NULL,
+    initial_balance NUMERIC(10,2) NOT NULL,
+    balance NUMERIC(10,2) NOT NULL CHECK (balance >= 0),
+    recipient_email TEXT,
+    order_id INTEGER REFERENCES orders(id) ON DELETE SET NULL,
+    issued_by INTEGER REFERENCES users(id) ON DELETE SET NULL,
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    expires_at TIMESTAMP,
+    disabled_at TIMESTAMP
+);
+CREATE TABLE IF NOT EXISTS gift_card_transactions (
+    id SERIAL PRIMARY KEY,
+    gift_card_id INTEGER NOT NULL REFERENCES gift_cards(id) ON DELETE CASCADE,
+    amount NUMERIC(10,2) NOT NULL,
+    order_id INTEGER REFERENCES orders(id) ON DELETE SET NULL,
+    note TEXT NOT NULL DEFAULT '',
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+);
+CREATE TABLE IF NOT EXISTS store_credit_transactions (
+    id SERIAL PRIMARY KEY,
+    user_id INTEGER NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    amount NUMERIC(10,2) NOT NULL,
+    order_id INTEGER REFERENCES orders(id) ON DELETE SET NULL,
+    actor_id INTEGER REFERENCES users(id) ON DELETE SET NULL,
+    note TEXT NOT NULL DEFAULT '',
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+);
+CREATE TABLE IF NOT EXISTS order_payments (
+    id SERIAL PRIMARY KEY,
+    order_id INTEGER NOT NULL REFERENCES orders(id) ON DELETE CASCADE,
+    tender TEXT NOT NULL CHECK (tender IN ('gift_card', 'store_credit', 'gateway')),
+    amount NUMERIC(10,2) NOT NULL,
+    gift_card_id INTEGER REFERENCES gift_cards(id) ON DELETE SET NULL,
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+);
+
+-- Currencies: prices are kept in the store's base currency and converted at
+-- these rates (units of the currency per base unit). Orders keep the currency
+-- the customer was charged in and the rate used
+CREATE TABLE IF NOT EXISTS exchange_rates (
+    currency TEXT PRIMARY KEY CHECK (currency ~ '^[A-Z]{3}$'),
+    rate NUMERIC(14,6) NOT NULL CHECK (rate > 0),
+    updated_at TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT now()
+);
+ALTER TABLE exchange_rates ALTER COLUMN updated_at TYPE TIMESTAMP WITH TIME ZONE;
+ALTER TABLE exchange_rates ALTER COLUMN updated_at SET DEFAULT now();
+-- Orders from before currencies were charged in the base currency. Apply
+-- with PGOPTIONS='-c bookstore.store_currency=EUR' to fill it in here;
+-- otherwise the server fills in STORE_CURRENCY when it starts. Either way
+-- the column is NOT NULL once no order is missing it
+ALTER TABLE orders ADD COLUMN IF NOT EXISTS currency TEXT;
+ALTER TABLE orders ALTER COLUMN currency DROP DEFAULT;
+DO $$
+BEGIN
+    UPDATE orders SET currency = UPPER(current_setting('bookstore.store_currency'))
+    WHERE currency IS NULL AND COALESCE(current_setting('bookstore.store_currency', true), '') <> '';
+    IF NOT EXISTS (SELECT 1 FROM orders WHERE currency IS NULL) THEN
+        ALTER TABLE orders ALTER COLUMN currency SET NOT NULL;
+    END IF;
+END $$;
+ALTER TABLE orders ADD COLUMN IF NOT EXISTS exchange_rate NUMERIC(14,6) NOT NULL DEFAULT 1;
+
+-- Invoices: numbers come from a single counter row, incremented in the
+-- transaction that issues the invoice, so they are sequential with no gaps
+CREATE TABLE IF NOT EXISTS invoice_counter (
+    id BOOLEAN PRIMARY KEY DEFAULT TRUE CHECK (id),
+    last_number INTEGER NOT NULL DEFAULT 0
+);
+INSERT INTO invoice_counter (id, last_number) VALUES (TRUE, 0) ON CONFLICT DO NOTHING;
+CREATE TABLE IF NOT EXISTS invoices (
+    order_id INTEGER PRIMARY KEY REFERENCES orders(id) ON DELETE RESTRICT,
+    invoice_number INTEGER UNIQUE NOT NULL,
+    issued_at TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT now()
+);
+ALTER TABLE invoices ALTER COLUMN issued_at TYPE TIMESTAMP WITH TIME ZONE;
+ALTER TABLE invoices ALTER COLUMN issued_at SET DEFAULT now();
+
+-- Invoices are issued at checkout. Orders from before that which were never
+-- invoiced are numbered here in the order they were placed
+DO $$
+BEGIN
+    PERFORM 1 FROM invoice_counter FOR UPDATE;
+    INSERT INTO invoices (order_id, invoice_number, issued_at)
+    SELECT o.id, c.last_number + row_number() OVER (ORDER BY o.created_at, o.id), o.created_at
+    FROM orders o, invoice_counter c
+    WHERE o.status <> 'cancelled' AND NOT EXISTS (SELECT 1 FROM invoices i WHERE i.order_id = o.id);
+    UPDATE invoice_counter SET last_number = (SELECT COALESCE(MAX(invoice_number), 0) FROM invoices);
+END $$;
+
+-- Order items keep the title and author they were sold under, so renaming
+-- or deleting a book never changes an issued invoice
+ALTER TABLE order_items ADD COLUMN IF NOT EXISTS book_title TEXT;
+ALTER TABLE order_items ADD COLUMN IF NOT EXISTS book_author TEXT;
+UPDATE order_items oi SET book_title = b.title, book_author = b.author
+FROM books b
+WHERE oi.book_id = b.id AND oi.book_title IS NULL;
+
+-- Background jobs: workers claim due pending jobs with FOR UPDATE SKIP LOCKED.
+-- Failed jobs are retried with exponential backoff and end up 'dead' once
+-- their attempts run out. dedupe_key keeps one pending or running job per key
+CREATE TABLE IF NOT EXISTS jobs (
+    id SERIAL PRIMARY KEY,
+    kind TEXT NOT NULL,
+    payload JSONB,
+    status TEXT NOT NULL DEFAULT 'pending' CHECK (status IN ('pending', 'running', 'succeeded', 'dead')),
+    attempts INTEGER NOT NULL DEFAULT 0,
+    last_error TEXT,
+    dedupe_key TEXT,
+    run_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    locked_at TIMESTAMP,
+    finished_at TIMESTAMP,
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+);
+
+-- Email used to have its own queue; move anything still unsent onto jobs
+DO $$
+BEGIN
+    IF to_regclass('mail_queue') IS NOT NULL THEN
+        INSERT INTO jobs (kind, payload, attempts, last_error, run_at)
+        SELECT 'send_mail',
+               jsonb_strip_nulls(jsonb_build_object('to', to_address, 'subject', subject, 'text', text_body, 'html', html_body)),
+               attempts, last_error, next_attempt_at
+        FROM mail_queue WHERE status = 'pending';
+        DROP TABLE mail_queue;
+    END IF;
+END $$;
+
+-- Outbox: domain events written in the transaction of the change they
+-- describe, then fanned out to the webhook endpoints subscribed to them.
+-- An endpoint with no events gets every event
+CREATE TABLE IF NOT EXISTS outbox_events (
+    id SERIAL PRIMARY KEY,
+    event_type TEXT NOT NULL,
+    payload JSONB NOT NULL,
+    created_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    dispatched_at TIMESTAMP
+);
+CREATE TABLE IF NOT EXISTS webhook_endpoints (
+    id SERIAL PRIMARY KEY,
+    url TEXT NOT NULL,
+    description TEXT NOT NULL DEFAULT '',
+    events TEXT[] NOT NULL DEFAULT '{}',
+    secret TEXT NOT NULL,
+    active BOOLEAN NOT NULL DEFAULT TRUE,
+    created_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP
+);
+CREATE TABLE IF NOT EXISTS webhook_deliveries (
+    id SERIAL PRIMARY KEY,
+    endpoint_id INTEGER NOT NULL REFERENCES webhook_endpoints(id) ON DELETE CASCADE,
+    event_id INTEGER NOT NULL REFERENCES outbox_events(id) ON DELETE CASCADE,
+    status TEXT NOT NULL DEFAULT 'pending' CHECK (status IN ('pending', 'succeeded', 'failed')),
+    attempts INTEGER NOT NULL DEFAULT 0,
+    response_status INTEGER,
+    response_body TEXT,
+    error TEXT,
+    created_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    last_attempt_at TIMESTAMP,
+    delivered_at TIMESTAMP,
+    UNIQUE (endpoint_id, event_id)
+);
+
+-- Cart line timestamps: updated_at moves whenever the line changes, so a
+-- cart's idle time is since its newest updated_at. They replace added_at,
+-- which was bumped on every add
+ALTER TABLE cart_items ADD COLUMN IF NOT EXISTS created_at TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT now();
+ALTER TABLE cart_items ADD COLUMN IF NOT EXISTS updated_at TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT now();
+DO $$
+BEGIN
+    IF EXISTS (SELECT 1 FROM information_schema.columns
+               WHERE table_name = 'cart_items' AND column_name = 'added_at') THEN
+        UPDATE cart_items SET created_at = added_at, updated_at = added_at;
+        ALTER TABLE cart_items DROP COLUMN added_at;
+    END IF;
+END $$;
+
+-- Abandoned cart reminders: the cart lines each reminder was sent for, which
+-- its restore link (token stored hashed) puts back, and its coupon if any
+CREATE TABLE IF NOT EXISTS cart_reminders (
+    id SERIAL PRIMARY KEY,
+    user_id INTEGER NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    token_hash TEXT NOT NULL UNIQUE,
+    items JSONB NOT NULL,
+    cart_updated_at TIMESTAMP WITH TIME ZONE NOT NULL,
+    promotion_id INTEGER REFERENCES promotions(id) ON DELETE SET NULL,
+    sent_at TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT now(),
+    restored_at TIMESTAMP WITH TIME ZONE
+);
+-- Unsubscribe links carry their own token, separate from the restore link's
+ALTER TABLE cart_reminders ADD COLUMN IF NOT EXISTS unsubscribe_token_hash TEXT UNIQUE;
+
+-- Categories a customer has opted in or out of; missing rows mean enabled
+CREATE TABLE IF NOT EXISTS notification_preferences (
+    user_id INTEGER NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    category TEXT NOT NULL,
+    enabled BOOLEAN NOT NULL,
+    PRIMARY KEY (user_id, category)
+);
+
 -- Indexes
 CREATE INDEX IF NOT EXISTS idx_books_category ON books(category_id);
 CREATE INDEX IF NOT EXISTS idx_orders_user ON orders(user_id);
+CREATE INDEX IF NOT EXISTS idx_orders_guest_email ON orders(LOWER(guest_email)) WHERE user_id IS NULL;
 CREATE INDEX IF NOT EXISTS idx_cart_user ON cart_items(user_id);
+CREATE INDEX IF NOT EXISTS idx_cart_reminders_user ON cart_reminders(user_id, sent_at);
+CREATE INDEX IF NOT EXISTS idx_addresses_user ON addresses(user_id);
+CREATE INDEX IF NOT EXISTS idx_user_sessions_user ON user_sessions(user_id);
+CREATE INDEX IF NOT EXISTS idx_api_tokens_user ON api_tokens(user_id);
+CREATE INDEX IF NOT EXISTS idx_security_events_user ON security_events(user_id, created_at);
+CREATE INDEX IF NOT EXISTS idx_admin_audit_log_target ON admin_audit_log(target_user_id, created_at);
+CREATE INDEX IF NOT EXISTS idx_order_discounts_order ON order_discounts(order_id);
+CREATE INDEX IF NOT EXISTS idx_order_discounts_promotion ON order_discounts(promotion_id);
+CREATE INDEX IF NOT EXISTS idx_shipping_rates_zone ON shipping_rates(zone_id);
+CREATE INDEX IF NOT EXISTS idx_gift_card_transactions_card ON gift_card_transactions(gift_card_id);
+CREATE INDEX IF NOT EXISTS idx_store_credit_transactions_user ON store_credit_transactions(user_id);
+CREATE INDEX IF NOT EXISTS idx_order_payments_order ON order_payments(order_id);
+CREATE INDEX IF NOT EXISTS idx_jobs_due ON jobs(run_at) WHERE status = 'pending';
+CREATE INDEX IF NOT EXISTS idx_webhook_deliveries_event ON webhook_deliveries(event_id);
+CREATE INDEX IF NOT EXISTS idx_outbox_events_dispatched ON outbox_events(dispatched_at);
+CREATE UNIQUE INDEX IF NOT EXISTS idx_jobs_dedupe ON jobs(dedupe_key) WHERE status IN ('pending', 'running');
 
 -- Trigger to update updated_at on orders
 CREATE OR REPLACE FUNCTION trg_update_updated_at()
@@ -102,3 +618,19 @@ CREATE TRIGGER set_updated_at
 BEFORE UPDATE ON orders
 FOR EACH ROW
 EXECUTE PROCEDURE trg_update_updated_at();
+
+-- Revoke every session of a user whose password changes
+CREATE OR REPLACE FUNCTION trg_revoke_sessions_on_password_change()
+RETURNS TRIGGER AS $$
+BEGIN
+    DELETE FROM user_sessions WHERE user_id = NEW.id;
+    RETURN NEW;
+END;
+$$ LANGUAGE plpgsql;
+
+DROP TRIGGER IF EXISTS revoke_sessions_on_password_change ON users;
+CREATE TRIGGER revoke_sessions_on_password_change
+AFTER UPDATE OF password_hash ON users
+FOR EACH ROW
+WHEN (OLD.password_hash IS DISTINCT FROM NEW.password_hash)
+EXECUTE PROCEDURE trg_revoke_sessions_on_password_change();
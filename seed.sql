@@ -17,12 +17,17 @@ INSERT INTO categories (name, description) VALUES
 ON CONFLICT (name) DO NOTHING;
 
 -- Admin and test customer (passwords hashed using bcrypt via pgcrypto)
-INSERT INTO users (email, password_hash, full_name, is_admin)
+INSERT INTO users (email, password_hash, full_name)
 VALUES
-('admin@bookstore.com', crypt('admin123', gen_salt('bf')), 'Site Admin', true),
-('customer@test.com', crypt('customer123', gen_salt('bf')), 'Test Customer', false)
+('admin@bookstore.com', crypt('admin123', gen_salt('bf')), 'Site Admin'),
+('customer@test.com', crypt('customer123', gen_salt('bf')), 'Test Customer')
 ON CONFLICT (email) DO NOTHING;
 
+INSERT INTO user_roles (user_id, role_id)
+SELECT u.id, r.id FROM users u, roles r
+WHERE u.email = 'admin@bookstore.com' AND r.name = 'superadmin'
+ON CONFLICT DO NOTHING;
+
 -- Sample books
 INSERT INTO books (title, author, description, price, stock_quantity, category_id, cover_image_url, isbn, publication_year)
 VALUES
@@ -38,3 +43,32 @@ ON CONFLICT (isbn) DO NOTHING;
 INSERT INTO addresses (user_id, full_name, phone, address_line1, city, state, postal_code, country, is_default)
 VALUES ((SELECT id FROM users WHERE email='customer@test.com'), 'Test Customer', '555-0100', '123 Test St', 'Testville', 'TS', '12345', 'Testland', true)
 ON CONFLICT DO NOTHING;
+
+-- Sample tax rates for the test customer's country
+INSERT INTO tax_rates (country, state, postal_code_prefix, tax_class, rate, name) VALUES
+('Testland', '', '', '', 10, 'Testland sales tax'),
+('Testland', '', '', 'books', 5, 'Testland reduced rate'),
+('Testland', '', '', 'ebooks', 0, 'Testland digital goods')
+ON CONFLICT DO NOTHING;
+
+-- Sample shipping: Testland gets standard, express and pickup, everywhere
+-- else standard only
+INSERT INTO shipping_zones (id, name) VALUES (1, 'Testland'), (2, 'Rest of world')
+ON CONFLICT DO NOTHING;
+SELECT setval('shipping_zones_id_seq', (SELECT MAX(id) FROM shipping_zones));
+INSERT INTO shipping_zone_regions (zone_id, country, state) VALUES (1, 'Testland', ''), (2, '', '')
+ON CONFLICT DO NOTHING;
+INSERT INTO shipping_rates (zone_id, method, basis, min_value, max_value, price, free_over)
+SELECT * FROM (VALUES
+    (1, 'standard', 'value', 0, NULL::numeric, 4.99, 50::numeric),
+    (1, 'express', 'count', 0, 5, 9.99, NULL),
+    (1, 'express', 'count', 5, NULL, 14.99, NULL),
+    (1, 'pickup', 'value', 0, NULL, 0, NULL),
+    (2, 'standard', 'weight', 0, 2000, 12.50, NULL),
+    (2, 'standard', 'weight', 2000, NULL, 24.00, NULL)
+) AS r
+WHERE NOT EXISTS (SELECT 1 FROM shipping_rates);
+
+-- Sample exchange rates against the USD base currency
+INSERT INTO exchange_rates (currency, rate) VALUES ('EUR', 0.92), ('GBP', 0.79), ('CAD', 1.36)
+ON CONFLICT DO NOTHING;
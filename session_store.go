@@ -0,0 +1,405 @@
+package main
+
+import (
+        "database/sql"
+        "encoding/base32"
+        "encoding/json"
+        "errors"
+        "fmt"
+        "log"
+        "net"
+        "net/http"
+        "os"
+        "strconv"
+        "strings"
+        "time"
+
+        "github.com/gorilla/securecookie"
+        "github.com/gorilla/sessions"
+)
+
+const (
+        defaultSessionSecret = "your-secret-key-change-in-production"
+        minSessionKeyLength  = 32
+)
+
+var errSessionRevoked = errors.New("session revoked")
+
+// PGStore is a sessions.Store that keeps session values in the user_sessions
+// table. The cookie only carries a signed session token, so sessions can be
+// listed and revoked server-side.
+type PGStore struct {
+        db      *sql.DB
+        Codecs  []securecookie.Codec
+        Options *sessions.Options
+}
+
+type UserSession struct {
+        ID         int       `json:"id"`
+        UserAgent  string    `json:"user_agent"`
+        IPAddress  string    `json:"ip_address"`
+        CreatedAt  time.Time `json:"created_at"`
+        LastSeenAt time.Time `json:"last_seen_at"`
+        ExpiresAt  time.Time `json:"expires_at"`
+        Current    bool      `json:"current"`
+}
+
+func NewPGStore(db *sql.DB, keyPairs ...[]byte) *PGStore {
+        s := &PGStore{
+                db:     db,
+                Codecs: securecookie.CodecsFromPairs(keyPairs...),
+                Options: &sessions.Options{
+                        Path:     "/",
+                        MaxAge:   86400 * 30,
+                        HttpOnly: true,
+                        SameSite: http.SameSiteLaxMode,
+                },
+        }
+        s.MaxAge(s.Options.MaxAge)
+        return s
+}
+
+// MaxAge sets the lifetime of new sessions and of the signed cookie values.
+func (s *PGStore) MaxAge(age int) {
+        s.Options.MaxAge = age
+        for _, codec := range s.Codecs {
+                if sc, ok := codec.(*securecookie.SecureCookie); ok {
+                        sc.MaxAge(age)
+                }
+        }
+}
+
+func (s *PGStore) Get(r *http.Request, name string) (*sessions.Session, error) {
+        return sessions.GetRegistry(r).Get(s, name)
+}
+
+func (s *PGStore) New(r *http.Request, name string) (*sessions.Session, error) {
+        session := sessions.NewSession(s, name)
+        opts := *s.Options
+        session.Options = &opts
+        session.IsNew = true
+
+        c, err := r.Cookie(name)
+        if err != nil {
+                return session, nil
+        }
+
+        var token string
+        if err := securecookie.DecodeMulti(name, c.Value, &token, s.Codecs...); err != nil {
+                return session, err
+        }
+
+        var data string
+        err = s.db.QueryRow("SELECT data FROM user_sessions WHERE token = $1 AND expires_at > now()", token).Scan(&data)
+        if err == sql.ErrNoRows {
+                return session, nil
+        }
+        if err != nil {
+                return session, err
+        }
+
+        if err := securecookie.DecodeMulti(name, data, &session.Values, s.Codecs...); err != nil {
+                return session, err
+        }
+        session.ID = token
+        session.IsNew = false
+
+        // Only touch the row once a minute so every request doesn't turn into a write.
+        s.db.Exec(`UPDATE user_sessions SET last_seen_at = now(), ip_address = $2, user_agent = $3
+                   WHERE token = $1 AND last_seen_at < now() - INTERVAL '1 minute'`,
+                token, clientIP(r), r.UserAgent())
+
+        return session, nil
+}
+
+func (s *PGStore) Save(r *http.Request, w http.ResponseWriter, session *sessions.Session) error {
+        if session.Options.MaxAge < 0 {
+                if session.ID != "" {
+                        if _, err := s.db.Exec("DELETE FROM user_sessions WHERE token = $1", session.ID); err != nil {
+                                return err
+                        }
+                }
+                http.SetCookie(w, sessions.NewCookie(session.Name(), "", session.Options))
+                return nil
+        }
+
+        data, err := securecookie.EncodeMulti(session.Name(), session.Values, s.Codecs...)
+        if err != nil {
+                return err
+        }
+
+        var userID interface{}
+        if id, ok := session.Values["user_id"].(int); ok {
+                userID = id
+        }
+        expiresAt := time.Now().Add(time.Duration(session.Options.MaxAge) * time.Second)
+
+        if session.ID == "" {
+                session.ID = newSessionToken()
+                _, err = s.db.Exec(`INSERT INTO user_sessions (token, user_id, data, user_agent, ip_address, expires_at)
+                                    VALUES ($1, $2, $3, $4, $5, $6)`,
+                        session.ID, userID, data, r.UserAgent(), clientIP(r), expiresAt)
+                if err != nil {
+                        return err
+                }
+        } else {
+                // Never re-insert an existing token: if the row is gone the session
+                // was revoked while this request was in flight.
+                res, err := s.db.Exec(`UPDATE user_sessions SET user_id = $2, data = $3, expires_at = $4, last_seen_at = now()
+                                       WHERE token = $1`,
+                        session.ID, userID, data, expiresAt)
+                if err != nil {
+                        return err
+                }
+                if n, _ := res.RowsAffected(); n == 0 {
+                        return errSessionRevoked
+                }
+        }
+
+        encoded, err := securecookie.EncodeMulti(session.Name(), session.ID, s.Codecs...)
+        if err != nil {
+                return err
+        }
+        http.SetCookie(w, sessions.NewCookie(session.Name(), encoded, session.Options))
+        return nil
+}
+
+// Renew drops the stored row behind session and gives it a fresh token on the
+// next Save. Call it whenever the session changes privilege level.
+func (s *PGStore) Renew(session *sessions.Session) error {
+        if session.ID != "" {
+                if _, err := s.db.Exec("DELETE FROM user_sessions WHERE token = $1", session.ID); err != nil {
+                        return err
+                }
+        }
+        session.ID = ""
+        session.IsNew = true
+        // A fresh login must not inherit an impersonation from the old session.
+        clearImpersonation(session)
+        return nil
+}
+
+// purgeExpired deletes expired sessions. It runs as the purge_sessions job.
+func (s *PGStore) purgeExpired() error {
+        _, err := s.db.Exec("DELETE FROM user_sessions WHERE expires_at < now()")
+        return err
+}
+
+func isProduction() bool {
+        return os.Getenv("APP_ENV") == "production"
+}
+
+// sessionKeyPairs reads the cookie signing keys from the environment.
+//
+// SESSION_KEYS holds a comma-separated list of "hashKey:blockKey" pairs,
+// newest first; the block (encryption) key is optional and must be 16, 24 or
+// 32 bytes. New cookies are signed with the first pair and older pairs are
+// only used for decoding, so a secret can be rotated by prepending a new pair
+// and dropping the old one once existing sessions have expired.
+//
+// SESSION_SECRET is still accepted as a single hash key. In production
+// (APP_ENV=production) the server refuses to start without a strong key.
+func sessionKeyPairs() ([][]byte, error) {
+        var specs []string
+        if keys := os.Getenv("SESSION_KEYS"); keys != "" {
+                specs = strings.Split(keys, ",")
+        } else if secret := os.Getenv("SESSION_SECRET"); secret != "" {
+                specs = []string{secret}
+        }
+
+        if len(specs) == 0 {
+                if isProduction() {
+                        return nil, fmt.Errorf("SESSION_KEYS or SESSION_SECRET must be set in production")
+                }
+                log.Println("WARNING: no session secret configured, using the insecure development default")
+                return [][]byte{[]byte(defaultSessionSecret), nil}, nil
+        }
+
+        var pairs [][]byte
+        for i, spec := range specs {
+                hashKey, blockKey, _ := strings.Cut(strings.TrimSpace(spec), ":")
+                if hashKey == "" {
+                        return nil, fmt.Errorf("session key %d is empty", i+1)
+                }
+                if isProduction() && (hashKey == defaultSessionSecret || len(hashKey) < minSessionKeyLength) {
+                        return nil, fmt.Errorf("session key %d must be at least %d bytes and not the default", i+1, minSessionKeyLength)
+                }
+                if i == 0 && len(hashKey) < minSessionKeyLength {
+                        log.Printf("WARNING: session key is shorter than %d bytes", minSessionKeyLength)
+                }
+
+                var block []byte
+                if blockKey != "" {
+                        switch len(blockKey) {
+                        case 16, 24, 32:
+                                block = []byte(blockKey)
+                        default:
+                                return nil, fmt.Errorf("session encryption key %d must be 16, 24 or 32 bytes", i+1)
+                        }
+                }
+                pairs = append(pairs, []byte(hashKey), block)
+        }
+
+        return pairs, nil
+}
+
+func newSessionToken() string {
+        return strings.TrimRight(base32.StdEncoding.EncodeToString(securecookie.GenerateRandomKey(32)), "=")
+}
+
+// trustedProxies are the reverse proxies, from TRUSTED_PROXIES (IPs or
+// CIDR ranges separated by commas), whose X-Forwarded-For is believed.
+var trustedProxies []*net.IPNet
+
+func loadTrustedProxies() error {
+        trustedProxies = nil
+        for _, entry := range strings.Split(os.Getenv("TRUSTED_PROXIES"), ",") {
+                entry = strings.TrimSpace(entry)
+                if entry == "" {
+                        continue
+                }
+                if !strings.Contains(entry, "/") {
+                        ip := net.ParseIP(entry)
+                        if ip == nil {
+                                return fmt.Errorf("TRUSTED_PROXIES: %q is not an IP address or CIDR range", entry)
+                        }
+                        bits := 128
+                        if ip.To4() != nil {
+                                ip, bits = ip.To4(), 32
+                        }
+                        trustedProxies = append(trustedProxies, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+                        continue
+                }
+                _, network, err := net.ParseCIDR(entry)
+                if err != nil {
+                        return fmt.Errorf("TRUSTED_PROXIES: %q is not an IP address or CIDR range", entry)
+                }
+                trustedProxies = append(trustedProxies, network)
+        }
+        return nil
+}
+
+func isTrustedProxy(addr string) bool {
+        ip := net.ParseIP(addr)
+        if ip == nil {
+                return false
+        }
+        for _, network := range trustedProxies {
+                if network.Contains(ip) {
+                        return true
+                }
+        }
+        return false
+}
+
+// clientIP is the address a request came from. X-Forwarded-For is only
+// read when the request came through a trusted proxy, and then from the
+// right: the first address no trusted proxy added is the client's, as
+// anything left of it may be forged.
+func clientIP(r *http.Request) string {
+        host, _, err := net.SplitHostPort(r.RemoteAddr)
+        if err != nil {
+                host = r.RemoteAddr
+        }
+        if !isTrustedProxy(host) {
+                return host
+        }
+        hops := strings.Split(r.Header.Get("X-Forwarded-For"), ",")
+        for i := len(hops) - 1; i >= 0; i-- {
+                hop := strings.TrimSpace(hops[i])
+                if hop == "" {
+                        continue
+                }
+                if !isTrustedProxy(hop) {
+                        return hop
+                }
+                host = hop
+        }
+        return host
+}
+
+func revokeUserSessions(userID int, exceptToken string) error {
+        _, err := db.Exec("DELETE FROM user_sessions WHERE user_id = $1 AND token <> $2", userID, exceptToken)
+        return err
+}
+
+func handleSessions(w http.ResponseWriter, r *http.Request) {
+        user, err := getSessionUser(r)
+        if err != nil {
+                http.Error(w, "Unauthorized", http.StatusUnauthorized)
+                return
+        }
+
+        session, _ := getSession(r)
+
+        switch r.Method {
+        case http.MethodGet:
+                rows, err := db.Query(`SELECT id, token, user_agent, ip_address, created_at, last_seen_at, expires_at
+                                       FROM user_sessions
+                                       WHERE user_id = $1 AND expires_at > now()
+                                       ORDER BY last_seen_at DESC`, user.ID)
+                if err != nil {
+                        http.Error(w, "Server error", http.StatusInternalServerError)
+                        return
+                }
+                defer rows.Close()
+
+                var list []UserSession
+                for rows.Next() {
+                        var s UserSession
+                        var token string
+                        rows.Scan(&s.ID, &token, &s.UserAgent, &s.IPAddress, &s.CreatedAt, &s.LastSeenAt, &s.ExpiresAt)
+                        s.Current = token == session.ID
+                        list = append(list, s)
+                }
+
+                w.Header().Set("Content-Type", "application/json")
+                json.NewEncoder(w).Encode(list)
+
+        case http.MethodDelete:
+                // Log out everywhere else; the current session stays signed in.
+                if err := revokeUserSessions(user.ID, session.ID); err != nil {
+                        http.Error(w, "Server error", http.StatusInternalServerError)
+                        return
+                }
+
+                w.Header().Set("Content-Type", "application/json")
+                json.NewEncoder(w).Encode(map[string]bool{"success": true})
+
+        default:
+                http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+        }
+}
+
+func handleSessionDetail(w http.ResponseWriter, r *http.Request) {
+        if r.Method != http.MethodDelete {
+                http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+                return
+        }
+
+        user, err := getSessionUser(r)
+        if err != nil {
+                http.Error(w, "Unauthorized", http.StatusUnauthorized)
+                return
+        }
+
+        idStr := strings.TrimPrefix(r.URL.Path, "/api/sessions/")
+        id, err := strconv.Atoi(idStr)
+        if err != nil {
+                http.Error(w, "Invalid session ID", http.StatusBadRequest)
+                return
+        }
+
+        res, err := db.Exec("DELETE FROM user_sessions WHERE id = $1 AND user_id = $2", id, user.ID)
+        if err != nil {
+                http.Error(w, "Server error", http.StatusInternalServerError)
+                return
+        }
+        if n, _ := res.RowsAffected(); n == 0 {
+                http.Error(w, "Session not found", http.StatusNotFound)
+                return
+        }
+
+        w.Header().Set("Content-Type", "application/json")
+        json.NewEncoder(w).Encode(map[string]bool{"success": true})
+}
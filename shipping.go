@@ -0,0 +1,467 @@
+package main
+
+import (
+        "database/sql"
+        "encoding/json"
+        "fmt"
+        "net/http"
+        "strconv"
+        "strings"
+)
+
+// shippingMethods are the methods a zone can offer, with the name shown to
+// customers, in the order they are listed.
+var shippingMethods = []struct{ Code, Name string }{
+        {"standard", "Standard delivery"},
+        {"express", "Express delivery"},
+        {"pickup", "Store pickup"},
+}
+
+func shippingMethodName(code string) string {
+        for _, m := range shippingMethods {
+                if m.Code == code {
+                        return m.Name
+                }
+        }
+        return ""
+}
+
+// Bases a shipping rate can be measured on: the cart's weight in grams, its
+// number of items, or its value after discounts.
+const (
+        shipByWeight = "weight"
+        shipByCount  = "count"
+        shipByValue  = "value"
+)
+
+// ShippingZone groups the regions that share shipping rates. A region with
+// an empty state covers the whole country; one with an empty country covers
+// everywhere no other zone does.
+type ShippingZone struct {
+        ID      int              `json:"id"`
+        Name    string           `json:"name"`
+        Regions []ShippingRegion `json:"regions"`
+        Rates   []ShippingRate   `json:"rates"`
+}
+
+type ShippingRegion struct {
+        Country string `json:"country"`
+        State   string `json:"state"`
+}
+
+// ShippingRate prices a method for carts whose measure on Basis is at least
+// Min and below Max. FreeOver makes it free from that cart value on.
+type ShippingRate struct {
+        Method   string   `json:"method"`
+        Basis    string   `json:"basis"`
+        Min      float64  `json:"min"`
+        Max      *float64 `json:"max"`
+        Price    float64  `json:"price"`
+        FreeOver *float64 `json:"free_over"`
+}
+
+type ShippingOption struct {
+        Method string  `json:"method"`
+        Name   string  `json:"name"`
+        Cost   float64 `json:"cost"`
+}
+
+// shippingZoneFor returns the ID of the zone that ships to dest, or 0. A
+// region naming the state beats one naming only the country, which beats a
+// catch-all.
+func shippingZoneFor(q queryer, dest Destination) (int, error) {
+        var zoneID int
+        err := q.QueryRow(`SELECT zone_id FROM shipping_zone_regions
+                           WHERE (country = '' OR UPPER(country) = UPPER($1))
+                             AND (state = '' OR UPPER(state) = UPPER($2))
+                           ORDER BY (country <> '')::int + (state <> '')::int DESC, zone_id
+                           LIMIT 1`, dest.Country, dest.State).Scan(&zoneID)
+        if err == sql.ErrNoRows {
+                return 0, nil
+        }
+        return zoneID, err
+}
+
+// shippingOptions lists the methods that can ship quote's cart to its
+// destination, with what each costs. Where several rates of a method match,
+// the cheapest applies.
+func shippingOptions(q queryer, quote *CartQuote) ([]ShippingOption, error) {
+        options := []ShippingOption{}
+        if quote.Destination.Country == "" || len(quote.Lines) == 0 {
+                return options, nil
+        }
+
+        zoneID, err := shippingZoneFor(q, quote.Destination)
+        if err != nil || zoneID == 0 {
+                return options, err
+        }
+
+        rows, err := q.Query(`SELECT method, basis, min_value, max_value, price, free_over
+                              FROM shipping_rates WHERE zone_id = $1`, zoneID)
+        if err != nil {
+                return nil, err
+        }
+        defer rows.Close()
+
+        var rates []ShippingRate
+        for rows.Next() {
+                var rate ShippingRate
+                if err := rows.Scan(&rate.Method, &rate.Basis, &rate.Min, &rate.Max, &rate.Price, &rate.FreeOver); err != nil {
+                        return nil, err
+                }
+                rates = append(rates, rate)
+        }
+        if err := rows.Err(); err != nil {
+                return nil, err
+        }
+        return shippingCosts(quote, rates), nil
+}
+
+// shippingCosts prices quote's cart with a zone's rates, one option per
+// method any of them matches, in the order of shippingMethods.
+func shippingCosts(quote *CartQuote, rates []ShippingRate) []ShippingOption {
+        var weight, count float64
+        for _, line := range quote.Lines {
+                weight += float64(line.weight * line.Quantity)
+                count += float64(line.Quantity)
+        }
+        value := quote.Subtotal - quote.DiscountTotal
+        measures := map[string]float64{shipByWeight: weight, shipByCount: count, shipByValue: value}
+
+        costs := map[string]float64{}
+        for _, rate := range rates {
+                measure := measures[rate.Basis]
+                if measure < rate.Min || (rate.Max != nil && measure >= *rate.Max) {
+                        continue
+                }
+                cost := rate.Price
+                if rate.FreeOver != nil && value >= *rate.FreeOver {
+                        cost = 0
+                }
+                if current, ok := costs[rate.Method]; !ok || cost < current {
+                        costs[rate.Method] = cost
+                }
+        }
+
+        options := []ShippingOption{}
+        for _, m := range shippingMethods {
+                if cost, ok := costs[m.Code]; ok {
+                        options = append(options, ShippingOption{Method: m.Code, Name: m.Name, Cost: roundCents(cost)})
+                }
+        }
+        return options
+}
+
+// applyShipping charges quote for method. Without a method the cheapest
+// option is used as an estimate; a method that can't ship there is reported
+// in quote.ShippingError.
+func applyShipping(q queryer, quote *CartQuote, method string) error {
+        options, err := shippingOptions(q, quote)
+        if err != nil {
+                return err
+        }
+        quote.chooseShipping(options, method)
+        return nil
+}
+
+// chooseShipping charges q for method, or the cheapest of options when
+// method is empty.
+func (q *CartQuote) chooseShipping(options []ShippingOption, method string) {
+        if method == "" {
+                for _, option := range options {
+                        if q.ShippingMethod == "" || option.Cost < q.Shipping {
+                                q.ShippingMethod, q.Shipping = option.Method, option.Cost
+                        }
+                }
+                return
+        }
+
+        for _, option := range options {
+                if option.Method == method {
+                        q.ShippingMethod, q.Shipping = method, option.Cost
+                        return
+                }
+        }
+        q.ShippingError = "This shipping method is not available for this address"
+}
+
+// handleShippingQuote serves GET /api/shipping/quote, the shipping methods
+// checkout can choose from for the cart and destination.
+func handleShippingQuote(w http.ResponseWriter, r *http.Request) {
+        if r.Method != http.MethodGet {
+                http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+                return
+        }
+
+        owner, err := getCartOwner(w, r, false)
+        if err != nil {
+                http.Error(w, "Unauthorized", http.StatusUnauthorized)
+                return
+        }
+
+        dest, err := destinationFromRequest(r, owner)
+        if err != nil {
+                if _, ok := err.(cartError); ok {
+                        http.Error(w, err.Error(), http.StatusBadRequest)
+                        return
+                }
+                http.Error(w, "Server error", http.StatusInternalServerError)
+                return
+        }
+
+        currency, ok := currencyOrError(w, r)
+        if !ok {
+                return
+        }
+
+        quote, err := quoteCart(db, owner, dest, "", false)
+        if err != nil {
+                http.Error(w, "Server error", http.StatusInternalServerError)
+                return
+        }
+        options, err := shippingOptions(db, quote)
+        if err != nil {
+                http.Error(w, "Server error", http.StatusInternalServerError)
+                return
+        }
+        for i := range options {
+                options[i].Cost = currency.convert(options[i].Cost)
+        }
+
+        w.Header().Set("Content-Type", "application/json")
+        json.NewEncoder(w).Encode(map[string]interface{}{
+                "destination": dest,
+                "currency":    currency.Code,
+                "options":     options,
+        })
+}
+
+func validateShippingZone(z *ShippingZone) error {
+        z.Name = strings.TrimSpace(z.Name)
+        if z.Name == "" {
+                return fmt.Errorf("Name is required")
+        }
+        if len(z.Regions) == 0 {
+                return fmt.Errorf("A zone needs at least one region")
+        }
+        for i := range z.Regions {
+                z.Regions[i].Country = strings.TrimSpace(z.Regions[i].Country)
+                z.Regions[i].State = strings.TrimSpace(z.Regions[i].State)
+                if z.Regions[i].Country == "" && z.Regions[i].State != "" {
+                        return fmt.Errorf("A region with a state needs a country")
+                }
+        }
+        for _, rate := range z.Rates {
+                switch {
+                case shippingMethodName(rate.Method) == "":
+                        return fmt.Errorf("Method must be standard, express or pickup")
+                case rate.Basis != shipByWeight && rate.Basis != shipByCount && rate.Basis != shipByValue:
+                        return fmt.Errorf("Basis must be weight, count or value")
+                case rate.Price < 0 || rate.Min < 0:
+                        return fmt.Errorf("Prices and bounds can't be negative")
+                case rate.Max != nil && *rate.Max <= rate.Min:
+                        return fmt.Errorf("Max must be above min")
+                case rate.FreeOver != nil && *rate.FreeOver < 0:
+                        return fmt.Errorf("Free shipping threshold can't be negative")
+                }
+        }
+        return nil
+}
+
+// saveShippingZone replaces the regions and rates of zone z.
+func saveShippingZone(tx *sql.Tx, z *ShippingZone) error {
+        if _, err := tx.Exec("DELETE FROM shipping_zone_regions WHERE zone_id = $1", z.ID); err != nil {
+                return err
+        }
+        if _, err := tx.Exec("DELETE FROM shipping_rates WHERE zone_id = $1", z.ID); err != nil {
+                return err
+        }
+        for _, region := range z.Regions {
+                if _, err := tx.Exec("INSERT INTO shipping_zone_regions (zone_id, country, state) VALUES ($1, $2, $3)",
+                        z.ID, region.Country, region.State); err != nil {
+                        return err
+                }
+        }
+        for _, rate := range z.Rates {
+                _, err := tx.Exec(`INSERT INTO shipping_rates (zone_id, method, basis, min_value, max_value, price, free_over)
+                                   VALUES ($1, $2, $3, $4, $5, $6, $7)`,
+                        z.ID, rate.Method, rate.Basis, rate.Min, rate.Max, rate.Price, rate.FreeOver)
+                if err != nil {
+                        return err
+                }
+        }
+        return nil
+}
+
+func loadShippingZones() ([]ShippingZone, error) {
+        rows, err := db.Query("SELECT id, name FROM shipping_zones ORDER BY name")
+        if err != nil {
+                return nil, err
+        }
+        zones := []ShippingZone{}
+        byID := map[int]int{}
+        for rows.Next() {
+                z := ShippingZone{Regions: []ShippingRegion{}, Rates: []ShippingRate{}}
+                if err := rows.Scan(&z.ID, &z.Name); err != nil {
+                        rows.Close()
+                        return nil, err
+                }
+                byID[z.ID] = len(zones)
+                zones = append(zones, z)
+        }
+        rows.Close()
+
+        rows, err = db.Query("SELECT zone_id, country, state FROM shipping_zone_regions ORDER BY country, state")
+        if err != nil {
+                return nil, err
+        }
+        for rows.Next() {
+                var zoneID int
+                var region ShippingRegion
+                if err := rows.Scan(&zoneID, &region.Country, &region.State); err != nil {
+                        rows.Close()
+                        return nil, err
+                }
+                zones[byID[zoneID]].Regions = append(zones[byID[zoneID]].Regions, region)
+        }
+        rows.Close()
+
+        rows, err = db.Query(`SELECT zone_id, method, basis, min_value, max_value, price, free_over
+                              FROM shipping_rates ORDER BY method, basis, min_value`)
+        if err != nil {
+                return nil, err
+        }
+        defer rows.Close()
+        for rows.Next() {
+                var zoneID int
+                var rate ShippingRate
+                if err := rows.Scan(&zoneID, &rate.Method, &rate.Basis, &rate.Min, &rate.Max, &rate.Price, &rate.FreeOver); err != nil {
+                        return nil, err
+                }
+                zones[byID[zoneID]].Rates = append(zones[byID[zoneID]].Rates, rate)
+        }
+        return zones, rows.Err()
+}
+
+// handleAdminShippingZones serves GET (list) and POST (create)
+// /api/admin/shipping/zones. A zone is written whole, with its regions and
+// rates.
+func handleAdminShippingZones(w http.ResponseWriter, r *http.Request) {
+        switch r.Method {
+        case http.MethodGet:
+                zones, err := loadShippingZones()
+                if err != nil {
+                        http.Error(w, "Server error", http.StatusInternalServerError)
+                        return
+                }
+
+                w.Header().Set("Content-Type", "application/json")
+                json.NewEncoder(w).Encode(zones)
+
+        case http.MethodPost:
+                var z ShippingZone
+                if err := json.NewDecoder(r.Body).Decode(&z); err != nil {
+                        http.Error(w, "Invalid request", http.StatusBadRequest)
+                        return
+                }
+                if err := validateShippingZone(&z); err != nil {
+                        http.Error(w, err.Error(), http.StatusBadRequest)
+                        return
+                }
+
+                tx, err := db.Begin()
+                if err != nil {
+                        http.Error(w, "Server error", http.StatusInternalServerError)
+                        return
+                }
+                defer tx.Rollback()
+
+                if err := tx.QueryRow("INSERT INTO shipping_zones (name) VALUES ($1) RETURNING id", z.Name).Scan(&z.ID); err != nil {
+                        http.Error(w, "Server error", http.StatusInternalServerError)
+                        return
+                }
+                if err := saveShippingZone(tx, &z); err != nil {
+                        http.Error(w, "Server error", http.StatusInternalServerError)
+                        return
+                }
+                if err := tx.Commit(); err != nil {
+                        http.Error(w, "Server error", http.StatusInternalServerError)
+                        return
+                }
+
+                w.Header().Set("Content-Type", "application/json")
+                w.WriteHeader(http.StatusCreated)
+                json.NewEncoder(w).Encode(z)
+
+        default:
+                http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+        }
+}
+
+// handleAdminShippingZoneDetail serves PUT and DELETE
+// /api/admin/shipping/zones/{id}. Orders keep their shipping method and cost,
+// so changing rates never changes past orders.
+func handleAdminShippingZoneDetail(w http.ResponseWriter, r *http.Request) {
+        idStr := strings.TrimPrefix(r.URL.Path, "/api/admin/shipping/zones/")
+        id, err := strconv.Atoi(idStr)
+        if err != nil {
+                http.Error(w, "Invalid zone ID", http.StatusBadRequest)
+                return
+        }
+
+        tx, err := db.Begin()
+        if err != nil {
+                http.Error(w, "Server error", http.StatusInternalServerError)
+                return
+        }
+        defer tx.Rollback()
+
+        var res sql.Result
+        switch r.Method {
+        case http.MethodPut:
+                var z ShippingZone
+                if err := json.NewDecoder(r.Body).Decode(&z); err != nil {
+                        http.Error(w, "Invalid request", http.StatusBadRequest)
+                        return
+                }
+                if err := validateShippingZone(&z); err != nil {
+                        http.Error(w, err.Error(), http.StatusBadRequest)
+                        return
+                }
+                z.ID = id
+
+                res, err = tx.Exec("UPDATE shipping_zones SET name = $1 WHERE id = $2", z.Name, id)
+                if err != nil {
+                        break
+                }
+                // Regions and rates of a missing zone would fail its foreign key.
+                if n, _ := res.RowsAffected(); n == 0 {
+                        http.Error(w, "Zone not found", http.StatusNotFound)
+                        return
+                }
+                err = saveShippingZone(tx, &z)
+
+        case http.MethodDelete:
+                res, err = tx.Exec("DELETE FROM shipping_zones WHERE id = $1", id)
+
+        default:
+                http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+                return
+        }
+
+        if err != nil {
+                http.Error(w, "Server error", http.StatusInternalServerError)
+                return
+        }
+        if n, _ := res.RowsAffected(); n == 0 {
+                http.Error(w, "Zone not found", http.StatusNotFound)
+                return
+        }
+        if err := tx.Commit(); err != nil {
+                http.Error(w, "Server error", http.StatusInternalServerError)
+                return
+        }
+
+        w.Header().Set("Content-Type", "application/json")
+        json.NewEncoder(w).Encode(map[string]bool{"success": true})
+}
@@ -0,0 +1,153 @@
+package main
+
+import (
+        "reflect"
+        "testing"
+)
+
+func floatPtr(f float64) *float64 { return &f }
+
+func TestShippingCosts(t *testing.T) {
+        tests := []struct {
+                name     string
+                lines    []QuoteLine
+                discount float64
+                rates    []ShippingRate
+                want     []ShippingOption
+        }{
+                {
+                        name:  "weight bands",
+                        lines: []QuoteLine{{UnitPrice: 10, Quantity: 2, weight: 400}, {UnitPrice: 5, Quantity: 1, weight: 250}},
+                        rates: []ShippingRate{
+                                {Method: "standard", Basis: shipByWeight, Min: 0, Max: floatPtr(1000), Price: 3.99},
+                                {Method: "standard", Basis: shipByWeight, Min: 1000, Max: floatPtr(5000), Price: 6.99},
+                        },
+                        want: []ShippingOption{{Method: "standard", Name: "Standard delivery", Cost: 6.99}},
+                },
+                {
+                        name:  "a band's max is exclusive",
+                        lines: []QuoteLine{{UnitPrice: 10, Quantity: 1, weight: 1000}},
+                        rates: []ShippingRate{
+                                {Method: "standard", Basis: shipByWeight, Max: floatPtr(1000), Price: 3.99},
+                        },
+                        want: []ShippingOption{},
+                },
+                {
+                        name:  "item count",
+                        lines: []QuoteLine{{UnitPrice: 10, Quantity: 3}, {UnitPrice: 5, Quantity: 2}},
+                        rates: []ShippingRate{
+                                {Method: "express", Basis: shipByCount, Min: 1, Max: floatPtr(5), Price: 9},
+                                {Method: "express", Basis: shipByCount, Min: 5, Price: 12},
+                        },
+                        want: []ShippingOption{{Method: "express", Name: "Express delivery", Cost: 12}},
+                },
+                {
+                        name:  "free over a cart value",
+                        lines: []QuoteLine{{UnitPrice: 35, Quantity: 1}},
+                        rates: []ShippingRate{
+                                {Method: "standard", Basis: shipByValue, Price: 4.99, FreeOver: floatPtr(35)},
+                        },
+                        want: []ShippingOption{{Method: "standard", Name: "Standard delivery", Cost: 0}},
+                },
+                {
+                        name:     "value is measured after discounts",
+                        lines:    []QuoteLine{{UnitPrice: 35, Quantity: 1}},
+                        discount: 0.01,
+                        rates: []ShippingRate{
+                                {Method: "standard", Basis: shipByValue, Price: 4.99, FreeOver: floatPtr(35)},
+                                {Method: "express", Basis: shipByValue, Min: 35, Price: 0},
+                        },
+                        want: []ShippingOption{{Method: "standard", Name: "Standard delivery", Cost: 4.99}},
+                },
+                {
+                        name:  "cheapest matching rate of a method wins, methods in listed order",
+                        lines: []QuoteLine{{UnitPrice: 20, Quantity: 2, weight: 300}},
+                        rates: []ShippingRate{
+                                {Method: "pickup", Basis: shipByCount, Price: 0},
+                                {Method: "express", Basis: shipByWeight, Price: 14.5},
+                                {Method: "standard", Basis: shipByWeight, Price: 5.25},
+                                {Method: "standard", Basis: shipByValue, Min: 30, Price: 2.75},
+                        },
+                        want: []ShippingOption{
+                                {Method: "standard", Name: "Standard delivery", Cost: 2.75},
+                                {Method: "express", Name: "Express delivery", Cost: 14.5},
+                                {Method: "pickup", Name: "Store pickup", Cost: 0},
+                        },
+                },
+        }
+        for _, tt := range tests {
+                t.Run(tt.name, func(t *testing.T) {
+                        quote := &CartQuote{Destination: Destination{Country: "US"}}
+                        for _, line := range tt.lines {
+                                quote.addLine(line)
+                        }
+                        quote.DiscountTotal = tt.discount
+                        if got := shippingCosts(quote, tt.rates); !reflect.DeepEqual(got, tt.want) {
+                                t.Errorf("shippingCosts() = %v, want %v", got, tt.want)
+                        }
+                })
+        }
+}
+
+func TestChooseShipping(t *testing.T) {
+        options := []ShippingOption{
+                {Method: "standard", Name: "Standard delivery", Cost: 4.99},
+                {Method: "express", Name: "Express delivery", Cost: 12},
+                {Method: "pickup", Name: "Store pickup", Cost: 0},
+        }
+
+        tests := []struct {
+                name       string
+                options    []ShippingOption
+                method     string
+                wantMethod string
+                wantCost   float64
+                wantError  bool
+        }{
+                {"cheapest when none is chosen", options, "", "pickup", 0, false},
+                {"chosen method", options, "express", "express", 12, false},
+                {"unavailable method", options[:2], "pickup", "", 0, true},
+                {"nothing ships there", []ShippingOption{}, "", "", 0, false},
+        }
+        for _, tt := range tests {
+                t.Run(tt.name, func(t *testing.T) {
+                        quote := &CartQuote{}
+                        quote.chooseShipping(tt.options, tt.method)
+                        if quote.ShippingMethod != tt.wantMethod || quote.Shipping != tt.wantCost {
+                                t.Errorf("got %q at %v, want %q at %v", quote.ShippingMethod, quote.Shipping, tt.wantMethod, tt.wantCost)
+                        }
+                        if (quote.ShippingError != "") != tt.wantError {
+                                t.Errorf("ShippingError = %q, want error %v", quote.ShippingError, tt.wantError)
+                        }
+                })
+        }
+}
+
+func TestValidateShippingZone(t *testing.T) {
+        tests := []struct {
+                name    string
+                zone    ShippingZone
+                wantErr bool
+        }{
+                {"valid", ShippingZone{Name: "Domestic", Regions: []ShippingRegion{{Country: "US"}},
+                        Rates: []ShippingRate{{Method: "standard", Basis: shipByWeight, Price: 4.99}}}, false},
+                {"name required", ShippingZone{Regions: []ShippingRegion{{Country: "US"}}}, true},
+                {"region needed", ShippingZone{Name: "Nowhere"}, true},
+                {"state without a country", ShippingZone{Name: "Odd", Regions: []ShippingRegion{{State: "CA"}}}, true},
+                {"unknown method", ShippingZone{Name: "Domestic", Regions: []ShippingRegion{{Country: "US"}},
+                        Rates: []ShippingRate{{Method: "drone", Basis: shipByWeight, Price: 4.99}}}, true},
+                {"unknown basis", ShippingZone{Name: "Domestic", Regions: []ShippingRegion{{Country: "US"}},
+                        Rates: []ShippingRate{{Method: "standard", Basis: "volume", Price: 4.99}}}, true},
+                {"negative price", ShippingZone{Name: "Domestic", Regions: []ShippingRegion{{Country: "US"}},
+                        Rates: []ShippingRate{{Method: "standard", Basis: shipByWeight, Price: -1}}}, true},
+                {"empty band", ShippingZone{Name: "Domestic", Regions: []ShippingRegion{{Country: "US"}},
+                        Rates: []ShippingRate{{Method: "standard", Basis: shipByWeight, Min: 500, Max: floatPtr(500), Price: 4}}}, true},
+        }
+        for _, tt := range tests {
+                t.Run(tt.name, func(t *testing.T) {
+                        if err := validateShippingZone(&tt.zone); (err != nil) != tt.wantErr {
+                                t.Errorf("validateShippingZone() error = %v, want error %v", err, tt.wantErr)
+                        }
+                })
+        }
+}
@@ -80,6 +80,10 @@ document.getElementById('book-form').addEventListener('submit', async (e) => {
         description: document.getElementById('book-description').value,
         price: parseFloat(document.getElementById('book-price').value),
         stock_quantity: parseInt(document.getElementById('book-stock').value),
+        max_per_customer: parseInt(document.getElementById('book-max-per-customer').value) || null,
+        tax_class: document.getElementById('book-tax-class').value,
+        weight_grams: parseInt(document.getElementById('book-weight').value) || 0,
+        gift_card: document.getElementById('book-gift-card').checked,
         category_id: parseInt(document.getElementById('book-category').value) || null,
         isbn: document.getElementById('book-isbn').value,
         publication_year: parseInt(document.getElementById('book-year').value) || null,
@@ -120,6 +124,10 @@ async function editBook(bookId) {
         document.getElementById('book-description').value = book.description || '';
         document.getElementById('book-price').value = book.price;
         document.getElementById('book-stock').value = book.stock_quantity;
+        document.getElementById('book-max-per-customer').value = book.max_per_customer || '';
+        document.getElementById('book-tax-class').value = book.tax_class || 'books';
+        document.getElementById('book-weight').value = book.weight_grams || '';
+        document.getElementById('book-gift-card').checked = !!book.gift_card;
         document.getElementById('book-category').value = book.category_id || '';
         document.getElementById('book-isbn').value = book.isbn || '';
         document.getElementById('book-year').value = book.publication_year || '';
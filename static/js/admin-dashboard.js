@@ -5,13 +5,14 @@ async function loadDashboardData() {
             fetch('/api/admin/orders')
         ]);
         
-        if (booksResponse.status === 403 || ordersResponse.status === 403) {
+        if (booksResponse.status === 403 && ordersResponse.status === 403) {
             window.location.href = '/';
             return;
         }
         
-        const books = await booksResponse.json();
-        const orders = await ordersResponse.json();
+        // Staff roles may only grant one of the two; show what is permitted.
+        const books = booksResponse.ok ? (await booksResponse.json()) || [] : [];
+        const orders = ordersResponse.ok ? (await ordersResponse.json()) || [] : [];
         
         let totalRevenue = 0;
         let pendingOrders = 0;
@@ -77,4 +78,58 @@ async function loadDashboardData() {
     }
 }
 
-loadDashboardData();
+async function startMFASetup() {
+    document.getElementById('mfa-setup').classList.remove('hidden');
+    
+    try {
+        const response = await fetch('/api/me/2fa/setup', { method: 'POST' });
+        if (!response.ok) {
+            showToast(await response.text(), 'error');
+            return;
+        }
+        
+        const setup = await response.json();
+        document.getElementById('mfa-qr').src = setup.qr_code;
+        document.getElementById('mfa-secret').textContent = setup.secret;
+    } catch (error) {
+        console.error('Failed to start 2FA setup:', error);
+    }
+}
+
+document.getElementById('mfa-enable-form').addEventListener('submit', async (e) => {
+    e.preventDefault();
+    
+    const code = document.getElementById('mfa-enable-code').value.trim();
+    
+    try {
+        const response = await fetch('/api/me/2fa/enable', {
+            method: 'POST',
+            headers: { 'Content-Type': 'application/json' },
+            body: JSON.stringify({ code })
+        });
+        
+        if (!response.ok) {
+            showToast(await response.text(), 'error');
+            return;
+        }
+        
+        const data = await response.json();
+        document.getElementById('mfa-recovery-codes').innerHTML = data.recovery_codes
+            .map(code => `<li>${code}</li>`).join('');
+        document.getElementById('mfa-setup-step').classList.add('hidden');
+        document.getElementById('mfa-recovery').classList.remove('hidden');
+    } catch (error) {
+        console.error('Failed to enable 2FA:', error);
+    }
+});
+
+async function initDashboard() {
+    const user = await checkAuth();
+    if (user && user.mfa_setup_required) {
+        startMFASetup();
+        return;
+    }
+    loadDashboardData();
+}
+
+initDashboard();
@@ -125,6 +125,9 @@ async function viewOrderDetails(orderId) {
                         </div>
                     </div>
                     
+                    ${order.status !== 'cancelled' ? `
+                        <a href="/api/admin/orders/${order.id}/invoice.pdf" target="_blank" class="block text-center text-purple-600 hover:underline mb-4">Download invoice (PDF)</a>
+                    ` : ''}
                     <button onclick="this.closest('.fixed').remove()" class="w-full bg-purple-600 text-white py-2 rounded-lg hover:bg-purple-700">
                         Close
                     </button>
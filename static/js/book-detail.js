@@ -26,7 +26,7 @@ async function loadBookDetail() {
                     ${book.category_name ? `<span class="inline-block bg-blue-100 text-blue-800 px-3 py-1 rounded-full mb-4">${book.category_name}</span>` : ''}
                     
                     <div class="mb-6">
-                        <p class="text-3xl font-bold text-blue-600">${formatPrice(book.price)}</p>
+                        <p class="text-3xl font-bold text-blue-600">${formatPrice(book.price, book.currency)}</p>
                         <p class="text-sm ${book.stock_quantity > 0 ? 'text-green-600' : 'text-red-600'} mt-2">
                             ${book.stock_quantity > 0 ? `${book.stock_quantity} in stock` : 'Out of stock'}
                         </p>
@@ -72,7 +72,7 @@ async function loadBookDetail() {
                     } else if (response.status === 401) {
                         window.location.href = '/login';
                     } else {
-                        showToast('Failed to add to cart', 'error');
+                        showToast(await response.text() || 'Failed to add to cart', 'error');
                     }
                 } catch (error) {
                     showToast('Failed to add to cart', 'error');
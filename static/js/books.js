@@ -52,7 +52,7 @@ async function loadBooks() {
                     ${book.category_name ? `<span class="inline-block bg-gray-200 text-gray-700 text-xs px-2 py-1 rounded mb-2">${book.category_name}</span>` : ''}
                     <p class="text-gray-500 text-sm mb-2">${book.stock_quantity > 0 ? 'In Stock' : 'Out of Stock'}</p>
                     <div class="flex justify-between items-center">
-                        <span class="text-blue-600 font-bold text-xl">${formatPrice(book.price)}</span>
+                        <span class="text-blue-600 font-bold text-xl">${formatPrice(book.price, book.currency)}</span>
                         <a href="/book/${book.id}" class="bg-blue-600 text-white px-4 py-2 rounded hover:bg-blue-700">
                             View
                         </a>
@@ -0,0 +1,22 @@
+document.getElementById('restore-btn').addEventListener('click', async () => {
+    const errorDiv = document.getElementById('error-message');
+    errorDiv.classList.add('hidden');
+
+    try {
+        const response = await fetch('/api/cart/restore', {
+            method: 'POST',
+            headers: { 'Content-Type': 'application/json' },
+            body: JSON.stringify({ token: new URLSearchParams(window.location.search).get('token') })
+        });
+        if (response.status === 404) {
+            window.location.href = '/cart?restore=expired';
+            return;
+        }
+        if (!response.ok) throw new Error(await response.text());
+
+        window.location.href = '/cart';
+    } catch (error) {
+        errorDiv.textContent = error.message || 'Failed to restore your cart';
+        errorDiv.classList.remove('hidden');
+    }
+});
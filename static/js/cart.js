@@ -23,11 +23,8 @@ async function loadCart() {
         cartItemsContainer.classList.remove('hidden');
         cartSummary.classList.remove('hidden');
         
-        let total = 0;
-        
         cartItemsContainer.innerHTML = items.map(item => {
             const subtotal = item.book.price * item.quantity;
-            total += subtotal;
             
             return `
                 <div class="bg-white rounded-lg shadow p-4">
@@ -39,7 +36,10 @@ async function loadCart() {
                         <div class="flex-1">
                             <h3 class="font-bold text-lg mb-1">${item.book.title}</h3>
                             <p class="text-gray-600 text-sm mb-2">${item.book.author}</p>
-                            <p class="text-blue-600 font-semibold">${formatPrice(item.book.price)}</p>
+                            <p class="text-blue-600 font-semibold">${formatPrice(item.book.price, item.book.currency)}</p>
+                            ${(item.warnings || []).map(warning => `
+                                <p class="text-sm text-orange-600 mt-1">⚠ ${warning.message}</p>
+                            `).join('')}
                             
                             <div class="flex items-center gap-4 mt-4">
                                 <div class="flex items-center gap-2">
@@ -49,7 +49,7 @@ async function loadCart() {
                                     <span class="px-4">${item.quantity}</span>
                                     <button onclick="updateQuantity(${item.book_id}, ${item.quantity + 1})" 
                                             class="bg-gray-200 px-3 py-1 rounded hover:bg-gray-300"
-                                            ${item.quantity >= item.book.stock_quantity ? 'disabled' : ''}>+</button>
+                                            ${item.quantity >= item.max_quantity ? 'disabled' : ''}>+</button>
                                 </div>
                                 
                                 <button onclick="removeItem(${item.book_id})" 
@@ -60,21 +60,82 @@ async function loadCart() {
                         </div>
                         
                         <div class="text-right">
-                            <p class="font-bold text-lg">${formatPrice(subtotal)}</p>
+                            <p class="font-bold text-lg">${formatPrice(subtotal, item.book.currency)}</p>
                         </div>
                     </div>
                 </div>
             `;
         }).join('');
         
-        document.getElementById('subtotal').textContent = formatPrice(total);
-        document.getElementById('total').textContent = formatPrice(total);
+        loadSummary();
         
     } catch (error) {
         console.error('Failed to load cart:', error);
     }
 }
 
+// The totals come from the server so they match what checkout will charge.
+async function loadSummary() {
+    try {
+        const response = await fetch('/api/cart/summary');
+        if (!response.ok) return;
+        
+        const summary = await response.json();
+        document.getElementById('subtotal').textContent = formatPrice(summary.subtotal, summary.currency);
+        document.getElementById('discounts').innerHTML = summary.discounts.map(discount => `
+            <div class="flex justify-between text-green-600">
+                <span>${discount.description || discount.code}</span>
+                <span class="font-semibold">-${formatPrice(discount.amount, summary.currency)}</span>
+            </div>
+        `).join('');
+        document.getElementById('coupon-form').classList.toggle('hidden', !!summary.coupon);
+        document.getElementById('coupon-applied').classList.toggle('hidden', !summary.coupon);
+        document.getElementById('coupon-name').textContent = summary.coupon || '';
+        const couponError = document.getElementById('coupon-error');
+        couponError.textContent = summary.coupon_error || '';
+        couponError.classList.toggle('hidden', !summary.coupon_error);
+        document.getElementById('shipping').textContent = formatPrice(summary.shipping, summary.currency);
+        document.getElementById('tax-label').textContent = summary.prices_include_tax ? 'Includes tax of' : 'Estimated tax';
+        document.getElementById('tax').textContent = formatPrice(summary.tax, summary.currency);
+        document.getElementById('total').textContent = formatPrice(summary.total, summary.currency);
+    } catch (error) {
+        console.error('Failed to load cart summary:', error);
+    }
+}
+
+document.getElementById('coupon-form').addEventListener('submit', async (e) => {
+    e.preventDefault();
+    
+    try {
+        const response = await fetch('/api/cart/coupon', {
+            method: 'POST',
+            headers: { 'Content-Type': 'application/json' },
+            body: JSON.stringify({ code: document.getElementById('coupon-code').value })
+        });
+        
+        if (response.ok) {
+            document.getElementById('coupon-code').value = '';
+            showToast('Code applied');
+            loadSummary();
+        } else {
+            showToast(await response.text() || 'Failed to apply code', 'error');
+        }
+    } catch (error) {
+        console.error('Failed to apply code:', error);
+    }
+});
+
+async function removeCoupon() {
+    try {
+        const response = await fetch('/api/cart/coupon', { method: 'DELETE' });
+        if (response.ok) {
+            loadSummary();
+        }
+    } catch (error) {
+        console.error('Failed to remove code:', error);
+    }
+}
+
 async function updateQuantity(bookId, newQuantity) {
     if (newQuantity < 1) return;
     
@@ -88,6 +149,8 @@ async function updateQuantity(bookId, newQuantity) {
         if (response.ok) {
             loadCart();
             updateCartCount();
+        } else {
+            showToast(await response.text() || 'Failed to update quantity', 'error');
         }
     } catch (error) {
         console.error('Failed to update quantity:', error);
@@ -114,4 +177,8 @@ async function removeItem(bookId) {
     }
 }
 
+if (new URLSearchParams(window.location.search).get('restore') === 'expired') {
+    showToast('That cart link has expired', 'error');
+}
+
 loadCart();
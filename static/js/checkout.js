@@ -1,7 +1,151 @@
+function toggleNewAddress() {
+    const useSaved = document.getElementById('address-select').value !== '';
+    const newAddress = document.getElementById('new-address');
+    newAddress.classList.toggle('hidden', useSaved);
+    newAddress.querySelectorAll('input[required], input[data-required]').forEach(input => {
+        input.dataset.required = 'true';
+        input.required = !useSaved;
+    });
+}
+
+let isGuest = false;
+
+function showGuestCheckout() {
+    isGuest = true;
+    document.getElementById('guest-email').classList.remove('hidden');
+    document.getElementById('email').required = true;
+    document.getElementById('save-address-option').classList.add('hidden');
+}
+
+async function loadSavedAddresses() {
+    try {
+        const response = await fetch('/api/addresses');
+        if (response.status === 401) {
+            showGuestCheckout();
+            return;
+        }
+        if (!response.ok) return;
+        
+        const addresses = await response.json();
+        if (addresses.length === 0) return;
+        
+        const select = document.getElementById('address-select');
+        addresses.forEach(address => {
+            const option = document.createElement('option');
+            option.value = address.id;
+            option.textContent = `${address.full_name}, ${address.address_line1}, ${address.city} ${address.postal_code}`;
+            select.insertBefore(option, select.lastElementChild);
+        });
+        select.value = addresses[0].id;
+        
+        document.getElementById('saved-addresses').classList.remove('hidden');
+        select.addEventListener('change', toggleNewAddress);
+        toggleNewAddress();
+    } catch (error) {
+        console.error('Failed to load addresses:', error);
+    }
+}
+
+// destinationParams describes the chosen address for the shipping quote and
+// cart summary endpoints.
+function destinationParams() {
+    const addressId = parseInt(document.getElementById('address-select').value);
+    if (addressId) {
+        return new URLSearchParams({ address_id: addressId });
+    }
+    return new URLSearchParams({
+        country: document.getElementById('country').value,
+        state: document.getElementById('state').value,
+        postal_code: document.getElementById('postal-code').value
+    });
+}
+
+async function loadShippingOptions() {
+    const container = document.getElementById('shipping-methods');
+    const params = destinationParams();
+    if (!params.get('address_id') && !params.get('country')) return;
+    
+    try {
+        const response = await fetch('/api/shipping/quote?' + params);
+        if (!response.ok) return;
+        
+        const data = await response.json();
+        const selected = document.querySelector('input[name="shipping-method"]:checked');
+        if (data.options.length === 0) {
+            container.innerHTML = '<p class="text-red-600">We don\'t ship to this address.</p>';
+        } else {
+            container.innerHTML = data.options.map(option => `
+                <label class="flex items-center gap-2">
+                    <input type="radio" name="shipping-method" value="${option.method}" required>
+                    <span class="flex-1">${option.name}</span>
+                    <span class="font-semibold">${option.cost > 0 ? formatPrice(option.cost, data.currency) : 'Free'}</span>
+                </label>
+            `).join('');
+            const previous = selected && container.querySelector(`input[value="${selected.value}"]`);
+            (previous || container.querySelector('input')).checked = true;
+            container.querySelectorAll('input').forEach(input => input.addEventListener('change', loadOrderSummary));
+        }
+        loadOrderSummary();
+    } catch (error) {
+        console.error('Failed to load shipping options:', error);
+    }
+}
+
+// The total shown is worked out by the server, the same way checkout will.
+async function loadOrderSummary() {
+    const params = destinationParams();
+    const method = document.querySelector('input[name="shipping-method"]:checked');
+    if (method) {
+        params.set('shipping_method', method.value);
+    }
+    
+    try {
+        const response = await fetch('/api/cart/summary?' + params);
+        if (!response.ok) return;
+        
+        const summary = await response.json();
+        document.getElementById('summary-subtotal').textContent = formatPrice(summary.subtotal, summary.currency);
+        document.getElementById('summary-discounts').textContent = '-' + formatPrice(summary.discount_total, summary.currency);
+        document.getElementById('summary-shipping').textContent = formatPrice(summary.shipping, summary.currency);
+        document.getElementById('summary-tax-label').textContent = summary.prices_include_tax ? 'Includes tax of' : 'Tax';
+        document.getElementById('summary-tax').textContent = formatPrice(summary.tax, summary.currency);
+        document.getElementById('summary-total').textContent = formatPrice(summary.total, summary.currency);
+        document.getElementById('order-summary').classList.remove('hidden');
+    } catch (error) {
+        console.error('Failed to load order summary:', error);
+    }
+}
+
+async function loadStoreCredit() {
+    if (isGuest) return;
+    try {
+        const response = await fetch('/api/me/store-credit');
+        if (!response.ok) return;
+        
+        const credit = await response.json();
+        if (credit.balance > 0) {
+            document.getElementById('store-credit-balance').textContent = formatPrice(credit.balance, credit.currency);
+            document.getElementById('store-credit-option').classList.remove('hidden');
+        }
+    } catch (error) {
+        console.error('Failed to load store credit:', error);
+    }
+}
+
+loadSavedAddresses().then(() => {
+    loadShippingOptions();
+    loadStoreCredit();
+});
+document.getElementById('address-select').addEventListener('change', loadShippingOptions);
+['country', 'state', 'postal-code'].forEach(id => {
+    document.getElementById(id).addEventListener('change', loadShippingOptions);
+});
+
 document.getElementById('checkout-form').addEventListener('submit', async (e) => {
     e.preventDefault();
     
-    const formData = {
+    const addressId = parseInt(document.getElementById('address-select').value);
+    const formData = addressId ? { address_id: addressId } : {
         full_name: document.getElementById('full-name').value,
         phone: document.getElementById('phone').value,
         address_line1: document.getElementById('address-line1').value,
@@ -9,8 +153,17 @@ document.getElementById('checkout-form').addEventListener('submit', async (e) =>
         city: document.getElementById('city').value,
         state: document.getElementById('state').value,
         postal_code: document.getElementById('postal-code').value,
-        country: document.getElementById('country').value
+        country: document.getElementById('country').value,
+        save_address: !isGuest && document.getElementById('save-address').checked
     };
+    if (isGuest) {
+        formData.email = document.getElementById('email').value;
+    }
+    const shippingMethod = document.querySelector('input[name="shipping-method"]:checked');
+    formData.shipping_method = shippingMethod ? shippingMethod.value : '';
+    formData.gift_cards = document.getElementById('gift-cards').value
+        .split(',').map(code => code.trim()).filter(code => code);
+    formData.use_store_credit = !isGuest && document.getElementById('use-store-credit').checked;
     
     const errorDiv = document.getElementById('error-message');
     errorDiv.classList.add('hidden');
@@ -28,6 +181,10 @@ document.getElementById('checkout-form').addEventListener('submit', async (e) =>
             document.getElementById('checkout-form-container').classList.add('hidden');
             document.getElementById('checkout-complete').classList.remove('hidden');
             document.getElementById('order-number').textContent = data.order_number;
+            if (data.guest) {
+                document.getElementById('guest-complete').classList.remove('hidden');
+                document.getElementById('order-details-link').classList.add('hidden');
+            }
             
             updateCartCount();
         } else {
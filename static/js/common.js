@@ -14,6 +14,10 @@ async function checkAuth() {
                 adminMenu.classList.remove('hidden');
             }
             
+            if (user.impersonator_id) {
+                showImpersonationBanner(user);
+            }
+            
             setupLogoutButton();
             return user;
         }
@@ -23,6 +27,30 @@ async function checkAuth() {
     return null;
 }
 
+function showImpersonationBanner(user) {
+    const banner = document.createElement('div');
+    banner.className = 'bg-yellow-300 text-yellow-900 text-center text-sm px-4 py-2';
+    banner.textContent = `You (${user.impersonator_email}) are viewing the store as ${user.full_name} <${user.email}>. Sensitive actions are disabled. `;
+    
+    const stopBtn = document.createElement('button');
+    stopBtn.className = 'underline font-semibold';
+    stopBtn.textContent = 'Stop impersonating';
+    stopBtn.addEventListener('click', async () => {
+        try {
+            const response = await fetch('/api/admin/impersonation/stop', { method: 'POST' });
+            if (response.ok) {
+                const data = await response.json();
+                window.location.href = data.redirect || '/admin';
+            }
+        } catch (error) {
+            console.error('Stop impersonation failed:', error);
+        }
+    });
+    
+    banner.appendChild(stopBtn);
+    document.body.prepend(banner);
+}
+
 function setupLogoutButton() {
     const logoutBtns = document.querySelectorAll('#logout-btn');
     logoutBtns.forEach(btn => {
@@ -48,8 +76,46 @@ function showToast(message, type = 'success') {
     }, 3000);
 }
 
-function formatPrice(price) {
-    return '$' + parseFloat(price).toFixed(2);
+// formatPrice shows an amount in currency, when the API says which; amounts
+// without one are in the store's base currency.
+function formatPrice(price, currency) {
+    if (!currency) {
+        return '$' + parseFloat(price).toFixed(2);
+    }
+    return new Intl.NumberFormat(undefined, { style: 'currency', currency }).format(price);
+}
+
+// setupCurrencySelector offers the currencies prices can be shown in. The
+// choice is kept in the session, so reloading shows every page in it.
+async function setupCurrencySelector() {
+    const select = document.getElementById('currency-select');
+    if (!select) return;
+    try {
+        const response = await fetch('/api/currencies');
+        if (!response.ok) return;
+        
+        const data = await response.json();
+        if (data.currencies.length < 2) return;
+        
+        select.innerHTML = data.currencies.map(code => `<option value="${code}">${code}</option>`).join('');
+        select.value = data.selected;
+        select.classList.remove('hidden');
+        select.addEventListener('change', async () => {
+            await fetch('/api/currencies?currency=' + encodeURIComponent(select.value));
+            window.location.reload();
+        });
+    } catch (error) {
+        console.error('Failed to load currencies:', error);
+    }
+}
+
+// tenderLabel names how part of an order was paid.
+function tenderLabel(payment) {
+    switch (payment.tender) {
+        case 'gift_card': return `gift card ending ${payment.gift_card_last4}`;
+        case 'store_credit': return 'store credit';
+        default: return 'card';
+    }
 }
 
 function formatDate(dateString) {
@@ -93,8 +159,10 @@ if (document.readyState === 'loading') {
     document.addEventListener('DOMContentLoaded', () => {
         checkAuth();
         updateCartCount();
+        setupCurrencySelector();
     });
 } else {
     checkAuth();
     updateCartCount();
+    setupCurrencySelector();
 }
@@ -131,9 +131,42 @@ async function viewOrder(orderId) {
                                     <p class="font-semibold">${formatPrice(item.subtotal)}</p>
                                 </div>
                             `).join('')}
+                            ${(order.discounts || []).map(discount => `
+                                <div class="flex justify-between text-green-600">
+                                    <p>${discount.description}${discount.code ? ` (${discount.code})` : ''}</p>
+                                    <p class="font-semibold">-${formatPrice(discount.amount)}</p>
+                                </div>
+                            `).join('')}
+                            ${order.shipping_method ? `
+                                <div class="flex justify-between text-gray-600">
+                                    <p>Shipping (${order.shipping_method})</p>
+                                    <p class="font-semibold">${formatPrice(order.shipping_amount)}</p>
+                                </div>
+                            ` : ''}
+                            ${order.tax_amount ? `
+                                <div class="flex justify-between text-gray-600">
+                                    <p>${order.prices_include_tax ? 'Includes tax of' : 'Tax'}</p>
+                                    <p class="font-semibold">${formatPrice(order.tax_amount)}</p>
+                                </div>
+                            ` : ''}
+                            ${(order.payments || []).map(payment => `
+                                <div class="flex justify-between text-gray-600">
+                                    <p>Paid by ${tenderLabel(payment)}</p>
+                                    <p class="font-semibold">${formatPrice(payment.amount)}</p>
+                                </div>
+                            `).join('')}
+                            ${order.exchange_rate && order.exchange_rate !== 1 ? `
+                                <div class="flex justify-between text-gray-600">
+                                    <p>Charged in ${order.currency} at ${order.exchange_rate}</p>
+                                    <p class="font-semibold">${formatPrice(order.total_amount * order.exchange_rate, order.currency)}</p>
+                                </div>
+                            ` : ''}
                         </div>
                     </div>
                     
+                    ${order.status !== 'cancelled' ? `
+                        <a href="/api/orders/${order.id}/invoice.pdf" target="_blank" class="block text-center text-blue-600 hover:underline mb-4">Download invoice (PDF)</a>
+                    ` : ''}
                     <button onclick="this.closest('.fixed').remove()" class="w-full bg-blue-600 text-white py-2 rounded-lg hover:bg-blue-700">
                         Close
                     </button>
@@ -147,4 +180,36 @@ async function viewOrder(orderId) {
     }
 }
 
+async function loadNotificationPreferences() {
+    try {
+        const response = await fetch('/api/me/notifications');
+        if (!response.ok) return;
+        const prefs = await response.json();
+
+        document.querySelectorAll('[data-category]').forEach(input => {
+            input.checked = prefs[input.dataset.category] !== false;
+            input.disabled = false;
+            input.addEventListener('change', () => saveNotificationPreference(input));
+        });
+    } catch (error) {
+        console.error('Failed to load notification preferences:', error);
+    }
+}
+
+async function saveNotificationPreference(input) {
+    try {
+        const response = await fetch('/api/me/notifications', {
+            method: 'PUT',
+            headers: { 'Content-Type': 'application/json' },
+            body: JSON.stringify({ [input.dataset.category]: input.checked })
+        });
+        if (!response.ok) throw new Error(await response.text());
+        showToast('Notification settings saved');
+    } catch (error) {
+        input.checked = !input.checked;
+        showToast('Failed to save notification settings', 'error');
+    }
+}
+
 loadOrders();
+loadNotificationPreferences();
@@ -20,7 +20,7 @@ async function loadFeaturedBooks() {
                     <h3 class="font-bold text-lg mb-2 truncate">${book.title}</h3>
                     <p class="text-gray-600 text-sm mb-2">${book.author}</p>
                     <div class="flex justify-between items-center">
-                        <span class="text-blue-600 font-bold text-xl">${formatPrice(book.price)}</span>
+                        <span class="text-blue-600 font-bold text-xl">${formatPrice(book.price, book.currency)}</span>
                         <a href="/book/${book.id}" class="bg-blue-600 text-white px-4 py-2 rounded hover:bg-blue-700">
                             View
                         </a>
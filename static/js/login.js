@@ -1,9 +1,30 @@
+function redirectAfterLogin(data) {
+    if (data.is_admin) {
+        window.location.href = '/admin';
+    } else {
+        window.location.href = '/';
+    }
+}
+
+function showMFAForm() {
+    document.getElementById('error-message').classList.add('hidden');
+    document.getElementById('login-form').classList.add('hidden');
+    document.getElementById('sso-login').classList.add('hidden');
+    document.getElementById('mfa-form').classList.remove('hidden');
+    document.getElementById('mfa-code').focus();
+}
+
+function showLoginError(message) {
+    const errorDiv = document.getElementById('error-message');
+    errorDiv.textContent = message;
+    errorDiv.classList.remove('hidden');
+}
+
 document.getElementById('login-form').addEventListener('submit', async (e) => {
     e.preventDefault();
     
     const email = document.getElementById('email').value;
     const password = document.getElementById('password').value;
-    const errorDiv = document.getElementById('error-message');
     
     try {
         const response = await fetch('/api/login', {
@@ -14,18 +35,65 @@ document.getElementById('login-form').addEventListener('submit', async (e) => {
         
         if (response.ok) {
             const data = await response.json();
-            if (data.is_admin) {
-                window.location.href = '/admin';
-            } else {
-                window.location.href = '/';
+            if (data.mfa_required) {
+                showMFAForm();
+                return;
             }
+            redirectAfterLogin(data);
         } else {
             const error = await response.text();
-            errorDiv.textContent = error || 'Login failed. Please check your credentials.';
-            errorDiv.classList.remove('hidden');
+            showLoginError(error || 'Login failed. Please check your credentials.');
         }
     } catch (error) {
-        errorDiv.textContent = 'An error occurred. Please try again.';
-        errorDiv.classList.remove('hidden');
+        showLoginError('An error occurred. Please try again.');
     }
 });
+
+document.getElementById('mfa-form').addEventListener('submit', async (e) => {
+    e.preventDefault();
+    
+    const value = document.getElementById('mfa-code').value.trim();
+    // Recovery codes look like "abcde-12345"; TOTP codes are 6 digits.
+    const body = /^\d{6}$/.test(value) ? { code: value } : { recovery_code: value };
+    
+    try {
+        const response = await fetch('/api/login/mfa', {
+            method: 'POST',
+            headers: { 'Content-Type': 'application/json' },
+            body: JSON.stringify(body)
+        });
+        
+        if (response.ok) {
+            redirectAfterLogin(await response.json());
+        } else {
+            const error = await response.text();
+            showLoginError(error || 'Verification failed.');
+            if (response.status === 401 && error.includes('expired')) {
+                document.getElementById('mfa-form').classList.add('hidden');
+                document.getElementById('login-form').classList.remove('hidden');
+            }
+        }
+    } catch (error) {
+        showLoginError('An error occurred. Please try again.');
+    }
+});
+
+async function initLoginPage() {
+    // Single sign-on redirects back here when the account also has 2FA.
+    if (new URLSearchParams(window.location.search).get('mfa') === 'required') {
+        showMFAForm();
+        return;
+    }
+    
+    try {
+        const response = await fetch('/api/auth/config');
+        const config = await response.json();
+        if (config.oidc_enabled) {
+            document.getElementById('sso-login').classList.remove('hidden');
+        }
+    } catch (error) {
+        console.error('Failed to load auth config:', error);
+    }
+}
+
+initLoginPage();
@@ -0,0 +1,139 @@
+const lookupParams = new URLSearchParams(window.location.search);
+
+function showLookupError(message) {
+    const errorDiv = document.getElementById('error-message');
+    errorDiv.textContent = message;
+    errorDiv.classList.remove('hidden');
+}
+
+function renderGuestOrder(order) {
+    const container = document.getElementById('order-details');
+    container.innerHTML = `
+        <div class="grid grid-cols-2 gap-4 mb-6">
+            <div>
+                <p class="text-sm text-gray-600">Order Number</p>
+                <p class="font-semibold">${order.order_number}</p>
+            </div>
+            <div>
+                <p class="text-sm text-gray-600">Order Date</p>
+                <p class="font-semibold">${formatDate(order.created_at)}</p>
+            </div>
+            <div>
+                <p class="text-sm text-gray-600">Status</p>
+                <span class="px-3 py-1 rounded-full text-xs font-semibold ${getStatusBadgeClass(order.status)}">
+                    ${order.status.toUpperCase()}
+                </span>
+            </div>
+            <div>
+                <p class="text-sm text-gray-600">Total Amount</p>
+                <p class="font-bold text-xl">${formatPrice(order.total_amount)}</p>
+                ${order.status !== 'cancelled' ? `
+                    <a href="/api/guest-orders/invoice.pdf?${lookupParams.toString()}" target="_blank" class="text-blue-600 hover:underline text-sm">Download invoice (PDF)</a>
+                ` : ''}
+            </div>
+        </div>
+        
+        <div class="mb-6">
+            <h3 class="font-bold mb-2">Shipping Address</h3>
+            <p>${order.shipping_address.full_name}</p>
+            <p>${order.shipping_address.address_line1}</p>
+            ${order.shipping_address.address_line2 ? `<p>${order.shipping_address.address_line2}</p>` : ''}
+            <p>${order.shipping_address.city}, ${order.shipping_address.state} ${order.shipping_address.postal_code}</p>
+            <p>${order.shipping_address.country}</p>
+        </div>
+        
+        <div>
+            <h3 class="font-bold mb-2">Order Items</h3>
+            <div class="space-y-2">
+                ${(order.items || []).map(item => `
+                    <div class="flex justify-between border-b pb-2">
+                        <div>
+                            <p class="font-semibold">${item.book_title}</p>
+                            <p class="text-sm">Quantity: ${item.quantity} × ${formatPrice(item.price_at_purchase)}</p>
+                        </div>
+                        <p class="font-semibold">${formatPrice(item.subtotal)}</p>
+                    </div>
+                `).join('')}
+                ${(order.discounts || []).map(discount => `
+                    <div class="flex justify-between text-green-600">
+                        <p>${discount.description}${discount.code ? ` (${discount.code})` : ''}</p>
+                        <p class="font-semibold">-${formatPrice(discount.amount)}</p>
+                    </div>
+                `).join('')}
+                ${order.shipping_method ? `
+                    <div class="flex justify-between text-gray-600">
+                        <p>Shipping (${order.shipping_method})</p>
+                        <p class="font-semibold">${formatPrice(order.shipping_amount)}</p>
+                    </div>
+                ` : ''}
+                ${order.tax_amount ? `
+                    <div class="flex justify-between text-gray-600">
+                        <p>${order.prices_include_tax ? 'Includes tax of' : 'Tax'}</p>
+                        <p class="font-semibold">${formatPrice(order.tax_amount)}</p>
+                    </div>
+                ` : ''}
+                ${(order.payments || []).map(payment => `
+                    <div class="flex justify-between text-gray-600">
+                        <p>Paid by ${tenderLabel(payment)}</p>
+                        <p class="font-semibold">${formatPrice(payment.amount)}</p>
+                    </div>
+                `).join('')}
+                ${order.exchange_rate && order.exchange_rate !== 1 ? `
+                    <div class="flex justify-between text-gray-600">
+                        <p>Charged in ${order.currency} at ${order.exchange_rate}</p>
+                        <p class="font-semibold">${formatPrice(order.total_amount * order.exchange_rate, order.currency)}</p>
+                    </div>
+                ` : ''}
+            </div>
+        </div>
+    `;
+    container.classList.remove('hidden');
+}
+
+async function loadGuestOrder() {
+    try {
+        const response = await fetch('/api/guest-orders?' + lookupParams.toString());
+        if (!response.ok) {
+            showLookupError('We could not find this order. Please use the link from your order email.');
+            return;
+        }
+        
+        const data = await response.json();
+        renderGuestOrder(data.order);
+        if (!data.has_account) {
+            document.getElementById('full-name').value = data.order.shipping_address.full_name || '';
+            document.getElementById('convert-account').classList.remove('hidden');
+        }
+    } catch (error) {
+        showLookupError('An error occurred. Please try again.');
+    }
+}
+
+document.getElementById('convert-form').addEventListener('submit', async (e) => {
+    e.preventDefault();
+    
+    try {
+        const response = await fetch('/api/guest-orders/convert', {
+            method: 'POST',
+            headers: { 'Content-Type': 'application/json' },
+            body: JSON.stringify({
+                order_number: lookupParams.get('order_number'),
+                email: lookupParams.get('email'),
+                token: lookupParams.get('token'),
+                full_name: document.getElementById('full-name').value,
+                password: document.getElementById('password').value
+            })
+        });
+        
+        if (response.ok) {
+            window.location.href = '/customer/dashboard';
+        } else {
+            const error = await response.text();
+            showLookupError(error || 'Could not create your account.');
+        }
+    } catch (error) {
+        showLookupError('An error occurred. Please try again.');
+    }
+});
+
+loadGuestOrder();
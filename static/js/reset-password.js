@@ -0,0 +1,37 @@
+function showResetError(message) {
+    const errorDiv = document.getElementById('error-message');
+    errorDiv.textContent = message;
+    errorDiv.classList.remove('hidden');
+}
+
+document.getElementById('reset-form').addEventListener('submit', async (e) => {
+    e.preventDefault();
+    
+    const token = new URLSearchParams(window.location.search).get('token');
+    const newPassword = document.getElementById('new-password').value;
+    const confirmPassword = document.getElementById('confirm-password').value;
+    
+    if (newPassword !== confirmPassword) {
+        showResetError('Passwords do not match.');
+        return;
+    }
+    
+    try {
+        const response = await fetch('/api/password-reset', {
+            method: 'POST',
+            headers: { 'Content-Type': 'application/json' },
+            body: JSON.stringify({ token, new_password: newPassword })
+        });
+        
+        if (response.ok) {
+            document.getElementById('error-message').classList.add('hidden');
+            document.getElementById('reset-form').classList.add('hidden');
+            document.getElementById('success-message').classList.remove('hidden');
+        } else {
+            const error = await response.text();
+            showResetError(error || 'Could not reset your password.');
+        }
+    } catch (error) {
+        showResetError('An error occurred. Please try again.');
+    }
+});
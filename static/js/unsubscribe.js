@@ -0,0 +1,19 @@
+document.getElementById('unsubscribe-btn').addEventListener('click', async () => {
+    const errorDiv = document.getElementById('error-message');
+    errorDiv.classList.add('hidden');
+
+    try {
+        const response = await fetch('/api/notifications/unsubscribe', {
+            method: 'POST',
+            headers: { 'Content-Type': 'application/json' },
+            body: JSON.stringify({ token: new URLSearchParams(window.location.search).get('token') })
+        });
+        if (!response.ok) throw new Error(await response.text());
+
+        document.getElementById('unsubscribe-prompt').classList.add('hidden');
+        document.getElementById('unsubscribe-done').classList.remove('hidden');
+    } catch (error) {
+        errorDiv.textContent = error.message || 'Failed to unsubscribe';
+        errorDiv.classList.remove('hidden');
+    }
+});
@@ -0,0 +1,148 @@
+package main
+
+import (
+        "database/sql"
+        "encoding/json"
+        "net/http"
+)
+
+// storeCreditBalance sums the user's store credit ledger. With lock set the
+// user row is locked first, so concurrent checkouts can't both spend the
+// same credit.
+func storeCreditBalance(q queryer, userID int, lock bool) (float64, error) {
+        if lock {
+                var id int
+                if err := q.QueryRow("SELECT id FROM users WHERE id = $1 FOR UPDATE", userID).Scan(&id); err != nil {
+                        return 0, err
+                }
+        }
+        var balance float64
+        err := q.QueryRow("SELECT COALESCE(SUM(amount), 0) FROM store_credit_transactions WHERE user_id = $1", userID).
+                Scan(&balance)
+        return balance, err
+}
+
+func loadStoreCreditLedger(userID int) ([]LedgerEntry, error) {
+        rows, err := db.Query(`SELECT amount, order_id, note, created_at FROM store_credit_transactions
+                               WHERE user_id = $1 ORDER BY created_at, id`, userID)
+        if err != nil {
+                return nil, err
+        }
+        defer rows.Close()
+
+        entries := []LedgerEntry{}
+        for rows.Next() {
+                var e LedgerEntry
+                if err := rows.Scan(&e.Amount, &e.OrderID, &e.Note, &e.CreatedAt); err != nil {
+                        return nil, err
+                }
+                entries = append(entries, e)
+        }
+        return entries, rows.Err()
+}
+
+func writeStoreCredit(w http.ResponseWriter, userID int) {
+        balance, err := storeCreditBalance(db, userID, false)
+        if err != nil {
+                http.Error(w, "Server error", http.StatusInternalServerError)
+                return
+        }
+        ledger, err := loadStoreCreditLedger(userID)
+        if err != nil {
+                http.Error(w, "Server error", http.StatusInternalServerError)
+                return
+        }
+
+        w.Header().Set("Content-Type", "application/json")
+        json.NewEncoder(w).Encode(map[string]interface{}{
+                "balance":  roundCents(balance),
+                "currency": baseCurrency,
+                "ledger":   ledger,
+        })
+}
+
+// handleStoreCredit serves GET /api/me/store-credit.
+func handleStoreCredit(w http.ResponseWriter, r *http.Request) {
+        if r.Method != http.MethodGet {
+                http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+                return
+        }
+
+        user, err := getAccountUser(r)
+        if err != nil {
+                http.Error(w, "Unauthorized", http.StatusUnauthorized)
+                return
+        }
+
+        writeStoreCredit(w, user.ID)
+}
+
+// handleAdminUserStoreCredit serves GET /api/admin/users/{id}/store-credit
+// and POST, which grants credit (for a return, say) or, with a negative
+// amount, takes some back.
+func handleAdminUserStoreCredit(w http.ResponseWriter, r *http.Request, id int) {
+        if _, err := loadUser(id); err != nil && err != errAccountDisabled {
+                http.Error(w, "User not found", http.StatusNotFound)
+                return
+        }
+
+        if r.Method == http.MethodGet {
+                writeStoreCredit(w, id)
+                return
+        }
+
+        actor, _ := getCurrentUser(r)
+
+        var req struct {
+                Amount float64 `json:"amount"`
+                Note   string  `json:"note"`
+        }
+        if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+                http.Error(w, "Invalid request", http.StatusBadRequest)
+                return
+        }
+        req.Amount = roundCents(req.Amount)
+        if req.Amount == 0 {
+                http.Error(w, "Amount is required", http.StatusBadRequest)
+                return
+        }
+        if req.Note == "" {
+                http.Error(w, "Note is required", http.StatusBadRequest)
+                return
+        }
+
+        tx, err := db.Begin()
+        if err != nil {
+                http.Error(w, "Server error", http.StatusInternalServerError)
+                return
+        }
+        defer tx.Rollback()
+
+        balance, err := storeCreditBalance(tx, id, true)
+        if err != nil && err != sql.ErrNoRows {
+                http.Error(w, "Server error", http.StatusInternalServerError)
+                return
+        }
+        if balance+req.Amount < 0 {
+                http.Error(w, "Store credit can't go below zero", http.StatusBadRequest)
+                return
+        }
+
+        _, err = tx.Exec(`INSERT INTO store_credit_transactions (user_id, amount, actor_id, note) VALUES ($1, $2, $3, $4)`,
+                id, req.Amount, actor.ID, req.Note)
+        if err != nil {
+                http.Error(w, "Server error", http.StatusInternalServerError)
+                return
+        }
+        if err := tx.Commit(); err != nil {
+                http.Error(w, "Server error", http.StatusInternalServerError)
+                return
+        }
+
+        recordAdminAudit(r, actor.ID, "user.store_credit_adjusted", id, map[string]interface{}{
+                "amount": req.Amount,
+                "note":   req.Note,
+        })
+
+        writeStoreCredit(w, id)
+}
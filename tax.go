@@ -0,0 +1,255 @@
+package main
+
+import (
+        "encoding/json"
+        "fmt"
+        "net/http"
+        "strconv"
+        "strings"
+)
+
+// Tax classes a book can have. Rates are configured per class, since books
+// are often taxed at a reduced rate and ebooks at yet another.
+const (
+        taxClassStandard = "standard"
+        taxClassBooks    = "books"
+        taxClassEbooks   = "ebooks"
+)
+
+func validTaxClass(class string) bool {
+        return class == taxClassStandard || class == taxClassBooks || class == taxClassEbooks
+}
+
+// pricesIncludeTax means book prices already contain tax, which is then
+// worked out of them instead of added on top. Off unless
+// PRICES_INCLUDE_TAX=true.
+var pricesIncludeTax bool
+
+// TaxRate is the rate, in percent, for a jurisdiction. State, PostalCodePrefix
+// and TaxClass left empty match anything.
+type TaxRate struct {
+        ID               int     `json:"id"`
+        Country          string  `json:"country"`
+        State            string  `json:"state"`
+        PostalCodePrefix string  `json:"postal_code_prefix"`
+        TaxClass         string  `json:"tax_class"`
+        Rate             float64 `json:"rate"`
+        Name             string  `json:"name"`
+}
+
+func normalizePostalCode(code string) string {
+        return strings.ToUpper(strings.NewReplacer(" ", "", "-", "").Replace(code))
+}
+
+func (t TaxRate) matches(dest Destination, class string) bool {
+        return strings.EqualFold(t.Country, dest.Country) &&
+                (t.State == "" || strings.EqualFold(t.State, dest.State)) &&
+                strings.HasPrefix(normalizePostalCode(dest.PostalCode), normalizePostalCode(t.PostalCodePrefix)) &&
+                (t.TaxClass == "" || t.TaxClass == class)
+}
+
+// specificity ranks matching rates: a longer postal code prefix beats a
+// state, which beats a tax class.
+func (t TaxRate) specificity() int {
+        score := len(normalizePostalCode(t.PostalCodePrefix)) * 4
+        if t.State != "" {
+                score += 2
+        }
+        if t.TaxClass != "" {
+                score++
+        }
+        return score
+}
+
+// applyTax sets the tax on every line of quote from the most specific rate
+// for its destination and the book's tax class. Tax is charged on what the
+// line costs after discounts. A quote without a destination has no tax.
+func applyTax(q queryer, quote *CartQuote) error {
+        if quote.Destination.Country == "" {
+                return nil
+        }
+
+        rows, err := q.Query(`SELECT id, country, state, postal_code_prefix, tax_class, rate, name
+                              FROM tax_rates WHERE UPPER(country) = UPPER($1)`, quote.Destination.Country)
+        if err != nil {
+                return err
+        }
+        var rates []TaxRate
+        for rows.Next() {
+                var t TaxRate
+                if err := rows.Scan(&t.ID, &t.Country, &t.State, &t.PostalCodePrefix, &t.TaxClass, &t.Rate, &t.Name); err != nil {
+                        rows.Close()
+                        return err
+                }
+                rates = append(rates, t)
+        }
+        rows.Close()
+        if err := rows.Err(); err != nil {
+                return err
+        }
+
+        quote.addTax(rates)
+        return nil
+}
+
+// addTax sets the tax on every line of q from the most specific of rates
+// that matches its destination and the book's tax class.
+func (q *CartQuote) addTax(rates []TaxRate) {
+        for i := range q.Lines {
+                line := &q.Lines[i]
+                if line.giftCard {
+                        // Tax is due when the card is spent, not when it is bought.
+                        continue
+                }
+                best := -1
+                for j, t := range rates {
+                        if t.matches(q.Destination, line.taxClass) && (best < 0 || t.specificity() > rates[best].specificity()) {
+                                best = j
+                        }
+                }
+                if best < 0 {
+                        continue
+                }
+
+                line.TaxRate = rates[best].Rate
+                base := line.Subtotal - line.Discount
+                if q.PricesIncludeTax {
+                        line.Tax = roundCents(base - base/(1+line.TaxRate/100))
+                } else {
+                        line.Tax = roundCents(base * line.TaxRate / 100)
+                }
+                q.Tax += line.Tax
+        }
+        q.Tax = roundCents(q.Tax)
+}
+
+func validateTaxRate(t *TaxRate) error {
+        t.Country = strings.TrimSpace(t.Country)
+        t.State = strings.TrimSpace(t.State)
+        t.PostalCodePrefix = normalizePostalCode(strings.TrimSpace(t.PostalCodePrefix))
+        t.Name = strings.TrimSpace(t.Name)
+        switch {
+        case t.Country == "":
+                return fmt.Errorf("Country is required")
+        case t.TaxClass != "" && !validTaxClass(t.TaxClass):
+                return fmt.Errorf("Tax class must be standard, books or ebooks")
+        case t.Rate < 0 || t.Rate > 100:
+                return fmt.Errorf("Rate must be between 0 and 100")
+        }
+        return nil
+}
+
+// handleAdminTaxRates serves GET (list) and POST (create) /api/admin/tax-rates.
+func handleAdminTaxRates(w http.ResponseWriter, r *http.Request) {
+        switch r.Method {
+        case http.MethodGet:
+                rows, err := db.Query(`SELECT id, country, state, postal_code_prefix, tax_class, rate, name
+                                       FROM tax_rates ORDER BY country, state, postal_code_prefix, tax_class`)
+                if err != nil {
+                        http.Error(w, "Server error", http.StatusInternalServerError)
+                        return
+                }
+                defer rows.Close()
+
+                rates := []TaxRate{}
+                for rows.Next() {
+                        var t TaxRate
+                        if err := rows.Scan(&t.ID, &t.Country, &t.State, &t.PostalCodePrefix, &t.TaxClass, &t.Rate, &t.Name); err != nil {
+                                continue
+                        }
+                        rates = append(rates, t)
+                }
+
+                w.Header().Set("Content-Type", "application/json")
+                json.NewEncoder(w).Encode(rates)
+
+        case http.MethodPost:
+                var t TaxRate
+                if err := json.NewDecoder(r.Body).Decode(&t); err != nil {
+                        http.Error(w, "Invalid request", http.StatusBadRequest)
+                        return
+                }
+                if err := validateTaxRate(&t); err != nil {
+                        http.Error(w, err.Error(), http.StatusBadRequest)
+                        return
+                }
+
+                err := db.QueryRow(`INSERT INTO tax_rates (country, state, postal_code_prefix, tax_class, rate, name)
+                                    VALUES ($1, $2, $3, $4, $5, $6) RETURNING id`,
+                        t.Country, t.State, t.PostalCodePrefix, t.TaxClass, t.Rate, t.Name).Scan(&t.ID)
+                if err != nil {
+                        if strings.Contains(err.Error(), "duplicate") {
+                                http.Error(w, "A rate for this jurisdiction and tax class already exists", http.StatusConflict)
+                                return
+                        }
+                        http.Error(w, "Server error", http.StatusInternalServerError)
+                        return
+                }
+
+                w.Header().Set("Content-Type", "application/json")
+                w.WriteHeader(http.StatusCreated)
+                json.NewEncoder(w).Encode(t)
+
+        default:
+                http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+        }
+}
+
+// handleAdminTaxRateDetail serves PUT and DELETE /api/admin/tax-rates/{id}.
+// Orders keep the rate and tax of each line, so changing a rate never
+// changes past orders.
+func handleAdminTaxRateDetail(w http.ResponseWriter, r *http.Request) {
+        idStr := strings.TrimPrefix(r.URL.Path, "/api/admin/tax-rates/")
+        id, err := strconv.Atoi(idStr)
+        if err != nil {
+                http.Error(w, "Invalid tax rate ID", http.StatusBadRequest)
+                return
+        }
+
+        var n int64
+        switch r.Method {
+        case http.MethodPut:
+                var t TaxRate
+                if err := json.NewDecoder(r.Body).Decode(&t); err != nil {
+                        http.Error(w, "Invalid request", http.StatusBadRequest)
+                        return
+                }
+                if err := validateTaxRate(&t); err != nil {
+                        http.Error(w, err.Error(), http.StatusBadRequest)
+                        return
+                }
+
+                res, err := db.Exec(`UPDATE tax_rates SET country = $1, state = $2, postal_code_prefix = $3, tax_class = $4,
+                                     rate = $5, name = $6 WHERE id = $7`,
+                        t.Country, t.State, t.PostalCodePrefix, t.TaxClass, t.Rate, t.Name, id)
+                if err != nil {
+                        if strings.Contains(err.Error(), "duplicate") {
+                                http.Error(w, "A rate for this jurisdiction and tax class already exists", http.StatusConflict)
+                                return
+                        }
+                        http.Error(w, "Server error", http.StatusInternalServerError)
+                        return
+                }
+                n, _ = res.RowsAffected()
+
+        case http.MethodDelete:
+                res, err := db.Exec("DELETE FROM tax_rates WHERE id = $1", id)
+                if err != nil {
+                        http.Error(w, "Server error", http.StatusInternalServerError)
+                        return
+                }
+                n, _ = res.RowsAffected()
+
+        default:
+                http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+                return
+        }
+
+        if n == 0 {
+                http.Error(w, "Tax rate not found", http.StatusNotFound)
+                return
+        }
+
+        w.Header().Set("Content-Type", "application/json")
+        json.NewEncoder(w).Encode(map[string]bool{"success": true})
+}
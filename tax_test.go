@@ -0,0 +1,146 @@
+package main
+
+import "testing"
+
+func TestTaxRateSelection(t *testing.T) {
+        rates := []TaxRate{
+                {Country: "US", Rate: 5, Name: "country"},
+                {Country: "US", TaxClass: taxClassBooks, Rate: 2, Name: "country books"},
+                {Country: "US", State: "NY", Rate: 8, Name: "state"},
+                {Country: "US", State: "NY", TaxClass: taxClassEbooks, Rate: 4, Name: "state ebooks"},
+                {Country: "US", State: "NY", PostalCodePrefix: "100", Rate: 8.875, Name: "city"},
+                {Country: "CA", Rate: 13, Name: "other country"},
+        }
+
+        tests := []struct {
+                name  string
+                dest  Destination
+                class string
+                want  float64
+        }{
+                {"country rate", Destination{Country: "US", State: "TX"}, taxClassStandard, 5},
+                {"country is matched case-insensitively", Destination{Country: "us", State: "TX"}, taxClassStandard, 5},
+                {"class beats plain country", Destination{Country: "US", State: "TX"}, taxClassBooks, 2},
+                {"state beats class", Destination{Country: "US", State: "NY", PostalCode: "12207"}, taxClassBooks, 8},
+                {"state and class beat state", Destination{Country: "US", State: "ny", PostalCode: "12207"}, taxClassEbooks, 4},
+                {"postal code prefix beats state and class", Destination{Country: "US", State: "NY", PostalCode: "10001"}, taxClassEbooks, 8.875},
+                {"postal codes are normalized", Destination{Country: "US", State: "NY", PostalCode: "1 00-01"}, taxClassStandard, 8.875},
+                {"no rate for the country", Destination{Country: "MX"}, taxClassStandard, 0},
+        }
+        for _, tt := range tests {
+                t.Run(tt.name, func(t *testing.T) {
+                        quote := &CartQuote{Destination: tt.dest}
+                        quote.addLine(QuoteLine{BookID: 1, UnitPrice: 100, Quantity: 1, taxClass: tt.class})
+                        quote.addTax(rates)
+                        if got := quote.Lines[0].TaxRate; got != tt.want {
+                                t.Errorf("rate = %v, want %v", got, tt.want)
+                        }
+                })
+        }
+}
+
+func TestAddTax(t *testing.T) {
+        rates := []TaxRate{
+                {Country: "DE", Rate: 19},
+                {Country: "DE", TaxClass: taxClassBooks, Rate: 7},
+        }
+        de := Destination{Country: "DE", PostalCode: "10115"}
+
+        tests := []struct {
+                name             string
+                pricesIncludeTax bool
+                lines            []QuoteLine
+                wantLineTax      []float64
+                wantTax          float64
+        }{
+                {
+                        name: "added on top, per line",
+                        lines: []QuoteLine{{UnitPrice: 10, Quantity: 3, taxClass: taxClassBooks},
+                                {UnitPrice: 4.99, Quantity: 1, taxClass: taxClassStandard}},
+                        wantLineTax: []float64{2.1, 0.95},
+                        wantTax:     3.05,
+                },
+                {
+                        name:             "worked out of prices that include it",
+                        pricesIncludeTax: true,
+                        lines: []QuoteLine{{UnitPrice: 10.7, Quantity: 1, taxClass: taxClassBooks},
+                                {UnitPrice: 11.9, Quantity: 2, taxClass: taxClassStandard}},
+                        wantLineTax: []float64{0.7, 3.8},
+                        wantTax:     4.5,
+                },
+                {
+                        name:        "charged after the line's discount",
+                        lines:       []QuoteLine{{UnitPrice: 20, Quantity: 1, Discount: 5, taxClass: taxClassBooks}},
+                        wantLineTax: []float64{1.05},
+                        wantTax:     1.05,
+                },
+                {
+                        name:             "included tax after the line's discount",
+                        pricesIncludeTax: true,
+                        lines:            []QuoteLine{{UnitPrice: 23.8, Quantity: 1, Discount: 11.9, taxClass: taxClassStandard}},
+                        wantLineTax:      []float64{1.9},
+                        wantTax:          1.9,
+                },
+                {
+                        name:        "per-line rounding is what adds up",
+                        lines:       []QuoteLine{{UnitPrice: 0.05, Quantity: 1}, {UnitPrice: 0.05, Quantity: 1}, {UnitPrice: 0.05, Quantity: 1}},
+                        wantLineTax: []float64{0.01, 0.01, 0.01},
+                        wantTax:     0.03,
+                },
+                {
+                        name:        "gift cards are not taxed",
+                        lines:       []QuoteLine{{UnitPrice: 50, Quantity: 1, giftCard: true}},
+                        wantLineTax: []float64{0},
+                        wantTax:     0,
+                },
+        }
+        for _, tt := range tests {
+                t.Run(tt.name, func(t *testing.T) {
+                        quote := &CartQuote{Destination: de, PricesIncludeTax: tt.pricesIncludeTax}
+                        for _, line := range tt.lines {
+                                discount := line.Discount
+                                quote.addLine(line)
+                                quote.Lines[len(quote.Lines)-1].Discount = discount
+                        }
+                        quote.addTax(rates)
+
+                        var got []float64
+                        for _, line := range quote.Lines {
+                                got = append(got, line.Tax)
+                        }
+                        if !sameAmounts(got, tt.wantLineTax) {
+                                t.Errorf("line tax = %v, want %v", got, tt.wantLineTax)
+                        }
+                        if quote.Tax != tt.wantTax {
+                                t.Errorf("Tax = %v, want %v", quote.Tax, tt.wantTax)
+                        }
+                })
+        }
+}
+
+func TestValidateTaxRate(t *testing.T) {
+        tests := []struct {
+                name    string
+                rate    TaxRate
+                wantErr bool
+        }{
+                {"valid", TaxRate{Country: "US", State: "NY", Rate: 8}, false},
+                {"country required", TaxRate{Country: " ", Rate: 8}, true},
+                {"unknown class", TaxRate{Country: "US", TaxClass: "food", Rate: 8}, true},
+                {"negative rate", TaxRate{Country: "US", Rate: -1}, true},
+                {"over 100 percent", TaxRate{Country: "US", Rate: 101}, true},
+        }
+        for _, tt := range tests {
+                t.Run(tt.name, func(t *testing.T) {
+                        if err := validateTaxRate(&tt.rate); (err != nil) != tt.wantErr {
+                                t.Errorf("validateTaxRate() error = %v, want error %v", err, tt.wantErr)
+                        }
+                })
+        }
+
+        rate := TaxRate{Country: " GB ", PostalCodePrefix: " sw1a-1 "}
+        validateTaxRate(&rate)
+        if rate.Country != "GB" || rate.PostalCodePrefix != "SW1A1" {
+                t.Errorf("normalized to %q, %q; want \"GB\", \"SW1A1\"", rate.Country, rate.PostalCodePrefix)
+        }
+}
@@ -0,0 +1,481 @@
+package main
+
+import (
+        "crypto/hmac"
+        "crypto/rand"
+        "crypto/sha1"
+        "crypto/sha256"
+        "crypto/subtle"
+        "database/sql"
+        "encoding/base32"
+        "encoding/base64"
+        "encoding/binary"
+        "encoding/hex"
+        "encoding/json"
+        "fmt"
+        "net/http"
+        "net/url"
+        "strings"
+        "time"
+
+        "github.com/skip2/go-qrcode"
+)
+
+const (
+        totpIssuer        = "Bookstore"
+        totpPeriod        = 30
+        totpDigits        = 6
+        recoveryCodeCount = 10
+        mfaLoginTimeout   = 5 * time.Minute
+        mfaMaxAttempts    = 5
+)
+
+// requireAdminMFA is set from REQUIRE_ADMIN_2FA. When true, admin accounts
+// without TOTP enabled lose admin access until they enrol.
+var requireAdminMFA bool
+
+var totpEncoding = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+func generateTOTPSecret() (string, error) {
+        buf := make([]byte, 20)
+        if _, err := rand.Read(buf); err != nil {
+                return "", err
+        }
+        return totpEncoding.EncodeToString(buf), nil
+}
+
+// totpCode computes the RFC 6238 code (HMAC-SHA1, 6 digits) for a time step.
+func totpCode(secret string, step int64) (string, error) {
+        key, err := totpEncoding.DecodeString(strings.ToUpper(secret))
+        if err != nil {
+                return "", err
+        }
+
+        var msg [8]byte
+        binary.BigEndian.PutUint64(msg[:], uint64(step))
+        mac := hmac.New(sha1.New, key)
+        mac.Write(msg[:])
+        sum := mac.Sum(nil)
+
+        offset := sum[len(sum)-1] & 0x0f
+        value := binary.BigEndian.Uint32(sum[offset:offset+4]) & 0x7fffffff
+        return fmt.Sprintf("%0*d", totpDigits, value%1000000), nil
+}
+
+// verifyTOTP checks code against the current step and one step either side
+// to allow for clock drift. It returns the matching step.
+func verifyTOTP(secret, code string, now time.Time) (int64, bool) {
+        code = strings.ReplaceAll(strings.TrimSpace(code), " ", "")
+        if len(code) != totpDigits {
+                return 0, false
+        }
+
+        current := now.Unix() / totpPeriod
+        for _, step := range []int64{current - 1, current, current + 1} {
+                expected, err := totpCode(secret, step)
+                if err != nil {
+                        return 0, false
+                }
+                if subtle.ConstantTimeCompare([]byte(expected), []byte(code)) == 1 {
+                        return step, true
+                }
+        }
+        return 0, false
+}
+
+func totpURI(secret, email string) string {
+        v := url.Values{}
+        v.Set("secret", secret)
+        v.Set("issuer", totpIssuer)
+        v.Set("algorithm", "SHA1")
+        v.Set("digits", fmt.Sprint(totpDigits))
+        v.Set("period", fmt.Sprint(totpPeriod))
+        return "otpauth://totp/" + url.PathEscape(totpIssuer+":"+email) + "?" + v.Encode()
+}
+
+func generateRecoveryCodes() ([]string, error) {
+        codes := make([]string, recoveryCodeCount)
+        for i := range codes {
+                buf := make([]byte, 5)
+                if _, err := rand.Read(buf); err != nil {
+                        return nil, err
+                }
+                h := hex.EncodeToString(buf)
+                codes[i] = h[:5] + "-" + h[5:]
+        }
+        return codes, nil
+}
+
+// Recovery codes are random, so a plain SHA-256 is enough to store them.
+func hashRecoveryCode(code string) string {
+        normalized := strings.ToLower(strings.NewReplacer("-", "", " ", "").Replace(code))
+        sum := sha256.Sum256([]byte(normalized))
+        return hex.EncodeToString(sum[:])
+}
+
+func replaceRecoveryCodes(tx *sql.Tx, userID int) ([]string, error) {
+        codes, err := generateRecoveryCodes()
+        if err != nil {
+                return nil, err
+        }
+
+        if _, err := tx.Exec("DELETE FROM mfa_recovery_codes WHERE user_id = $1", userID); err != nil {
+                return nil, err
+        }
+        for _, code := range codes {
+                if _, err := tx.Exec("INSERT INTO mfa_recovery_codes (user_id, code_hash) VALUES ($1, $2)",
+                        userID, hashRecoveryCode(code)); err != nil {
+                        return nil, err
+                }
+        }
+        return codes, nil
+}
+
+// checkSecondFactor accepts either a TOTP code or an unused recovery code.
+// TOTP steps are recorded so the same code cannot be replayed.
+func checkSecondFactor(userID int, code, recoveryCode string) (bool, error) {
+        if recoveryCode != "" {
+                res, err := db.Exec(`UPDATE mfa_recovery_codes SET used_at = now()
+                                     WHERE user_id = $1 AND code_hash = $2 AND used_at IS NULL`,
+                        userID, hashRecoveryCode(recoveryCode))
+                if err != nil {
+                        return false, err
+                }
+                n, _ := res.RowsAffected()
+                return n == 1, nil
+        }
+
+        var secret sql.NullString
+        err := db.QueryRow("SELECT totp_secret FROM users WHERE id = $1 AND totp_enabled", userID).Scan(&secret)
+        if err == sql.ErrNoRows {
+                return false, nil
+        }
+        if err != nil {
+                return false, err
+        }
+        if !secret.Valid {
+                return false, nil
+        }
+
+        step, ok := verifyTOTP(secret.String, code, time.Now())
+        if !ok {
+                return false, nil
+        }
+
+        res, err := db.Exec("UPDATE users SET totp_last_step = $1 WHERE id = $2 AND totp_last_step < $1", step, userID)
+        if err != nil {
+                return false, err
+        }
+        n, _ := res.RowsAffected()
+        return n == 1, nil
+}
+
+func handleMFASetup(w http.ResponseWriter, r *http.Request) {
+        if r.Method != http.MethodPost {
+                http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+                return
+        }
+
+        user, err := getSessionUser(r)
+        if err != nil {
+                http.Error(w, "Unauthorized", http.StatusUnauthorized)
+                return
+        }
+
+        if user.TOTPEnabled {
+                http.Error(w, "Two-factor authentication is already enabled", http.StatusConflict)
+                return
+        }
+
+        secret, err := generateTOTPSecret()
+        if err != nil {
+                http.Error(w, "Server error", http.StatusInternalServerError)
+                return
+        }
+
+        _, err = db.Exec("UPDATE users SET totp_secret = $1, totp_last_step = 0 WHERE id = $2", secret, user.ID)
+        if err != nil {
+                http.Error(w, "Server error", http.StatusInternalServerError)
+                return
+        }
+
+        uri := totpURI(secret, user.Email)
+        png, err := qrcode.Encode(uri, qrcode.Medium, 256)
+        if err != nil {
+                http.Error(w, "Server error", http.StatusInternalServerError)
+                return
+        }
+
+        w.Header().Set("Content-Type", "application/json")
+        json.NewEncoder(w).Encode(map[string]interface{}{
+                "secret":      secret,
+                "otpauth_uri": uri,
+                "qr_code":     "data:image/png;base64," + base64.StdEncoding.EncodeToString(png),
+        })
+}
+
+func handleMFAEnable(w http.ResponseWriter, r *http.Request) {
+        if r.Method != http.MethodPost {
+                http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+                return
+        }
+
+        user, err := getSessionUser(r)
+        if err != nil {
+                http.Error(w, "Unauthorized", http.StatusUnauthorized)
+                return
+        }
+
+        var req struct {
+                Code string `json:"code"`
+        }
+
+        if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+                http.Error(w, "Invalid request", http.StatusBadRequest)
+                return
+        }
+
+        if user.TOTPEnabled {
+                http.Error(w, "Two-factor authentication is already enabled", http.StatusConflict)
+                return
+        }
+
+        var secret sql.NullString
+        db.QueryRow("SELECT totp_secret FROM users WHERE id = $1", user.ID).Scan(&secret)
+        if !secret.Valid {
+                http.Error(w, "Start two-factor setup first", http.StatusBadRequest)
+                return
+        }
+
+        step, ok := verifyTOTP(secret.String, req.Code, time.Now())
+        if !ok {
+                http.Error(w, "Invalid code", http.StatusBadRequest)
+                return
+        }
+
+        tx, err := db.Begin()
+        if err != nil {
+                http.Error(w, "Server error", http.StatusInternalServerError)
+                return
+        }
+        defer tx.Rollback()
+
+        _, err = tx.Exec("UPDATE users SET totp_enabled = TRUE, totp_last_step = $1 WHERE id = $2", step, user.ID)
+        if err != nil {
+                http.Error(w, "Server error", http.StatusInternalServerError)
+                return
+        }
+
+        codes, err := replaceRecoveryCodes(tx, user.ID)
+        if err != nil {
+                http.Error(w, "Server error", http.StatusInternalServerError)
+                return
+        }
+
+        if err = tx.Commit(); err != nil {
+                http.Error(w, "Server error", http.StatusInternalServerError)
+                return
+        }
+
+        w.Header().Set("Content-Type", "application/json")
+        json.NewEncoder(w).Encode(map[string]interface{}{
+                "success":        true,
+                "recovery_codes": codes,
+        })
+}
+
+func handleMFADisable(w http.ResponseWriter, r *http.Request) {
+        if r.Method != http.MethodPost {
+                http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+                return
+        }
+
+        user, err := getSessionUser(r)
+        if err != nil {
+                http.Error(w, "Unauthorized", http.StatusUnauthorized)
+                return
+        }
+
+        var req struct {
+                Password     string `json:"password"`
+                Code         string `json:"code"`
+                RecoveryCode string `json:"recovery_code"`
+        }
+
+        if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+                http.Error(w, "Invalid request", http.StatusBadRequest)
+                return
+        }
+
+        if requireAdminMFA && user.IsAdmin {
+                http.Error(w, "Two-factor authentication is required for admin accounts", http.StatusForbidden)
+                return
+        }
+
+        if !checkPassword(user.ID, req.Password) {
+                http.Error(w, "Invalid credentials", http.StatusUnauthorized)
+                return
+        }
+
+        ok, err := checkSecondFactor(user.ID, req.Code, req.RecoveryCode)
+        if err != nil {
+                http.Error(w, "Server error", http.StatusInternalServerError)
+                return
+        }
+        if !ok {
+                http.Error(w, "Invalid code", http.StatusUnauthorized)
+                return
+        }
+
+        tx, err := db.Begin()
+        if err != nil {
+                http.Error(w, "Server error", http.StatusInternalServerError)
+                return
+        }
+        defer tx.Rollback()
+
+        _, err = tx.Exec("UPDATE users SET totp_enabled = FALSE, totp_secret = NULL, totp_last_step = 0 WHERE id = $1", user.ID)
+        if err != nil {
+                http.Error(w, "Server error", http.StatusInternalServerError)
+                return
+        }
+
+        _, err = tx.Exec("DELETE FROM mfa_recovery_codes WHERE user_id = $1", user.ID)
+        if err != nil {
+                http.Error(w, "Server error", http.StatusInternalServerError)
+                return
+        }
+
+        if err = tx.Commit(); err != nil {
+                http.Error(w, "Server error", http.StatusInternalServerError)
+                return
+        }
+
+        w.Header().Set("Content-Type", "application/json")
+        json.NewEncoder(w).Encode(map[string]bool{"success": true})
+}
+
+func handleMFARecoveryCodes(w http.ResponseWriter, r *http.Request) {
+        if r.Method != http.MethodPost {
+                http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+                return
+        }
+
+        user, err := getSessionUser(r)
+        if err != nil {
+                http.Error(w, "Unauthorized", http.StatusUnauthorized)
+                return
+        }
+
+        var req struct {
+                Code string `json:"code"`
+        }
+
+        if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+                http.Error(w, "Invalid request", http.StatusBadRequest)
+                return
+        }
+
+        ok, err := checkSecondFactor(user.ID, req.Code, "")
+        if err != nil {
+                http.Error(w, "Server error", http.StatusInternalServerError)
+                return
+        }
+        if !ok {
+                http.Error(w, "Invalid code", http.StatusUnauthorized)
+                return
+        }
+
+        tx, err := db.Begin()
+        if err != nil {
+                http.Error(w, "Server error", http.StatusInternalServerError)
+                return
+        }
+        defer tx.Rollback()
+
+        codes, err := replaceRecoveryCodes(tx, user.ID)
+        if err != nil {
+                http.Error(w, "Server error", http.StatusInternalServerError)
+                return
+        }
+
+        if err = tx.Commit(); err != nil {
+                http.Error(w, "Server error", http.StatusInternalServerError)
+                return
+        }
+
+        w.Header().Set("Content-Type", "application/json")
+        json.NewEncoder(w).Encode(map[string]interface{}{
+                "success":        true,
+                "recovery_codes": codes,
+        })
+}
+
+// handleLoginMFA completes the second step of a login that returned
+// mfa_required. The session only gets user_id once the code checks out.
+func handleLoginMFA(w http.ResponseWriter, r *http.Request) {
+        if r.Method != http.MethodPost {
+                http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+                return
+        }
+
+        var req struct {
+                Code         string `json:"code"`
+                RecoveryCode string `json:"recovery_code"`
+        }
+
+        if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+                http.Error(w, "Invalid request", http.StatusBadRequest)
+                return
+        }
+
+        session, _ := getSession(r)
+        userID, ok := session.Values["mfa_user_id"].(int)
+        started, _ := session.Values["mfa_started"].(int64)
+        if !ok || time.Since(time.Unix(started, 0)) > mfaLoginTimeout {
+                http.Error(w, "Login expired, please sign in again", http.StatusUnauthorized)
+                return
+        }
+
+        valid, err := checkSecondFactor(userID, req.Code, req.RecoveryCode)
+        if err != nil {
+                http.Error(w, "Server error", http.StatusInternalServerError)
+                return
+        }
+
+        if !valid {
+                attempts, _ := session.Values["mfa_attempts"].(int)
+                attempts++
+                if attempts >= mfaMaxAttempts {
+                        delete(session.Values, "mfa_user_id")
+                        delete(session.Values, "mfa_started")
+                        delete(session.Values, "mfa_attempts")
+                } else {
+                        session.Values["mfa_attempts"] = attempts
+                }
+                session.Save(r, w)
+                http.Error(w, "Invalid code", http.StatusUnauthorized)
+                return
+        }
+
+        user := User{ID: userID}
+        if err := loadUserRoles(&user); err != nil {
+                http.Error(w, "Server error", http.StatusInternalServerError)
+                return
+        }
+
+        store.Renew(session)
+        delete(session.Values, "mfa_user_id")
+        delete(session.Values, "mfa_started")
+        delete(session.Values, "mfa_attempts")
+        session.Values["user_id"] = userID
+        mergeGuestCart(session, userID)
+        session.Save(r, w)
+
+        w.Header().Set("Content-Type", "application/json")
+        json.NewEncoder(w).Encode(map[string]interface{}{
+                "success":  true,
+                "user_id":  userID,
+                "is_admin": user.IsAdmin,
+        })
+}
@@ -0,0 +1,546 @@
+package main
+
+import (
+        "bytes"
+        "crypto/hmac"
+        "crypto/rand"
+        "crypto/sha256"
+        "database/sql"
+        "encoding/hex"
+        "encoding/json"
+        "fmt"
+        "io"
+        "net"
+        "net/http"
+        "net/url"
+        "strconv"
+        "strings"
+        "syscall"
+        "time"
+
+        "github.com/lib/pq"
+)
+
+// Domain events integrations can subscribe to.
+const (
+        eventOrderCreated       = "order.created"
+        eventOrderPaid          = "order.paid"
+        eventOrderStatusChanged = "order.status_changed"
+        eventOrderShipped       = "order.shipped"
+        eventStockChanged       = "stock.changed"
+        eventBookCreated        = "book.created"
+        eventBookUpdated        = "book.updated"
+        eventBookDeleted        = "book.deleted"
+)
+
+var eventTypes = []string{
+        eventOrderCreated, eventOrderPaid, eventOrderStatusChanged, eventOrderShipped,
+        eventStockChanged, eventBookCreated, eventBookUpdated, eventBookDeleted,
+}
+
+// webhookMaxAttempts is how often a delivery is tried, backing off as jobs
+// do, before it is marked failed: about two hours of retries.
+const webhookMaxAttempts = 8
+
+// webhookClient only connects to public addresses, whatever the endpoint's
+// host resolves to when it is dialled, so an endpoint can't be pointed at
+// the server's own network and have its responses read back from the
+// delivery log. It ignores proxy settings for the same reason.
+var webhookClient = &http.Client{
+        Timeout: 10 * time.Second,
+        Transport: &http.Transport{
+                DialContext: (&net.Dialer{
+                        Timeout: 5 * time.Second,
+                        Control: func(network, address string, _ syscall.RawConn) error {
+                                host, _, err := net.SplitHostPort(address)
+                                if err != nil {
+                                        return err
+                                }
+                                if !publicAddress(net.ParseIP(host)) {
+                                        return fmt.Errorf("webhook endpoint %s is not a public address", host)
+                                }
+                                return nil
+                        },
+                }).DialContext,
+                TLSHandshakeTimeout: 5 * time.Second,
+        },
+}
+
+// publicAddress reports whether ip is routable on the internet: not
+// loopback, private, link-local (which includes cloud metadata services),
+// shared or unspecified.
+func publicAddress(ip net.IP) bool {
+        if ip == nil || ip.IsLoopback() || ip.IsPrivate() || ip.IsUnspecified() || ip.IsMulticast() ||
+                ip.IsLinkLocalUnicast() || ip.IsLinkLocalMulticast() || ip.IsInterfaceLocalMulticast() {
+                return false
+        }
+        // Carrier-grade NAT, 100.64.0.0/10, is private in all but name.
+        if ip4 := ip.To4(); ip4 != nil && ip4[0] == 100 && ip4[1]&0xc0 == 64 {
+                return false
+        }
+        return true
+}
+
+// recordEvent writes an event to the outbox. Pass the transaction the change
+// it describes is made in: the event, and the job that hands it to webhook
+// endpoints, exist only if that change commits.
+func recordEvent(q queryer, eventType string, data interface{}) error {
+        payload, err := json.Marshal(data)
+        if err != nil {
+                return err
+        }
+        var id int
+        err = q.QueryRow("INSERT INTO outbox_events (event_type, payload) VALUES ($1, $2) RETURNING id",
+                eventType, payload).Scan(&id)
+        if err != nil {
+                return err
+        }
+        return enqueueJob(q, "dispatch_event", map[string]int{"event_id": id})
+}
+
+// recordStockChange records a stock.changed event for a book whose stock
+// changed by change to stock.
+func recordStockChange(q queryer, bookID, stock, change int) error {
+        return recordEvent(q, eventStockChanged, map[string]int{
+                "book_id":        bookID,
+                "stock_quantity": stock,
+                "change":         change,
+        })
+}
+
+// runDispatchEventJob creates a delivery, and a job to make it, for every
+// active endpoint subscribed to the event. A rerun skips endpoints that
+// already have their delivery.
+func runDispatchEventJob(payload json.RawMessage) error {
+        var p struct {
+                EventID int `json:"event_id"`
+        }
+        if err := json.Unmarshal(payload, &p); err != nil {
+                return err
+        }
+
+        tx, err := db.Begin()
+        if err != nil {
+                return err
+        }
+        defer tx.Rollback()
+
+        rows, err := tx.Query(`INSERT INTO webhook_deliveries (endpoint_id, event_id)
+                               SELECT e.id, ev.id FROM webhook_endpoints e, outbox_events ev
+                               WHERE ev.id = $1 AND e.active AND (cardinality(e.events) = 0 OR ev.event_type = ANY(e.events))
+                               ON CONFLICT (endpoint_id, event_id) DO NOTHING
+                               RETURNING id`, p.EventID)
+        if err != nil {
+                return err
+        }
+        var deliveries []int
+        for rows.Next() {
+                var id int
+                if err := rows.Scan(&id); err != nil {
+                        rows.Close()
+                        return err
+                }
+                deliveries = append(deliveries, id)
+        }
+        rows.Close()
+        if err := rows.Err(); err != nil {
+                return err
+        }
+
+        for _, id := range deliveries {
+                if err := enqueueJob(tx, "deliver_webhook", map[string]int{"delivery_id": id}); err != nil {
+                        return err
+                }
+        }
+        if _, err := tx.Exec("UPDATE outbox_events SET dispatched_at = now() WHERE id = $1", p.EventID); err != nil {
+                return err
+        }
+        return tx.Commit()
+}
+
+// runDeliverWebhookJob POSTs an event to an endpoint and logs the attempt on
+// the delivery. Any response but a 2xx is a failure, which the job queue
+// retries.
+func runDeliverWebhookJob(payload json.RawMessage) error {
+        var p struct {
+                DeliveryID int `json:"delivery_id"`
+        }
+        if err := json.Unmarshal(payload, &p); err != nil {
+                return err
+        }
+
+        var endpointURL, secret, status, eventType string
+        var active bool
+        var event struct {
+                ID        int             `json:"id"`
+                Type      string          `json:"type"`
+                CreatedAt time.Time       `json:"created_at"`
+                Data      json.RawMessage `json:"data"`
+        }
+        err := db.QueryRow(`SELECT e.url, e.secret, e.active, d.status, ev.id, ev.event_type, ev.created_at, ev.payload
+                            FROM webhook_deliveries d
+                            JOIN webhook_endpoints e ON e.id = d.endpoint_id
+                            JOIN outbox_events ev ON ev.id = d.event_id
+                            WHERE d.id = $1`, p.DeliveryID).
+                Scan(&endpointURL, &secret, &active, &status, &event.ID, &eventType, &event.CreatedAt, &event.Data)
+        if err == sql.ErrNoRows {
+                // The endpoint was deleted.
+                return nil
+        }
+        if err != nil {
+                return err
+        }
+        if status == "succeeded" {
+                return nil
+        }
+        if !active {
+                _, err := db.Exec("UPDATE webhook_deliveries SET status = 'failed', error = 'Endpoint disabled' WHERE id = $1", p.DeliveryID)
+                return err
+        }
+        event.Type = eventType
+
+        body, err := json.Marshal(event)
+        if err != nil {
+                return err
+        }
+        timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+
+        var responseStatus sql.NullInt64
+        var responseBody string
+        sendErr := func() error {
+                req, err := http.NewRequest(http.MethodPost, endpointURL, bytes.NewReader(body))
+                if err != nil {
+                        return err
+                }
+                req.Header.Set("Content-Type", "application/json")
+                req.Header.Set("User-Agent", "Bookstore-Webhooks/1.0")
+                req.Header.Set("X-Bookstore-Event", eventType)
+                req.Header.Set("X-Bookstore-Delivery", strconv.Itoa(p.DeliveryID))
+                req.Header.Set("X-Bookstore-Signature", "t="+timestamp+",v1="+signWebhook(secret, timestamp, body))
+
+                resp, err := webhookClient.Do(req)
+                if err != nil {
+                        return err
+                }
+                defer resp.Body.Close()
+                snippet, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+                responseStatus = sql.NullInt64{Int64: int64(resp.StatusCode), Valid: true}
+                responseBody = string(snippet)
+                if resp.StatusCode < 200 || resp.StatusCode > 299 {
+                        return fmt.Errorf("endpoint answered %s", resp.Status)
+                }
+                return nil
+        }()
+
+        var errText sql.NullString
+        if sendErr != nil {
+                errText = sql.NullString{String: sendErr.Error(), Valid: true}
+        }
+        _, err = db.Exec(`UPDATE webhook_deliveries SET attempts = attempts + 1, last_attempt_at = now(),
+                                 response_status = $2, response_body = $3, error = $4,
+                                 status = CASE WHEN $4::text IS NULL THEN 'succeeded'
+                                               WHEN attempts + 1 >= $5 THEN 'failed' ELSE 'pending' END,
+                                 delivered_at = CASE WHEN $4::text IS NULL THEN now() END
+                          WHERE id = $1`, p.DeliveryID, responseStatus, responseBody, errText, webhookMaxAttempts)
+        if err != nil {
+                return err
+        }
+        return sendErr
+}
+
+// outboxRetention is how long dispatched events and their delivery log are
+// kept.
+const outboxRetention = 30 * 24 * time.Hour
+
+func runPurgeOutboxJob(json.RawMessage) error {
+        _, err := db.Exec("DELETE FROM outbox_events WHERE dispatched_at < $1", time.Now().Add(-outboxRetention))
+        return err
+}
+
+// signWebhook is the hex HMAC-SHA256, keyed with the endpoint's secret, of
+// the timestamp, a dot and the body. Receivers recompute it to check that a
+// request came from us, and reject old timestamps to stop replays.
+func signWebhook(secret, timestamp string, body []byte) string {
+        mac := hmac.New(sha256.New, []byte(secret))
+        mac.Write([]byte(timestamp + "."))
+        mac.Write(body)
+        return hex.EncodeToString(mac.Sum(nil))
+}
+
+func newWebhookSecret() string {
+        buf := make([]byte, 24)
+        rand.Read(buf)
+        return "whsec_" + hex.EncodeToString(buf)
+}
+
+type WebhookEndpoint struct {
+        ID          int       `json:"id"`
+        URL         string    `json:"url"`
+        Description string    `json:"description"`
+        Events      []string  `json:"events"`
+        Active      bool      `json:"active"`
+        CreatedAt   time.Time `json:"created_at"`
+        // Secret is only shown when the endpoint is created.
+        Secret string `json:"secret,omitempty"`
+}
+
+const webhookEndpointColumns = `id, url, description, events, active, created_at`
+
+func scanWebhookEndpoint(row interface{ Scan(...interface{}) error }) (WebhookEndpoint, error) {
+        var e WebhookEndpoint
+        err := row.Scan(&e.ID, &e.URL, &e.Description, pq.Array(&e.Events), &e.Active, &e.CreatedAt)
+        if e.Events == nil {
+                e.Events = []string{}
+        }
+        return e, err
+}
+
+// validateWebhookEndpoint checks an endpoint from the admin API. No events
+// means every event.
+func validateWebhookEndpoint(e *WebhookEndpoint) error {
+        e.URL = strings.TrimSpace(e.URL)
+        u, err := url.Parse(e.URL)
+        if err != nil || (u.Scheme != "https" && u.Scheme != "http") || u.Host == "" {
+                return fmt.Errorf("URL must be an absolute http or https URL")
+        }
+        // Deliveries check again when they connect, as DNS can change.
+        ips, err := net.LookupIP(u.Hostname())
+        if err != nil {
+                return fmt.Errorf("URL host %s could not be resolved", u.Hostname())
+        }
+        for _, ip := range ips {
+                if !publicAddress(ip) {
+                        return fmt.Errorf("URL must not point at a loopback, private or link-local address")
+                }
+        }
+        if e.Events == nil {
+                e.Events = []string{}
+        }
+        for _, event := range e.Events {
+                known := false
+                for _, t := range eventTypes {
+                        known = known || t == event
+                }
+                if !known {
+                        return fmt.Errorf("Unknown event %s", event)
+                }
+        }
+        return nil
+}
+
+// handleAdminWebhooks serves GET (list, with the events one can subscribe
+// to) and POST (register) /api/admin/webhooks.
+func handleAdminWebhooks(w http.ResponseWriter, r *http.Request) {
+        switch r.Method {
+        case http.MethodGet:
+                rows, err := db.Query("SELECT " + webhookEndpointColumns + " FROM webhook_endpoints ORDER BY id")
+                if err != nil {
+                        http.Error(w, "Server error", http.StatusInternalServerError)
+                        return
+                }
+                defer rows.Close()
+
+                endpoints := []WebhookEndpoint{}
+                for rows.Next() {
+                        e, err := scanWebhookEndpoint(rows)
+                        if err != nil {
+                                http.Error(w, "Server error", http.StatusInternalServerError)
+                                return
+                        }
+                        endpoints = append(endpoints, e)
+                }
+
+                w.Header().Set("Content-Type", "application/json")
+                json.NewEncoder(w).Encode(map[string]interface{}{
+                        "endpoints": endpoints,
+                        "events":    eventTypes,
+                })
+
+        case http.MethodPost:
+                e := WebhookEndpoint{Active: true}
+                if err := json.NewDecoder(r.Body).Decode(&e); err != nil {
+                        http.Error(w, "Invalid request", http.StatusBadRequest)
+                        return
+                }
+                if err := validateWebhookEndpoint(&e); err != nil {
+                        http.Error(w, err.Error(), http.StatusBadRequest)
+                        return
+                }
+                e.Secret = newWebhookSecret()
+
+                err := db.QueryRow(`INSERT INTO webhook_endpoints (url, description, events, active, secret)
+                                    VALUES ($1, $2, $3, $4, $5) RETURNING id, created_at`,
+                        e.URL, e.Description, pq.Array(e.Events), e.Active, e.Secret).Scan(&e.ID, &e.CreatedAt)
+                if err != nil {
+                        http.Error(w, "Server error", http.StatusInternalServerError)
+                        return
+                }
+                actor, _ := getCurrentUser(r)
+                recordAdminAudit(r, actor.ID, "webhook.created", 0, map[string]interface{}{"webhook_id": e.ID, "url": e.URL})
+
+                w.Header().Set("Content-Type", "application/json")
+                w.WriteHeader(http.StatusCreated)
+                json.NewEncoder(w).Encode(e)
+
+        default:
+                http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+        }
+}
+
+// WebhookDelivery is one event sent, or being sent, to one endpoint, with
+// the outcome of its latest attempt.
+type WebhookDelivery struct {
+        ID             int        `json:"id"`
+        EventID        int        `json:"event_id"`
+        EventType      string     `json:"event_type"`
+        Status         string     `json:"status"`
+        Attempts       int        `json:"attempts"`
+        ResponseStatus *int       `json:"response_status"`
+        ResponseBody   *string    `json:"response_body"`
+        Error          *string    `json:"error"`
+        CreatedAt      time.Time  `json:"created_at"`
+        LastAttemptAt  *time.Time `json:"last_attempt_at"`
+        DeliveredAt    *time.Time `json:"delivered_at"`
+}
+
+// handleAdminWebhookDetail serves /api/admin/webhooks/{id}: GET, PUT (url,
+// description, events, active) and DELETE, plus
+// GET /api/admin/webhooks/{id}/deliveries?status= (the delivery log) and
+// POST /api/admin/webhooks/{id}/deliveries/{delivery}/retry.
+func handleAdminWebhookDetail(w http.ResponseWriter, r *http.Request) {
+        parts := strings.Split(strings.TrimPrefix(r.URL.Path, "/api/admin/webhooks/"), "/")
+        id, err := strconv.Atoi(parts[0])
+        if err != nil {
+                http.Error(w, "Invalid webhook ID", http.StatusBadRequest)
+                return
+        }
+
+        endpoint, err := scanWebhookEndpoint(db.QueryRow("SELECT "+webhookEndpointColumns+" FROM webhook_endpoints WHERE id = $1", id))
+        if err == sql.ErrNoRows {
+                http.Error(w, "Webhook not found", http.StatusNotFound)
+                return
+        }
+        if err != nil {
+                http.Error(w, "Server error", http.StatusInternalServerError)
+                return
+        }
+
+        switch {
+        case len(parts) == 2 && parts[1] == "deliveries" && r.Method == http.MethodGet:
+                listWebhookDeliveries(w, r, id)
+                return
+        case len(parts) == 4 && parts[1] == "deliveries" && parts[3] == "retry" && r.Method == http.MethodPost:
+                retryWebhookDelivery(w, r, id, parts[2])
+                return
+        case len(parts) != 1 || r.Method == http.MethodPost:
+                http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+                return
+        }
+
+        actor, _ := getCurrentUser(r)
+        switch r.Method {
+        case http.MethodGet:
+        case http.MethodPut:
+                req := endpoint
+                if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+                        http.Error(w, "Invalid request", http.StatusBadRequest)
+                        return
+                }
+                if err := validateWebhookEndpoint(&req); err != nil {
+                        http.Error(w, err.Error(), http.StatusBadRequest)
+                        return
+                }
+                _, err := db.Exec("UPDATE webhook_endpoints SET url = $1, description = $2, events = $3, active = $4 WHERE id = $5",
+                        req.URL, req.Description, pq.Array(req.Events), req.Active, id)
+                if err != nil {
+                        http.Error(w, "Server error", http.StatusInternalServerError)
+                        return
+                }
+                req.ID, req.CreatedAt, req.Secret = endpoint.ID, endpoint.CreatedAt, ""
+                endpoint = req
+                recordAdminAudit(r, actor.ID, "webhook.updated", 0, map[string]interface{}{"webhook_id": id, "url": req.URL})
+        case http.MethodDelete:
+                if _, err := db.Exec("DELETE FROM webhook_endpoints WHERE id = $1", id); err != nil {
+                        http.Error(w, "Server error", http.StatusInternalServerError)
+                        return
+                }
+                recordAdminAudit(r, actor.ID, "webhook.deleted", 0, map[string]interface{}{"webhook_id": id, "url": endpoint.URL})
+
+                w.Header().Set("Content-Type", "application/json")
+                json.NewEncoder(w).Encode(map[string]bool{"success": true})
+                return
+        default:
+                http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+                return
+        }
+
+        w.Header().Set("Content-Type", "application/json")
+        json.NewEncoder(w).Encode(endpoint)
+}
+
+func listWebhookDeliveries(w http.ResponseWriter, r *http.Request, endpointID int) {
+        rows, err := db.Query(`SELECT d.id, d.event_id, ev.event_type, d.status, d.attempts, d.response_status, d.response_body,
+                                      d.error, d.created_at, d.last_attempt_at, d.delivered_at
+                               FROM webhook_deliveries d JOIN outbox_events ev ON ev.id = d.event_id
+                               WHERE d.endpoint_id = $1 AND ($2 = '' OR d.status = $2)
+                               ORDER BY d.id DESC LIMIT 200`, endpointID, r.URL.Query().Get("status"))
+        if err != nil {
+                http.Error(w, "Server error", http.StatusInternalServerError)
+                return
+        }
+        defer rows.Close()
+
+        deliveries := []WebhookDelivery{}
+        for rows.Next() {
+                var d WebhookDelivery
+                err := rows.Scan(&d.ID, &d.EventID, &d.EventType, &d.Status, &d.Attempts, &d.ResponseStatus, &d.ResponseBody,
+                        &d.Error, &d.CreatedAt, &d.LastAttemptAt, &d.DeliveredAt)
+                if err != nil {
+                        http.Error(w, "Server error", http.StatusInternalServerError)
+                        return
+                }
+                deliveries = append(deliveries, d)
+        }
+
+        w.Header().Set("Content-Type", "application/json")
+        json.NewEncoder(w).Encode(deliveries)
+}
+
+// retryWebhookDelivery sends a delivery again with a fresh set of attempts,
+// whether it failed or succeeded.
+func retryWebhookDelivery(w http.ResponseWriter, r *http.Request, endpointID int, deliveryStr string) {
+        deliveryID, err := strconv.Atoi(deliveryStr)
+        if err != nil {
+                http.Error(w, "Invalid delivery ID", http.StatusBadRequest)
+                return
+        }
+
+        tx, err := db.Begin()
+        if err != nil {
+                http.Error(w, "Server error", http.StatusInternalServerError)
+                return
+        }
+        defer tx.Rollback()
+
+        res, err := tx.Exec(`UPDATE webhook_deliveries SET status = 'pending', attempts = 0, delivered_at = NULL
+                             WHERE id = $1 AND endpoint_id = $2`, deliveryID, endpointID)
+        if err != nil {
+                http.Error(w, "Server error", http.StatusInternalServerError)
+                return
+        }
+        if n, _ := res.RowsAffected(); n == 0 {
+                http.Error(w, "Delivery not found", http.StatusNotFound)
+                return
+        }
+        if err := enqueueJob(tx, "deliver_webhook", map[string]int{"delivery_id": deliveryID}); err != nil {
+                http.Error(w, "Server error", http.StatusInternalServerError)
+                return
+        }
+        if err := tx.Commit(); err != nil {
+                http.Error(w, "Server error", http.StatusInternalServerError)
+                return
+        }
+
+        w.Header().Set("Content-Type", "application/json")
+        json.NewEncoder(w).Encode(map[string]bool{"success": true})
+}